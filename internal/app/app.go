@@ -3,9 +3,11 @@ package app
 
 import (
 	"context"
+	"flag"
 	"github.com/zhel1/yandex-practicum-go/internal/auth"
 	"github.com/zhel1/yandex-practicum-go/internal/http"
 	"github.com/zhel1/yandex-practicum-go/internal/service"
+	"github.com/zhel1/yandex-practicum-go/internal/storage/cached"
 	"github.com/zhel1/yandex-practicum-go/internal/storage/infile"
 	"github.com/zhel1/yandex-practicum-go/internal/storage/inmemory"
 	"github.com/zhel1/yandex-practicum-go/internal/storage/inpsql"
@@ -27,35 +29,71 @@ func Run() {
 		log.Fatal(err)
 	}
 
-	var strg storage.Storage
-	if cfg.DatabaseDSN != "" {
-		strg, err = inpsql.NewStorage(cfg.DatabaseDSN)
-		if err != nil {
+	if flag.NArg() > 0 {
+		if err = runCommand(&cfg, flag.Args()); err != nil {
 			log.Fatal(err)
 		}
-		log.Println("Database is used")
-	} else if cfg.FileStoragePath != "" {
-		strg, err = infile.NewStorage(cfg.FileStoragePath)
+		return
+	}
+
+	strg, err := newStorage(&cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var cache *cached.Storage
+	if cfg.CacheSize > 0 {
+		cache = cached.NewStorage(strg, cfg.CacheSize, cfg.CacheTTL.Duration)
+		strg = cache
+		log.Printf("Cache of %d short URLs is used", cfg.CacheSize)
+	}
+
+	tokenManager, err := newTokenManager(&cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	generator, err := service.NewGenerator(cfg.CodeGenerator, cfg.CodeLength)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	visitorSalt := cfg.VisitorSalt
+	if visitorSalt == "" {
+		visitorSalt, err = service.LoadVisitorSalt(cfg.VisitorSaltFile)
 		if err != nil {
 			log.Fatal(err)
 		}
-		log.Println("File is used")
-	} else {
-		strg = inmemory.NewStorage()
-		log.Println("Memory is used")
 	}
 
-	tokenManager, err := auth.NewManager(cfg.UserKey)
+	bots, err := service.LoadBotClassifier(cfg.BotSignatures)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	trustedSubnet, err := service.ParseTrustedSubnet(cfg.TrustedSubnet)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	deps := service.Deps{
-		Storage:      strg,
-		BaseURL:      cfg.BaseURL,
-		TokenManager: tokenManager,
+		Storage:       strg,
+		BaseURL:       cfg.BaseURL,
+		TokenManager:  tokenManager,
+		AccessTTL:     cfg.AccessTokenTTL.Duration,
+		RefreshTTL:    cfg.RefreshTokenTTL.Duration,
+		Generator:     generator,
+		Clicks:        service.NewClickRecorder(strg, cfg.ClickQueueSize, cfg.ClickBatchSize, cfg.ClickFlush.Duration),
+		Events:        service.NewEventHub(service.DefaultEventRingSize, service.DefaultEventBufferSize),
+		Bots:          bots,
+		VisitorSalt:   visitorSalt,
+		TrustedSubnet: trustedSubnet,
 	}
 
+	sweeper := service.NewSweeper(strg, cfg.SweepInterval.Duration, cfg.ExpiredTTL.Duration)
+	sweeper.Start()
+	deps.Clicks.Start()
+
 	services := service.NewServices(deps)
 	handlers := http.NewHandler(services)
 
@@ -66,12 +104,29 @@ func Run() {
 
 	signal.Notify(interrupt, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 
+	if cfg.KeyFile != "" {
+		go reloadKeys(tokenManager)
+	}
+
 	go func() {
 		<-interrupt
+		// streams of events never become idle, they are closed before the server waits for connections
+		deps.Events.Close()
 		if err := srv.Stop(context.Background()); err != nil {
 			log.Printf("HTTP server shutdown: %v", err)
 		}
 
+		sweeper.Stop()
+
+		deps.Clicks.Stop()
+		clickStats := deps.Clicks.Stats()
+		log.Printf("Clicks: %d saved, %d dropped, %d failed", clickStats.Saved, clickStats.Dropped, clickStats.Failed)
+
+		if cache != nil {
+			stats := cache.Stats()
+			log.Printf("Cache: %d hits, %d misses", stats.Hits, stats.Misses)
+		}
+
 		if err := strg.Close(); err != nil {
 			log.Printf("Storage shutdown: %v", err)
 		}
@@ -85,3 +140,67 @@ func Run() {
 	<-connectionsClosed
 	log.Println("Server shutdown gracefully")
 }
+
+// newTokenManager creates the manager of tokens with the keyring from the key file or with UserKey.
+func newTokenManager(cfg *config.Config) (*auth.Manager, error) {
+	if cfg.KeyFile == "" {
+		return auth.NewManager(cfg.UserKey)
+	}
+
+	tokenManager, err := auth.LoadManager(cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Keyring is loaded, the active key is %q", tokenManager.ActiveKey())
+	return tokenManager, nil
+}
+
+// reloadKeys reloads the keyring from the key file on SIGHUP, the keyring is kept if the file is invalid.
+func reloadKeys(tokenManager *auth.Manager) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	for range hangup {
+		if err := tokenManager.Reload(); err != nil {
+			log.Printf("Keyring reload: %v", err)
+			continue
+		}
+		log.Printf("Keyring is reloaded, the active key is %q", tokenManager.ActiveKey())
+	}
+}
+
+// newStorage creates storage selected by configuration.
+func newStorage(cfg *config.Config) (storage.Storage, error) {
+	if cfg.DatabaseDSN != "" {
+		strg, err := inpsql.NewStorage(cfg.DatabaseDSN, inpsql.PoolConfig{
+			MaxOpenConns:    cfg.DBMaxOpenConns,
+			MaxIdleConns:    cfg.DBMaxIdleConns,
+			ConnMaxLifetime: cfg.DBConnLifetime.Duration,
+			ConnMaxIdleTime: cfg.DBConnIdleTime.Duration,
+		})
+		if err != nil {
+			return nil, err
+		}
+		log.Println("Database is used")
+		return strg, nil
+	}
+
+	if cfg.FileStoragePath != "" {
+		compaction := infile.DefaultCompactionConfig
+		compaction.Interval = cfg.CompactInterval.Duration
+		compaction.Ratio = cfg.CompactRatio
+		strg, err := infile.NewStorage(cfg.FileStoragePath, compaction)
+		if err != nil {
+			return nil, err
+		}
+		log.Println("File is used")
+		return strg, nil
+	}
+
+	if cfg.MemoryShards > 1 {
+		log.Printf("Memory with %d shards is used", cfg.MemoryShards)
+		return inmemory.NewShardedStorage(cfg.MemoryShards), nil
+	}
+
+	log.Println("Memory is used")
+	return inmemory.NewStorage(), nil
+}
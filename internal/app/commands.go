@@ -0,0 +1,74 @@
+// Package app contains methods for launching shortener service.
+package app
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/zhel1/yandex-practicum-go/internal/config"
+	"github.com/zhel1/yandex-practicum-go/internal/storage/inpsql"
+	"os"
+	"text/tabwriter"
+)
+
+// runCommand executes the command passed after flags instead of launching the server.
+func runCommand(cfg *config.Config, args []string) error {
+	switch args[0] {
+	case "migrate":
+		return migrate(cfg, args[1:])
+	case "export":
+		return exportLinks(cfg, args[1:])
+	case "import":
+		return importLinks(cfg, args[1:])
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+// migrate applies or rolls back schema migrations of the database: migrate up|down|status.
+func migrate(cfg *config.Config, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: shortener migrate up|down|status")
+	}
+	if cfg.DatabaseDSN == "" {
+		return errors.New("database DSN is not set")
+	}
+
+	db, err := sql.Open("postgres", cfg.DatabaseDSN)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	migrator, err := inpsql.NewMigrator(db)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	switch args[0] {
+	case "up":
+		return migrator.Up(ctx)
+	case "down":
+		return migrator.Down(ctx)
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+		for _, st := range statuses {
+			appliedAt := "pending"
+			if st.Applied {
+				appliedAt = st.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", st.Version, st.Name, appliedAt)
+		}
+		return w.Flush()
+	default:
+		return fmt.Errorf("unknown migrate command %q", args[0])
+	}
+}
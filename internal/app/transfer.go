@@ -0,0 +1,217 @@
+// Package app contains methods for launching shortener service.
+package app
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/zhel1/yandex-practicum-go/internal/config"
+	"github.com/zhel1/yandex-practicum-go/internal/dto"
+	"github.com/zhel1/yandex-practicum-go/internal/storage"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// checkpointEvery is the number of imported records after which the checkpoint is saved.
+const checkpointEvery = 1000
+
+// importStats counts results of import.
+type importStats struct {
+	Created   int
+	Existing  int
+	Deleted   int
+	Conflicts int
+}
+
+// exportLinks writes all links of the configured storage to the dump file, one JSON record per line.
+func exportLinks(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	output := flags.String("o", "links.jsonl", "Dump file")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	strg, err := newStorage(cfg)
+	if err != nil {
+		return err
+	}
+	defer strg.Close()
+
+	file, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	encoder.SetEscapeHTML(false)
+
+	count := 0
+	err = strg.Export(context.Background(), func(record storage.LinkRecord) error {
+		count++
+		return encoder.Encode(record)
+	})
+	if err != nil {
+		return err
+	}
+	if err = writer.Flush(); err != nil {
+		return err
+	}
+
+	log.Printf("%d links are exported to %s", count, *output)
+	return file.Sync()
+}
+
+// importLinks puts links from the dump file into the configured storage.
+// Import is idempotent: links which already exist are skipped. Processed lines are saved in the checkpoint file,
+// so interrupted import is resumed from the last checkpoint.
+func importLinks(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	input := flags.String("i", "links.jsonl", "Dump file")
+	checkpoint := flags.String("checkpoint", "", "Checkpoint file (default <dump file>.checkpoint)")
+	dryRun := flags.Bool("dry-run", false, "Only report conflicts without changes")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *checkpoint == "" {
+		*checkpoint = *input + ".checkpoint"
+	}
+
+	file, err := os.Open(*input)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	skip := 0
+	if !*dryRun {
+		if skip, err = readCheckpoint(*checkpoint); err != nil {
+			return err
+		}
+		if skip > 0 {
+			log.Printf("Import is resumed from line %d", skip+1)
+		}
+	}
+
+	strg, err := newStorage(cfg)
+	if err != nil {
+		return err
+	}
+	defer strg.Close()
+
+	ctx := context.Background()
+	var stats importStats
+	reader := bufio.NewReader(file)
+	line := 0
+	for {
+		data, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if len(strings.TrimSpace(string(data))) > 0 {
+			line++
+			if line > skip {
+				var record storage.LinkRecord
+				if jsonErr := json.Unmarshal(data, &record); jsonErr != nil {
+					return fmt.Errorf("line %d: %w", line, jsonErr)
+				}
+				if importErr := importLink(ctx, strg, record, *dryRun, &stats); importErr != nil {
+					return fmt.Errorf("line %d: %w", line, importErr)
+				}
+				if !*dryRun && line%checkpointEvery == 0 {
+					if cpErr := writeCheckpoint(*checkpoint, line); cpErr != nil {
+						return cpErr
+					}
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+
+	if !*dryRun {
+		if err = writeCheckpoint(*checkpoint, line); err != nil {
+			return err
+		}
+	}
+
+	mode := "imported"
+	if *dryRun {
+		mode = "checked (dry run)"
+	}
+	log.Printf("%d links are %s: %d created, %d already exist, %d deleted, %d conflicts",
+		line-skip, mode, stats.Created, stats.Existing, stats.Deleted, stats.Conflicts)
+	return nil
+}
+
+// importLink puts one link into storage.
+// The link conflicts when its short URL already points to another original URL or to the same URL with another password,
+// or when storage reports the link as existing though the short URL was free, e.g. the original URL got another short URL.
+func importLink(ctx context.Context, strg storage.Storage, record storage.LinkRecord, dryRun bool, stats *importStats) error {
+	originURL, err := strg.Get(ctx, record.ShortURL)
+	found := false
+	switch {
+	case err == nil && originURL != record.OriginURL:
+		stats.Conflicts++
+		log.Printf("Conflict: %s points to %s, not to %s (user %s)", record.ShortURL, originURL, record.OriginURL, record.UserID)
+		return nil
+	case err == nil || errors.Is(err, dto.ErrDeleted) || errors.Is(err, dto.ErrExpired):
+		found = true
+	case !errors.Is(err, dto.ErrNotFound):
+		return err
+	}
+
+	if dryRun {
+		if found {
+			stats.Existing++
+		} else {
+			stats.Created++
+		}
+		return nil
+	}
+
+	err = strg.Put(ctx, record.UserID, record.ShortURL, record.OriginURL, record.Options())
+	switch {
+	case errors.Is(err, dto.ErrCodeTaken) || (!found && errors.Is(err, dto.ErrAlreadyExists)):
+		stats.Conflicts++
+		log.Printf("Conflict: %s to %s can't be saved (user %s): %v", record.ShortURL, record.OriginURL, record.UserID, err)
+		return nil
+	case err != nil && !errors.Is(err, dto.ErrAlreadyExists):
+		return err
+	case found:
+		stats.Existing++
+	default:
+		stats.Created++
+	}
+
+	if record.IsDeleted {
+		stats.Deleted++
+		return strg.Delete(ctx, []string{record.ShortURL}, record.UserID)
+	}
+	return nil
+}
+
+// readCheckpoint returns the number of lines processed by previous import.
+func readCheckpoint(fileName string) (int, error) {
+	data, err := os.ReadFile(fileName)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// writeCheckpoint saves the number of processed lines.
+func writeCheckpoint(fileName string, line int) error {
+	return os.WriteFile(fileName, []byte(strconv.Itoa(line)+"\n"), 0644)
+}
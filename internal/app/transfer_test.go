@@ -0,0 +1,155 @@
+// Package app contains methods for launching shortener service.
+package app
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhel1/yandex-practicum-go/internal/config"
+	"github.com/zhel1/yandex-practicum-go/internal/dto"
+	"github.com/zhel1/yandex-practicum-go/internal/storage"
+	storageErrors "github.com/zhel1/yandex-practicum-go/internal/storage/errors"
+	"github.com/zhel1/yandex-practicum-go/internal/storage/inmemory"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// existingStorage reports every put link as existing one.
+type existingStorage struct {
+	storage.Storage
+}
+
+func (s existingStorage) Put(ctx context.Context, userID, shortURL, originURL string, opts storage.LinkOptions) error {
+	return &storageErrors.AlreadyExistsError{Err: dto.ErrAlreadyExists}
+}
+
+func TestImportLink(t *testing.T) {
+	ctx := context.Background()
+	strg := inmemory.NewStorage()
+	record := storage.LinkRecord{UserID: "user1", ShortURL: "1234567", OriginURL: "https://yandex.ru/news/"}
+
+	tests := []struct {
+		name   string
+		strg   storage.Storage
+		record storage.LinkRecord
+		dryRun bool
+		want   importStats
+	}{
+		{name: "dry run", strg: strg, record: record, dryRun: true, want: importStats{Created: 1}},
+		{name: "new link", strg: strg, record: record, want: importStats{Created: 1}},
+		{name: "existing link", strg: strg, record: record, want: importStats{Existing: 1}},
+		{name: "link of another user", strg: strg, record: storage.LinkRecord{UserID: "user2", ShortURL: "1234567", OriginURL: "https://yandex.ru/news/"}, want: importStats{Existing: 1}},
+		{name: "another URL", strg: strg, record: storage.LinkRecord{UserID: "user1", ShortURL: "1234567", OriginURL: "https://yandex.ru/sport/"}, want: importStats{Conflicts: 1}},
+		{name: "another password", strg: strg, record: storage.LinkRecord{UserID: "user3", ShortURL: "1234567", OriginURL: "https://yandex.ru/news/", PasswordHash: "hash"}, want: importStats{Conflicts: 1}},
+		{name: "URL exists under another short URL", strg: existingStorage{Storage: inmemory.NewStorage()}, record: record, want: importStats{Conflicts: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stats importStats
+			require.NoError(t, importLink(ctx, tt.strg, tt.record, tt.dryRun, &stats))
+			assert.Equal(t, tt.want, stats)
+		})
+	}
+
+	links, err := strg.GetUserLinks(ctx, "user1")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"1234567": "https://yandex.ru/news/"}, links)
+	_, err = strg.GetUserLinks(ctx, "user3")
+	assert.ErrorIs(t, err, dto.ErrNotFound)
+}
+
+func TestExportImport(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	dump := filepath.Join(dir, "links.jsonl")
+	expiresAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+
+	src := &config.Config{FileStoragePath: filepath.Join(dir, "src.log")}
+	strg, err := newStorage(src)
+	require.NoError(t, err)
+	require.NoError(t, strg.Put(ctx, "user1", "1111111", "https://yandex.ru/1", storage.LinkOptions{}))
+	require.NoError(t, strg.Put(ctx, "user2", "1111111", "https://yandex.ru/1", storage.LinkOptions{}))
+	require.NoError(t, strg.Put(ctx, "user1", "2222222", "https://yandex.ru/2", storage.LinkOptions{ExpiresAt: expiresAt, MaxClicks: 5}))
+	require.NoError(t, strg.Put(ctx, "user2", "3333333", "https://yandex.ru/3", storage.LinkOptions{PasswordHash: "hash"}))
+	require.NoError(t, strg.Put(ctx, "user2", "4444444", "https://yandex.ru/4", storage.LinkOptions{}))
+	require.NoError(t, strg.Delete(ctx, []string{"4444444"}, "user2"))
+	require.NoError(t, strg.Close())
+
+	require.NoError(t, exportLinks(src, []string{"-o", dump}))
+	records := readDump(t, dump)
+	require.Len(t, records, 5)
+
+	// the first records are skipped as imported before the interruption
+	dst := &config.Config{FileStoragePath: filepath.Join(dir, "dst.log")}
+	checkpoint := dump + ".checkpoint"
+	require.NoError(t, writeCheckpoint(checkpoint, 2))
+	require.NoError(t, importLinks(dst, []string{"-i", dump}))
+	skip, err := readCheckpoint(checkpoint)
+	require.NoError(t, err)
+	assert.Equal(t, len(records), skip)
+	assert.Equal(t, sortRecords(records[2:]), exportRecords(t, dst))
+
+	// import from the beginning adds the skipped records, the imported ones already exist
+	require.NoError(t, os.Remove(checkpoint))
+	require.NoError(t, importLinks(dst, []string{"-i", dump}))
+	assert.Equal(t, sortRecords(records), exportRecords(t, dst))
+
+	// the imported links work like the exported ones
+	strg, err = newStorage(dst)
+	require.NoError(t, err)
+	defer strg.Close()
+	link, err := strg.GetLink(ctx, "2222222")
+	require.NoError(t, err)
+	assert.True(t, expiresAt.Equal(link.Options.ExpiresAt))
+	assert.Equal(t, int64(5), link.Options.MaxClicks)
+	_, err = strg.Get(ctx, "4444444")
+	assert.ErrorIs(t, err, dto.ErrDeleted)
+}
+
+// readDump returns records of the dump file in order of lines.
+func readDump(t *testing.T, path string) []storage.LinkRecord {
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+
+	var records []storage.LinkRecord
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record storage.LinkRecord
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+		records = append(records, record)
+	}
+	require.NoError(t, scanner.Err())
+	return records
+}
+
+// exportRecords returns all records of the configured storage sorted by short URL and user.
+func exportRecords(t *testing.T, cfg *config.Config) []storage.LinkRecord {
+	strg, err := newStorage(cfg)
+	require.NoError(t, err)
+	defer strg.Close()
+
+	var records []storage.LinkRecord
+	require.NoError(t, strg.Export(context.Background(), func(record storage.LinkRecord) error {
+		records = append(records, record)
+		return nil
+	}))
+	return sortRecords(records)
+}
+
+// sortRecords sorts a copy of records by short URL and user.
+func sortRecords(records []storage.LinkRecord) []storage.LinkRecord {
+	sorted := append([]storage.LinkRecord(nil), records...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].ShortURL != sorted[j].ShortURL {
+			return sorted[i].ShortURL < sorted[j].ShortURL
+		}
+		return sorted[i].UserID < sorted[j].UserID
+	})
+	return sorted
+}
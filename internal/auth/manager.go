@@ -1,9 +1,14 @@
 package auth
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"math/rand"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
@@ -12,20 +17,104 @@ import (
 // TokenManager provides logic for JWT & Refresh tokens generation and parsing.
 type TokenManager interface {
 	NewJWT(userID string, ttl time.Duration) (string, error)
-	Parse(accessToken string) (string, error)
+	// Parse returns the user of the token and whether the token is signed by the active key.
+	Parse(accessToken string) (userID string, active bool, err error)
 	NewRefreshToken() (string, error)
 }
 
+// Key is the signing key of the keyring. Tokens are signed with the ID of the key in the kid header,
+// tokens without it are verified by the key with the empty ID.
+type Key struct {
+	ID     string `json:"id"`
+	Secret string `json:"secret"`
+}
+
+// keyFile is the JSON file with the keyring, the active key signs new tokens and the others only verify them.
+type keyFile struct {
+	Active string `json:"active"`
+	Keys   []Key  `json:"keys"`
+}
+
+// Manager signs tokens with the active key of the keyring and verifies them by any key of the keyring,
+// so keys can be rotated without logging users out: the new key is activated first and the old one
+// is removed after tokens signed by it expire.
 type Manager struct {
-	signingKey string
+	mu     sync.RWMutex
+	keys   map[string][]byte
+	active string
+	path   string // the key file, empty if the keyring is not loaded from file
 }
 
+// NewManager creates Manager with the only key of the empty ID, its tokens have no kid header.
 func NewManager(signingKey string) (*Manager, error) {
 	if signingKey == "" {
 		return nil, errors.New("empty signing key")
 	}
 
-	return &Manager{signingKey: signingKey}, nil
+	m := &Manager{}
+	if err := m.setKeys(keyFile{Keys: []Key{{Secret: signingKey}}}); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// LoadManager creates Manager with the keyring from the key file, see Reload.
+func LoadManager(path string) (*Manager, error) {
+	m := &Manager{path: path}
+	if err := m.Reload(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Reload replaces the keyring by the key file, the keyring is kept if the file is invalid.
+func (m *Manager) Reload() error {
+	if m.path == "" {
+		return errors.New("keyring is not loaded from file")
+	}
+
+	data, err := os.ReadFile(m.path)
+	if err != nil {
+		return err
+	}
+	var file keyFile
+	if err = json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("key file %s: %w", m.path, err)
+	}
+	if err = m.setKeys(file); err != nil {
+		return fmt.Errorf("key file %s: %w", m.path, err)
+	}
+	return nil
+}
+
+// ActiveKey returns the ID of the key signing new tokens.
+func (m *Manager) ActiveKey() string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.active
+}
+
+// setKeys validates the keyring and makes it current.
+func (m *Manager) setKeys(file keyFile) error {
+	keys := make(map[string][]byte, len(file.Keys))
+	for _, key := range file.Keys {
+		if key.Secret == "" {
+			return fmt.Errorf("empty signing key %q", key.ID)
+		}
+		if _, ok := keys[key.ID]; ok {
+			return fmt.Errorf("duplicate signing key %q", key.ID)
+		}
+		keys[key.ID] = []byte(key.Secret)
+	}
+	if _, ok := keys[file.Active]; !ok {
+		return fmt.Errorf("no active signing key %q", file.Active)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.keys = keys
+	m.active = file.Active
+	return nil
 }
 
 func (m *Manager) NewJWT(userID string, ttl time.Duration) (string, error) {
@@ -34,38 +123,64 @@ func (m *Manager) NewJWT(userID string, ttl time.Duration) (string, error) {
 		Subject:   userID,
 	})
 
-	return token.SignedString([]byte(m.signingKey))
+	m.mu.RLock()
+	key, keyID := m.keys[m.active], m.active
+	m.mu.RUnlock()
+	if keyID != "" {
+		token.Header["kid"] = keyID
+	}
+	return token.SignedString(key)
 }
 
-func (m *Manager) Parse(accessToken string) (string, error) {
+func (m *Manager) Parse(accessToken string) (string, bool, error) {
+	var keyID string
 	token, err := jwt.Parse(accessToken, func(token *jwt.Token) (i interface{}, err error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
 		}
 
-		return []byte(m.signingKey), nil
+		if kid, ok := token.Header["kid"]; ok {
+			if keyID, ok = kid.(string); !ok || keyID == "" {
+				return nil, fmt.Errorf("invalid key ID: %v", kid)
+			}
+		}
+		m.mu.RLock()
+		key, ok := m.keys[keyID]
+		m.mu.RUnlock()
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key %q", keyID)
+		}
+		return key, nil
 	})
 	if err != nil {
-		return "", err
+		return "", false, err
 	}
 
 	claims, ok := token.Claims.(jwt.MapClaims)
 	if !ok {
-		return "", fmt.Errorf("error get user claims from token")
+		return "", false, fmt.Errorf("error get user claims from token")
 	}
 
-	return claims["sub"].(string), nil
+	userID, ok := claims["sub"].(string)
+	if !ok || userID == "" {
+		return "", false, fmt.Errorf("token has no subject")
+	}
+	return userID, keyID == m.ActiveKey(), nil
 }
 
+// NewRefreshToken returns the opaque token of 256 random bits, only its hash is stored.
 func (m *Manager) NewRefreshToken() (string, error) {
 	b := make([]byte, 32)
-
-	s := rand.NewSource(time.Now().Unix())
-	r := rand.New(s)
-
-	if _, err := r.Read(b); err != nil {
+	if _, err := rand.Read(b); err != nil {
 		return "", err
 	}
 
-	return fmt.Sprintf("%x", b), nil
+	return hex.EncodeToString(b), nil
+}
+
+// HashToken returns the hash of the refresh token to store and look it up by.
+// Tokens are random, so they are hashed without salt.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
 }
@@ -0,0 +1,125 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeKeyFile(t *testing.T, path, keys string) {
+	require.NoError(t, os.WriteFile(path, []byte(keys), 0600))
+}
+
+func TestManager(t *testing.T) {
+	_, err := NewManager("")
+	assert.Error(t, err)
+
+	m, err := NewManager("PaSsW0rD")
+	require.NoError(t, err)
+	token, err := m.NewJWT("user1", time.Minute)
+	require.NoError(t, err)
+	parsed, _, err := new(jwt.Parser).ParseUnverified(token, jwt.MapClaims{})
+	require.NoError(t, err)
+	assert.NotContains(t, parsed.Header, "kid", "the key without ID signs tokens without kid")
+
+	userID, active, err := m.Parse(token)
+	require.NoError(t, err)
+	assert.Equal(t, "user1", userID)
+	assert.True(t, active)
+
+	expired, err := m.NewJWT("user1", -time.Minute)
+	require.NoError(t, err)
+	_, _, err = m.Parse(expired)
+	assert.Error(t, err)
+
+	other, err := NewManager("secret")
+	require.NoError(t, err)
+	_, _, err = other.Parse(token)
+	assert.Error(t, err)
+}
+
+func TestManagerKeyring(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	legacy, err := NewManager("PaSsW0rD")
+	require.NoError(t, err)
+	legacyToken, err := legacy.NewJWT("user1", time.Minute)
+	require.NoError(t, err)
+
+	// the key of UserKey is kept without ID to verify tokens signed before the keyring
+	writeKeyFile(t, path, `{"active":"k1","keys":[{"id":"","secret":"PaSsW0rD"},{"id":"k1","secret":"secret1"}]}`)
+	m, err := LoadManager(path)
+	require.NoError(t, err)
+	assert.Equal(t, "k1", m.ActiveKey())
+
+	userID, active, err := m.Parse(legacyToken)
+	require.NoError(t, err)
+	assert.Equal(t, "user1", userID)
+	assert.False(t, active)
+
+	token, err := m.NewJWT("user2", time.Minute)
+	require.NoError(t, err)
+	parsed, _, err := new(jwt.Parser).ParseUnverified(token, jwt.MapClaims{})
+	require.NoError(t, err)
+	assert.Equal(t, "k1", parsed.Header["kid"])
+	userID, active, err = m.Parse(token)
+	require.NoError(t, err)
+	assert.Equal(t, "user2", userID)
+	assert.True(t, active)
+
+	// invalid files don't replace the keyring
+	tests := []struct {
+		name string
+		keys string
+	}{
+		{name: "not JSON", keys: `active: k2`},
+		{name: "no active key", keys: `{"active":"k2","keys":[{"id":"k1","secret":"secret1"}]}`},
+		{name: "empty secret", keys: `{"active":"k1","keys":[{"id":"k1","secret":""}]}`},
+		{name: "duplicate key", keys: `{"active":"k1","keys":[{"id":"k1","secret":"secret1"},{"id":"k1","secret":"secret2"}]}`},
+	}
+	for _, tt := range tests {
+		writeKeyFile(t, path, tt.keys)
+		assert.Error(t, m.Reload(), tt.name)
+		assert.Equal(t, "k1", m.ActiveKey(), tt.name)
+		_, _, err = m.Parse(token)
+		assert.NoError(t, err, tt.name)
+	}
+
+	// retired keys don't verify tokens anymore
+	writeKeyFile(t, path, `{"active":"k2","keys":[{"id":"k1","secret":"secret1"},{"id":"k2","secret":"secret2"}]}`)
+	require.NoError(t, m.Reload())
+	_, active, err = m.Parse(token)
+	require.NoError(t, err)
+	assert.False(t, active)
+	_, _, err = m.Parse(legacyToken)
+	assert.Error(t, err)
+
+	// the key ID can't be forged to pick another key
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.StandardClaims{Subject: "user1"})
+	forged.Header["kid"] = "k2"
+	forgedToken, err := forged.SignedString([]byte("secret1"))
+	require.NoError(t, err)
+	_, _, err = m.Parse(forgedToken)
+	assert.Error(t, err)
+
+	_, err = LoadManager(filepath.Join(t.TempDir(), "missing.json"))
+	assert.Error(t, err)
+	assert.Error(t, legacy.Reload(), "keyring of UserKey can't be reloaded")
+}
+
+func TestRefreshToken(t *testing.T) {
+	m, err := NewManager("PaSsW0rD")
+	require.NoError(t, err)
+	first, err := m.NewRefreshToken()
+	require.NoError(t, err)
+	second, err := m.NewRefreshToken()
+	require.NoError(t, err)
+	assert.Len(t, first, 64)
+	assert.NotEqual(t, first, second)
+	assert.Equal(t, HashToken(first), HashToken(first))
+	assert.NotEqual(t, first, HashToken(first))
+}
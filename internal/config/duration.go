@@ -0,0 +1,29 @@
+// Package config provides two ways to configure app
+package config
+
+import "time"
+
+//Duration is time.Duration which is parsed from strings like "10m" in config file, environment and flags
+type Duration struct {
+	time.Duration
+}
+
+//UnmarshalText parses duration. It is used by json and env packages
+func (d *Duration) UnmarshalText(text []byte) error {
+	return d.Set(string(text))
+}
+
+//MarshalText serializes duration as string
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+//Set parses duration. It implements flag.Value
+func (d *Duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
@@ -5,7 +5,27 @@ import "errors"
 var (
 	ErrNotFound      = errors.New("not found")
 	ErrDeleted       = errors.New("marked as deleted")
+	ErrExpired       = errors.New("link is expired")
+	ErrInvalidExpiry = errors.New("invalid expiry")
 	ErrAlreadyExists = errors.New("already exists")
+	ErrCodeTaken     = errors.New("short URL is taken by another URL")
+	ErrAliasTaken    = errors.New("alias is already taken")
+	ErrInvalidAlias  = errors.New("invalid alias")
+
+	ErrPasswordRequired = errors.New("password is required")
+	ErrWrongPassword    = errors.New("wrong password")
+	ErrTooManyAttempts  = errors.New("too many attempts to enter password")
+	ErrInvalidPassword  = errors.New("invalid password")
+
+	ErrNotOwner   = errors.New("link is not owned by the user")
+	ErrLinkShared = errors.New("link is shared with other users")
+
+	ErrInvalidQuery = errors.New("invalid query")
+	ErrUntrusted    = errors.New("client is not in the trusted subnet")
+
+	ErrTokenUsed   = errors.New("refresh token is already used")
+	ErrTokenReused = errors.New("refresh token is reused, the session is revoked")
+
 	ErrExecutionPSQL = errors.New("execution PSQL error")
 	ErrStatementPSQL = errors.New("statement PSQL error")
 )
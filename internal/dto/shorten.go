@@ -1,6 +1,8 @@
 // Package dto contains data transfer objects and some constants for app.
 package dto
 
+import "time"
+
 type UserConst string
 
 func (c UserConst) String() string {
@@ -15,12 +17,33 @@ var (
 type ModelURL struct {
 	ShortURL    string `json:"short_url"`
 	OriginalURL string `json:"original_url"`
+	IsDeleted   bool   `json:"is_deleted,omitempty"`
+}
+
+// ModelLinksQuery selects the page of links of the user
+type ModelLinksQuery struct {
+	Limit   int    // the default size of page if zero
+	Cursor  string // position returned with the previous page, the first page if empty
+	Sort    string // "created" (default) or "url", descending with "-" prefix
+	Search  string // substring of the original URL
+	Domain  string // host of the original URL or its parent domain
+	Deleted *bool  // both deleted and not deleted links if nil
+}
+
+// ModelURLPage is the page of links of the user
+type ModelURLPage struct {
+	URLs       []ModelURL
+	NextCursor string // empty on the last page
 }
 
 // ModelOriginalURLBatch struct
 type ModelOriginalURLBatch struct {
-	CorrelationID string `json:"correlation_id"`
-	OriginalURL   string `json:"original_url"`
+	CorrelationID string     `json:"correlation_id"`
+	OriginalURL   string     `json:"original_url"`
+	Alias         string     `json:"alias,omitempty"`      // custom short URL, generated if empty
+	ExpiresAt     *time.Time `json:"expires_at,omitempty"` // the link stops redirecting at the time
+	MaxClicks     int64      `json:"max_clicks,omitempty"` // the link stops redirecting after the number of redirects
+	Password      string     `json:"password,omitempty"`   // the link redirects only after the password is entered
 }
 
 //ModelShortURLBatch struct
@@ -31,10 +54,103 @@ type ModelShortURLBatch struct {
 
 //ModelOriginalURL struct
 type ModelOriginalURL struct {
-	OriginalURL string `json:"url"`
+	OriginalURL string     `json:"url"`
+	Alias       string     `json:"alias,omitempty"`      // custom short URL, generated if empty
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"` // the link stops redirecting at the time
+	MaxClicks   int64      `json:"max_clicks,omitempty"` // the link stops redirecting after the number of redirects
+	Password    string     `json:"password,omitempty"`   // the link redirects only after the password is entered
 }
 
 //ModelShortURL struct
 type ModelShortURL struct {
 	ShortURL string `json:"result"`
 }
+
+//ModelEditURL is the new original URL of the short URL
+type ModelEditURL struct {
+	OriginalURL string `json:"url"`
+}
+
+//ModelRollback is the revision to roll back, the last one if zero
+type ModelRollback struct {
+	Revision int `json:"revision,omitempty"`
+}
+
+//ModelRevision is one change of the original URL
+type ModelRevision struct {
+	Revision  int       `json:"revision"`
+	UserID    string    `json:"user_id"`
+	ChangedAt time.Time `json:"changed_at"`
+	OldURL    string    `json:"old_url"`
+	NewURL    string    `json:"new_url"`
+}
+
+//ModelClick is the redirect by the short URL as it is received
+type ModelClick struct {
+	ShortURL   string
+	Referrer   string
+	UserAgent  string
+	RemoteAddr string // address of the client, it is anonymised before saving
+	Method     string // HTTP method of the request
+	Purpose    string // the header marking prefetching or the preview of the link, e.g. "prefetch"
+}
+
+//ModelStatsQuery selects statistics of clicks of the link, bounds are rounded to whole hours outwards
+type ModelStatsQuery struct {
+	From   *time.Time // the default period before To if nil
+	To     *time.Time // now if nil
+	Bucket string     // "hour" or "day" (default)
+	Bots   bool       // include clicks of bots
+}
+
+//ModelLinkStats are statistics of clicks of the link
+type ModelLinkStats struct {
+	ShortURL  string             `json:"short_url"`
+	From      time.Time          `json:"from"`
+	To        time.Time          `json:"to"`
+	Bucket    string             `json:"bucket"`
+	Total     int64              `json:"total"`
+	Visitors  int64              `json:"visitors"`  //estimated unique visitors of whole days overlapping the period
+	Bots      int64              `json:"bots"`      //clicks of bots in the period whether they are included or not
+	BotShare  float64            `json:"bot_share"` //share of clicks of bots among all clicks of the period
+	Buckets   []ModelStatsBucket `json:"buckets"`
+	Referrers []ModelStatsCount  `json:"referrers"`
+	Agents    []ModelStatsCount  `json:"agents"`
+}
+
+//ModelStatsBucket is the number of clicks within the bucket starting at Start
+type ModelStatsBucket struct {
+	Start    time.Time `json:"start"`
+	Clicks   int64     `json:"clicks"`
+	Visitors int64     `json:"visitors,omitempty"` //estimated unique visitors, only for day buckets
+}
+
+//ModelClickEvent is the click streamed to owners of the link, ID orders events of the stream
+type ModelClickEvent struct {
+	ID        uint64    `json:"id"`
+	ShortURL  string    `json:"short_url"`
+	At        time.Time `json:"at"`
+	Referrer  string    `json:"referrer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Bot       bool      `json:"bot,omitempty"`
+}
+
+//ModelStatsCount is the number of clicks with the referrer or the agent family
+type ModelStatsCount struct {
+	Name   string `json:"name"`
+	Clicks int64  `json:"clicks"`
+}
+
+//ModelInternalStats are numbers of short URLs and users of the service
+type ModelInternalStats struct {
+	URLs  int64 `json:"urls"`
+	Users int64 `json:"users"`
+}
+
+//ModelSession are tokens of the user: the short-lived access token and the refresh token issuing new ones
+type ModelSession struct {
+	UserID           string
+	AccessToken      string
+	RefreshToken     string    // empty if the refresh token is not rotated
+	RefreshExpiresAt time.Time // zero if the refresh token is not rotated
+}
@@ -0,0 +1,234 @@
+// Package hll implements HyperLogLog sketches estimating the number of distinct values.
+package hll
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"sort"
+)
+
+// Parameters of sketches: 2^14 registers give standard error of about 0.8%.
+const (
+	precision = 14
+	registers = 1 << precision
+	maxRank   = 64 - precision + 1
+)
+
+// Encodings of marshaled sketches.
+const (
+	formatVersion  = 1
+	encodingDense  = 0 // one byte per register
+	encodingSparse = 1 // index (2 bytes) and value (1 byte) of every non-zero register in order of indexes
+	headerSize     = 3 // version, precision, encoding
+	sparseItemSize = 3
+)
+
+var errInvalidSketch = errors.New("invalid sketch")
+
+// Sketch is HyperLogLog sketch of 64-bit hashes. Hashes must be uniformly distributed.
+// Sketches are mergeable: the merged sketch estimates the number of distinct values added to any of them.
+// Small sketches keep only non-zero registers, so sketches of rarely visited links take little memory.
+type Sketch struct {
+	sparse []uint32 // index<<8 | rank of non-zero registers in order of indexes, used while dense is nil
+	dense  []uint8  // all registers
+}
+
+// New creates empty Sketch.
+func New() *Sketch {
+	return &Sketch{}
+}
+
+// Add adds the hash of the value.
+func (s *Sketch) Add(hash uint64) {
+	index := hash >> (64 - precision)
+	// the guard bit limits the rank when the rest of the hash is zero
+	rank := bits.LeadingZeros64(hash<<precision|1<<(precision-1)) + 1
+	s.set(int(index), uint8(rank))
+}
+
+// set raises the register to the rank.
+func (s *Sketch) set(index int, rank uint8) {
+	if s.dense != nil {
+		if rank > s.dense[index] {
+			s.dense[index] = rank
+		}
+		return
+	}
+
+	i := sort.Search(len(s.sparse), func(i int) bool {
+		return int(s.sparse[i]>>8) >= index
+	})
+	switch {
+	case i < len(s.sparse) && int(s.sparse[i]>>8) == index:
+		if rank > uint8(s.sparse[i]) {
+			s.sparse[i] = uint32(index)<<8 | uint32(rank)
+		}
+	default:
+		s.sparse = append(s.sparse, 0)
+		copy(s.sparse[i+1:], s.sparse[i:])
+		s.sparse[i] = uint32(index)<<8 | uint32(rank)
+		// sparse registers take 4 bytes each, dense ones take 1 byte
+		if len(s.sparse)*4 >= registers {
+			s.toDense()
+		}
+	}
+}
+
+// toDense switches the sketch to dense registers.
+func (s *Sketch) toDense() {
+	if s.dense != nil {
+		return
+	}
+	s.dense = make([]uint8, registers)
+	for _, item := range s.sparse {
+		s.dense[item>>8] = uint8(item)
+	}
+	s.sparse = nil
+}
+
+// each calls fn for every non-zero register in order of indexes.
+func (s *Sketch) each(fn func(index int, rank uint8)) {
+	if s.dense == nil {
+		for _, item := range s.sparse {
+			fn(int(item>>8), uint8(item))
+		}
+		return
+	}
+	for index, rank := range s.dense {
+		if rank != 0 {
+			fn(index, rank)
+		}
+	}
+}
+
+// Merge adds all values of the other sketch.
+func (s *Sketch) Merge(other *Sketch) {
+	if other.dense != nil {
+		s.toDense()
+	}
+	other.each(s.set)
+}
+
+// Estimate returns the estimated number of distinct values.
+// It uses the improved estimator of O. Ertl ("New cardinality estimation algorithms for HyperLogLog sketches", 2017),
+// which needs neither empirical bias correction nor switching to linear counting.
+func (s *Sketch) Estimate() uint64 {
+	var counts [maxRank + 1]int
+	counts[0] = registers
+	s.each(func(index int, rank uint8) {
+		counts[0]--
+		counts[rank]++
+	})
+	if counts[0] == registers {
+		return 0
+	}
+
+	const m = float64(registers)
+	z := m * tau(1-float64(counts[maxRank])/m)
+	for k := maxRank - 1; k >= 1; k-- {
+		z = 0.5 * (z + float64(counts[k]))
+	}
+	z += m * sigma(float64(counts[0])/m)
+	return uint64(math.Round(m * m / (2 * math.Ln2) / z))
+}
+
+// sigma is the function of the estimator correcting it for empty registers.
+func sigma(x float64) float64 {
+	if x == 1 {
+		return math.Inf(1)
+	}
+	y, z := 1.0, x
+	for {
+		x *= x
+		prev := z
+		z += x * y
+		y += y
+		if z == prev {
+			return z
+		}
+	}
+}
+
+// tau is the function of the estimator correcting it for saturated registers.
+func tau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+	y, z := 1.0, 1-x
+	for {
+		x = math.Sqrt(x)
+		prev := z
+		y *= 0.5
+		z -= (1 - x) * (1 - x) * y
+		if z == prev {
+			return z / 3
+		}
+	}
+}
+
+// MarshalBinary encodes the sketch. Sketches with few non-zero registers are encoded sparsely.
+func (s *Sketch) MarshalBinary() ([]byte, error) {
+	nonZero := 0
+	s.each(func(int, uint8) { nonZero++ })
+
+	if nonZero*sparseItemSize >= registers {
+		data := make([]byte, headerSize+registers)
+		data[0], data[1], data[2] = formatVersion, precision, encodingDense
+		s.each(func(index int, rank uint8) {
+			data[headerSize+index] = rank
+		})
+		return data, nil
+	}
+
+	data := make([]byte, headerSize, headerSize+nonZero*sparseItemSize)
+	data[0], data[1], data[2] = formatVersion, precision, encodingSparse
+	s.each(func(index int, rank uint8) {
+		data = append(data, byte(index>>8), byte(index), rank)
+	})
+	return data, nil
+}
+
+// UnmarshalBinary decodes the sketch encoded by MarshalBinary.
+func (s *Sketch) UnmarshalBinary(data []byte) error {
+	if len(data) < headerSize {
+		return errInvalidSketch
+	}
+	if data[0] != formatVersion || data[1] != precision {
+		return fmt.Errorf("%w: unsupported version %d or precision %d", errInvalidSketch, data[0], data[1])
+	}
+
+	decoded := New()
+	body := data[headerSize:]
+	switch data[2] {
+	case encodingDense:
+		if len(body) != registers {
+			return errInvalidSketch
+		}
+		decoded.dense = make([]uint8, registers)
+		for index, rank := range body {
+			if rank > maxRank {
+				return errInvalidSketch
+			}
+			decoded.dense[index] = rank
+		}
+	case encodingSparse:
+		if len(body)%sparseItemSize != 0 {
+			return errInvalidSketch
+		}
+		for i := 0; i < len(body); i += sparseItemSize {
+			index, rank := binary.BigEndian.Uint16(body[i:]), body[i+2]
+			if index >= registers || rank == 0 || rank > maxRank {
+				return errInvalidSketch
+			}
+			decoded.set(int(index), rank)
+		}
+	default:
+		return fmt.Errorf("%w: unknown encoding %d", errInvalidSketch, data[2])
+	}
+
+	*s = *decoded
+	return nil
+}
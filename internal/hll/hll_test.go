@@ -0,0 +1,108 @@
+// Package hll implements HyperLogLog sketches estimating the number of distinct values.
+package hll
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math"
+	"strconv"
+	"testing"
+)
+
+// hash returns uniformly distributed hash of the value like the ones of visitor fingerprints.
+func hash(value string) uint64 {
+	sum := sha256.Sum256([]byte(value))
+	return binary.BigEndian.Uint64(sum[:])
+}
+
+// dump returns all registers of the sketch.
+func dump(s *Sketch) [registers]uint8 {
+	var regs [registers]uint8
+	s.each(func(index int, rank uint8) {
+		regs[index] = rank
+	})
+	return regs
+}
+
+// assertAccuracy checks that the estimate is within 3 standard errors of the exact count.
+func assertAccuracy(t *testing.T, exact int, estimate uint64) {
+	t.Helper()
+	stdErr := 1.04 / math.Sqrt(registers)
+	tolerance := math.Max(3*stdErr*float64(exact), 1)
+	assert.InDelta(t, float64(exact), float64(estimate), tolerance, "exact %d, estimate %d", exact, estimate)
+}
+
+func TestEstimate(t *testing.T) {
+	assert.Equal(t, uint64(0), New().Estimate())
+
+	for _, exact := range []int{1, 10, 100, 1000, 10000, 40000, 100000, 1000000} {
+		t.Run(strconv.Itoa(exact), func(t *testing.T) {
+			s := New()
+			for i := 0; i < exact; i++ {
+				s.Add(hash("visitor" + strconv.Itoa(i)))
+			}
+			// repeated values are not counted
+			for i := 0; i < exact; i += 2 {
+				s.Add(hash("visitor" + strconv.Itoa(i)))
+			}
+			assertAccuracy(t, exact, s.Estimate())
+		})
+	}
+}
+
+func TestMerge(t *testing.T) {
+	// days with overlapping visitors
+	days := []*Sketch{New(), New(), New()}
+	for i := 0; i < 30000; i++ {
+		days[i%3].Add(hash("visitor" + strconv.Itoa(i)))
+		days[(i+1)%3].Add(hash("visitor" + strconv.Itoa(i)))
+	}
+
+	merged := New()
+	for _, day := range days {
+		assertAccuracy(t, 20000, day.Estimate())
+		merged.Merge(day)
+	}
+	assertAccuracy(t, 30000, merged.Estimate())
+
+	// sparse and dense sketches are merged in any order
+	small := New()
+	for i := 29900; i < 30100; i++ {
+		small.Add(hash("visitor" + strconv.Itoa(i)))
+	}
+	require.Nil(t, small.dense)
+	smallFirst := New()
+	smallFirst.Merge(small)
+	smallFirst.Merge(merged)
+	merged.Merge(small)
+	assert.Equal(t, dump(merged), dump(smallFirst))
+	assertAccuracy(t, 30100, merged.Estimate())
+}
+
+func TestMarshal(t *testing.T) {
+	for _, exact := range []int{0, 100, 100000} {
+		s := New()
+		for i := 0; i < exact; i++ {
+			s.Add(hash("visitor" + strconv.Itoa(i)))
+		}
+
+		data, err := s.MarshalBinary()
+		require.NoError(t, err)
+		assert.LessOrEqual(t, len(data), headerSize+registers)
+		if exact <= 100 {
+			assert.Nil(t, s.dense, "small sketches must be sparse in memory")
+			assert.Less(t, len(data), 1000, "small sketches must be sparse")
+		}
+
+		decoded := New()
+		require.NoError(t, decoded.UnmarshalBinary(data))
+		assert.Equal(t, dump(s), dump(decoded))
+		assert.Equal(t, s.Estimate(), decoded.Estimate())
+	}
+
+	for _, data := range [][]byte{nil, {2, precision, encodingDense}, {formatVersion, precision, encodingSparse, 0xff, 0xff, 1}, {formatVersion, precision, 7}} {
+		assert.Error(t, New().UnmarshalBinary(data))
+	}
+}
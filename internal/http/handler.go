@@ -11,6 +11,8 @@ import (
 	"github.com/zhel1/yandex-practicum-go/internal/service"
 	"io"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 type Handler struct {
@@ -26,10 +28,12 @@ func NewHandler(services *service.Services) *Handler {
 func (h *Handler) Init() *chi.Mux {
 	router := chi.NewRouter()
 	router.Use(middleware.GzipHandler)
-	router.Use(middleware.NewCookieHandler(h.services).CookieHandler)
 
-	router.Post("/", h.AddLink())
+	// users are identified only by routes which need them, so redirects and checks don't make sessions
+	router.With(middleware.NewCookieHandler(h.services).CookieHandler).Post("/", h.AddLink())
 	router.Get("/{id}", h.GetLink())
+	router.Head("/{id}", h.GetLink()) // checks of links by crawlers, recorded as clicks of bots
+	router.Post("/{id}", h.GetLink()) // unlock form of protected links
 	router.Get("/ping", h.Ping())
 
 	h.initAPI(router)
@@ -45,6 +49,8 @@ func (h *Handler) initAPI(router chi.Router) {
 }
 
 // AddLink accepts a URL string in the request body for shortening.
+// Alias can be passed in the "alias" query parameter,
+// restrictions of the link in "expires_at" (RFC 3339) and "max_clicks" ones, password in PasswordHeader.
 func (h *Handler) AddLink() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		userID, err := middleware.TakeUserID(r.Context())
@@ -59,14 +65,36 @@ func (h *Handler) AddLink() http.HandlerFunc {
 			return
 		}
 
-		status := http.StatusCreated
-		shortLink, err := h.services.Shorten.ShortenURL(r.Context(), userID, dto.ModelOriginalURL{
+		longLink := dto.ModelOriginalURL{
 			OriginalURL: string(longLinkBytes),
-		})
+			Alias:       r.URL.Query().Get("alias"),
+			Password:    r.Header.Get(PasswordHeader),
+		}
+		if v := r.URL.Query().Get("expires_at"); v != "" {
+			expiresAt, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			longLink.ExpiresAt = &expiresAt
+		}
+		if v := r.URL.Query().Get("max_clicks"); v != "" {
+			longLink.MaxClicks, err = strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		status := http.StatusCreated
+		shortLink, err := h.services.Shorten.ShortenURL(r.Context(), userID, longLink)
 		if err != nil {
 			switch {
 			case errors.Is(err, dto.ErrAlreadyExists):
 				status = http.StatusConflict
+			case errors.Is(err, dto.ErrAliasTaken):
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
 			default:
 				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
@@ -80,22 +108,58 @@ func (h *Handler) AddLink() http.HandlerFunc {
 }
 
 //GetLink accepts the identifier of the short URL as a URL parameter and returns a response
+//Password of the protected link is taken from PasswordHeader or from the posted unlock form,
+//browsers get the form instead of errors about the password
+//Every redirect is recorded as the click, recording never delays the response
+//HEAD requests, prefetching and previews of the link are recorded as clicks of bots
 func (h *Handler) GetLink() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		shortURL := chi.URLParam(r, "id")
-		originalLink, err := h.services.Users.GetOriginalURLByShort(r.Context(), shortURL)
+		password := r.Header.Get(PasswordHeader)
+		fromHeader := password != ""
+		fromForm := !fromHeader && r.Method == http.MethodPost
+		if fromForm {
+			r.Body = http.MaxBytesReader(w, r.Body, maxUnlockFormSize)
+			password = r.PostFormValue("password")
+		}
+
+		originalLink, err := h.services.Users.GetOriginalURLByShort(r.Context(), shortURL, password)
 		if err != nil {
-			switch err {
-			case dto.ErrDeleted:
+			switch {
+			case errors.Is(err, dto.ErrDeleted), errors.Is(err, dto.ErrExpired):
 				http.Error(w, err.Error(), http.StatusGone)
+			case errors.Is(err, dto.ErrPasswordRequired) && !fromHeader:
+				renderUnlockForm(w, http.StatusUnauthorized, "")
+			case errors.Is(err, dto.ErrWrongPassword) && !fromHeader:
+				renderUnlockForm(w, http.StatusUnauthorized, "Wrong password, try again.")
+			case errors.Is(err, dto.ErrTooManyAttempts) && !fromHeader:
+				renderUnlockForm(w, http.StatusTooManyRequests, "Too many attempts, try again later.")
+			case errors.Is(err, dto.ErrPasswordRequired), errors.Is(err, dto.ErrWrongPassword):
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+			case errors.Is(err, dto.ErrTooManyAttempts):
+				http.Error(w, err.Error(), http.StatusTooManyRequests)
 			default:
 				http.Error(w, err.Error(), http.StatusBadRequest)
 			}
 			return
 		}
 
+		h.services.Analytics.RecordClick(r.Context(), dto.ModelClick{
+			ShortURL:   shortURL,
+			Referrer:   r.Referer(),
+			UserAgent:  r.UserAgent(),
+			RemoteAddr: r.RemoteAddr,
+			Method:     r.Method,
+			Purpose:    clickPurpose(r),
+		})
+
+		//the posted form is redirected by GET
+		status := http.StatusTemporaryRedirect
+		if fromForm {
+			status = http.StatusSeeOther
+		}
 		w.Header().Set("Location", originalLink)
-		w.WriteHeader(http.StatusTemporaryRedirect)
+		w.WriteHeader(status)
 	}
 }
 
@@ -109,3 +173,16 @@ func (h *Handler) Ping() http.HandlerFunc {
 		w.WriteHeader(http.StatusOK)
 	}
 }
+
+//purposeHeaders mark prefetching and previews of links by browsers
+var purposeHeaders = []string{"Sec-Purpose", "Purpose", "X-Purpose", "X-Moz"}
+
+//clickPurpose returns the first of purposeHeaders set in the request
+func clickPurpose(r *http.Request) string {
+	for _, header := range purposeHeaders {
+		if purpose := r.Header.Get(header); purpose != "" {
+			return purpose
+		}
+	}
+	return ""
+}
@@ -3,6 +3,7 @@ package http
 
 import (
 	"context"
+	"errors"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-resty/resty/v2"
 	"github.com/google/uuid"
@@ -21,6 +22,7 @@ import (
 	"net/url"
 	"strings"
 	"testing"
+	"time"
 )
 
 type HandlersTestSuite struct {
@@ -68,8 +70,12 @@ func TestHandlersTestSuite(t *testing.T) {
 func (ht *HandlersTestSuite) TestGetLink() {
 	ht.router.Get("/{id}", ht.handler.GetLink())
 	userID := uuid.New().String()
-	ht.storage.Put(context.Background(), userID, "1234567", "https://yandex.ru/news/story/Minoborony_zayavilo_ob_unichtozhenii_podLvovom_sklada_inostrannogo_oruzhiya--5da2bb9cc9ddc47c0adb17be6d81bd72?lang=ru&rubric=index&fan=1&stid=yjizNz0bbyG1LTQtz2jv&t=1650312349&tt=true&persistent_id=192628644&story=4bc48b1b-a772-571f-a583-40d87f145dd6")
-	ht.storage.Put(context.Background(), userID, "1234568", "https://yandex.ru/news/")
+	ht.storage.Put(context.Background(), userID, "1234567", "https://yandex.ru/news/story/Minoborony_zayavilo_ob_unichtozhenii_podLvovom_sklada_inostrannogo_oruzhiya--5da2bb9cc9ddc47c0adb17be6d81bd72?lang=ru&rubric=index&fan=1&stid=yjizNz0bbyG1LTQtz2jv&t=1650312349&tt=true&persistent_id=192628644&story=4bc48b1b-a772-571f-a583-40d87f145dd6", storage.LinkOptions{})
+	ht.storage.Put(context.Background(), userID, "1234568", "https://yandex.ru/news/", storage.LinkOptions{})
+	ht.storage.Put(context.Background(), userID, "1234570", "https://yandex.ru/sport/", storage.LinkOptions{})
+	ht.storage.Delete(context.Background(), []string{"1234570"}, userID)
+	ht.storage.Put(context.Background(), userID, "1234571", "https://yandex.ru/maps/", storage.LinkOptions{ExpiresAt: time.Now().Add(-time.Minute)})
+	ht.storage.Put(context.Background(), userID, "1234572", "https://yandex.ru/weather/", storage.LinkOptions{MaxClicks: 1})
 	defer ht.ts.Close()
 
 	tests := []struct {
@@ -102,6 +108,26 @@ func (ht *HandlersTestSuite) TestGetLink() {
 			value:    "",
 			wantCode: http.StatusNotFound,
 		},
+		{
+			name:     "Negative test #5. Deleted link.",
+			value:    "1234570",
+			wantCode: http.StatusGone,
+		},
+		{
+			name:     "Negative test #6. Expired link.",
+			value:    "1234571",
+			wantCode: http.StatusGone,
+		},
+		{
+			name:     "Positive test #7. Link with one redirect.",
+			value:    "1234572",
+			wantCode: http.StatusTemporaryRedirect,
+		},
+		{
+			name:     "Negative test #8. Link with used up redirects.",
+			value:    "1234572",
+			wantCode: http.StatusGone,
+		},
 	}
 
 	for _, tt := range tests {
@@ -186,3 +212,236 @@ func (ht *HandlersTestSuite) TestAddLink() {
 		})
 	}
 }
+
+func (ht *HandlersTestSuite) TestAddExistingLink() {
+	defer ht.ts.Close()
+	tokenManager, err := auth.NewManager(ht.cfg.UserKey)
+	require.NoError(ht.T(), err)
+
+	for _, name := range []string{service.GeneratorHash, service.GeneratorRandom, service.GeneratorCounter} {
+		ht.T().Run(name, func(t *testing.T) {
+			generator, err := service.NewGenerator(name, service.DefaultCodeLength)
+			require.NoError(t, err)
+			services := service.NewServices(service.Deps{
+				Storage:      inmemory.NewStorage(),
+				BaseURL:      ht.cfg.BaseURL,
+				TokenManager: tokenManager,
+				Generator:    generator,
+			})
+			router := chi.NewRouter()
+			router.Use(middleware.NewCookieHandler(services).CookieHandler)
+			router.Post("/", NewHandler(services).AddLink())
+			ts := httptest.NewServer(router)
+			defer ts.Close()
+
+			// the user gets the existing short URL whatever the generator is
+			client := resty.New()
+			resp, err := client.R().SetBody("https://yandex.ru/news/").Post(ts.URL + "/")
+			require.NoError(t, err)
+			require.Equal(t, http.StatusCreated, resp.StatusCode())
+			shortURL := string(resp.Body())
+
+			resp, err = client.R().SetBody("https://yandex.ru/news/").Post(ts.URL + "/")
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusConflict, resp.StatusCode())
+			assert.Equal(t, shortURL, string(resp.Body()))
+
+			resp, err = client.R().SetBody("https://yandex.ru/sport/").Post(ts.URL + "/")
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusCreated, resp.StatusCode())
+			assert.NotEqual(t, shortURL, string(resp.Body()))
+		})
+	}
+}
+
+// tokenlessStorage fails to save refresh tokens, so sessions can't be created.
+type tokenlessStorage struct {
+	storage.Storage
+}
+
+func (s tokenlessStorage) SaveRefreshToken(ctx context.Context, token storage.RefreshToken) error {
+	return errors.New("connection refused")
+}
+
+func (ht *HandlersTestSuite) TestSessionRoutes() {
+	defer ht.ts.Close()
+	tokenManager, err := auth.NewManager(ht.cfg.UserKey)
+	require.NoError(ht.T(), err)
+	require.NoError(ht.T(), ht.storage.Put(context.Background(), "user1", "1234567", "https://yandex.ru/news/", storage.LinkOptions{}))
+
+	newServer := func(strg storage.Storage) *httptest.Server {
+		services := service.NewServices(service.Deps{
+			Storage:      strg,
+			BaseURL:      ht.cfg.BaseURL,
+			TokenManager: tokenManager,
+		})
+		return httptest.NewServer(NewHandler(services).Init())
+	}
+	client := resty.New().SetRedirectPolicy(resty.RedirectPolicyFunc(func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}))
+
+	// anonymous requests pass without sessions even when sessions can't be created
+	ts := newServer(tokenlessStorage{Storage: ht.storage})
+	defer ts.Close()
+	for _, tt := range []struct {
+		method   string
+		path     string
+		wantCode int
+	}{
+		{method: http.MethodGet, path: "/1234567", wantCode: http.StatusTemporaryRedirect},
+		{method: http.MethodHead, path: "/1234567", wantCode: http.StatusTemporaryRedirect},
+		{method: http.MethodGet, path: "/api/internal/stats", wantCode: http.StatusForbidden},
+		{method: http.MethodPost, path: "/", wantCode: http.StatusInternalServerError},
+		{method: http.MethodGet, path: "/api/user/urls", wantCode: http.StatusInternalServerError},
+	} {
+		resp, err := client.R().SetBody("https://yandex.ru/sport/").Execute(tt.method, ts.URL+tt.path)
+		require.NoError(ht.T(), err)
+		assert.Equal(ht.T(), tt.wantCode, resp.StatusCode(), tt.method+" "+tt.path)
+		assert.Empty(ht.T(), resp.Header().Values("Set-Cookie"), tt.method+" "+tt.path)
+	}
+
+	// routes of users make sessions
+	ts = newServer(ht.storage)
+	defer ts.Close()
+	resp, err := client.R().Get(ts.URL + "/1234567")
+	require.NoError(ht.T(), err)
+	assert.Empty(ht.T(), resp.Cookies())
+	resp, err = client.R().SetBody("https://yandex.ru/sport/").Post(ts.URL + "/")
+	require.NoError(ht.T(), err)
+	assert.Equal(ht.T(), http.StatusCreated, resp.StatusCode())
+	assert.NotEmpty(ht.T(), resp.Cookies())
+}
+
+func (ht *HandlersTestSuite) TestGetProtectedLink() {
+	ht.router.Use(ht.cookieHandler.CookieHandler)
+	ht.router.Post("/", ht.handler.AddLink())
+	ht.router.Get("/{id}", ht.handler.GetLink())
+	ht.router.Post("/{id}", ht.handler.GetLink())
+	defer ht.ts.Close()
+
+	client := resty.New()
+	client.SetRedirectPolicy(resty.RedirectPolicyFunc(func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}))
+
+	resp, err := client.R().SetHeader(PasswordHeader, "secret").SetBody("https://yandex.ru/docs/").Post(ht.ts.URL + "/")
+	require.NoError(ht.T(), err)
+	require.Equal(ht.T(), http.StatusCreated, resp.StatusCode())
+	shortURL := ht.ts.URL + "/" + strings.TrimPrefix(resp.String(), ht.cfg.BaseURL)
+
+	tests := []struct {
+		name        string
+		method      string
+		header      string
+		form        string
+		wantCode    int
+		contentType string
+	}{
+		{
+			name:        "Browser gets unlock form",
+			method:      http.MethodGet,
+			wantCode:    http.StatusUnauthorized,
+			contentType: "text/html; charset=utf-8",
+		},
+		{
+			name:        "Wrong password in form",
+			method:      http.MethodPost,
+			form:        "wrong",
+			wantCode:    http.StatusUnauthorized,
+			contentType: "text/html; charset=utf-8",
+		},
+		{
+			name:     "Right password in form",
+			method:   http.MethodPost,
+			form:     "secret",
+			wantCode: http.StatusSeeOther,
+		},
+		{
+			name:        "Wrong password in header",
+			method:      http.MethodGet,
+			header:      "wrong",
+			wantCode:    http.StatusUnauthorized,
+			contentType: "text/plain; charset=utf-8",
+		},
+		{
+			name:     "Right password in header",
+			method:   http.MethodGet,
+			header:   "secret",
+			wantCode: http.StatusTemporaryRedirect,
+		},
+	}
+
+	for _, tt := range tests {
+		ht.T().Run(tt.name, func(t *testing.T) {
+			req := client.R()
+			if tt.header != "" {
+				req.SetHeader(PasswordHeader, tt.header)
+			}
+			if tt.method == http.MethodPost {
+				req.SetFormData(map[string]string{"password": tt.form})
+			}
+			resp, err := req.Execute(tt.method, shortURL)
+			require.NoError(t, err)
+
+			assert.Equal(t, tt.wantCode, resp.StatusCode())
+			if tt.contentType != "" {
+				assert.Equal(t, tt.contentType, resp.Header().Get("Content-Type"))
+			} else {
+				assert.Equal(t, "https://yandex.ru/docs/", resp.Header().Get("Location"))
+			}
+		})
+	}
+}
+
+func (ht *HandlersTestSuite) TestGetLinkRecordsClick() {
+	tokenManager, err := auth.NewManager(ht.cfg.UserKey)
+	ht.Require().NoError(err)
+	clicks := service.NewClickRecorder(ht.storage, 10, 10, time.Hour)
+	clicks.Start()
+	handler := NewHandler(service.NewServices(service.Deps{
+		Storage:      ht.storage,
+		BaseURL:      ht.cfg.BaseURL,
+		TokenManager: tokenManager,
+		Clicks:       clicks,
+	}))
+	ht.router.Get("/{id}", handler.GetLink())
+	ht.router.Head("/{id}", handler.GetLink())
+	defer ht.ts.Close()
+
+	ht.Require().NoError(ht.storage.Put(context.Background(), "user1", "1234567", "https://yandex.ru/news/", storage.LinkOptions{}))
+	client := resty.New()
+	client.SetRedirectPolicy(resty.RedirectPolicyFunc(func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}))
+	resp, err := client.R().
+		SetHeader("Referer", "https://ya.ru/").
+		SetHeader("User-Agent", "curl/7.79.1").
+		Get(ht.ts.URL + "/1234567")
+	ht.Require().NoError(err)
+	ht.Equal(http.StatusTemporaryRedirect, resp.StatusCode())
+
+	// failed requests are not clicks
+	resp, err = client.R().Get(ht.ts.URL + "/unknown")
+	ht.Require().NoError(err)
+	ht.Equal(http.StatusBadRequest, resp.StatusCode())
+
+	// checks and prefetching of the link are clicks of bots
+	resp, err = client.R().Head(ht.ts.URL + "/1234567")
+	ht.Require().NoError(err)
+	ht.Equal(http.StatusTemporaryRedirect, resp.StatusCode())
+	resp, err = client.R().SetHeader("Sec-Purpose", "prefetch").Get(ht.ts.URL + "/1234567")
+	ht.Require().NoError(err)
+	ht.Equal(http.StatusTemporaryRedirect, resp.StatusCode())
+
+	clicks.Stop()
+	recorded, err := ht.storage.GetClicks(context.Background(), "1234567", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	ht.Require().NoError(err)
+	ht.Require().Len(recorded, 3)
+	ht.Equal("https://ya.ru/", recorded[0].Referrer)
+	ht.Equal("curl/7.79.1", recorded[0].UserAgent)
+	ht.Equal("127.0.0.0", recorded[0].IP)
+	ht.False(recorded[0].Bot)
+	ht.True(recorded[1].Bot)
+	ht.True(recorded[2].Bot)
+}
@@ -17,6 +17,16 @@ func (w gzipWriter) Write(b []byte) (int, error) {
 	return w.Writer.Write(b)
 }
 
+// Flush sends data compressed so far to the client, streaming handlers rely on it.
+func (w gzipWriter) Flush() {
+	if gzWriter, ok := w.Writer.(*gzip.Writer); ok {
+		gzWriter.Flush()
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
 func GzipHandler(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if strings.Contains(r.Header.Get(`Content-Encoding`), `gzip`) {
@@ -7,11 +7,15 @@ import (
 	"fmt"
 	"github.com/zhel1/yandex-practicum-go/internal/dto"
 	"github.com/zhel1/yandex-practicum-go/internal/service"
+	"log"
 	"net/http"
 
 	"github.com/google/uuid"
 )
 
+// RefreshCookieName is the name of the cookie with the refresh token.
+const RefreshCookieName = "RefreshToken"
+
 type CookieHandler struct {
 	services *service.Services
 }
@@ -26,21 +30,16 @@ func NewCookieHandler(services *service.Services) *CookieHandler {
 	}
 }
 
+// CookieHandler identifies the user by the access token from the cookie, the token signed by the inactive key
+// is re-issued under the active one.
+// When the access token is missing or expired, the session is refreshed by the refresh token from its cookie
+// and both cookies are replaced. Clients without a valid session become new users.
 func (h *CookieHandler) CookieHandler(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		userIDCookie, err := r.Cookie(dto.UserIDCtxName.String())
-
-		var userID string
-		if errors.Is(err, http.ErrNoCookie) { //no cookie
-			userID = uuid.New().String()
-			http.SetCookie(w, h.CreateNewCookie(r.Context(), userID))
-		} else if err != nil {
-			http.Error(w, "Cookie crumbled", http.StatusInternalServerError)
-		} else { //cookie found
-			userID, err = h.services.Users.CheckToken(r.Context(), userIDCookie.Value)
-			if err != nil {
-				http.SetCookie(w, h.CreateNewCookie(r.Context(), userID))
-			}
+		userID, err := h.authenticate(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
 
 		userIDCtxName := dto.UserIDCtxName
@@ -48,6 +47,66 @@ func (h *CookieHandler) CookieHandler(next http.Handler) http.Handler {
 	})
 }
 
+// authenticate returns the user of the request and sets cookies of the refreshed or the new session.
+// Failures of storage are returned rather than making a new user, so users don't lose links when storage is down.
+func (h *CookieHandler) authenticate(w http.ResponseWriter, r *http.Request) (string, error) {
+	if accessCookie, err := r.Cookie(dto.UserIDCtxName.String()); err == nil {
+		userID, renewed, err := h.services.Users.CheckToken(r.Context(), accessCookie.Value)
+		if err == nil {
+			if renewed != "" {
+				setAccessCookie(w, renewed)
+			}
+			return userID, nil
+		}
+	}
+
+	if refreshCookie, err := r.Cookie(RefreshCookieName); err == nil {
+		session, err := h.services.Users.RefreshSession(r.Context(), refreshCookie.Value)
+		switch {
+		case err == nil:
+			h.setSession(w, session)
+			return session.UserID, nil
+		case errors.Is(err, dto.ErrTokenReused):
+			log.Printf("Reuse of refresh token is detected, the session of the user is revoked")
+		case !errors.Is(err, dto.ErrNotFound) && !errors.Is(err, dto.ErrExpired):
+			return "", err
+		}
+	}
+
+	session, err := h.services.Users.CreateSession(r.Context(), uuid.New().String())
+	if err != nil {
+		return "", err
+	}
+	h.setSession(w, session)
+	return session.UserID, nil
+}
+
+// setSession sets cookies with tokens of the session, the refresh token is set only if it is rotated.
+func (h *CookieHandler) setSession(w http.ResponseWriter, session dto.ModelSession) {
+	setAccessCookie(w, session.AccessToken)
+	if session.RefreshToken == "" {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     RefreshCookieName,
+		Value:    session.RefreshToken,
+		Path:     "/",
+		Expires:  session.RefreshExpiresAt,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// setAccessCookie sets the cookie with the access token.
+func setAccessCookie(w http.ResponseWriter, accessToken string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     dto.UserIDCtxName.String(),
+		Value:    accessToken,
+		Path:     "/",
+		HttpOnly: true,
+	})
+}
+
 func TakeUserID(context context.Context) (string, error) {
 	userIDCtx := ""
 	if id := context.Value(dto.UserIDCtxName); id != nil {
@@ -59,19 +118,3 @@ func TakeUserID(context context.Context) (string, error) {
 	}
 	return userIDCtx, nil
 }
-
-//**********************************************************************************************************************
-
-func (h *CookieHandler) CreateNewCookie(ctx context.Context, userID string) *http.Cookie {
-	token, err := h.services.Users.CreateNewToken(ctx, userID)
-	if err != nil {
-		panic(err.Error())
-	}
-
-	cookie := &http.Cookie{
-		Name:  dto.UserIDCtxName.String(),
-		Value: token,
-		Path:  "/",
-	}
-	return cookie
-}
@@ -0,0 +1,40 @@
+// Package http provides handler functions to be used for endpoints for http protocol.
+package http
+
+import (
+	"html/template"
+	"net/http"
+)
+
+// PasswordHeader is the header with password of the protected link for API clients.
+// It is also used to set the password when the link is shortened by the plain text endpoint.
+const PasswordHeader = "X-Link-Password"
+
+// maxUnlockFormSize limits the body of the unlock form.
+const maxUnlockFormSize = 4 << 10
+
+// unlockForm asks password of the protected link and posts it to the same URL.
+var unlockForm = template.Must(template.New("unlock").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Protected link</title>
+</head>
+<body>
+<form method="post">
+	<p>The link is protected by password.</p>
+	{{if .}}<p>{{.}}</p>{{end}}
+	<input type="password" name="password" autofocus required>
+	<button type="submit">Open</button>
+</form>
+</body>
+</html>
+`))
+
+// renderUnlockForm writes the unlock form with the message about the previous attempt.
+func renderUnlockForm(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("content-type", "text/html; charset=utf-8")
+	w.Header().Set("cache-control", "no-store")
+	w.WriteHeader(status)
+	unlockForm.Execute(w, message)
+}
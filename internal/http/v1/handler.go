@@ -3,6 +3,7 @@ package v1
 
 import (
 	"github.com/go-chi/chi/v5"
+	"github.com/zhel1/yandex-practicum-go/internal/http/middleware"
 	"github.com/zhel1/yandex-practicum-go/internal/service"
 )
 
@@ -16,7 +17,12 @@ func NewHandler(services *service.Services) *Handler {
 	}
 }
 
+// Init adds routes of the api. Only routes of shortening and of links of users identify users.
 func (h *Handler) Init(r chi.Router) {
-	h.initShortenRoutes(r)
-	h.initUserRoutes(r)
+	r.Group(func(r chi.Router) {
+		r.Use(middleware.NewCookieHandler(h.services).CookieHandler)
+		h.initShortenRoutes(r)
+		h.initUserRoutes(r)
+	})
+	h.initInternalRoutes(r)
 }
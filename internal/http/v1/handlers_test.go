@@ -2,8 +2,10 @@
 package v1
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-resty/resty/v2"
 	"github.com/google/uuid"
@@ -17,12 +19,15 @@ import (
 	"github.com/zhel1/yandex-practicum-go/internal/service"
 	"github.com/zhel1/yandex-practicum-go/internal/storage"
 	"github.com/zhel1/yandex-practicum-go/internal/storage/inmemory"
+	"io"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 type HandlersTestSuite struct {
@@ -175,7 +180,7 @@ func (ht *HandlersTestSuite) TestGetUserLinks() {
 
 	for _, tt := range tests {
 		if tt.stData {
-			ht.storage.Put(context.Background(), userID, idLink, origLink)
+			ht.storage.Put(context.Background(), userID, idLink, origLink, storage.LinkOptions{})
 		}
 		ht.T().Run(tt.name, func(t *testing.T) {
 			client := resty.New()
@@ -261,3 +266,516 @@ func (ht *HandlersTestSuite) TestAddLinkBatchJSON() {
 		})
 	}
 }
+
+func (ht *HandlersTestSuite) TestAddLinkJSONAlias() {
+	ht.router.Use(ht.cookieHandler.CookieHandler)
+	ht.router.Post("/api/shorten", ht.handler.AddLinkJSON())
+	ht.router.Post("/api/shorten/batch", ht.handler.AddLinkBatchJSON())
+	defer ht.ts.Close()
+
+	tests := []struct {
+		name     string
+		endpoint string
+		body     string
+		wantCode int
+	}{
+		{
+			name:     "positive test #1. New alias.",
+			endpoint: "/api/shorten",
+			body:     `{"url":"https://yandex.ru/news/","alias":"spring-sale"}`,
+			wantCode: http.StatusCreated,
+		},
+		{
+			name:     "negative test #2. Alias is taken by another URL.",
+			endpoint: "/api/shorten",
+			body:     `{"url":"https://yandex.ru/sport/","alias":"spring-sale"}`,
+			wantCode: http.StatusConflict,
+		},
+		{
+			name:     "negative test #3. Reserved alias.",
+			endpoint: "/api/shorten",
+			body:     `{"url":"https://yandex.ru/sport/","alias":"API"}`,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "negative test #4. Wrong characters.",
+			endpoint: "/api/shorten",
+			body:     `{"url":"https://yandex.ru/sport/","alias":"spring/sale"}`,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "negative test #5. Alias in batch is taken.",
+			endpoint: "/api/shorten/batch",
+			body:     `[{"correlation_id":"1","original_url":"https://yandex.ru/sport/","alias":"spring-sale"}]`,
+			wantCode: http.StatusConflict,
+		},
+		{
+			name:     "positive test #6. Aliases in batch.",
+			endpoint: "/api/shorten/batch",
+			body:     `[{"correlation_id":"1","original_url":"https://yandex.ru/sport/","alias":"summer-sale"},{"correlation_id":"2","original_url":"https://yandex.ru/weather/"}]`,
+			wantCode: http.StatusCreated,
+		},
+	}
+
+	for _, tt := range tests {
+		ht.T().Run(tt.name, func(t *testing.T) {
+			client := resty.New()
+			resp, err := client.R().SetBody(tt.body).Post(ht.ts.URL + tt.endpoint)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantCode, resp.StatusCode())
+		})
+	}
+
+	originURL, err := ht.storage.Get(context.Background(), "spring-sale")
+	ht.Require().NoError(err)
+	ht.Equal("https://yandex.ru/news/", originURL)
+
+	originURL, err = ht.storage.Get(context.Background(), "summer-sale")
+	ht.Require().NoError(err)
+	ht.Equal("https://yandex.ru/sport/", originURL)
+}
+
+func (ht *HandlersTestSuite) TestEditUserLink() {
+	ht.router.Use(ht.cookieHandler.CookieHandler)
+	ht.router.Route("/api", func(r chi.Router) {
+		ht.handler.initUserRoutes(r)
+	})
+	defer ht.ts.Close()
+
+	newClient := func(userID string) *resty.Client {
+		token, err := ht.handler.services.Users.CreateNewToken(context.Background(), userID)
+		require.NoError(ht.T(), err)
+		return resty.New().SetCookie(&http.Cookie{
+			Name:  dto.UserIDCtxName.String(),
+			Value: token,
+			Path:  "/",
+		})
+	}
+	owner, stranger := newClient("user1"), newClient("user2")
+	require.NoError(ht.T(), ht.storage.Put(context.Background(), "user1", "1234567", "https://yandex.ru/news/", storage.LinkOptions{}))
+	linkURL := ht.ts.URL + "/api/user/urls/1234567"
+
+	resp, err := stranger.R().SetBody(`{"url":"https://evil.com/"}`).Patch(linkURL)
+	require.NoError(ht.T(), err)
+	assert.Equal(ht.T(), http.StatusForbidden, resp.StatusCode())
+
+	resp, err = owner.R().SetBody(`{"url":"not a url"}`).Patch(linkURL)
+	require.NoError(ht.T(), err)
+	assert.Equal(ht.T(), http.StatusBadRequest, resp.StatusCode())
+
+	resp, err = owner.R().SetBody(`{"url":"https://yandex.ru/sport/"}`).Patch(ht.ts.URL + "/api/user/urls/unknown")
+	require.NoError(ht.T(), err)
+	assert.Equal(ht.T(), http.StatusNotFound, resp.StatusCode())
+
+	for _, target := range []string{"https://yandex.ru/sport/", "https://yandex.ru/weather/"} {
+		resp, err = owner.R().SetBody(`{"url":"` + target + `"}`).Patch(linkURL)
+		require.NoError(ht.T(), err)
+		require.Equal(ht.T(), http.StatusOK, resp.StatusCode())
+		var modelURL dto.ModelURL
+		require.NoError(ht.T(), json.Unmarshal(resp.Body(), &modelURL))
+		assert.Equal(ht.T(), target, modelURL.OriginalURL)
+	}
+
+	resp, err = owner.R().Get(linkURL + "/history")
+	require.NoError(ht.T(), err)
+	require.Equal(ht.T(), http.StatusOK, resp.StatusCode())
+	var revisions []dto.ModelRevision
+	require.NoError(ht.T(), json.Unmarshal(resp.Body(), &revisions))
+	require.Len(ht.T(), revisions, 2)
+	assert.Equal(ht.T(), "https://yandex.ru/news/", revisions[0].OldURL)
+	assert.Equal(ht.T(), "https://yandex.ru/weather/", revisions[1].NewURL)
+
+	// the first revision is rolled back, the rollback becomes the third one
+	resp, err = owner.R().SetBody(`{"revision":1}`).Post(linkURL + "/rollback")
+	require.NoError(ht.T(), err)
+	require.Equal(ht.T(), http.StatusOK, resp.StatusCode())
+	originURL, err := ht.storage.Get(context.Background(), "1234567")
+	require.NoError(ht.T(), err)
+	assert.Equal(ht.T(), "https://yandex.ru/news/", originURL)
+
+	// the last revision is rolled back without body
+	resp, err = owner.R().Post(linkURL + "/rollback")
+	require.NoError(ht.T(), err)
+	require.Equal(ht.T(), http.StatusOK, resp.StatusCode())
+	originURL, err = ht.storage.Get(context.Background(), "1234567")
+	require.NoError(ht.T(), err)
+	assert.Equal(ht.T(), "https://yandex.ru/weather/", originURL)
+
+	resp, err = owner.R().SetBody(`{"revision":10}`).Post(linkURL + "/rollback")
+	require.NoError(ht.T(), err)
+	assert.Equal(ht.T(), http.StatusNotFound, resp.StatusCode())
+
+	// the link shared with another user can't be changed
+	require.NoError(ht.T(), ht.storage.Put(context.Background(), "user2", "1234567", "https://yandex.ru/weather/", storage.LinkOptions{}))
+	resp, err = owner.R().SetBody(`{"url":"https://yandex.ru/maps/"}`).Patch(linkURL)
+	require.NoError(ht.T(), err)
+	assert.Equal(ht.T(), http.StatusConflict, resp.StatusCode())
+}
+
+func (ht *HandlersTestSuite) TestGetUserLinksPages() {
+	ht.router.Use(ht.cookieHandler.CookieHandler)
+	ht.router.Route("/api", func(r chi.Router) {
+		ht.handler.initUserRoutes(r)
+	})
+	defer ht.ts.Close()
+
+	token, err := ht.handler.services.Users.CreateNewToken(context.Background(), "user1")
+	require.NoError(ht.T(), err)
+	client := resty.New().SetCookie(&http.Cookie{
+		Name:  dto.UserIDCtxName.String(),
+		Value: token,
+		Path:  "/",
+	})
+	for _, id := range []string{"1111111", "2222222", "3333333", "4444444"} {
+		require.NoError(ht.T(), ht.storage.Put(context.Background(), "user1", id, "https://yandex.ru/"+id, storage.LinkOptions{}))
+	}
+	require.NoError(ht.T(), ht.storage.Put(context.Background(), "user1", "5555555", "https://google.com/", storage.LinkOptions{}))
+
+	var shortURLs []string
+	next := "/api/user/urls?limit=3&sort=-created&domain=yandex.ru"
+	for next != "" {
+		resp, err := client.R().Get(ht.ts.URL + next)
+		require.NoError(ht.T(), err)
+		require.Equal(ht.T(), http.StatusOK, resp.StatusCode())
+
+		var modelURLs []dto.ModelURL
+		require.NoError(ht.T(), json.Unmarshal(resp.Body(), &modelURLs))
+		for _, modelURL := range modelURLs {
+			shortURLs = append(shortURLs, modelURL.ShortURL)
+		}
+
+		next = ""
+		if link := resp.Header().Get("link"); link != "" {
+			require.True(ht.T(), strings.HasSuffix(link, `>; rel="next"`), link)
+			next = strings.TrimSuffix(strings.TrimPrefix(link, "<"), `>; rel="next"`)
+			nextURL, err := url.Parse(next)
+			require.NoError(ht.T(), err)
+			assert.Equal(ht.T(), "yandex.ru", nextURL.Query().Get("domain"), "parameters must be kept")
+		}
+	}
+	assert.Equal(ht.T(), []string{
+		ht.cfg.BaseURL + "4444444",
+		ht.cfg.BaseURL + "3333333",
+		ht.cfg.BaseURL + "2222222",
+		ht.cfg.BaseURL + "1111111",
+	}, shortURLs)
+
+	tests := []struct {
+		name     string
+		query    string
+		wantCode int
+	}{
+		{name: "unknown sort", query: "?sort=clicks", wantCode: http.StatusBadRequest},
+		{name: "too big limit", query: "?limit=1001", wantCode: http.StatusBadRequest},
+		{name: "zero limit", query: "?limit=0", wantCode: http.StatusBadRequest},
+		{name: "negative limit", query: "?limit=-1", wantCode: http.StatusBadRequest},
+		{name: "invalid limit", query: "?limit=ten", wantCode: http.StatusBadRequest},
+		{name: "invalid deleted", query: "?deleted=maybe", wantCode: http.StatusBadRequest},
+		{name: "malformed cursor", query: "?cursor=abc", wantCode: http.StatusBadRequest},
+		{name: "nothing found", query: "?q=bing", wantCode: http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		resp, err := client.R().Get(ht.ts.URL + "/api/user/urls" + tt.query)
+		require.NoError(ht.T(), err)
+		assert.Equal(ht.T(), tt.wantCode, resp.StatusCode(), tt.name)
+	}
+
+	// the cursor of one order can't be used with another one
+	resp, err := client.R().Get(ht.ts.URL + "/api/user/urls?limit=1&sort=url")
+	require.NoError(ht.T(), err)
+	link, err := url.Parse(strings.TrimSuffix(strings.TrimPrefix(resp.Header().Get("link"), "<"), `>; rel="next"`))
+	require.NoError(ht.T(), err)
+	resp, err = client.R().Get(ht.ts.URL + "/api/user/urls?sort=created&cursor=" + link.Query().Get("cursor"))
+	require.NoError(ht.T(), err)
+	assert.Equal(ht.T(), http.StatusBadRequest, resp.StatusCode())
+}
+
+// failingStorage fails to list links of users.
+type failingStorage struct {
+	storage.Storage
+}
+
+func (s failingStorage) ListUserLinks(ctx context.Context, userID string, query storage.LinksQuery) (storage.LinksPage, error) {
+	return storage.LinksPage{}, errors.New("connection refused")
+}
+
+func (ht *HandlersTestSuite) TestGetUserLinksStorageError() {
+	defer ht.ts.Close()
+	tokenManager, err := auth.NewManager(ht.cfg.UserKey)
+	require.NoError(ht.T(), err)
+	services := service.NewServices(service.Deps{
+		Storage:      failingStorage{Storage: ht.storage},
+		BaseURL:      ht.cfg.BaseURL,
+		TokenManager: tokenManager,
+	})
+	handler := NewHandler(services)
+	ht.router.Use(middleware.NewCookieHandler(services).CookieHandler)
+	ht.router.Route("/api", func(r chi.Router) {
+		handler.initUserRoutes(r)
+	})
+
+	token, err := services.Users.CreateNewToken(context.Background(), "user1")
+	require.NoError(ht.T(), err)
+	resp, err := resty.New().SetCookie(&http.Cookie{
+		Name:  dto.UserIDCtxName.String(),
+		Value: token,
+		Path:  "/",
+	}).R().Get(ht.ts.URL + "/api/user/urls")
+	require.NoError(ht.T(), err)
+	assert.Equal(ht.T(), http.StatusInternalServerError, resp.StatusCode())
+}
+
+func (ht *HandlersTestSuite) TestGetUserLinkStats() {
+	ht.router.Use(ht.cookieHandler.CookieHandler)
+	ht.router.Route("/api", func(r chi.Router) {
+		ht.handler.initUserRoutes(r)
+	})
+	defer ht.ts.Close()
+
+	newClient := func(userID string) *resty.Client {
+		token, err := ht.handler.services.Users.CreateNewToken(context.Background(), userID)
+		require.NoError(ht.T(), err)
+		return resty.New().SetCookie(&http.Cookie{
+			Name:  dto.UserIDCtxName.String(),
+			Value: token,
+			Path:  "/",
+		})
+	}
+	owner, stranger := newClient("user1"), newClient("user2")
+	require.NoError(ht.T(), ht.storage.Put(context.Background(), "user1", "1234567", "https://yandex.ru/news/", storage.LinkOptions{}))
+	day := time.Date(2022, 5, 1, 0, 0, 0, 0, time.UTC)
+	require.NoError(ht.T(), ht.storage.SaveClicks(context.Background(), []storage.Click{
+		{ShortURL: "1234567", At: day.Add(time.Hour), Referrer: "https://ya.ru/", UserAgent: "curl/7.79.1"},
+		{ShortURL: "1234567", At: day.Add(25 * time.Hour), Referrer: "https://ya.ru/", UserAgent: "curl/7.79.1"},
+	}))
+	statsURL := ht.ts.URL + "/api/user/urls/1234567/stats"
+
+	resp, err := owner.R().SetQueryParams(map[string]string{
+		"from":   "2022-05-01T00:00:00Z",
+		"to":     "2022-05-03T00:00:00Z",
+		"bucket": "day",
+	}).Get(statsURL)
+	require.NoError(ht.T(), err)
+	require.Equal(ht.T(), http.StatusOK, resp.StatusCode())
+	var stats dto.ModelLinkStats
+	require.NoError(ht.T(), json.Unmarshal(resp.Body(), &stats))
+	assert.Equal(ht.T(), int64(2), stats.Total)
+	assert.Equal(ht.T(), []dto.ModelStatsBucket{{Start: day, Clicks: 1}, {Start: day.Add(24 * time.Hour), Clicks: 1}}, stats.Buckets)
+	assert.Equal(ht.T(), []dto.ModelStatsCount{{Name: "ya.ru", Clicks: 2}}, stats.Referrers)
+	assert.Equal(ht.T(), []dto.ModelStatsCount{{Name: "curl", Clicks: 2}}, stats.Agents)
+
+	tests := []struct {
+		name     string
+		client   *resty.Client
+		path     string
+		query    string
+		wantCode int
+	}{
+		{name: "not owner", client: stranger, path: "/1234567/stats", wantCode: http.StatusForbidden},
+		{name: "unknown link", client: owner, path: "/unknown/stats", wantCode: http.StatusNotFound},
+		{name: "invalid time", client: owner, path: "/1234567/stats", query: "?from=yesterday", wantCode: http.StatusBadRequest},
+		{name: "unknown bucket", client: owner, path: "/1234567/stats", query: "?bucket=week", wantCode: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		resp, err := tt.client.R().Get(ht.ts.URL + "/api/user/urls" + tt.path + tt.query)
+		require.NoError(ht.T(), err)
+		assert.Equal(ht.T(), tt.wantCode, resp.StatusCode(), tt.name)
+	}
+}
+
+func (ht *HandlersTestSuite) TestGetInternalStats() {
+	tokenManager, err := auth.NewManager(ht.cfg.UserKey)
+	require.NoError(ht.T(), err)
+	trustedSubnet, err := service.ParseTrustedSubnet("192.168.1.0/24")
+	require.NoError(ht.T(), err)
+	handler := NewHandler(service.NewServices(service.Deps{
+		Storage:       ht.storage,
+		BaseURL:       ht.cfg.BaseURL,
+		TokenManager:  tokenManager,
+		TrustedSubnet: trustedSubnet,
+	}))
+	ht.router.Route("/api", handler.initInternalRoutes)
+	defer ht.ts.Close()
+
+	require.NoError(ht.T(), ht.storage.Put(context.Background(), "user1", "1234567", "https://yandex.ru/news/", storage.LinkOptions{}))
+	require.NoError(ht.T(), ht.storage.Put(context.Background(), "user1", "1234568", "https://yandex.ru/maps/", storage.LinkOptions{}))
+	require.NoError(ht.T(), ht.storage.Put(context.Background(), "user2", "1234568", "https://yandex.ru/maps/", storage.LinkOptions{}))
+
+	resp, err := resty.New().R().SetHeader(RealIPHeader, "192.168.1.42").Get(ht.ts.URL + "/api/internal/stats")
+	require.NoError(ht.T(), err)
+	require.Equal(ht.T(), http.StatusOK, resp.StatusCode())
+	assert.JSONEq(ht.T(), `{"urls":2,"users":2}`, string(resp.Body()))
+
+	tests := []struct {
+		name   string
+		realIP string
+	}{
+		{name: "without real IP"},
+		{name: "outside subnet", realIP: "192.168.2.42"},
+		{name: "invalid IP", realIP: "192.168.1"},
+	}
+	for _, tt := range tests {
+		req := resty.New().R()
+		if tt.realIP != "" {
+			req.SetHeader(RealIPHeader, tt.realIP)
+		}
+		resp, err = req.Get(ht.ts.URL + "/api/internal/stats")
+		require.NoError(ht.T(), err)
+		assert.Equal(ht.T(), http.StatusForbidden, resp.StatusCode(), tt.name)
+	}
+}
+
+// readEvent reads the next event or comment of the stream of server-sent events as map of its fields.
+// Comments are returned as the field with empty name.
+func readEvent(t *testing.T, reader *bufio.Reader) map[string]string {
+	fields := make(map[string]string)
+	for {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return fields
+		}
+		name, value := line, ""
+		if i := strings.Index(line, ":"); i >= 0 {
+			name, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+		fields[name] = value
+	}
+}
+
+func (ht *HandlersTestSuite) TestGetUserLinkEvents() {
+	ht.router.Use(ht.cookieHandler.CookieHandler)
+	ht.router.Route("/api", func(r chi.Router) {
+		ht.handler.initUserRoutes(r)
+	})
+	defer ht.ts.Close()
+	defer func(interval time.Duration) { heartbeatInterval = interval }(heartbeatInterval)
+	heartbeatInterval = 50 * time.Millisecond
+
+	ctx := context.Background()
+	require.NoError(ht.T(), ht.storage.Put(ctx, "user1", "1234567", "https://yandex.ru/news/", storage.LinkOptions{}))
+	require.NoError(ht.T(), ht.storage.Put(ctx, "user2", "7654321", "https://yandex.ru/maps/", storage.LinkOptions{}))
+	subscribe := func(userID, path, lastEventID string) *http.Response {
+		token, err := ht.handler.services.Users.CreateNewToken(ctx, userID)
+		require.NoError(ht.T(), err)
+		req, err := http.NewRequest(http.MethodGet, ht.ts.URL+"/api/user/urls"+path, nil)
+		require.NoError(ht.T(), err)
+		req.AddCookie(&http.Cookie{Name: dto.UserIDCtxName.String(), Value: token})
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(ht.T(), err)
+		return resp
+	}
+	click := func(shortURL string) {
+		ht.handler.services.Analytics.RecordClick(ctx, dto.ModelClick{ShortURL: shortURL, Referrer: "https://ya.ru/", UserAgent: "curl/7.79.1"})
+	}
+
+	resp := subscribe("user1", "/1234567/events", "")
+	require.Equal(ht.T(), http.StatusOK, resp.StatusCode)
+	assert.Equal(ht.T(), "text/event-stream", resp.Header.Get("Content-Type"))
+	reader := bufio.NewReader(resp.Body)
+	assert.Equal(ht.T(), "3000", readEvent(ht.T(), reader)["retry"])
+
+	click("7654321")
+	click("1234567")
+	event := readEvent(ht.T(), reader)
+	assert.Equal(ht.T(), "click", event["event"])
+	var data dto.ModelClickEvent
+	require.NoError(ht.T(), json.Unmarshal([]byte(event["data"]), &data))
+	assert.Equal(ht.T(), ht.cfg.BaseURL+"1234567", data.ShortURL)
+	assert.Equal(ht.T(), "https://ya.ru/", data.Referrer)
+	assert.Equal(ht.T(), strconv.FormatUint(data.ID, 10), event["id"])
+
+	// idle streams get heartbeats
+	_, ok := readEvent(ht.T(), reader)[""]
+	assert.True(ht.T(), ok, "heartbeat comment is expected")
+	resp.Body.Close()
+
+	// the client resumes the stream after the last event it received
+	click("1234567")
+	resp = subscribe("user1", "/events", event["id"])
+	require.Equal(ht.T(), http.StatusOK, resp.StatusCode)
+	reader = bufio.NewReader(resp.Body)
+	readEvent(ht.T(), reader)
+	resumed := readEvent(ht.T(), reader)
+	assert.Equal(ht.T(), strconv.FormatUint(data.ID+1, 10), resumed["id"])
+	resp.Body.Close()
+
+	tests := []struct {
+		name     string
+		userID   string
+		path     string
+		wantCode int
+	}{
+		{name: "not owner", userID: "user2", path: "/1234567/events", wantCode: http.StatusForbidden},
+		{name: "unknown link", userID: "user1", path: "/unknown/events", wantCode: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		resp := subscribe(tt.userID, tt.path, "")
+		resp.Body.Close()
+		assert.Equal(ht.T(), tt.wantCode, resp.StatusCode, tt.name)
+	}
+}
+
+func (ht *HandlersTestSuite) TestCookieSession() {
+	ht.router.Use(ht.cookieHandler.CookieHandler)
+	ht.router.Get("/whoami", func(w http.ResponseWriter, r *http.Request) {
+		userID, _ := middleware.TakeUserID(r.Context())
+		w.Write([]byte(userID))
+	})
+	defer ht.ts.Close()
+
+	// request sends the cookies and returns the user with cookies set by the response
+	request := func(cookies ...*http.Cookie) (string, map[string]*http.Cookie) {
+		req, err := http.NewRequest(http.MethodGet, ht.ts.URL+"/whoami", nil)
+		require.NoError(ht.T(), err)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(ht.T(), err)
+		defer resp.Body.Close()
+		require.Equal(ht.T(), http.StatusOK, resp.StatusCode)
+
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(ht.T(), err)
+		set := make(map[string]*http.Cookie)
+		for _, cookie := range resp.Cookies() {
+			set[cookie.Name] = cookie
+		}
+		return string(body), set
+	}
+	accessName := dto.UserIDCtxName.String()
+
+	// new users get both cookies
+	userID, cookies := request()
+	require.NotEmpty(ht.T(), userID)
+	require.Contains(ht.T(), cookies, accessName)
+	require.Contains(ht.T(), cookies, middleware.RefreshCookieName)
+	assert.True(ht.T(), cookies[middleware.RefreshCookieName].HttpOnly)
+	refresh := cookies[middleware.RefreshCookieName]
+
+	// valid access token is used as is
+	sameUser, set := request(cookies[accessName], refresh)
+	assert.Equal(ht.T(), userID, sameUser)
+	assert.Empty(ht.T(), set)
+
+	// without the access token the session is refreshed and the refresh token is rotated
+	sameUser, set = request(&http.Cookie{Name: accessName, Value: "expired"}, refresh)
+	assert.Equal(ht.T(), userID, sameUser)
+	require.Contains(ht.T(), set, accessName)
+	require.Contains(ht.T(), set, middleware.RefreshCookieName)
+	assert.NotEqual(ht.T(), refresh.Value, set[middleware.RefreshCookieName].Value)
+	rotated := set[middleware.RefreshCookieName]
+
+	sameUser, _ = request(rotated)
+	assert.Equal(ht.T(), userID, sameUser)
+
+	// unknown refresh tokens make a new user
+	otherUser, set := request(&http.Cookie{Name: middleware.RefreshCookieName, Value: "unknown"})
+	assert.NotEqual(ht.T(), userID, otherUser)
+	assert.Contains(ht.T(), set, middleware.RefreshCookieName)
+}
@@ -0,0 +1,36 @@
+// Package v1 implements api version v1 for http protocol.
+package v1
+
+import (
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"github.com/zhel1/yandex-practicum-go/internal/dto"
+	"net/http"
+)
+
+// RealIPHeader is the header with the address of the client set by the reverse proxy.
+const RealIPHeader = "X-Real-IP"
+
+func (h *Handler) initInternalRoutes(r chi.Router) {
+	r.Route("/internal", func(r chi.Router) {
+		r.Get("/stats", h.GetInternalStats())
+	})
+}
+
+// GetInternalStats returns numbers of short URLs and users of the service.
+// Only clients of the trusted subnet get them, the address of the client is taken from RealIPHeader.
+func (h *Handler) GetInternalStats() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stats, err := h.services.Internal.GetStats(r.Context(), r.Header.Get(RealIPHeader))
+		if err != nil {
+			if errors.Is(err, dto.ErrUntrusted) {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, stats)
+	}
+}
@@ -35,6 +35,10 @@ func (h *Handler) AddLinkJSON() http.HandlerFunc {
 		}
 
 		modelShortURL, err := h.services.Shorten.ShortenURL(r.Context(), userID, b)
+		if errors.Is(err, dto.ErrAliasTaken) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
 		if err != nil && !errors.Is(err, dto.ErrAlreadyExists) {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
@@ -75,7 +79,11 @@ func (h *Handler) AddLinkBatchJSON() http.HandlerFunc {
 		}
 
 		bResArr, err := h.services.Shorten.ShortenBatchURL(r.Context(), userID, bReq)
-		if errors.Is(err, dto.ErrAlreadyExists) {
+		if errors.Is(err, dto.ErrAliasTaken) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
@@ -4,20 +4,33 @@ package v1
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/go-chi/chi/v5"
+	"github.com/zhel1/yandex-practicum-go/internal/dto"
 	"github.com/zhel1/yandex-practicum-go/internal/http/middleware"
+	"io"
 	"net/http"
+	"net/url"
+	"strconv"
+	"time"
 )
 
 func (h *Handler) initUserRoutes(r chi.Router) {
 	r.Route("/user", func(r chi.Router) {
 		r.Get("/urls", h.GetUserLinks())
 		r.Delete("/urls", h.DeleteUserLinksBatch())
+		r.Patch("/urls/{id}", h.EditUserLink())
+		r.Get("/urls/{id}/history", h.GetUserLinkHistory())
+		r.Post("/urls/{id}/rollback", h.RollbackUserLink())
+		r.Get("/urls/{id}/stats", h.GetUserLinkStats())
+		r.Get("/urls/events", h.GetUserEvents())
+		r.Get("/urls/{id}/events", h.GetUserLinkEvents())
 	})
 }
 
-// GetUserLinks returns to the user all links ever saved by him.
+// GetUserLinks returns to the user the page of links saved by him.
+// The next page is referenced by the Link header with the cursor and the same parameters of the query.
 func (h *Handler) GetUserLinks() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		userID, err := middleware.TakeUserID(r.Context())
@@ -26,31 +39,69 @@ func (h *Handler) GetUserLinks() http.HandlerFunc {
 			return
 		}
 
-		modelURLs, err := h.services.Users.GetURLsByUserID(r.Context(), userID)
+		query, err := parseLinksQuery(r.URL.Query())
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusNoContent)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		if len(modelURLs) == 0 {
-			http.Error(w, "", http.StatusNoContent)
+		page, err := h.services.Users.GetURLsByUserID(r.Context(), userID, query)
+		if err != nil {
+			switch {
+			case errors.Is(err, dto.ErrInvalidQuery):
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			case errors.Is(err, dto.ErrNotFound):
+				http.Error(w, "", http.StatusNoContent)
+			default:
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
 			return
 		}
 
-		buf := bytes.NewBuffer([]byte{})
-		encoder := json.NewEncoder(buf)
-		encoder.SetEscapeHTML(false)
-		if err = encoder.Encode(modelURLs); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if len(page.URLs) == 0 && query.Cursor == "" {
+			http.Error(w, "", http.StatusNoContent)
 			return
 		}
 
-		w.Header().Set("content-type", "application/json; charset=utf-8")
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprint(w, buf)
+		if page.NextCursor != "" {
+			next := r.URL.Query()
+			next.Set("cursor", page.NextCursor)
+			w.Header().Set("link", fmt.Sprintf(`<%s?%s>; rel="next"`, r.URL.Path, next.Encode()))
+		}
+		writeJSON(w, http.StatusOK, page.URLs)
 	}
 }
 
+// parseLinksQuery reads parameters of the page of user links from the query string.
+func parseLinksQuery(values url.Values) (dto.ModelLinksQuery, error) {
+	query := dto.ModelLinksQuery{
+		Cursor: values.Get("cursor"),
+		Sort:   values.Get("sort"),
+		Search: values.Get("q"),
+		Domain: values.Get("domain"),
+	}
+
+	if limit := values.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil {
+			return dto.ModelLinksQuery{}, fmt.Errorf("%w: invalid limit", dto.ErrInvalidQuery)
+		}
+		if n <= 0 {
+			return dto.ModelLinksQuery{}, fmt.Errorf("%w: limit must be positive", dto.ErrInvalidQuery)
+		}
+		query.Limit = n
+	}
+
+	if deleted := values.Get("deleted"); deleted != "" {
+		isDeleted, err := strconv.ParseBool(deleted)
+		if err != nil {
+			return dto.ModelLinksQuery{}, fmt.Errorf("%w: invalid deleted filter", dto.ErrInvalidQuery)
+		}
+		query.Deleted = &isDeleted
+	}
+	return query, nil
+}
+
 // DeleteUserLinksBatch accepts a list of abbreviated URL IDs to delete.
 func (h *Handler) DeleteUserLinksBatch() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -75,3 +126,231 @@ func (h *Handler) DeleteUserLinksBatch() http.HandlerFunc {
 		w.WriteHeader(http.StatusAccepted)
 	}
 }
+
+// EditUserLink changes the original URL of the short URL owned only by the user.
+func (h *Handler) EditUserLink() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := middleware.TakeUserID(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var editURL dto.ModelEditURL
+		if err = json.NewDecoder(r.Body).Decode(&editURL); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		modelURL, err := h.services.Users.EditURL(r.Context(), userID, chi.URLParam(r, "id"), editURL.OriginalURL)
+		if err != nil {
+			http.Error(w, err.Error(), editStatus(err))
+			return
+		}
+
+		writeJSON(w, http.StatusOK, modelURL)
+	}
+}
+
+// GetUserLinkHistory returns changes of the original URL of the short URL owned by the user.
+func (h *Handler) GetUserLinkHistory() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := middleware.TakeUserID(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		revisions, err := h.services.Users.GetURLHistory(r.Context(), userID, chi.URLParam(r, "id"))
+		if err != nil {
+			http.Error(w, err.Error(), editStatus(err))
+			return
+		}
+
+		writeJSON(w, http.StatusOK, revisions)
+	}
+}
+
+// RollbackUserLink restores the original URL which the short URL had before the revision.
+// The last revision is rolled back if the body is empty.
+func (h *Handler) RollbackUserLink() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := middleware.TakeUserID(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var rollback dto.ModelRollback
+		if err = json.NewDecoder(r.Body).Decode(&rollback); err != nil && !errors.Is(err, io.EOF) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		modelURL, err := h.services.Users.RollbackURL(r.Context(), userID, chi.URLParam(r, "id"), rollback.Revision)
+		if err != nil {
+			http.Error(w, err.Error(), editStatus(err))
+			return
+		}
+
+		writeJSON(w, http.StatusOK, modelURL)
+	}
+}
+
+// GetUserLinkStats returns statistics of clicks of the short URL owned by the user.
+// The period is set by "from" and "to" parameters (RFC 3339), buckets by "bucket" one ("hour" or "day").
+// Clicks of bots are excluded unless "bots" parameter is true.
+func (h *Handler) GetUserLinkStats() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, err := middleware.TakeUserID(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		query := dto.ModelStatsQuery{Bucket: r.URL.Query().Get("bucket")}
+		if query.From, err = parseTimeParam(r.URL.Query(), "from"); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if query.To, err = parseTimeParam(r.URL.Query(), "to"); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if bots := r.URL.Query().Get("bots"); bots != "" {
+			if query.Bots, err = strconv.ParseBool(bots); err != nil {
+				http.Error(w, fmt.Errorf("%w: invalid bots filter", dto.ErrInvalidQuery).Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		stats, err := h.services.Analytics.GetLinkStats(r.Context(), userID, chi.URLParam(r, "id"), query)
+		if err != nil {
+			http.Error(w, err.Error(), editStatus(err))
+			return
+		}
+
+		writeJSON(w, http.StatusOK, stats)
+	}
+}
+
+// parseTimeParam reads the time in RFC 3339 format from the query parameter, nil if it is not set.
+func parseTimeParam(values url.Values, name string) (*time.Time, error) {
+	v := values.Get(name)
+	if v == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid %s", dto.ErrInvalidQuery, name)
+	}
+	return &t, nil
+}
+
+// editStatus returns status of the response to failed change of the link.
+func editStatus(err error) int {
+	switch {
+	case errors.Is(err, dto.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, dto.ErrDeleted):
+		return http.StatusGone
+	case errors.Is(err, dto.ErrNotOwner):
+		return http.StatusForbidden
+	case errors.Is(err, dto.ErrLinkShared):
+		return http.StatusConflict
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// heartbeatInterval is the period of comments which keep idle streams of events open through proxies.
+var heartbeatInterval = 15 * time.Second
+
+// eventsRetry is the delay in milliseconds before clients reconnect to the closed stream of events.
+const eventsRetry = 3000
+
+// GetUserEvents streams clicks of all links of the user as server-sent events.
+func (h *Handler) GetUserEvents() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h.streamClicks(w, r, "")
+	}
+}
+
+// GetUserLinkEvents streams clicks of the link of the user as server-sent events.
+func (h *Handler) GetUserLinkEvents() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h.streamClicks(w, r, chi.URLParam(r, "id"))
+	}
+}
+
+// streamClicks streams clicks of the link or of all links of the user if shortURL is empty until the client disconnects.
+// The stream is resumed after the event in the Last-Event-ID header sent by reconnecting clients.
+func (h *Handler) streamClicks(w http.ResponseWriter, r *http.Request, shortURL string) {
+	userID, err := middleware.TakeUserID(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// invalid IDs start a new stream
+	lastEventID, _ := strconv.ParseUint(r.Header.Get("Last-Event-ID"), 10, 64)
+	sub, err := h.services.Analytics.SubscribeClicks(r.Context(), userID, shortURL, lastEventID)
+	if err != nil {
+		http.Error(w, err.Error(), editStatus(err))
+		return
+	}
+	defer sub.Close()
+
+	w.Header().Set("content-type", "text/event-stream")
+	w.Header().Set("cache-control", "no-cache")
+	w.Header().Set("x-accel-buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", eventsRetry)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case event, ok := <-sub.Events():
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				return
+			}
+			if _, err = fmt.Fprintf(w, "id: %d\nevent: click\ndata: %s\n\n", event.ID, data); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if _, err = io.WriteString(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// writeJSON writes v as JSON response with the status.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	buf := bytes.NewBuffer([]byte{})
+	encoder := json.NewEncoder(buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	fmt.Fprint(w, buf)
+}
@@ -0,0 +1,42 @@
+// Package service implements the business logic of the application.
+package service
+
+import (
+	"fmt"
+	"github.com/zhel1/yandex-practicum-go/internal/dto"
+	"strings"
+)
+
+// Limits of length of aliases.
+const (
+	minAliasLength = 3
+	maxAliasLength = 64
+)
+
+// reservedAliases are paths of the service which can't be used as short URLs.
+var reservedAliases = []string{"ping", "api"}
+
+// validateAlias checks that alias can be used as short URL.
+func validateAlias(alias string) error {
+	if len(alias) < minAliasLength || len(alias) > maxAliasLength {
+		return fmt.Errorf("%w: length must be from %d to %d", dto.ErrInvalidAlias, minAliasLength, maxAliasLength)
+	}
+
+	for _, c := range alias {
+		if !isAliasChar(c) {
+			return fmt.Errorf("%w: only latin letters, digits, '-' and '_' are allowed", dto.ErrInvalidAlias)
+		}
+	}
+
+	for _, reserved := range reservedAliases {
+		if strings.EqualFold(alias, reserved) {
+			return fmt.Errorf("%w: %q is reserved", dto.ErrInvalidAlias, alias)
+		}
+	}
+	return nil
+}
+
+// isAliasChar checks whether the character is allowed in alias.
+func isAliasChar(c rune) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_'
+}
@@ -0,0 +1,247 @@
+// Package service implements the business logic of the application.
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/zhel1/yandex-practicum-go/internal/dto"
+	"github.com/zhel1/yandex-practicum-go/internal/storage"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// Limits of statistics of the link.
+const (
+	statsTop           = 10                  // the number of top referrers and agent families
+	defaultStatsPeriod = 30 * 24 * time.Hour // the period when the start is not set
+	maxHourBuckets     = 31 * 24
+	maxDayBuckets      = 366
+)
+
+// linksRefreshInterval is the period of reloading of links of the user who streams events of all his links,
+// so events of links created after subscribing are streamed too.
+const linksRefreshInterval = 30 * time.Second
+
+// Names of clicks without the referrer or the user agent in statistics.
+const (
+	directReferrer = "(direct)"
+	unknownAgent   = "(unknown)"
+)
+
+// AnalyticsService records redirects by short URLs, streams them to owners of links and returns their statistics.
+type AnalyticsService struct {
+	storage     storage.Storage
+	baseURL     string
+	clicks      *ClickRecorder
+	events      *EventHub
+	bots        *BotClassifier
+	visitorSalt []byte
+}
+
+// NewAnalyticsService creates AnalyticsService. Clicks are not recorded if the recorder is nil
+// and are not classified as clicks of bots if the classifier is nil.
+// Fingerprints of visitors are salted by visitorSalt, so they can't be matched with other data.
+func NewAnalyticsService(storage storage.Storage, baseURL string, clicks *ClickRecorder, events *EventHub, bots *BotClassifier, visitorSalt string) *AnalyticsService {
+	return &AnalyticsService{
+		storage:     storage,
+		baseURL:     baseURL,
+		clicks:      clicks,
+		events:      events,
+		bots:        bots,
+		visitorSalt: []byte(visitorSalt),
+	}
+}
+
+// RecordClick publishes the redirect to subscribers and queues it for saving, the address of the client is anonymised.
+// Unique visitors are counted by the salted fingerprint of the address and the user agent,
+// clicks of bots are tagged, so statistics can exclude them.
+// It never blocks: the click is dropped if the queue is full.
+func (s *AnalyticsService) RecordClick(ctx context.Context, click dto.ModelClick) {
+	record := storage.Click{
+		ShortURL:  click.ShortURL,
+		At:        time.Now().UTC(),
+		Referrer:  truncate(click.Referrer, maxClickFieldLength),
+		UserAgent: truncate(click.UserAgent, maxClickFieldLength),
+		IP:        anonymizeIP(click.RemoteAddr),
+		Visitor:   visitorFingerprint(s.visitorSalt, click.RemoteAddr, click.UserAgent),
+		Bot:       s.bots != nil && s.bots.IsBot(click),
+	}
+
+	if s.events != nil {
+		s.events.Publish(record.ShortURL, dto.ModelClickEvent{
+			ShortURL:  s.baseURL + record.ShortURL,
+			At:        record.At,
+			Referrer:  record.Referrer,
+			UserAgent: record.UserAgent,
+			Bot:       record.Bot,
+		})
+	}
+	if s.clicks != nil {
+		s.clicks.Record(record)
+	}
+}
+
+// SubscribeClicks subscribes the user to events of clicks of the link he owns or of all his links if shortURL is empty.
+// Events after lastEventID are received first if they are still kept, lastEventID 0 means a new stream.
+func (s *AnalyticsService) SubscribeClicks(ctx context.Context, userID, shortURL string, lastEventID uint64) (*Subscription, error) {
+	links, err := s.userLinks(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if shortURL != "" {
+		if _, ok := links[shortURL]; !ok {
+			if _, err = s.storage.GetLink(ctx, shortURL); err != nil {
+				return nil, err
+			}
+			return nil, dto.ErrNotOwner
+		}
+		return s.events.Subscribe(func(code string) bool {
+			return code == shortURL
+		}, lastEventID), nil
+	}
+
+	var owned atomic.Value // map[string]string
+	owned.Store(links)
+	sub := s.events.Subscribe(func(code string) bool {
+		_, ok := owned.Load().(map[string]string)[code]
+		return ok
+	}, lastEventID)
+
+	go func() {
+		ticker := time.NewTicker(linksRefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				ctx, cancel := context.WithTimeout(context.Background(), linksRefreshInterval)
+				links, err := s.userLinks(ctx, userID)
+				cancel()
+				if err != nil {
+					log.Printf("Reloading of links of user %s: %v", userID, err)
+					continue
+				}
+				owned.Store(links)
+			case <-sub.Done():
+				return
+			}
+		}
+	}()
+	return sub, nil
+}
+
+// userLinks returns links of the user, the user without links has an empty map.
+func (s *AnalyticsService) userLinks(ctx context.Context, userID string) (map[string]string, error) {
+	links, err := s.storage.GetUserLinks(ctx, userID)
+	if errors.Is(err, dto.ErrNotFound) {
+		return map[string]string{}, nil
+	}
+	return links, err
+}
+
+// GetLinkStats returns statistics of clicks of the link owned by the user.
+// Every bucket of the period is returned, buckets without clicks have zero clicks.
+// Unique visitors are estimated for whole days overlapping the period and for day buckets only.
+// Clicks of bots are excluded unless the query includes them, their share is returned either way.
+func (s *AnalyticsService) GetLinkStats(ctx context.Context, userID, shortURL string, query dto.ModelStatsQuery) (dto.ModelLinkStats, error) {
+	statsQuery, err := parseStatsQuery(query, time.Now())
+	if err != nil {
+		return dto.ModelLinkStats{}, err
+	}
+
+	stats, err := s.storage.GetLinkStats(ctx, userID, shortURL, statsQuery)
+	if err != nil {
+		return dto.ModelLinkStats{}, err
+	}
+
+	response := dto.ModelLinkStats{
+		ShortURL:  s.baseURL + shortURL,
+		From:      statsQuery.From,
+		To:        statsQuery.To,
+		Bucket:    statsQuery.Bucket,
+		Total:     stats.Total,
+		Visitors:  stats.Visitors,
+		Bots:      stats.Bots,
+		Buckets:   make([]dto.ModelStatsBucket, 0),
+		Referrers: statsCounts(stats.Referrers, directReferrer),
+		Agents:    statsCounts(stats.Agents, unknownAgent),
+	}
+
+	all := stats.Total
+	if !statsQuery.Bots {
+		all += stats.Bots
+	}
+	if all > 0 {
+		response.BotShare = float64(stats.Bots) / float64(all)
+	}
+
+	buckets := make(map[time.Time]storage.StatsBucket, len(stats.Buckets))
+	for _, bucket := range stats.Buckets {
+		buckets[bucket.Start] = bucket
+	}
+	for start := statsQuery.BucketStart(statsQuery.From); start.Before(statsQuery.To); start = nextBucket(start, statsQuery.Bucket) {
+		bucket := buckets[start]
+		response.Buckets = append(response.Buckets, dto.ModelStatsBucket{Start: start, Clicks: bucket.Clicks, Visitors: bucket.Visitors})
+	}
+	return response, nil
+}
+
+// parseStatsQuery validates the query of statistics and rounds its bounds to whole hours outwards.
+func parseStatsQuery(query dto.ModelStatsQuery, now time.Time) (storage.StatsQuery, error) {
+	statsQuery := storage.StatsQuery{Bucket: query.Bucket, Top: statsTop, Bots: query.Bots}
+	switch statsQuery.Bucket {
+	case "":
+		statsQuery.Bucket = storage.BucketDay
+	case storage.BucketHour, storage.BucketDay:
+	default:
+		return storage.StatsQuery{}, fmt.Errorf("%w: unknown bucket %q", dto.ErrInvalidQuery, query.Bucket)
+	}
+
+	to := now
+	if query.To != nil {
+		to = *query.To
+	}
+	statsQuery.To = storage.ClickHour(to)
+	if statsQuery.To.Before(to) {
+		statsQuery.To = statsQuery.To.Add(time.Hour)
+	}
+
+	from := statsQuery.To.Add(-defaultStatsPeriod)
+	if query.From != nil {
+		from = *query.From
+	}
+	statsQuery.From = storage.ClickHour(from)
+
+	if !statsQuery.From.Before(statsQuery.To) {
+		return storage.StatsQuery{}, fmt.Errorf("%w: the start of the period must be before its end", dto.ErrInvalidQuery)
+	}
+	period := statsQuery.To.Sub(statsQuery.From)
+	if statsQuery.Bucket == storage.BucketHour && period > maxHourBuckets*time.Hour ||
+		statsQuery.Bucket == storage.BucketDay && period > maxDayBuckets*24*time.Hour {
+		return storage.StatsQuery{}, fmt.Errorf("%w: the period is too long for buckets by %s", dto.ErrInvalidQuery, statsQuery.Bucket)
+	}
+	return statsQuery, nil
+}
+
+// nextBucket returns the start of the bucket after the one which starts at start.
+func nextBucket(start time.Time, bucket string) time.Time {
+	if bucket == storage.BucketDay {
+		return start.AddDate(0, 0, 1)
+	}
+	return start.Add(time.Hour)
+}
+
+// statsCounts converts counts of storage, empty name is replaced by the name of missing value.
+func statsCounts(counts []storage.StatsCount, missing string) []dto.ModelStatsCount {
+	result := make([]dto.ModelStatsCount, 0, len(counts))
+	for _, count := range counts {
+		name := count.Name
+		if name == "" {
+			name = missing
+		}
+		result = append(result, dto.ModelStatsCount{Name: name, Clicks: count.Clicks})
+	}
+	return result
+}
@@ -0,0 +1,169 @@
+// Package service implements the business logic of the application.
+package service
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhel1/yandex-practicum-go/internal/dto"
+	"github.com/zhel1/yandex-practicum-go/internal/storage"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseStatsQuery(t *testing.T) {
+	now := time.Date(2022, 5, 10, 15, 20, 0, 0, time.UTC)
+	at := func(s string) *time.Time {
+		tm, err := time.Parse(time.RFC3339, s)
+		require.NoError(t, err)
+		return &tm
+	}
+
+	tests := []struct {
+		name     string
+		query    dto.ModelStatsQuery
+		wantFrom time.Time
+		wantTo   time.Time
+		wantErr  bool
+	}{
+		{
+			name:     "defaults",
+			query:    dto.ModelStatsQuery{},
+			wantFrom: time.Date(2022, 4, 10, 16, 0, 0, 0, time.UTC),
+			wantTo:   time.Date(2022, 5, 10, 16, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "bounds are rounded outwards",
+			query:    dto.ModelStatsQuery{From: at("2022-05-09T10:30:00Z"), To: at("2022-05-09T12:00:01Z"), Bucket: "hour"},
+			wantFrom: time.Date(2022, 5, 9, 10, 0, 0, 0, time.UTC),
+			wantTo:   time.Date(2022, 5, 9, 13, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "bounds are converted to UTC",
+			query:    dto.ModelStatsQuery{From: at("2022-05-09T10:00:00+03:00"), To: at("2022-05-09T12:00:00+03:00"), Bucket: "hour"},
+			wantFrom: time.Date(2022, 5, 9, 7, 0, 0, 0, time.UTC),
+			wantTo:   time.Date(2022, 5, 9, 9, 0, 0, 0, time.UTC),
+		},
+		{name: "unknown bucket", query: dto.ModelStatsQuery{Bucket: "week"}, wantErr: true},
+		{name: "empty period", query: dto.ModelStatsQuery{From: at("2022-05-09T10:00:00Z"), To: at("2022-05-09T10:00:00Z")}, wantErr: true},
+		{name: "too many hours", query: dto.ModelStatsQuery{From: at("2022-03-01T00:00:00Z"), Bucket: "hour"}, wantErr: true},
+		{name: "too many days", query: dto.ModelStatsQuery{From: at("2020-01-01T00:00:00Z")}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, err := parseStatsQuery(tt.query, now)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, dto.ErrInvalidQuery)
+				return
+			}
+			require.NoError(t, err)
+			assert.True(t, tt.wantFrom.Equal(query.From), query.From)
+			assert.True(t, tt.wantTo.Equal(query.To), query.To)
+		})
+	}
+}
+
+func TestGetLinkStats(t *testing.T) {
+	ctx := context.Background()
+	st := newClicksStorage(t)
+	day := time.Date(2022, 5, 1, 0, 0, 0, 0, time.UTC)
+	require.NoError(t, st.SaveClicks(ctx, []storage.Click{
+		{ShortURL: "1234567", At: day.Add(time.Hour), Referrer: "https://ya.ru/", UserAgent: "curl/7.79.1"},
+		{ShortURL: "1234567", At: day.Add(3 * time.Hour)},
+	}))
+	analytics := NewAnalyticsService(st, "http://localhost:8080/", nil, nil, nil, "salt")
+
+	from, to := day, day.Add(4*time.Hour)
+	stats, err := analytics.GetLinkStats(ctx, "user1", "1234567", dto.ModelStatsQuery{From: &from, To: &to, Bucket: "hour"})
+	require.NoError(t, err)
+	assert.Equal(t, "http://localhost:8080/1234567", stats.ShortURL)
+	assert.Equal(t, int64(2), stats.Total)
+	assert.Equal(t, []dto.ModelStatsBucket{
+		{Start: day, Clicks: 0},
+		{Start: day.Add(time.Hour), Clicks: 1},
+		{Start: day.Add(2 * time.Hour), Clicks: 0},
+		{Start: day.Add(3 * time.Hour), Clicks: 1},
+	}, stats.Buckets, "empty buckets must be filled")
+	assert.Equal(t, []dto.ModelStatsCount{{Name: directReferrer, Clicks: 1}, {Name: "ya.ru", Clicks: 1}}, stats.Referrers)
+	assert.Equal(t, []dto.ModelStatsCount{{Name: unknownAgent, Clicks: 1}, {Name: "curl", Clicks: 1}}, stats.Agents)
+
+	_, err = analytics.GetLinkStats(ctx, "user2", "1234567", dto.ModelStatsQuery{})
+	assert.ErrorIs(t, err, dto.ErrNotOwner)
+}
+
+func TestGetLinkStatsVisitors(t *testing.T) {
+	ctx := context.Background()
+	st := newClicksStorage(t)
+	day := time.Date(2022, 5, 1, 0, 0, 0, 0, time.UTC)
+	salt := []byte("salt")
+	visitor := func(i int) uint64 {
+		return visitorFingerprint(salt, "10.0."+strconv.Itoa(i/256)+"."+strconv.Itoa(i%256), "curl/7.79.1")
+	}
+
+	// 2000 visitors reload the link 3 times on the first day, 1000 visitors come on the second day and half of them are new
+	var clicks []storage.Click
+	for i := 0; i < 2000; i++ {
+		for j := 0; j < 3; j++ {
+			clicks = append(clicks, storage.Click{ShortURL: "1234567", At: day.Add(time.Duration(j) * time.Hour), Visitor: visitor(i)})
+		}
+	}
+	for i := 1500; i < 2500; i++ {
+		clicks = append(clicks, storage.Click{ShortURL: "1234567", At: day.Add(30 * time.Hour), Visitor: visitor(i)})
+	}
+	require.NoError(t, st.SaveClicks(ctx, clicks))
+	analytics := NewAnalyticsService(st, "http://localhost:8080/", nil, nil, nil, "salt")
+
+	// estimates must be within 3% of exact counts
+	from, to := day, day.Add(48*time.Hour)
+	stats, err := analytics.GetLinkStats(ctx, "user1", "1234567", dto.ModelStatsQuery{From: &from, To: &to, Bucket: "day"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(7000), stats.Total)
+	assert.InEpsilon(t, 2500, stats.Visitors, 0.03)
+	require.Len(t, stats.Buckets, 2)
+	assert.InEpsilon(t, 2000, stats.Buckets[0].Visitors, 0.03)
+	assert.InEpsilon(t, 1000, stats.Buckets[1].Visitors, 0.03)
+
+	// visitors are counted by whole days, hour buckets have no visitors
+	from, to = day.Add(30*time.Hour), day.Add(31*time.Hour)
+	stats, err = analytics.GetLinkStats(ctx, "user1", "1234567", dto.ModelStatsQuery{From: &from, To: &to, Bucket: "hour"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1000), stats.Total)
+	assert.InEpsilon(t, 1000, stats.Visitors, 0.03)
+	require.Len(t, stats.Buckets, 1)
+	assert.Zero(t, stats.Buckets[0].Visitors)
+}
+
+func TestGetLinkStatsBots(t *testing.T) {
+	ctx := context.Background()
+	st := newClicksStorage(t)
+	day := time.Date(2022, 5, 1, 0, 0, 0, 0, time.UTC)
+	require.NoError(t, st.SaveClicks(ctx, []storage.Click{
+		{ShortURL: "1234567", At: day.Add(time.Hour)},
+		{ShortURL: "1234567", At: day.Add(time.Hour), Bot: true},
+		{ShortURL: "1234567", At: day.Add(2 * time.Hour), Bot: true},
+		{ShortURL: "1234567", At: day.Add(3 * time.Hour), Bot: true},
+	}))
+	analytics := NewAnalyticsService(st, "http://localhost:8080/", nil, nil, nil, "salt")
+
+	// the share of bots doesn't depend on their inclusion
+	from, to := day, day.Add(4*time.Hour)
+	stats, err := analytics.GetLinkStats(ctx, "user1", "1234567", dto.ModelStatsQuery{From: &from, To: &to, Bucket: "hour"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), stats.Total)
+	assert.Equal(t, int64(3), stats.Bots)
+	assert.Equal(t, 0.75, stats.BotShare)
+
+	stats, err = analytics.GetLinkStats(ctx, "user1", "1234567", dto.ModelStatsQuery{From: &from, To: &to, Bucket: "hour", Bots: true})
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), stats.Total)
+	assert.Equal(t, int64(3), stats.Bots)
+	assert.Equal(t, 0.75, stats.BotShare)
+
+	// the period without clicks has no share
+	from, to = day.Add(24*time.Hour), day.Add(25*time.Hour)
+	stats, err = analytics.GetLinkStats(ctx, "user1", "1234567", dto.ModelStatsQuery{From: &from, To: &to})
+	require.NoError(t, err)
+	assert.Zero(t, stats.BotShare)
+}
@@ -0,0 +1,89 @@
+// Package service implements the business logic of the application.
+package service
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/zhel1/yandex-practicum-go/internal/dto"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// DefaultBotSignatures are substrings of user agents of crawlers, link previews of messengers and headless browsers.
+var DefaultBotSignatures = []string{
+	"bot", "crawler", "spider", "slurp",
+	"facebookexternalhit", "facebookcatalog", "slack-imgproxy", "whatsapp", "skypeuripreview", "vkshare",
+	"embedly", "quora link preview", "bingpreview", "google-pagerenderer", "yandexmetrika",
+	"headlesschrome", "phantomjs", "lighthouse",
+}
+
+// previewPurposes are values of Purpose headers of prefetching and previews of links.
+var previewPurposes = []string{"prefetch", "preview"}
+
+// BotClassifier tells clicks made by bots, crawlers and previews of links from clicks made by people.
+type BotClassifier struct {
+	signatures []string
+}
+
+// NewBotClassifier creates BotClassifier by signatures: case-insensitive substrings of user agents of bots.
+func NewBotClassifier(signatures []string) *BotClassifier {
+	c := &BotClassifier{signatures: make([]string, 0, len(signatures))}
+	for _, signature := range signatures {
+		if signature = strings.ToLower(strings.TrimSpace(signature)); signature != "" {
+			c.signatures = append(c.signatures, signature)
+		}
+	}
+	return c
+}
+
+// LoadBotClassifier creates BotClassifier by signatures from the file, one per line, lines starting with # are comments.
+// DefaultBotSignatures are used if path is empty.
+func LoadBotClassifier(path string) (*BotClassifier, error) {
+	if path == "" {
+		return NewBotClassifier(DefaultBotSignatures), nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var signatures []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		signatures = append(signatures, line)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading of bot signatures: %w", err)
+	}
+	return NewBotClassifier(signatures), nil
+}
+
+// IsBot checks whether the click is made by a bot: HEAD requests, prefetching or previews of the link
+// and user agents matching signatures.
+func (c *BotClassifier) IsBot(click dto.ModelClick) bool {
+	if click.Method == http.MethodHead {
+		return true
+	}
+
+	purpose := strings.ToLower(click.Purpose)
+	for _, preview := range previewPurposes {
+		if strings.Contains(purpose, preview) {
+			return true
+		}
+	}
+
+	ua := strings.ToLower(click.UserAgent)
+	for _, signature := range c.signatures {
+		if strings.Contains(ua, signature) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,56 @@
+// Package service implements the business logic of the application.
+package service
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhel1/yandex-practicum-go/internal/dto"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsBot(t *testing.T) {
+	chrome := "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/101.0.4951.64 Safari/537.36"
+	tests := []struct {
+		name  string
+		click dto.ModelClick
+		want  bool
+	}{
+		{name: "browser", click: dto.ModelClick{Method: http.MethodGet, UserAgent: chrome}, want: false},
+		{name: "without user agent", click: dto.ModelClick{Method: http.MethodGet}, want: false},
+		{name: "crawler", click: dto.ModelClick{UserAgent: "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"}, want: true},
+		{name: "messenger preview", click: dto.ModelClick{UserAgent: "facebookexternalhit/1.1"}, want: true},
+		{name: "signatures ignore case", click: dto.ModelClick{UserAgent: "Mozilla/5.0 HeadlessChrome/101.0"}, want: true},
+		{name: "HEAD request", click: dto.ModelClick{Method: http.MethodHead, UserAgent: chrome}, want: true},
+		{name: "prefetching", click: dto.ModelClick{UserAgent: chrome, Purpose: "prefetch;prerender"}, want: true},
+		{name: "preview", click: dto.ModelClick{UserAgent: chrome, Purpose: "Preview"}, want: true},
+	}
+
+	classifier := NewBotClassifier(DefaultBotSignatures)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, classifier.IsBot(tt.click))
+		})
+	}
+}
+
+func TestLoadBotClassifier(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bots.txt")
+	require.NoError(t, os.WriteFile(path, []byte("# monitoring\n  UptimeRobot \n\ncurl\n"), 0600))
+
+	classifier, err := LoadBotClassifier(path)
+	require.NoError(t, err)
+	assert.True(t, classifier.IsBot(dto.ModelClick{UserAgent: "Mozilla/5.0+(compatible; UptimeRobot/2.0)"}))
+	assert.True(t, classifier.IsBot(dto.ModelClick{UserAgent: "curl/7.79.1"}))
+	assert.False(t, classifier.IsBot(dto.ModelClick{UserAgent: "facebookexternalhit/1.1"}), "signatures of the file replace default ones")
+	assert.False(t, classifier.IsBot(dto.ModelClick{UserAgent: "# monitoring"}), "comments are not signatures")
+
+	classifier, err = LoadBotClassifier("")
+	require.NoError(t, err)
+	assert.True(t, classifier.IsBot(dto.ModelClick{UserAgent: "facebookexternalhit/1.1"}))
+
+	_, err = LoadBotClassifier(filepath.Join(t.TempDir(), "unknown.txt"))
+	assert.Error(t, err)
+}
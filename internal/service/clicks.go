@@ -0,0 +1,230 @@
+// Package service implements the business logic of the application.
+package service
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/zhel1/yandex-practicum-go/internal/storage"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// maxClickFieldLength limits the length of referrer and user agent saved with the click.
+const maxClickFieldLength = 512
+
+// clickSaveTimeout limits saving of one batch of clicks.
+const clickSaveTimeout = 10 * time.Second
+
+// ClickStats are counters of ClickRecorder.
+type ClickStats struct {
+	Saved   int64 // clicks passed to storage
+	Dropped int64 // clicks dropped because the queue was full
+	Failed  int64 // clicks lost because storage failed to save them
+}
+
+// ClickRecorder saves clicks to storage asynchronously by batches.
+// Clicks are collected in the bounded queue and flushed when the batch is full or the interval passes.
+// When the queue is full, clicks are dropped and counted, so redirects are never blocked by storage.
+type ClickRecorder struct {
+	stats     ClickStats // updated atomically, it is first to be aligned for atomic operations
+	storage   storage.Storage
+	queue     chan storage.Click
+	batchSize int
+	interval  time.Duration
+	shutdown  chan struct{}
+	done      chan struct{}
+}
+
+// NewClickRecorder creates ClickRecorder with the queue of queueSize clicks
+// which saves batches of batchSize clicks at least every interval.
+func NewClickRecorder(st storage.Storage, queueSize, batchSize int, interval time.Duration) *ClickRecorder {
+	return &ClickRecorder{
+		storage:   st,
+		queue:     make(chan storage.Click, queueSize),
+		batchSize: batchSize,
+		interval:  interval,
+		shutdown:  make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// Start runs saving of clicks in background.
+func (r *ClickRecorder) Start() {
+	go func() {
+		defer close(r.done)
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+
+		batch := make([]storage.Click, 0, r.batchSize)
+		add := func(click storage.Click) {
+			batch = append(batch, click)
+			if len(batch) >= r.batchSize {
+				r.flush(batch)
+				batch = batch[:0]
+			}
+		}
+
+		for {
+			select {
+			case click := <-r.queue:
+				add(click)
+			case <-ticker.C:
+				r.flush(batch)
+				batch = batch[:0]
+			case <-r.shutdown:
+				// clicks queued before Stop are saved
+				for {
+					select {
+					case click := <-r.queue:
+						add(click)
+					default:
+						r.flush(batch)
+						return
+					}
+				}
+			}
+		}
+	}()
+}
+
+// Record queues the click without blocking. It reports false if the click is dropped.
+func (r *ClickRecorder) Record(click storage.Click) bool {
+	select {
+	case r.queue <- click:
+		return true
+	default:
+		atomic.AddInt64(&r.stats.Dropped, 1)
+		return false
+	}
+}
+
+// Stats returns counters of saved, dropped and lost clicks.
+func (r *ClickRecorder) Stats() ClickStats {
+	return ClickStats{
+		Saved:   atomic.LoadInt64(&r.stats.Saved),
+		Dropped: atomic.LoadInt64(&r.stats.Dropped),
+		Failed:  atomic.LoadInt64(&r.stats.Failed),
+	}
+}
+
+// Stop saves queued clicks and stops ClickRecorder. It must be called after Start and before storage is closed.
+func (r *ClickRecorder) Stop() {
+	close(r.shutdown)
+	<-r.done
+}
+
+// flush saves the batch of clicks. The batch can be reused after the call.
+func (r *ClickRecorder) flush(batch []storage.Click) {
+	if len(batch) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), clickSaveTimeout)
+	defer cancel()
+	if err := r.storage.SaveClicks(ctx, batch); err != nil {
+		atomic.AddInt64(&r.stats.Failed, int64(len(batch)))
+		log.Printf("Saving of %d clicks: %v", len(batch), err)
+		return
+	}
+	atomic.AddInt64(&r.stats.Saved, int64(len(batch)))
+}
+
+// anonymizeIP returns the network of the client address: /24 for IPv4 and /48 for IPv6.
+// The address can have a port. Empty string is returned for invalid addresses.
+func anonymizeIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+
+	ip := net.ParseIP(addr)
+	switch {
+	case ip == nil:
+		return ""
+	case ip.To4() != nil:
+		return ip.Mask(net.CIDRMask(24, 32)).String()
+	default:
+		return ip.Mask(net.CIDRMask(48, 128)).String()
+	}
+}
+
+// visitorSaltSize is the number of random bytes of generated salt of fingerprints of visitors.
+const visitorSaltSize = 32
+
+// LoadVisitorSalt reads the salt of fingerprints of visitors from the file.
+// If the file doesn't exist, random salt is generated and saved to it, so visitors are identified
+// the same way after restart. The salt is never derived from keys signing tokens of users.
+func LoadVisitorSalt(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		salt := strings.TrimSpace(string(data))
+		if salt == "" {
+			return "", fmt.Errorf("salt of visitors in %s is empty", path)
+		}
+		return salt, nil
+	case !errors.Is(err, os.ErrNotExist):
+		return "", err
+	}
+
+	buf := make([]byte, visitorSaltSize)
+	if _, err = rand.Read(buf); err != nil {
+		return "", err
+	}
+	salt := hex.EncodeToString(buf)
+
+	// the existing salt is never overwritten
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	if _, err = file.WriteString(salt + "\n"); err != nil {
+		file.Close()
+		return "", err
+	}
+	if err = file.Close(); err != nil {
+		return "", err
+	}
+	return salt, nil
+}
+
+// visitorFingerprint returns the hash identifying the visitor by the address of the client and the user agent.
+// The full address is used, but it can't be recovered from the hash without the salt.
+// The hash is never 0, because 0 means that the visitor is unknown.
+func visitorFingerprint(salt []byte, addr, userAgent string) uint64 {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+
+	mac := hmac.New(sha256.New, salt)
+	mac.Write([]byte(addr))
+	mac.Write([]byte{0})
+	mac.Write([]byte(userAgent))
+	if fingerprint := binary.BigEndian.Uint64(mac.Sum(nil)); fingerprint != 0 {
+		return fingerprint
+	}
+	return 1
+}
+
+// truncate cuts the string to at most n bytes without breaking runes.
+// Invalid UTF-8 and NUL bytes are removed, because headers are not validated and DB rejects them.
+func truncate(s string, n int) string {
+	s = strings.ReplaceAll(strings.ToValidUTF8(s, ""), "\x00", "")
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
@@ -0,0 +1,215 @@
+// Package service implements the business logic of the application.
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhel1/yandex-practicum-go/internal/dto"
+	"github.com/zhel1/yandex-practicum-go/internal/storage"
+	"github.com/zhel1/yandex-practicum-go/internal/storage/inmemory"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// clicksStorage records sizes of saved batches and can block saving until it is released.
+type clicksStorage struct {
+	storage.Storage
+	release chan struct{} // saving is not blocked if nil
+	err     error
+
+	mu      sync.Mutex
+	batches []int
+}
+
+func (s *clicksStorage) SaveClicks(ctx context.Context, clicks []storage.Click) error {
+	if s.release != nil {
+		<-s.release
+	}
+	s.mu.Lock()
+	s.batches = append(s.batches, len(clicks))
+	s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	return s.Storage.SaveClicks(ctx, clicks)
+}
+
+func (s *clicksStorage) savedBatches() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]int(nil), s.batches...)
+}
+
+func newClicksStorage(t *testing.T) *clicksStorage {
+	st := inmemory.NewStorage()
+	require.NoError(t, st.Put(context.Background(), "user1", "1234567", "https://yandex.ru/", storage.LinkOptions{}))
+	return &clicksStorage{Storage: st}
+}
+
+func TestClickRecorderBatches(t *testing.T) {
+	st := newClicksStorage(t)
+	recorder := NewClickRecorder(st, 10, 2, time.Hour)
+	recorder.Start()
+
+	for i := 0; i < 3; i++ {
+		require.True(t, recorder.Record(storage.Click{ShortURL: "1234567", At: time.Now()}))
+	}
+	require.Eventually(t, func() bool {
+		return len(st.savedBatches()) == 1
+	}, time.Second, 10*time.Millisecond, "the full batch must be saved at once")
+
+	// the rest is saved on stop
+	recorder.Stop()
+	assert.Equal(t, []int{2, 1}, st.savedBatches())
+	assert.Equal(t, ClickStats{Saved: 3}, recorder.Stats())
+
+	clicks, err := st.GetClicks(context.Background(), "1234567", time.Now().Add(-time.Hour), time.Now())
+	require.NoError(t, err)
+	assert.Len(t, clicks, 3)
+}
+
+func TestClickRecorderInterval(t *testing.T) {
+	st := newClicksStorage(t)
+	recorder := NewClickRecorder(st, 10, 100, 20*time.Millisecond)
+	recorder.Start()
+	defer recorder.Stop()
+
+	require.True(t, recorder.Record(storage.Click{ShortURL: "1234567", At: time.Now()}))
+	require.Eventually(t, func() bool {
+		return recorder.Stats().Saved == 1
+	}, time.Second, 10*time.Millisecond, "the incomplete batch must be saved after the interval")
+}
+
+func TestClickRecorderDrops(t *testing.T) {
+	st := newClicksStorage(t)
+	st.release = make(chan struct{})
+	recorder := NewClickRecorder(st, 2, 1, time.Hour)
+	recorder.Start()
+
+	// the first click is taken from the queue and blocks saving
+	require.True(t, recorder.Record(storage.Click{ShortURL: "1234567", At: time.Now()}))
+	require.Eventually(t, func() bool {
+		return len(recorder.queue) == 0
+	}, time.Second, 10*time.Millisecond)
+
+	// the queue is filled, the next clicks are dropped without blocking
+	assert.True(t, recorder.Record(storage.Click{ShortURL: "1234567", At: time.Now()}))
+	assert.True(t, recorder.Record(storage.Click{ShortURL: "1234567", At: time.Now()}))
+	assert.False(t, recorder.Record(storage.Click{ShortURL: "1234567", At: time.Now()}))
+	assert.False(t, recorder.Record(storage.Click{ShortURL: "1234567", At: time.Now()}))
+
+	close(st.release)
+	recorder.Stop()
+	assert.Equal(t, ClickStats{Saved: 3, Dropped: 2}, recorder.Stats())
+}
+
+func TestClickRecorderFailure(t *testing.T) {
+	st := newClicksStorage(t)
+	st.err = errors.New("storage is down")
+	recorder := NewClickRecorder(st, 10, 2, time.Hour)
+	recorder.Start()
+
+	for i := 0; i < 3; i++ {
+		require.True(t, recorder.Record(storage.Click{ShortURL: "1234567", At: time.Now()}))
+	}
+	recorder.Stop()
+	assert.Equal(t, ClickStats{Failed: 3}, recorder.Stats())
+}
+
+func TestRecordClick(t *testing.T) {
+	st := newClicksStorage(t)
+	recorder := NewClickRecorder(st, 10, 10, time.Hour)
+	recorder.Start()
+	analytics := NewAnalyticsService(st, "http://localhost:8080/", recorder, nil, NewBotClassifier(DefaultBotSignatures), "salt")
+
+	userAgent := strings.Repeat("a", maxClickFieldLength+1)
+	analytics.RecordClick(context.Background(), dto.ModelClick{
+		ShortURL:   "1234567",
+		Referrer:   "https://ya.ru/",
+		UserAgent:  userAgent,
+		RemoteAddr: "192.168.1.42:54321",
+	})
+	analytics.RecordClick(context.Background(), dto.ModelClick{ShortURL: "1234567", Method: http.MethodHead})
+	recorder.Stop()
+
+	clicks, err := st.GetClicks(context.Background(), "1234567", time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	require.Len(t, clicks, 2)
+	assert.Equal(t, "https://ya.ru/", clicks[0].Referrer)
+	assert.Len(t, clicks[0].UserAgent, maxClickFieldLength)
+	assert.Equal(t, "192.168.1.0", clicks[0].IP)
+	assert.Equal(t, visitorFingerprint([]byte("salt"), "192.168.1.42", userAgent), clicks[0].Visitor)
+	assert.False(t, clicks[0].Bot)
+	assert.True(t, clicks[1].Bot)
+
+	// clicks are not recorded without recorder
+	NewAnalyticsService(st, "http://localhost:8080/", nil, nil, nil, "salt").RecordClick(context.Background(), dto.ModelClick{ShortURL: "1234567"})
+}
+
+func TestAnonymizeIP(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{addr: "192.168.1.42:54321", want: "192.168.1.0"},
+		{addr: "192.168.1.42", want: "192.168.1.0"},
+		{addr: "[2001:db8:85a3:8d3:1319:8a2e:370:7348]:443", want: "2001:db8:85a3::"},
+		{addr: "2001:db8:85a3:8d3:1319:8a2e:370:7348", want: "2001:db8:85a3::"},
+		{addr: "::ffff:10.1.2.3", want: "10.1.2.0"},
+		{addr: "localhost:8080", want: ""},
+		{addr: "", want: ""},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, anonymizeIP(tt.addr), tt.addr)
+	}
+}
+
+func TestVisitorFingerprint(t *testing.T) {
+	salt := []byte("salt")
+	visitor := visitorFingerprint(salt, "192.168.1.42:54321", "curl/7.79.1")
+	assert.NotZero(t, visitor)
+	assert.Equal(t, visitor, visitorFingerprint(salt, "192.168.1.42:12345", "curl/7.79.1"), "ports of connections must be ignored")
+	assert.NotEqual(t, visitor, visitorFingerprint(salt, "192.168.1.43:54321", "curl/7.79.1"), "clients of one network must differ")
+	assert.NotEqual(t, visitor, visitorFingerprint(salt, "192.168.1.42:54321", "curl/7.80.0"))
+	assert.NotEqual(t, visitor, visitorFingerprint([]byte("pepper"), "192.168.1.42:54321", "curl/7.79.1"))
+}
+
+func TestLoadVisitorSalt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "visitor.salt")
+	salt, err := LoadVisitorSalt(path)
+	require.NoError(t, err)
+	assert.Len(t, salt, 2*visitorSaltSize)
+
+	// the generated salt is kept
+	loaded, err := LoadVisitorSalt(path)
+	require.NoError(t, err)
+	assert.Equal(t, salt, loaded)
+	other, err := LoadVisitorSalt(filepath.Join(t.TempDir(), "visitor.salt"))
+	require.NoError(t, err)
+	assert.NotEqual(t, salt, other)
+
+	require.NoError(t, os.WriteFile(path, []byte(" pepper \n"), 0600))
+	loaded, err = LoadVisitorSalt(path)
+	require.NoError(t, err)
+	assert.Equal(t, "pepper", loaded)
+
+	require.NoError(t, os.WriteFile(path, []byte("\n"), 0600))
+	_, err = LoadVisitorSalt(path)
+	assert.Error(t, err)
+}
+
+func TestTruncate(t *testing.T) {
+	assert.Equal(t, "abc", truncate("abc", 5))
+	assert.Equal(t, "ab", truncate("abc", 2))
+	assert.Equal(t, "я", truncate("яя", 3), "runes must not be broken")
+	assert.Equal(t, "ab", truncate("a\xffb", 5), "invalid UTF-8 must be removed")
+	assert.Equal(t, "ab", truncate("a\x00b", 5), "NUL bytes must be removed")
+}
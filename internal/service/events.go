@@ -0,0 +1,155 @@
+// Package service implements the business logic of the application.
+package service
+
+import (
+	"github.com/zhel1/yandex-practicum-go/internal/dto"
+	"sync"
+	"time"
+)
+
+// Default limits of EventHub.
+const (
+	DefaultEventRingSize   = 1024 // events kept for resuming streams
+	DefaultEventBufferSize = 64   // events waiting for sending to one subscriber
+)
+
+// clickEvent is the event kept in the ring with the short URL it is matched by.
+type clickEvent struct {
+	shortURL string
+	event    dto.ModelClickEvent
+}
+
+// EventHub fans out click events to subscribers within the process.
+// The last events are kept in the ring, so the subscriber can resume the stream after the last event it received.
+// Every subscriber has the bounded buffer: the subscriber which doesn't keep up is closed rather than blocking
+// redirects, and its client resumes the stream from the ring when it reconnects.
+type EventHub struct {
+	mu          sync.Mutex
+	lastID      uint64
+	ring        []clickEvent // the oldest event is at next when the ring is full
+	next        int
+	bufferSize  int
+	subscribers map[*Subscription]struct{}
+	closed      bool
+}
+
+// NewEventHub creates EventHub which keeps ringSize last events and buffers bufferSize events for every subscriber.
+// IDs of events start from the current time in microseconds, so they keep growing after restart.
+func NewEventHub(ringSize, bufferSize int) *EventHub {
+	return &EventHub{
+		lastID:      uint64(time.Now().UnixMicro()),
+		ring:        make([]clickEvent, 0, ringSize),
+		bufferSize:  bufferSize,
+		subscribers: make(map[*Subscription]struct{}),
+	}
+}
+
+// Subscription receives events of short URLs accepted by its match function.
+type Subscription struct {
+	hub    *EventHub
+	events chan dto.ModelClickEvent
+	done   chan struct{}
+	match  func(shortURL string) bool
+}
+
+// Events returns the channel of events. It is closed when the subscription is closed
+// by Close, by closing of the hub or because the subscriber doesn't keep up.
+func (s *Subscription) Events() <-chan dto.ModelClickEvent {
+	return s.events
+}
+
+// Done returns the channel which is closed with the subscription.
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+// Close stops the subscription. It can be called more than once.
+func (s *Subscription) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	s.hub.remove(s)
+}
+
+// Publish assigns ID to the event, keeps it in the ring and sends it to matching subscribers without blocking.
+func (h *EventHub) Publish(shortURL string, event dto.ModelClickEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return
+	}
+
+	h.lastID++
+	event.ID = h.lastID
+	e := clickEvent{shortURL: shortURL, event: event}
+	if len(h.ring) < cap(h.ring) {
+		h.ring = append(h.ring, e)
+	} else if len(h.ring) > 0 {
+		h.ring[h.next] = e
+		h.next = (h.next + 1) % len(h.ring)
+	}
+
+	for s := range h.subscribers {
+		if !s.match(shortURL) {
+			continue
+		}
+		select {
+		case s.events <- event:
+		default:
+			h.remove(s)
+		}
+	}
+}
+
+// Subscribe registers the subscriber of events of short URLs accepted by match. match is called under the lock of the hub.
+// Events after lastID which are still kept in the ring are received first, lastID 0 means a new stream.
+func (h *EventHub) Subscribe(match func(shortURL string) bool, lastID uint64) *Subscription {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var replay []dto.ModelClickEvent
+	if lastID != 0 {
+		for i := range h.ring {
+			e := h.ring[(h.next+i)%len(h.ring)]
+			if e.event.ID > lastID && match(e.shortURL) {
+				replay = append(replay, e.event)
+			}
+		}
+	}
+
+	s := &Subscription{
+		hub:    h,
+		events: make(chan dto.ModelClickEvent, h.bufferSize+len(replay)),
+		done:   make(chan struct{}),
+		match:  match,
+	}
+	for _, event := range replay {
+		s.events <- event
+	}
+
+	if h.closed {
+		close(s.events)
+		close(s.done)
+		return s
+	}
+	h.subscribers[s] = struct{}{}
+	return s
+}
+
+// Close closes all subscriptions, so streams end and the server can shut down. Later subscriptions are closed at once.
+func (h *EventHub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for s := range h.subscribers {
+		h.remove(s)
+	}
+}
+
+// remove closes the subscription if it is not closed yet. It must be called under the lock.
+func (h *EventHub) remove(s *Subscription) {
+	if _, ok := h.subscribers[s]; ok {
+		delete(h.subscribers, s)
+		close(s.events)
+		close(s.done)
+	}
+}
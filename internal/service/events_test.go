@@ -0,0 +1,142 @@
+// Package service implements the business logic of the application.
+package service
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhel1/yandex-practicum-go/internal/dto"
+	"github.com/zhel1/yandex-practicum-go/internal/storage"
+	"testing"
+)
+
+// receive returns short URLs of events which are received by the subscription without waiting.
+func receive(sub *Subscription) []string {
+	var shortURLs []string
+	for {
+		select {
+		case event, ok := <-sub.Events():
+			if !ok {
+				return shortURLs
+			}
+			shortURLs = append(shortURLs, event.ShortURL)
+		default:
+			return shortURLs
+		}
+	}
+}
+
+// only returns the function matching one short URL.
+func only(shortURL string) func(string) bool {
+	return func(code string) bool {
+		return code == shortURL
+	}
+}
+
+func TestEventHubFanOut(t *testing.T) {
+	hub := NewEventHub(10, 10)
+	first, second := hub.Subscribe(only("a"), 0), hub.Subscribe(only("b"), 0)
+	all := hub.Subscribe(func(string) bool { return true }, 0)
+
+	for _, shortURL := range []string{"a", "b", "a", "c"} {
+		hub.Publish(shortURL, dto.ModelClickEvent{ShortURL: shortURL})
+	}
+	assert.Equal(t, []string{"a", "a"}, receive(first))
+	assert.Equal(t, []string{"b"}, receive(second))
+	assert.Equal(t, []string{"a", "b", "a", "c"}, receive(all))
+
+	// closed subscriptions receive nothing
+	first.Close()
+	first.Close()
+	hub.Publish("a", dto.ModelClickEvent{ShortURL: "a"})
+	_, ok := <-first.Events()
+	assert.False(t, ok)
+	assert.Equal(t, []string{"a"}, receive(all))
+}
+
+func TestEventHubReplay(t *testing.T) {
+	hub := NewEventHub(3, 10)
+	sub := hub.Subscribe(only("a"), 0)
+	for i := 0; i < 5; i++ {
+		hub.Publish("a", dto.ModelClickEvent{ShortURL: "a"})
+	}
+	var ids []uint64
+	for i := 0; i < 5; i++ {
+		event := <-sub.Events()
+		ids = append(ids, event.ID)
+	}
+	for i := 1; i < len(ids); i++ {
+		require.Equal(t, ids[i-1]+1, ids[i], "IDs must grow by one")
+	}
+
+	// the stream is resumed after the last received event
+	resumed := hub.Subscribe(only("a"), ids[3])
+	event := <-resumed.Events()
+	assert.Equal(t, ids[4], event.ID)
+	assert.Empty(t, receive(resumed))
+
+	// only the last events are kept
+	resumed = hub.Subscribe(only("a"), ids[0])
+	assert.Len(t, receive(resumed), 3)
+
+	// new streams are not replayed
+	assert.Empty(t, receive(hub.Subscribe(only("a"), 0)))
+}
+
+func TestEventHubSlowSubscriber(t *testing.T) {
+	hub := NewEventHub(10, 2)
+	slow := hub.Subscribe(only("a"), 0)
+	for i := 0; i < 3; i++ {
+		hub.Publish("a", dto.ModelClickEvent{ShortURL: "a"})
+	}
+
+	// buffered events are received before the subscription is closed
+	assert.Equal(t, []string{"a", "a"}, receive(slow))
+	_, ok := <-slow.Events()
+	assert.False(t, ok)
+	<-slow.Done()
+}
+
+func TestEventHubClose(t *testing.T) {
+	hub := NewEventHub(10, 10)
+	sub := hub.Subscribe(only("a"), 0)
+	hub.Publish("a", dto.ModelClickEvent{ShortURL: "a"})
+	hub.Close()
+
+	assert.Equal(t, []string{"a"}, receive(sub))
+	<-sub.Done()
+
+	// subscriptions after closing are closed at once, but get the replay
+	sub = hub.Subscribe(only("a"), 1)
+	assert.Equal(t, []string{"a"}, receive(sub))
+	<-sub.Done()
+}
+
+func TestSubscribeClicks(t *testing.T) {
+	ctx := context.Background()
+	st := newClicksStorage(t)
+	require.NoError(t, st.Put(ctx, "user2", "7654321", "https://yandex.ru/maps/", storage.LinkOptions{}))
+	analytics := NewAnalyticsService(st, "http://localhost:8080/", nil, NewEventHub(10, 10), nil, "salt")
+
+	_, err := analytics.SubscribeClicks(ctx, "user1", "7654321", 0)
+	assert.ErrorIs(t, err, dto.ErrNotOwner)
+	_, err = analytics.SubscribeClicks(ctx, "user1", "unknown", 0)
+	assert.ErrorIs(t, err, dto.ErrNotFound)
+
+	link, err := analytics.SubscribeClicks(ctx, "user1", "1234567", 0)
+	require.NoError(t, err)
+	defer link.Close()
+	all, err := analytics.SubscribeClicks(ctx, "user1", "", 0)
+	require.NoError(t, err)
+	defer all.Close()
+	// users without links can subscribe to them
+	none, err := analytics.SubscribeClicks(ctx, "user3", "", 0)
+	require.NoError(t, err)
+	defer none.Close()
+
+	analytics.RecordClick(ctx, dto.ModelClick{ShortURL: "1234567", Referrer: "https://ya.ru/", RemoteAddr: "192.168.1.42:54321"})
+	analytics.RecordClick(ctx, dto.ModelClick{ShortURL: "7654321"})
+	assert.Equal(t, []string{"http://localhost:8080/1234567"}, receive(link))
+	assert.Equal(t, []string{"http://localhost:8080/1234567"}, receive(all))
+	assert.Empty(t, receive(none))
+}
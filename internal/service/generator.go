@@ -0,0 +1,154 @@
+// Package service implements the business logic of the application.
+package service
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"math/bits"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Names of generators of short codes.
+const (
+	GeneratorHash    = "hash"
+	GeneratorRandom  = "random"
+	GeneratorCounter = "counter"
+)
+
+// Limits of length of short codes. Codes of maxCodeLength base62 digits fit into uint64.
+const (
+	DefaultCodeLength = 8
+	minCodeLength     = 4
+	maxCodeLength     = 10
+)
+
+// base62Alphabet contains digits of short codes.
+const base62Alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// counterMultiplier is coprime with 62, so multiplication by it modulo 62^n shuffles counter values without repeats.
+const counterMultiplier uint64 = 1<<61 - 1
+
+// Check interface implementation
+var (
+	_ Generator = (*HashGenerator)(nil)
+	_ Generator = (*RandomGenerator)(nil)
+	_ Generator = (*CounterGenerator)(nil)
+)
+
+// Generator makes short codes for original URLs.
+type Generator interface {
+	// Generate returns short code for the original URL.
+	// attempt is the number of codes made for the URL before which turned out to be taken by other URLs.
+	Generate(originURL string, attempt int) (string, error)
+}
+
+// NewGenerator creates generator by its name.
+func NewGenerator(name string, length int) (Generator, error) {
+	if length < minCodeLength || length > maxCodeLength {
+		return nil, fmt.Errorf("length of short code must be from %d to %d, got %d", minCodeLength, maxCodeLength, length)
+	}
+
+	switch name {
+	case GeneratorHash:
+		return NewHashGenerator(length), nil
+	case GeneratorRandom:
+		return NewRandomGenerator(length), nil
+	case GeneratorCounter:
+		return NewCounterGenerator(length), nil
+	default:
+		return nil, fmt.Errorf("unknown generator of short codes %q", name)
+	}
+}
+
+// HashGenerator makes short code from MD5 hash of the URL.
+// The same URL always gets the same code, the number of attempt is mixed into hash on collision.
+type HashGenerator struct {
+	length int
+	space  uint64
+}
+
+// NewHashGenerator creates HashGenerator of codes of the length.
+func NewHashGenerator(length int) *HashGenerator {
+	return &HashGenerator{length: length, space: codeSpace(length)}
+}
+
+// Generate returns base62 encoded hash of the URL.
+func (g *HashGenerator) Generate(originURL string, attempt int) (string, error) {
+	data := originURL
+	if attempt > 0 {
+		data += "#" + strconv.Itoa(attempt)
+	}
+	sum := md5.Sum([]byte(data))
+	return encodeBase62(binary.BigEndian.Uint64(sum[:8])%g.space, g.length), nil
+}
+
+// RandomGenerator makes random short codes.
+type RandomGenerator struct {
+	length int
+	space  *big.Int
+}
+
+// NewRandomGenerator creates RandomGenerator of codes of the length.
+func NewRandomGenerator(length int) *RandomGenerator {
+	return &RandomGenerator{length: length, space: new(big.Int).SetUint64(codeSpace(length))}
+}
+
+// Generate returns uniformly distributed random code.
+func (g *RandomGenerator) Generate(originURL string, attempt int) (string, error) {
+	n, err := rand.Int(rand.Reader, g.space)
+	if err != nil {
+		return "", err
+	}
+	return encodeBase62(n.Uint64(), g.length), nil
+}
+
+// CounterGenerator makes short codes from monotonic counter.
+// Values of the counter are shuffled, so consecutive codes don't look consecutive.
+// The counter starts from the current time in microseconds, so codes made after restart
+// don't repeat the previous ones while less than one code per microsecond is made.
+type CounterGenerator struct {
+	counter uint64
+	length  int
+	space   uint64
+}
+
+// NewCounterGenerator creates CounterGenerator of codes of the length.
+func NewCounterGenerator(length int) *CounterGenerator {
+	space := codeSpace(length)
+	return &CounterGenerator{
+		counter: uint64(time.Now().UnixNano()/int64(time.Microsecond)) % space,
+		length:  length,
+		space:   space,
+	}
+}
+
+// Generate returns the next value of the counter.
+func (g *CounterGenerator) Generate(originURL string, attempt int) (string, error) {
+	n := atomic.AddUint64(&g.counter, 1) % g.space
+	hi, lo := bits.Mul64(n, counterMultiplier%g.space)
+	return encodeBase62(bits.Rem64(hi, lo, g.space), g.length), nil
+}
+
+// codeSpace returns the number of codes of the length.
+func codeSpace(length int) uint64 {
+	space := uint64(1)
+	for i := 0; i < length; i++ {
+		space *= uint64(len(base62Alphabet))
+	}
+	return space
+}
+
+// encodeBase62 encodes n as base62 number of the length padded by zeros.
+func encodeBase62(n uint64, length int) string {
+	code := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		code[i] = base62Alphabet[n%uint64(len(base62Alphabet))]
+		n /= uint64(len(base62Alphabet))
+	}
+	return string(code)
+}
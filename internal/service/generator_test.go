@@ -0,0 +1,109 @@
+// Package service implements the business logic of the application.
+package service
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhel1/yandex-practicum-go/internal/dto"
+	"github.com/zhel1/yandex-practicum-go/internal/storage"
+	"github.com/zhel1/yandex-practicum-go/internal/storage/inmemory"
+	"strings"
+	"testing"
+)
+
+// sequenceGenerator returns codes from the list by number of attempt.
+type sequenceGenerator []string
+
+func (g sequenceGenerator) Generate(originURL string, attempt int) (string, error) {
+	return g[attempt%len(g)], nil
+}
+
+func TestNewGenerator(t *testing.T) {
+	tests := []struct {
+		name    string
+		length  int
+		wantErr bool
+	}{
+		{name: GeneratorHash, length: 8},
+		{name: GeneratorRandom, length: 4},
+		{name: GeneratorCounter, length: 10},
+		{name: GeneratorHash, length: 11, wantErr: true},
+		{name: GeneratorHash, length: 3, wantErr: true},
+		{name: "unknown", length: 8, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		gen, err := NewGenerator(tt.name, tt.length)
+		if tt.wantErr {
+			assert.Error(t, err)
+			continue
+		}
+		require.NoError(t, err)
+
+		for attempt := 0; attempt < 100; attempt++ {
+			code, err := gen.Generate("https://yandex.ru/news/", attempt)
+			require.NoError(t, err)
+			require.Len(t, code, tt.length)
+			for _, c := range code {
+				require.True(t, strings.ContainsRune(base62Alphabet, c), code)
+			}
+		}
+	}
+}
+
+func TestHashGenerator(t *testing.T) {
+	gen := NewHashGenerator(DefaultCodeLength)
+
+	code1, _ := gen.Generate("https://yandex.ru/news/", 0)
+	code2, _ := gen.Generate("https://yandex.ru/news/", 0)
+	assert.Equal(t, code1, code2)
+
+	code3, _ := gen.Generate("https://yandex.ru/news/", 1)
+	assert.NotEqual(t, code1, code3)
+}
+
+func TestCounterGenerator(t *testing.T) {
+	gen := NewCounterGenerator(minCodeLength)
+	gen.counter = gen.space - 1000 // wrap around the end of the space
+
+	codes := make(map[string]struct{})
+	for i := 0; i < 100000; i++ {
+		code, err := gen.Generate("", 0)
+		require.NoError(t, err)
+		_, ok := codes[code]
+		require.False(t, ok, "code %s is repeated", code)
+		codes[code] = struct{}{}
+	}
+}
+
+func TestShortenCollisions(t *testing.T) {
+	ctx := context.Background()
+	st := inmemory.NewStorage()
+	require.NoError(t, st.Put(ctx, "user1", "taken", "https://yandex.ru/", storage.LinkOptions{}))
+
+	s := NewShortenService(st, "http://localhost:8080/", sequenceGenerator{"taken", "free1", "free2"})
+
+	res, err := s.ShortenURL(ctx, "user1", dto.ModelOriginalURL{OriginalURL: "https://yandex.ru/news/"})
+	require.NoError(t, err)
+	assert.Equal(t, "http://localhost:8080/free1", res.ShortURL)
+
+	// the same URL follows the same codes and finds itself
+	_, err = s.ShortenURL(ctx, "user1", dto.ModelOriginalURL{OriginalURL: "https://yandex.ru/news/"})
+	assert.ErrorIs(t, err, dto.ErrAlreadyExists)
+
+	// URLs of the batch get different codes
+	s = NewShortenService(st, "http://localhost:8080/", sequenceGenerator{"taken", "free3", "free4", "free5"})
+	batch, err := s.ShortenBatchURL(ctx, "user2", []dto.ModelOriginalURLBatch{
+		{CorrelationID: "1", OriginalURL: "https://yandex.ru/sport/"},
+		{CorrelationID: "2", OriginalURL: "https://yandex.ru/weather/"},
+	})
+	require.NoError(t, err)
+	require.Len(t, batch, 2)
+	assert.NotEqual(t, batch[0].ShortURL, batch[1].ShortURL)
+
+	// all codes are taken
+	s = NewShortenService(st, "http://localhost:8080/", sequenceGenerator{"taken"})
+	_, err = s.ShortenURL(ctx, "user1", dto.ModelOriginalURL{OriginalURL: "https://yandex.ru/maps/"})
+	assert.ErrorIs(t, err, dto.ErrCodeTaken)
+}
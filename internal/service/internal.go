@@ -0,0 +1,51 @@
+// Package service implements the business logic of the application.
+package service
+
+import (
+	"context"
+	"fmt"
+	"github.com/zhel1/yandex-practicum-go/internal/dto"
+	"github.com/zhel1/yandex-practicum-go/internal/storage"
+	"net"
+)
+
+// InternalService returns statistics of the service to clients of the trusted subnet.
+type InternalService struct {
+	storage       storage.Storage
+	trustedSubnet *net.IPNet
+}
+
+// NewInternalService creates InternalService. No client is trusted if trustedSubnet is nil.
+func NewInternalService(storage storage.Storage, trustedSubnet *net.IPNet) *InternalService {
+	return &InternalService{
+		storage:       storage,
+		trustedSubnet: trustedSubnet,
+	}
+}
+
+// ParseTrustedSubnet parses the trusted subnet in CIDR notation, nil if it is empty.
+func ParseTrustedSubnet(cidr string) (*net.IPNet, error) {
+	if cidr == "" {
+		return nil, nil
+	}
+	_, subnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted subnet: %w", err)
+	}
+	return subnet, nil
+}
+
+// GetStats returns numbers of short URLs and users if the client address is within the trusted subnet,
+// dto.ErrUntrusted otherwise.
+func (s *InternalService) GetStats(ctx context.Context, clientIP string) (dto.ModelInternalStats, error) {
+	ip := net.ParseIP(clientIP)
+	if s.trustedSubnet == nil || ip == nil || !s.trustedSubnet.Contains(ip) {
+		return dto.ModelInternalStats{}, dto.ErrUntrusted
+	}
+
+	counts, err := s.storage.GetCounts(ctx)
+	if err != nil {
+		return dto.ModelInternalStats{}, err
+	}
+	return dto.ModelInternalStats{URLs: counts.URLs, Users: counts.Users}, nil
+}
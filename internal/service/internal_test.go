@@ -0,0 +1,62 @@
+// Package service implements the business logic of the application.
+package service
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhel1/yandex-practicum-go/internal/dto"
+	"github.com/zhel1/yandex-practicum-go/internal/storage"
+	"github.com/zhel1/yandex-practicum-go/internal/storage/inmemory"
+	"net"
+	"testing"
+)
+
+func TestInternalGetStats(t *testing.T) {
+	ctx := context.Background()
+	st := inmemory.NewStorage()
+	require.NoError(t, st.Put(ctx, "user1", "1234567", "https://yandex.ru/news/", storage.LinkOptions{}))
+	subnet, err := ParseTrustedSubnet("10.0.0.0/8")
+	require.NoError(t, err)
+	v6subnet, err := ParseTrustedSubnet("2001:db8::/32")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		subnet   *net.IPNet
+		clientIP string
+		wantErr  error
+	}{
+		{name: "trusted client", subnet: subnet, clientIP: "10.1.2.3"},
+		{name: "trusted IPv6 client", subnet: v6subnet, clientIP: "2001:db8::1"},
+		{name: "untrusted client", subnet: subnet, clientIP: "11.1.2.3", wantErr: dto.ErrUntrusted},
+		{name: "without address", subnet: subnet, clientIP: "", wantErr: dto.ErrUntrusted},
+		{name: "invalid address", subnet: subnet, clientIP: "10.1.2", wantErr: dto.ErrUntrusted},
+		{name: "address with port", subnet: subnet, clientIP: "10.1.2.3:8080", wantErr: dto.ErrUntrusted},
+		{name: "without trusted subnet", clientIP: "10.1.2.3", wantErr: dto.ErrUntrusted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stats, err := NewInternalService(st, tt.subnet).GetStats(ctx, tt.clientIP)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, dto.ModelInternalStats{URLs: 1, Users: 1}, stats)
+		})
+	}
+}
+
+func TestParseTrustedSubnet(t *testing.T) {
+	subnet, err := ParseTrustedSubnet("")
+	require.NoError(t, err)
+	assert.Nil(t, subnet)
+
+	subnet, err = ParseTrustedSubnet("192.168.1.7/24")
+	require.NoError(t, err)
+	assert.Equal(t, "192.168.1.0/24", subnet.String())
+
+	_, err = ParseTrustedSubnet("192.168.1.0")
+	assert.Error(t, err)
+}
@@ -0,0 +1,80 @@
+// Package service implements the business logic of the application.
+package service
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/zhel1/yandex-practicum-go/internal/dto"
+	"github.com/zhel1/yandex-practicum-go/internal/storage"
+	"strings"
+)
+
+// pageCursor is the position in the list of user links passed to clients.
+// The sort order is kept to reject cursors of lists with another order.
+type pageCursor struct {
+	Sort string `json:"sort"`
+	storage.LinksCursor
+}
+
+// parseLinksQuery validates the query of user links and converts it to the storage query.
+func parseLinksQuery(query dto.ModelLinksQuery) (storage.LinksQuery, error) {
+	linksQuery := storage.LinksQuery{
+		Sort:    strings.TrimPrefix(query.Sort, "-"),
+		Desc:    strings.HasPrefix(query.Sort, "-"),
+		Search:  query.Search,
+		Domain:  strings.ToLower(strings.TrimSuffix(query.Domain, ".")),
+		Deleted: query.Deleted,
+		Limit:   query.Limit,
+	}
+
+	switch linksQuery.Sort {
+	case "":
+		linksQuery.Sort = storage.SortCreated
+	case storage.SortCreated, storage.SortURL:
+	default:
+		return storage.LinksQuery{}, fmt.Errorf("%w: unknown sort order %q", dto.ErrInvalidQuery, query.Sort)
+	}
+
+	switch {
+	case linksQuery.Limit == 0:
+		linksQuery.Limit = storage.DefaultPageSize
+	case linksQuery.Limit < 0 || linksQuery.Limit > storage.MaxPageSize:
+		return storage.LinksQuery{}, fmt.Errorf("%w: limit must be from 1 to %d", dto.ErrInvalidQuery, storage.MaxPageSize)
+	}
+
+	if query.Cursor != "" {
+		after, err := decodeCursor(query.Sort, query.Cursor)
+		if err != nil {
+			return storage.LinksQuery{}, err
+		}
+		linksQuery.After = &after
+	}
+	return linksQuery, nil
+}
+
+// encodeCursor returns opaque cursor of the position in the list with the sort order.
+func encodeCursor(sort string, after storage.LinksCursor) (string, error) {
+	data, err := json.Marshal(pageCursor{Sort: sort, LinksCursor: after})
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// decodeCursor returns the position from the cursor made for the list with the same sort order.
+func decodeCursor(sort, cursor string) (storage.LinksCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return storage.LinksCursor{}, fmt.Errorf("%w: malformed cursor", dto.ErrInvalidQuery)
+	}
+
+	var c pageCursor
+	if err = json.Unmarshal(data, &c); err != nil || c.Seq <= 0 {
+		return storage.LinksCursor{}, fmt.Errorf("%w: malformed cursor", dto.ErrInvalidQuery)
+	}
+	if c.Sort != sort {
+		return storage.LinksCursor{}, fmt.Errorf("%w: cursor is made for another sort order", dto.ErrInvalidQuery)
+	}
+	return c.LinksCursor, nil
+}
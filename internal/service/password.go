@@ -0,0 +1,134 @@
+// Package service implements the business logic of the application.
+package service
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Parameters of hashes of passwords. Hashes keep their parameters, so they can be changed without breaking stored hashes.
+const (
+	passwordScheme     = "pbkdf2-sha256"
+	passwordIterations = 100000
+	passwordSaltSize   = 16
+	passwordKeySize    = 32
+	maxPasswordLength  = 256
+)
+
+// Limits of attempts to enter password of one link. Successful attempt resets the counter.
+const (
+	maxPasswordAttempts    = 5
+	passwordAttemptsWindow = time.Minute
+)
+
+// hashPassword returns salted PBKDF2 hash of the password in format "pbkdf2-sha256$iterations$salt$key".
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, passwordSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := pbkdf2.Key([]byte(password), salt, passwordIterations, passwordKeySize, sha256.New)
+	return strings.Join([]string{
+		passwordScheme,
+		strconv.Itoa(passwordIterations),
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	}, "$"), nil
+}
+
+// checkPassword checks the password against the hash made by hashPassword in constant time.
+func checkPassword(hash, password string) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != passwordScheme {
+		return false, fmt.Errorf("unknown format of password hash")
+	}
+
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations <= 0 {
+		return false, fmt.Errorf("invalid number of iterations of password hash")
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false, fmt.Errorf("invalid salt of password hash: %w", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false, fmt.Errorf("invalid key of password hash: %w", err)
+	}
+
+	actual := pbkdf2.Key([]byte(password), salt, iterations, len(key), sha256.New)
+	return subtle.ConstantTimeCompare(actual, key) == 1, nil
+}
+
+// attemptLimiter limits the number of attempts by key within the window.
+// Attempts are counted before they are checked, so concurrent attempts can't exceed the limit.
+type attemptLimiter struct {
+	sync.Mutex
+	max      int
+	window   time.Duration
+	attempts map[string]*attempts
+	cleaned  time.Time
+}
+
+// attempts is the number of attempts made since the start of the window.
+type attempts struct {
+	count int
+	since time.Time
+}
+
+// newAttemptLimiter creates attemptLimiter of max attempts within the window.
+func newAttemptLimiter(max int, window time.Duration) *attemptLimiter {
+	return &attemptLimiter{
+		max:      max,
+		window:   window,
+		attempts: make(map[string]*attempts),
+	}
+}
+
+// take counts the attempt by the key and checks whether it is allowed.
+func (l *attemptLimiter) take(key string, now time.Time) bool {
+	l.Lock()
+	defer l.Unlock()
+	l.clean(now)
+
+	a, ok := l.attempts[key]
+	if !ok || now.Sub(a.since) >= l.window {
+		a = &attempts{since: now}
+		l.attempts[key] = a
+	}
+	if a.count >= l.max {
+		return false
+	}
+	a.count++
+	return true
+}
+
+// reset forgets attempts by the key.
+func (l *attemptLimiter) reset(key string) {
+	l.Lock()
+	defer l.Unlock()
+	delete(l.attempts, key)
+}
+
+// clean removes attempts of passed windows at most once per window. It must be called under the lock.
+func (l *attemptLimiter) clean(now time.Time) {
+	if now.Sub(l.cleaned) < l.window {
+		return
+	}
+	for key, a := range l.attempts {
+		if now.Sub(a.since) >= l.window {
+			delete(l.attempts, key)
+		}
+	}
+	l.cleaned = now
+}
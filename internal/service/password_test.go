@@ -0,0 +1,104 @@
+// Package service implements the business logic of the application.
+package service
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhel1/yandex-practicum-go/internal/dto"
+	"github.com/zhel1/yandex-practicum-go/internal/storage/inmemory"
+	"testing"
+	"time"
+)
+
+func TestCheckPasswordVector(t *testing.T) {
+	// the key of the test vector of RFC 7914, hashes keep their parameters
+	key, err := hex.DecodeString("4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56")
+	require.NoError(t, err)
+	hash := "pbkdf2-sha256$80000$" + base64.RawStdEncoding.EncodeToString([]byte("NaCl")) + "$" + base64.RawStdEncoding.EncodeToString(key)
+
+	ok, err := checkPassword(hash, "Password")
+	require.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = checkPassword(hash, "password")
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestHashPassword(t *testing.T) {
+	hash1, err := hashPassword("secret")
+	require.NoError(t, err)
+	hash2, err := hashPassword("secret")
+	require.NoError(t, err)
+	assert.NotEqual(t, hash1, hash2, "hashes must be salted")
+	assert.NotContains(t, hash1, "secret")
+
+	ok, err := checkPassword(hash1, "secret")
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = checkPassword(hash1, "Secret")
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	_, err = checkPassword("md5$secret", "secret")
+	assert.Error(t, err)
+}
+
+func TestAttemptLimiter(t *testing.T) {
+	limiter := newAttemptLimiter(2, time.Minute)
+	now := time.Now()
+
+	assert.True(t, limiter.take("link1", now))
+	assert.True(t, limiter.take("link1", now))
+	assert.False(t, limiter.take("link1", now))
+	assert.True(t, limiter.take("link2", now), "links are limited separately")
+
+	assert.True(t, limiter.take("link1", now.Add(time.Minute)), "limit is reset after the window")
+
+	limiter.reset("link2")
+	assert.True(t, limiter.take("link2", now))
+	assert.True(t, limiter.take("link2", now))
+
+	// attempts of passed windows are evicted
+	for i := 0; i < 100; i++ {
+		limiter.take(fmt.Sprintf("link%d", i), now)
+	}
+	assert.Len(t, limiter.attempts, 100)
+	limiter.take("link1", now.Add(2*time.Minute))
+	assert.Len(t, limiter.attempts, 1)
+}
+
+func TestProtectedLink(t *testing.T) {
+	ctx := context.Background()
+	st := inmemory.NewStorage()
+	shorten := NewShortenService(st, "http://localhost:8080/", NewHashGenerator(DefaultCodeLength))
+	users := NewUserService(st, "http://localhost:8080/", nil, DefaultAccessTokenTTL, DefaultRefreshTokenTTL)
+
+	public, err := shorten.ShortenURL(ctx, "user1", dto.ModelOriginalURL{OriginalURL: "https://yandex.ru/docs/"})
+	require.NoError(t, err)
+	protected, err := shorten.ShortenURL(ctx, "user2", dto.ModelOriginalURL{OriginalURL: "https://yandex.ru/docs/", Password: "secret"})
+	require.NoError(t, err)
+	require.NotEqual(t, public.ShortURL, protected.ShortURL, "protected link must not share code with public one")
+
+	shortURL := protected.ShortURL[len("http://localhost:8080/"):]
+	_, err = users.GetOriginalURLByShort(ctx, shortURL, "")
+	assert.ErrorIs(t, err, dto.ErrPasswordRequired)
+
+	originURL, err := users.GetOriginalURLByShort(ctx, shortURL, "secret")
+	require.NoError(t, err)
+	assert.Equal(t, "https://yandex.ru/docs/", originURL)
+
+	for i := 0; i < maxPasswordAttempts; i++ {
+		_, err = users.GetOriginalURLByShort(ctx, shortURL, "guess")
+		assert.ErrorIs(t, err, dto.ErrWrongPassword)
+	}
+	_, err = users.GetOriginalURLByShort(ctx, shortURL, "secret")
+	assert.ErrorIs(t, err, dto.ErrTooManyAttempts)
+
+	_, err = shorten.ShortenURL(ctx, "user2", dto.ModelOriginalURL{OriginalURL: "https://yandex.ru/", Password: string(make([]byte, maxPasswordLength+1))})
+	assert.ErrorIs(t, err, dto.ErrInvalidPassword)
+}
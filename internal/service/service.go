@@ -6,14 +6,21 @@ import (
 	"github.com/zhel1/yandex-practicum-go/internal/auth"
 	"github.com/zhel1/yandex-practicum-go/internal/dto"
 	"github.com/zhel1/yandex-practicum-go/internal/storage"
+	"net"
+	"time"
 )
 
 type User interface {
 	CreateNewToken(ctx context.Context, userID string) (string, error)
-	CheckToken(ctx context.Context, token string) (string, error)
-	GetOriginalURLByShort(ctx context.Context, shortURL string) (string, error)
-	GetURLsByUserID(ctx context.Context, userID string) ([]dto.ModelURL, error)
+	CreateSession(ctx context.Context, userID string) (dto.ModelSession, error)
+	RefreshSession(ctx context.Context, refreshToken string) (dto.ModelSession, error)
+	CheckToken(ctx context.Context, token string) (userID, renewed string, err error)
+	GetOriginalURLByShort(ctx context.Context, shortURL, password string) (string, error)
+	GetURLsByUserID(ctx context.Context, userID string, query dto.ModelLinksQuery) (dto.ModelURLPage, error)
 	DeleteBatchURL(ctx context.Context, userID string, shortURLs []string) error
+	EditURL(ctx context.Context, userID, shortURL, originURL string) (dto.ModelURL, error)
+	GetURLHistory(ctx context.Context, userID, shortURL string) ([]dto.ModelRevision, error)
+	RollbackURL(ctx context.Context, userID, shortURL string, revision int) (dto.ModelURL, error)
 	Ping(ctx context.Context) error
 }
 
@@ -22,20 +29,65 @@ type Shorten interface {
 	ShortenBatchURL(ctx context.Context, userID string, URLs []dto.ModelOriginalURLBatch) ([]dto.ModelShortURLBatch, error)
 }
 
+type Analytics interface {
+	RecordClick(ctx context.Context, click dto.ModelClick)
+	GetLinkStats(ctx context.Context, userID, shortURL string, query dto.ModelStatsQuery) (dto.ModelLinkStats, error)
+	SubscribeClicks(ctx context.Context, userID, shortURL string, lastEventID uint64) (*Subscription, error)
+}
+
+type Internal interface {
+	GetStats(ctx context.Context, clientIP string) (dto.ModelInternalStats, error)
+}
+
 type Services struct {
-	Users   User
-	Shorten Shorten
+	Users     User
+	Shorten   Shorten
+	Analytics Analytics
+	Internal  Internal
 }
 
 type Deps struct {
-	Storage      storage.Storage
-	BaseURL      string
-	TokenManager auth.TokenManager
+	Storage       storage.Storage
+	BaseURL       string
+	TokenManager  auth.TokenManager
+	AccessTTL     time.Duration  // DefaultAccessTokenTTL is used if zero
+	RefreshTTL    time.Duration  // DefaultRefreshTokenTTL is used if zero
+	Generator     Generator      // hash generator is used if nil
+	Clicks        *ClickRecorder // clicks are not recorded if nil
+	Events        *EventHub      // hub with default limits is used if nil
+	Bots          *BotClassifier // classifier with default signatures is used if nil
+	VisitorSalt   string         // salt of fingerprints of unique visitors
+	TrustedSubnet *net.IPNet     // clients allowed to get internal statistics, none if nil
 }
 
 func NewServices(deps Deps) *Services {
+	generator := deps.Generator
+	if generator == nil {
+		generator = NewHashGenerator(DefaultCodeLength)
+	}
+
+	events := deps.Events
+	if events == nil {
+		events = NewEventHub(DefaultEventRingSize, DefaultEventBufferSize)
+	}
+
+	accessTTL, refreshTTL := deps.AccessTTL, deps.RefreshTTL
+	if accessTTL == 0 {
+		accessTTL = DefaultAccessTokenTTL
+	}
+	if refreshTTL == 0 {
+		refreshTTL = DefaultRefreshTokenTTL
+	}
+
+	bots := deps.Bots
+	if bots == nil {
+		bots = NewBotClassifier(DefaultBotSignatures)
+	}
+
 	return &Services{
-		Shorten: NewShortenService(deps.Storage, deps.BaseURL),
-		Users:   NewUserService(deps.Storage, deps.BaseURL, deps.TokenManager),
+		Shorten:   NewShortenService(deps.Storage, deps.BaseURL, generator),
+		Users:     NewUserService(deps.Storage, deps.BaseURL, deps.TokenManager, accessTTL, refreshTTL),
+		Analytics: NewAnalyticsService(deps.Storage, deps.BaseURL, deps.Clicks, events, bots, deps.VisitorSalt),
+		Internal:  NewInternalService(deps.Storage, deps.TrustedSubnet),
 	}
 }
@@ -4,10 +4,12 @@ package service
 import (
 	"context"
 	"errors"
+	"fmt"
 	"github.com/zhel1/yandex-practicum-go/internal/dto"
 	"github.com/zhel1/yandex-practicum-go/internal/storage"
-	"github.com/zhel1/yandex-practicum-go/internal/utils"
+	storageErrors "github.com/zhel1/yandex-practicum-go/internal/storage/errors"
 	"net/url"
+	"time"
 )
 
 // Check interface implementation
@@ -15,15 +17,20 @@ var (
 	_ Shorten = (*ShortenService)(nil)
 )
 
+// maxAttempts is the number of short codes tried for one URL before giving up.
+const maxAttempts = 10
+
 type ShortenService struct {
-	baseURL string
-	storage storage.Storage
+	baseURL   string
+	storage   storage.Storage
+	generator Generator
 }
 
-func NewShortenService(storage storage.Storage, baseURL string) *ShortenService {
+func NewShortenService(storage storage.Storage, baseURL string, generator Generator) *ShortenService {
 	return &ShortenService{
-		baseURL: baseURL,
-		storage: storage,
+		baseURL:   baseURL,
+		storage:   storage,
+		generator: generator,
 	}
 }
 
@@ -32,47 +39,239 @@ func (s *ShortenService) ShortenURL(ctx context.Context, userID string, URL dto.
 		return dto.ModelShortURL{}, err
 	}
 
-	shortIDLink := utils.MD5(URL.OriginalURL)[:8]
+	opts, err := linkOptions(URL.ExpiresAt, URL.MaxClicks, URL.Password)
+	if err != nil {
+		return dto.ModelShortURL{}, err
+	}
 
-	response := dto.ModelShortURL{
-		ShortURL: s.baseURL + shortIDLink,
+	var shortIDLink string
+	if URL.Alias != "" {
+		shortIDLink, err = s.putAlias(ctx, userID, URL.Alias, URL.OriginalURL, opts)
+	} else {
+		shortIDLink, err = s.putGenerated(ctx, userID, URL.OriginalURL, opts)
+	}
+	if shortIDLink == "" {
+		return dto.ModelShortURL{}, err
 	}
 
-	if err := s.storage.Put(ctx, userID, shortIDLink, URL.OriginalURL); err != nil {
-		switch {
-		case errors.Is(err, dto.ErrAlreadyExists):
-			return response, err
-		default:
-			return dto.ModelShortURL{}, err
-		}
+	// the short URL is returned also with dto.ErrAlreadyExists
+	response := dto.ModelShortURL{
+		ShortURL: s.baseURL + shortIDLink,
 	}
-	return response, nil
+	return response, err
 }
 
 func (s *ShortenService) ShortenBatchURL(ctx context.Context, userID string, URLs []dto.ModelOriginalURLBatch) ([]dto.ModelShortURLBatch, error) {
-	bResArr := make([]dto.ModelShortURLBatch, 0, len(URLs))
+	shortURLs := make(map[string]string, len(URLs)) // original URL -> short URL
+	owners := make(map[string]string, len(URLs))    // short URL -> original URL of the batch, "" if taken by another URL
+	attempts := make(map[string]int, len(URLs))
+	pending := make([]string, 0, len(URLs))
+	aliases := make(map[string]bool)                 // original URLs with aliases
+	linkOpts := make(map[string]storage.LinkOptions) // original URL -> restrictions
 	batchForDB := make(map[string]string, len(URLs))
-
+	existing := false // some URLs are already saved by the user
 	for _, batch := range URLs {
-		short := utils.MD5(batch.OriginalURL)[:8]
+		short, ok := shortURLs[batch.OriginalURL]
+		if !ok {
+			opts, err := linkOptions(batch.ExpiresAt, batch.MaxClicks, batch.Password)
+			if err != nil {
+				return nil, err
+			}
+			linkOpts[batch.OriginalURL] = opts
+		}
 
-		bRes := dto.ModelShortURLBatch{
-			CorrelationID: batch.CorrelationID,
-			ShortURL:      s.baseURL + short,
+		switch {
+		case ok && batch.Alias != "" && batch.Alias != short:
+			return nil, fmt.Errorf("%w: %s has several short URLs in the batch", dto.ErrInvalidAlias, batch.OriginalURL)
+		case ok:
+		case batch.Alias == "":
+			short, err := s.findExisting(ctx, userID, batch.OriginalURL, linkOpts[batch.OriginalURL])
+			switch {
+			case errors.Is(err, dto.ErrAlreadyExists):
+				existing = true
+				shortURLs[batch.OriginalURL] = short
+				owners[short] = batch.OriginalURL
+			case err != nil:
+				return nil, err
+			default:
+				shortURLs[batch.OriginalURL] = ""
+				pending = append(pending, batch.OriginalURL)
+			}
+		default:
+			if err := validateAlias(batch.Alias); err != nil {
+				return nil, err
+			}
+			if _, ok := owners[batch.Alias]; ok {
+				return nil, dto.ErrAliasTaken
+			}
+			shortURLs[batch.OriginalURL] = batch.Alias
+			owners[batch.Alias] = batch.OriginalURL
+			aliases[batch.OriginalURL] = true
+			batchForDB[batch.OriginalURL] = batch.Alias
 		}
+	}
 
-		batchForDB[batch.OriginalURL] = short
+	// codes taken by other URLs are replaced by the next ones until all URLs are saved, aliases are not replaced
+	for len(pending) > 0 || len(batchForDB) > 0 {
+		for _, originURL := range pending {
+			short, err := s.generateFree(originURL, attempts, owners)
+			if err != nil {
+				return nil, err
+			}
+			shortURLs[originURL] = short
+			owners[short] = originURL
+			batchForDB[originURL] = short
+		}
+		pending = pending[:0]
 
-		bResArr = append(bResArr, bRes)
-	}
+		batchOpts := make(map[string]storage.LinkOptions)
+		for originURL, short := range batchForDB {
+			if opts := linkOpts[originURL]; opts != (storage.LinkOptions{}) {
+				batchOpts[short] = opts
+			}
+		}
 
-	if err := s.storage.PutBatch(ctx, userID, batchForDB); err != nil {
+		err := s.storage.PutBatch(ctx, userID, batchForDB, batchOpts)
+		batchForDB = make(map[string]string, len(pending))
+		var takenErr *storageErrors.CodeTakenError
 		switch {
+		case err == nil:
+		case errors.As(err, &takenErr):
+			existing = existing || len(takenErr.Existing) > 0
+			for _, short := range takenErr.Keys {
+				originURL := owners[short]
+				if aliases[originURL] {
+					return nil, dto.ErrAliasTaken
+				}
+				owners[short] = ""
+				attempts[originURL]++
+				pending = append(pending, originURL)
+			}
 		case errors.Is(err, dto.ErrAlreadyExists):
-			return nil, dto.ErrAlreadyExists
+			existing = true
 		default:
 			return nil, err
 		}
 	}
+
+	if existing {
+		return nil, dto.ErrAlreadyExists
+	}
+
+	bResArr := make([]dto.ModelShortURLBatch, 0, len(URLs))
+	for _, batch := range URLs {
+		bResArr = append(bResArr, dto.ModelShortURLBatch{
+			CorrelationID: batch.CorrelationID,
+			ShortURL:      s.baseURL + shortURLs[batch.OriginalURL],
+		})
+	}
 	return bResArr, nil
 }
+
+// putGenerated saves the URL under the first generated code which is not taken by other URLs.
+// It returns the existing code with dto.ErrAlreadyExists when the user already has the URL.
+func (s *ShortenService) putGenerated(ctx context.Context, userID, originURL string, opts storage.LinkOptions) (string, error) {
+	if shortURL, err := s.findExisting(ctx, userID, originURL, opts); shortURL != "" || err != nil {
+		return shortURL, err
+	}
+
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		shortURL, err := s.generator.Generate(originURL, attempt)
+		if err != nil {
+			return "", err
+		}
+
+		err = s.storage.Put(ctx, userID, shortURL, originURL, opts)
+		switch {
+		case err == nil || errors.Is(err, dto.ErrAlreadyExists):
+			return shortURL, err
+		case !errors.Is(err, dto.ErrCodeTaken):
+			return "", err
+		}
+	}
+	return "", errNoFreeCode()
+}
+
+// putAlias saves the URL under the alias chosen by the user.
+// It returns the alias also when the user already has the URL under it.
+func (s *ShortenService) putAlias(ctx context.Context, userID, alias, originURL string, opts storage.LinkOptions) (string, error) {
+	if err := validateAlias(alias); err != nil {
+		return "", err
+	}
+
+	err := s.storage.Put(ctx, userID, alias, originURL, opts)
+	switch {
+	case err == nil || errors.Is(err, dto.ErrAlreadyExists):
+		return alias, err
+	case errors.Is(err, dto.ErrCodeTaken):
+		return "", dto.ErrAliasTaken
+	default:
+		return "", err
+	}
+}
+
+// findExisting returns the short URL of the user to the URL with dto.ErrAlreadyExists or "" if there is none.
+// Generators other than the hash one make another code for the same URL, so the existing link is looked up
+// before the code is made. Protected links are never reused.
+func (s *ShortenService) findExisting(ctx context.Context, userID, originURL string, opts storage.LinkOptions) (string, error) {
+	if opts.PasswordHash != "" {
+		return "", nil
+	}
+
+	shortURL, err := s.storage.FindUserLink(ctx, userID, originURL)
+	switch {
+	case err == nil:
+		return shortURL, dto.ErrAlreadyExists
+	case errors.Is(err, dto.ErrNotFound):
+		return "", nil
+	default:
+		return "", err
+	}
+}
+
+// generateFree returns code for the URL which is not used by other URLs of the batch.
+func (s *ShortenService) generateFree(originURL string, attempts map[string]int, owners map[string]string) (string, error) {
+	for ; attempts[originURL] < maxAttempts; attempts[originURL]++ {
+		short, err := s.generator.Generate(originURL, attempts[originURL])
+		if err != nil {
+			return "", err
+		}
+		if _, ok := owners[short]; !ok {
+			return short, nil
+		}
+	}
+	return "", errNoFreeCode()
+}
+
+// linkOptions validates restrictions of the link requested by the user. Only the hash of the password is kept.
+func linkOptions(expiresAt *time.Time, maxClicks int64, password string) (storage.LinkOptions, error) {
+	var opts storage.LinkOptions
+	if expiresAt != nil {
+		if !expiresAt.After(time.Now()) {
+			return opts, fmt.Errorf("%w: expiration time is in the past", dto.ErrInvalidExpiry)
+		}
+		opts.ExpiresAt = *expiresAt
+	}
+
+	if maxClicks < 0 {
+		return opts, fmt.Errorf("%w: number of redirects must be positive", dto.ErrInvalidExpiry)
+	}
+	opts.MaxClicks = maxClicks
+
+	if len(password) > maxPasswordLength {
+		return opts, fmt.Errorf("%w: password must be shorter than %d bytes", dto.ErrInvalidPassword, maxPasswordLength)
+	}
+	if password != "" {
+		hash, err := hashPassword(password)
+		if err != nil {
+			return opts, err
+		}
+		opts.PasswordHash = hash
+	}
+	return opts, nil
+}
+
+// errNoFreeCode reports that all attempts to make short code were taken.
+func errNoFreeCode() error {
+	return fmt.Errorf("all %d attempts to make short URL are taken: %w", maxAttempts, dto.ErrCodeTaken)
+}
@@ -0,0 +1,65 @@
+// Package service implements the business logic of the application.
+package service
+
+import (
+	"context"
+	"github.com/zhel1/yandex-practicum-go/internal/storage"
+	"log"
+	"time"
+)
+
+// Sweeper periodically purges links which expired long ago.
+// Recently expired links are kept, so their owners still see them and get 410 instead of 404.
+type Sweeper struct {
+	storage   storage.Storage
+	interval  time.Duration
+	retention time.Duration
+	shutdown  chan struct{}
+	done      chan struct{}
+}
+
+// NewSweeper creates Sweeper which purges links expired more than retention ago every interval.
+func NewSweeper(storage storage.Storage, interval, retention time.Duration) *Sweeper {
+	return &Sweeper{
+		storage:   storage,
+		interval:  interval,
+		retention: retention,
+		shutdown:  make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// Start runs sweeping in background.
+func (s *Sweeper) Start() {
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := s.Sweep(context.Background()); err != nil {
+					log.Printf("Sweeping of expired links: %v", err)
+				}
+			case <-s.shutdown:
+				return
+			}
+		}
+	}()
+}
+
+// Sweep purges links expired more than retention ago and returns their number.
+func (s *Sweeper) Sweep(ctx context.Context) (int, error) {
+	purged, err := s.storage.Purge(ctx, time.Now().Add(-s.retention))
+	if len(purged) > 0 {
+		log.Printf("%d expired links are purged", len(purged))
+	}
+	return len(purged), err
+}
+
+// Stop waits for the current sweeping and stops Sweeper. It must be called after Start.
+func (s *Sweeper) Stop() {
+	close(s.shutdown)
+	<-s.done
+}
@@ -3,9 +3,13 @@ package service
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
 	"github.com/zhel1/yandex-practicum-go/internal/auth"
 	"github.com/zhel1/yandex-practicum-go/internal/dto"
 	"github.com/zhel1/yandex-practicum-go/internal/storage"
+	"net/url"
 	"time"
 )
 
@@ -14,23 +18,39 @@ var (
 	_ User = (*UserService)(nil)
 )
 
+// Default lifetimes of tokens of users.
+const (
+	DefaultAccessTokenTTL  = 15 * time.Minute
+	DefaultRefreshTokenTTL = 30 * 24 * time.Hour
+)
+
+// refreshReuseGrace is the period after rotation of the refresh token when it is accepted again without rotation.
+// Concurrent requests of one client carry the same token, so only one of them rotates it.
+var refreshReuseGrace = 10 * time.Second
+
 type UserService struct {
 	storage      storage.Storage
 	baseURL      string
 	tokenManager auth.TokenManager
+	accessTTL    time.Duration
+	refreshTTL   time.Duration
+	attempts     *attemptLimiter // attempts to enter passwords of links
 }
 
-func NewUserService(storage storage.Storage, baseURL string, tokenManager auth.TokenManager) *UserService {
+func NewUserService(storage storage.Storage, baseURL string, tokenManager auth.TokenManager, accessTTL, refreshTTL time.Duration) *UserService {
 	return &UserService{
 		storage:      storage,
 		baseURL:      baseURL,
 		tokenManager: tokenManager,
+		accessTTL:    accessTTL,
+		refreshTTL:   refreshTTL,
+		attempts:     newAttemptLimiter(maxPasswordAttempts, passwordAttemptsWindow),
 	}
 }
 
+// CreateNewToken issues the access token of the user which expires after the access TTL.
 func (s *UserService) CreateNewToken(ctx context.Context, userID string) (string, error) {
-	var expiredAt time.Duration = 1<<63 - 1 //forever
-	token, err := s.tokenManager.NewJWT(userID, expiredAt)
+	token, err := s.tokenManager.NewJWT(userID, s.accessTTL)
 	if err != nil {
 		return "", err
 	}
@@ -38,34 +58,159 @@ func (s *UserService) CreateNewToken(ctx context.Context, userID string) (string
 	return token, nil
 }
 
-func (s *UserService) CheckToken(ctx context.Context, token string) (string, error) {
-	userID, err := s.tokenManager.Parse(token)
+// CreateSession issues the access token and the refresh token of the new family to the user.
+func (s *UserService) CreateSession(ctx context.Context, userID string) (dto.ModelSession, error) {
+	refreshToken, err := s.tokenManager.NewRefreshToken()
 	if err != nil {
-		return "", err
+		return dto.ModelSession{}, err
 	}
-	return userID, nil
+
+	token := storage.RefreshToken{
+		Hash:      auth.HashToken(refreshToken),
+		UserID:    userID,
+		Family:    uuid.New().String(),
+		ExpiresAt: time.Now().Add(s.refreshTTL),
+	}
+	if err = s.storage.SaveRefreshToken(ctx, token); err != nil {
+		return dto.ModelSession{}, err
+	}
+	return s.session(ctx, userID, refreshToken, token.ExpiresAt)
 }
 
-func (s *UserService) GetOriginalURLByShort(ctx context.Context, shortURL string) (string, error) {
-	return s.storage.Get(ctx, shortURL)
+// RefreshSession rotates the refresh token: it is exchanged for the new access token and the next refresh token
+// of its family. Reuse of the rotated token revokes the family, so the stolen token and all tokens issued after it
+// stop working, and dto.ErrTokenReused is returned. The token reused within refreshReuseGrace by concurrent requests
+// gets the access token only. Unknown and expired tokens are rejected with dto.ErrNotFound and dto.ErrExpired.
+func (s *UserService) RefreshSession(ctx context.Context, refreshToken string) (dto.ModelSession, error) {
+	nextToken, err := s.tokenManager.NewRefreshToken()
+	if err != nil {
+		return dto.ModelSession{}, err
+	}
+
+	now := time.Now()
+	next := storage.RefreshToken{Hash: auth.HashToken(nextToken), ExpiresAt: now.Add(s.refreshTTL)}
+	used, err := s.storage.RotateRefreshToken(ctx, auth.HashToken(refreshToken), next, now)
+	switch {
+	case errors.Is(err, dto.ErrTokenUsed) && used.UsedAt != nil && now.Sub(*used.UsedAt) < refreshReuseGrace:
+		return s.session(ctx, used.UserID, "", time.Time{})
+	case errors.Is(err, dto.ErrTokenUsed):
+		if err = s.storage.RevokeTokenFamily(ctx, used.Family); err != nil {
+			return dto.ModelSession{}, err
+		}
+		return dto.ModelSession{}, dto.ErrTokenReused
+	case err != nil:
+		return dto.ModelSession{}, err
+	}
+	return s.session(ctx, used.UserID, nextToken, next.ExpiresAt)
 }
 
-func (s *UserService) GetURLsByUserID(ctx context.Context, UserID string) ([]dto.ModelURL, error) {
-	links, err := s.storage.GetUserLinks(ctx, UserID)
+// session issues the access token of the session with the refresh token.
+func (s *UserService) session(ctx context.Context, userID, refreshToken string, refreshExpiresAt time.Time) (dto.ModelSession, error) {
+	accessToken, err := s.CreateNewToken(ctx, userID)
 	if err != nil {
-		return nil, err
+		return dto.ModelSession{}, err
 	}
+	return dto.ModelSession{
+		UserID:           userID,
+		AccessToken:      accessToken,
+		RefreshToken:     refreshToken,
+		RefreshExpiresAt: refreshExpiresAt,
+	}, nil
+}
 
-	responseURLs := make([]dto.ModelURL, 0, len(links))
-	for short, orign := range links {
-		responseURL := dto.ModelURL{
-			OriginalURL: orign,
-			ShortURL:    s.baseURL + short,
+// CheckToken returns the user of the access token. The token signed by the key which is not active anymore
+// is re-issued under the active key, so the old key can be retired; renewed is empty otherwise.
+func (s *UserService) CheckToken(ctx context.Context, token string) (userID, renewed string, err error) {
+	userID, active, err := s.tokenManager.Parse(token)
+	if err != nil {
+		return "", "", err
+	}
+	if !active {
+		if renewed, err = s.CreateNewToken(ctx, userID); err != nil {
+			return "", "", err
 		}
-		responseURLs = append(responseURLs, responseURL)
+	}
+	return userID, renewed, nil
+}
+
+// GetOriginalURLByShort resolves short URL for redirect, the redirect is counted by the storage.
+// It returns dto.ErrExpired if the link is expired by time or by the number of redirects.
+// Links protected by password are resolved only with the right password,
+// otherwise dto.ErrPasswordRequired, dto.ErrWrongPassword or dto.ErrTooManyAttempts is returned.
+func (s *UserService) GetOriginalURLByShort(ctx context.Context, shortURL, password string) (string, error) {
+	link, err := s.storage.GetLink(ctx, shortURL)
+	if err != nil {
+		return "", err
+	}
+
+	if link.Expired(time.Now()) {
+		return "", dto.ErrExpired
+	}
+
+	if link.Options.PasswordHash != "" {
+		if err = s.unlock(shortURL, link.Options.PasswordHash, password); err != nil {
+			return "", err
+		}
+	}
+
+	// only redirects by links with limited number of them are counted
+	if link.Options.MaxClicks == 0 {
+		return link.OriginURL, nil
+	}
+	return s.storage.Visit(ctx, shortURL)
+}
+
+// unlock checks the password of the link. Wrong attempts are throttled per link.
+func (s *UserService) unlock(shortURL, hash, password string) error {
+	if password == "" {
+		return dto.ErrPasswordRequired
+	}
+
+	if !s.attempts.take(shortURL, time.Now()) {
+		return dto.ErrTooManyAttempts
+	}
+
+	ok, err := checkPassword(hash, password)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return dto.ErrWrongPassword
+	}
+
+	s.attempts.reset(shortURL)
+	return nil
+}
+
+// GetURLsByUserID returns the page of links of the user.
+func (s *UserService) GetURLsByUserID(ctx context.Context, UserID string, query dto.ModelLinksQuery) (dto.ModelURLPage, error) {
+	linksQuery, err := parseLinksQuery(query)
+	if err != nil {
+		return dto.ModelURLPage{}, err
+	}
+
+	page, err := s.storage.ListUserLinks(ctx, UserID, linksQuery)
+	if err != nil {
+		return dto.ModelURLPage{}, err
+	}
+
+	responseURLs := make([]dto.ModelURL, 0, len(page.Links))
+	for _, link := range page.Links {
+		responseURLs = append(responseURLs, dto.ModelURL{
+			OriginalURL: link.OriginURL,
+			ShortURL:    s.baseURL + link.ShortURL,
+			IsDeleted:   link.IsDeleted,
+		})
 	}
 
-	return responseURLs, nil
+	response := dto.ModelURLPage{URLs: responseURLs}
+	if page.Next != nil {
+		response.NextCursor, err = encodeCursor(query.Sort, *page.Next)
+		if err != nil {
+			return dto.ModelURLPage{}, err
+		}
+	}
+	return response, nil
 }
 
 func (s *UserService) DeleteBatchURL(ctx context.Context, userID string, shortURLs []string) error {
@@ -73,6 +218,60 @@ func (s *UserService) DeleteBatchURL(ctx context.Context, userID string, shortUR
 	return s.storage.Delete(ctx, shortURLs, userID)
 }
 
+// EditURL changes the original URL of short URL owned only by the user.
+func (s *UserService) EditURL(ctx context.Context, userID, shortURL, originURL string) (dto.ModelURL, error) {
+	if _, err := url.ParseRequestURI(originURL); err != nil {
+		return dto.ModelURL{}, err
+	}
+
+	if _, err := s.storage.Edit(ctx, userID, shortURL, originURL, time.Now()); err != nil {
+		return dto.ModelURL{}, err
+	}
+
+	return dto.ModelURL{
+		ShortURL:    s.baseURL + shortURL,
+		OriginalURL: originURL,
+	}, nil
+}
+
+// GetURLHistory returns changes of the original URL of short URL owned by the user in order they were made.
+func (s *UserService) GetURLHistory(ctx context.Context, userID, shortURL string) ([]dto.ModelRevision, error) {
+	history, err := s.storage.GetHistory(ctx, userID, shortURL)
+	if err != nil {
+		return nil, err
+	}
+
+	revisions := make([]dto.ModelRevision, 0, len(history))
+	for _, rev := range history {
+		revisions = append(revisions, dto.ModelRevision{
+			Revision:  rev.Number,
+			UserID:    rev.UserID,
+			ChangedAt: rev.ChangedAt,
+			OldURL:    rev.OldURL,
+			NewURL:    rev.NewURL,
+		})
+	}
+	return revisions, nil
+}
+
+// RollbackURL restores the original URL which short URL had before the revision, the last revision if it is zero.
+// Rollback is recorded as a new revision, so it can be rolled back too.
+func (s *UserService) RollbackURL(ctx context.Context, userID, shortURL string, revision int) (dto.ModelURL, error) {
+	history, err := s.storage.GetHistory(ctx, userID, shortURL)
+	if err != nil {
+		return dto.ModelURL{}, err
+	}
+
+	if revision == 0 {
+		revision = len(history)
+	}
+	if revision < 1 || revision > len(history) {
+		return dto.ModelURL{}, fmt.Errorf("revision %d: %w", revision, dto.ErrNotFound)
+	}
+
+	return s.EditURL(ctx, userID, shortURL, history[revision-1].OldURL)
+}
+
 func (s *UserService) Ping(ctx context.Context) error {
 	pinger, valid := s.storage.(storage.Pinger)
 	if valid {
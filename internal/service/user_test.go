@@ -0,0 +1,151 @@
+// Package service implements the business logic of the application.
+package service
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhel1/yandex-practicum-go/internal/auth"
+	"github.com/zhel1/yandex-practicum-go/internal/dto"
+	"github.com/zhel1/yandex-practicum-go/internal/storage/inmemory"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newSessionUsers creates UserService with tokens signed by the test key.
+func newSessionUsers(t *testing.T, accessTTL, refreshTTL time.Duration) *UserService {
+	tokenManager, err := auth.NewManager("PaSsW0rD")
+	require.NoError(t, err)
+	return NewUserService(inmemory.NewStorage(), "http://localhost:8080/", tokenManager, accessTTL, refreshTTL)
+}
+
+func TestCreateSession(t *testing.T) {
+	ctx := context.Background()
+	users := newSessionUsers(t, DefaultAccessTokenTTL, DefaultRefreshTokenTTL)
+
+	session, err := users.CreateSession(ctx, "user1")
+	require.NoError(t, err)
+	assert.Equal(t, "user1", session.UserID)
+	assert.NotEmpty(t, session.RefreshToken)
+	assert.WithinDuration(t, time.Now().Add(DefaultRefreshTokenTTL), session.RefreshExpiresAt, time.Minute)
+	userID, _, err := users.CheckToken(ctx, session.AccessToken)
+	require.NoError(t, err)
+	assert.Equal(t, "user1", userID)
+
+	other, err := users.CreateSession(ctx, "user1")
+	require.NoError(t, err)
+	assert.NotEqual(t, session.RefreshToken, other.RefreshToken)
+
+	// access tokens expire
+	users = newSessionUsers(t, -time.Second, DefaultRefreshTokenTTL)
+	session, err = users.CreateSession(ctx, "user1")
+	require.NoError(t, err)
+	_, _, err = users.CheckToken(ctx, session.AccessToken)
+	assert.Error(t, err)
+}
+
+func TestRefreshSession(t *testing.T) {
+	ctx := context.Background()
+	users := newSessionUsers(t, DefaultAccessTokenTTL, DefaultRefreshTokenTTL)
+	first, err := users.CreateSession(ctx, "user1")
+	require.NoError(t, err)
+
+	// every refresh rotates the token
+	second, err := users.RefreshSession(ctx, first.RefreshToken)
+	require.NoError(t, err)
+	assert.Equal(t, "user1", second.UserID)
+	assert.NotEmpty(t, second.RefreshToken)
+	assert.NotEqual(t, first.RefreshToken, second.RefreshToken)
+	userID, _, err := users.CheckToken(ctx, second.AccessToken)
+	require.NoError(t, err)
+	assert.Equal(t, "user1", userID)
+
+	// concurrent requests with the rotated token get the access token only
+	concurrent, err := users.RefreshSession(ctx, first.RefreshToken)
+	require.NoError(t, err)
+	assert.Equal(t, "user1", concurrent.UserID)
+	assert.NotEmpty(t, concurrent.AccessToken)
+	assert.Empty(t, concurrent.RefreshToken)
+
+	third, err := users.RefreshSession(ctx, second.RefreshToken)
+	require.NoError(t, err)
+	assert.NotEqual(t, second.RefreshToken, third.RefreshToken)
+
+	_, err = users.RefreshSession(ctx, "unknown")
+	assert.ErrorIs(t, err, dto.ErrNotFound)
+}
+
+func TestRefreshSessionReuse(t *testing.T) {
+	defer func(grace time.Duration) { refreshReuseGrace = grace }(refreshReuseGrace)
+	refreshReuseGrace = 0
+
+	ctx := context.Background()
+	users := newSessionUsers(t, DefaultAccessTokenTTL, DefaultRefreshTokenTTL)
+	stolen, err := users.CreateSession(ctx, "user1")
+	require.NoError(t, err)
+	other, err := users.CreateSession(ctx, "user1")
+	require.NoError(t, err)
+	legit, err := users.RefreshSession(ctx, stolen.RefreshToken)
+	require.NoError(t, err)
+
+	// reuse of the rotated token revokes tokens issued after it
+	_, err = users.RefreshSession(ctx, stolen.RefreshToken)
+	assert.ErrorIs(t, err, dto.ErrTokenReused)
+	_, err = users.RefreshSession(ctx, legit.RefreshToken)
+	assert.ErrorIs(t, err, dto.ErrNotFound)
+
+	// other sessions of the user are not affected
+	_, err = users.RefreshSession(ctx, other.RefreshToken)
+	assert.NoError(t, err)
+}
+
+func TestRefreshSessionExpired(t *testing.T) {
+	ctx := context.Background()
+	users := newSessionUsers(t, DefaultAccessTokenTTL, -time.Second)
+	session, err := users.CreateSession(ctx, "user1")
+	require.NoError(t, err)
+
+	_, err = users.RefreshSession(ctx, session.RefreshToken)
+	assert.ErrorIs(t, err, dto.ErrExpired)
+}
+
+func TestCheckTokenKeyRotation(t *testing.T) {
+	ctx := context.Background()
+	keyFile := filepath.Join(t.TempDir(), "keys.json")
+	writeKeys := func(keys string) {
+		require.NoError(t, os.WriteFile(keyFile, []byte(keys), 0600))
+	}
+	writeKeys(`{"active":"k1","keys":[{"id":"k1","secret":"secret1"}]}`)
+	tokenManager, err := auth.LoadManager(keyFile)
+	require.NoError(t, err)
+	users := NewUserService(inmemory.NewStorage(), "http://localhost:8080/", tokenManager, DefaultAccessTokenTTL, DefaultRefreshTokenTTL)
+
+	token, err := users.CreateNewToken(ctx, "user1")
+	require.NoError(t, err)
+	userID, renewed, err := users.CheckToken(ctx, token)
+	require.NoError(t, err)
+	assert.Equal(t, "user1", userID)
+	assert.Empty(t, renewed, "tokens of the active key are not re-issued")
+
+	// the token of the old key is re-issued under the new one
+	writeKeys(`{"active":"k2","keys":[{"id":"k1","secret":"secret1"},{"id":"k2","secret":"secret2"}]}`)
+	require.NoError(t, tokenManager.Reload())
+	userID, renewed, err = users.CheckToken(ctx, token)
+	require.NoError(t, err)
+	assert.Equal(t, "user1", userID)
+	require.NotEmpty(t, renewed)
+	userID, renewedAgain, err := users.CheckToken(ctx, renewed)
+	require.NoError(t, err)
+	assert.Equal(t, "user1", userID)
+	assert.Empty(t, renewedAgain)
+
+	// tokens of the retired key are rejected
+	writeKeys(`{"active":"k2","keys":[{"id":"k2","secret":"secret2"}]}`)
+	require.NoError(t, tokenManager.Reload())
+	_, _, err = users.CheckToken(ctx, token)
+	assert.Error(t, err)
+	_, _, err = users.CheckToken(ctx, renewed)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,101 @@
+// Package cached implements read-through cache decorator for storage.
+package cached
+
+import (
+	"container/list"
+	"github.com/zhel1/yandex-practicum-go/internal/storage"
+	"sync"
+	"time"
+)
+
+// entry is a cached result of GetLink.
+type entry struct {
+	key       string
+	link      storage.Link
+	err       error
+	expiresAt time.Time
+}
+
+// lru is a bounded cache which evicts the least recently used entries.
+type lru struct {
+	mu    sync.Mutex
+	size  int
+	ttl   time.Duration
+	order *list.List               // front is the most recently used
+	items map[string]*list.Element // key -> element of order
+	epoch uint64                   // it is incremented on every invalidation
+}
+
+// newLRU creates cache with at most size entries living ttl.
+func newLRU(size int, ttl time.Duration) *lru {
+	return &lru{
+		size:  size,
+		ttl:   ttl,
+		order: list.New(),
+		items: make(map[string]*list.Element, size),
+	}
+}
+
+// get returns cached result if it is present and not expired.
+func (c *lru) get(key string) (entry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return entry{}, false
+	}
+
+	e := el.Value.(*entry)
+	if c.ttl > 0 && time.Now().After(e.expiresAt) {
+		c.remove(el)
+		return entry{}, false
+	}
+	c.order.MoveToFront(el)
+	return *e, true
+}
+
+// currentEpoch returns the number of invalidations. It is taken before loading the value from storage.
+func (c *lru) currentEpoch() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.epoch
+}
+
+// add saves result loaded from storage unless the cache was invalidated during loading.
+func (c *lru) add(key string, link storage.Link, err error, epoch uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if epoch != c.epoch {
+		return
+	}
+
+	e := &entry{key: key, link: link, err: err, expiresAt: time.Now().Add(c.ttl)}
+	if el, ok := c.items[key]; ok {
+		el.Value = e
+		c.order.MoveToFront(el)
+		return
+	}
+
+	c.items[key] = c.order.PushFront(e)
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+}
+
+// invalidate removes keys from cache.
+func (c *lru) invalidate(keys ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.epoch++
+	for _, key := range keys {
+		if el, ok := c.items[key]; ok {
+			c.remove(el)
+		}
+	}
+}
+
+// remove deletes element. It must be called under the lock.
+func (c *lru) remove(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.items, el.Value.(*entry).key)
+}
@@ -0,0 +1,226 @@
+// Package cached implements read-through cache decorator for storage.
+package cached
+
+import (
+	"context"
+	"errors"
+	"github.com/zhel1/yandex-practicum-go/internal/dto"
+	"github.com/zhel1/yandex-practicum-go/internal/storage"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// Check interface implementation.
+var (
+	_ storage.Storage = (*Storage)(nil)
+	_ storage.Pinger  = (*Storage)(nil)
+)
+
+// Stats contains counters of cache usage.
+type Stats struct {
+	Hits   int64
+	Misses int64
+}
+
+// Storage wraps any storage and caches links in LRU cache.
+// Missing short URLs are cached too. Concurrent misses on the same short URL are collapsed into one request to storage.
+// Links with limited number of redirects are always resolved by storage, because it counts them.
+type Storage struct {
+	storage storage.Storage
+	cache   *lru
+	group   singleflight.Group
+	hits    int64
+	misses  int64
+}
+
+// NewStorage creates cache of size entries living ttl over st.
+// Links deleted by st asynchronously are invalidated again when they are actually deleted.
+func NewStorage(st storage.Storage, size int, ttl time.Duration) *Storage {
+	s := &Storage{
+		storage: st,
+		cache:   newLRU(size, ttl),
+	}
+	if notifier, ok := st.(storage.DeleteNotifier); ok {
+		notifier.OnDelete(func(shortURLs []string) {
+			s.cache.invalidate(shortURLs...)
+		})
+	}
+	return s
+}
+
+// Get gets base URL from cache or from storage.
+func (s *Storage) Get(ctx context.Context, shortURL string) (string, error) {
+	e := s.lookup(ctx, shortURL)
+	if e.err == nil && e.link.Options.MaxClicks > 0 {
+		return s.storage.Get(ctx, shortURL)
+	}
+	return resolve(e)
+}
+
+// GetLink gets base URL with its restrictions from cache or from storage.
+func (s *Storage) GetLink(ctx context.Context, shortURL string) (storage.Link, error) {
+	e := s.lookup(ctx, shortURL)
+	if e.err == nil && e.link.Options.MaxClicks > 0 {
+		return s.storage.GetLink(ctx, shortURL)
+	}
+	return e.link, e.err
+}
+
+// Visit gets base URL for redirect from cache or from storage.
+func (s *Storage) Visit(ctx context.Context, shortURL string) (string, error) {
+	e := s.lookup(ctx, shortURL)
+	if e.err == nil && e.link.Options.MaxClicks > 0 {
+		return s.storage.Visit(ctx, shortURL)
+	}
+	return resolve(e)
+}
+
+// GetUserLinks returns all URLs by UserID from storage.
+func (s *Storage) GetUserLinks(ctx context.Context, userID string) (map[string]string, error) {
+	return s.storage.GetUserLinks(ctx, userID)
+}
+
+// FindUserLink returns short URL of the user to the original URL from storage.
+func (s *Storage) FindUserLink(ctx context.Context, userID, originURL string) (string, error) {
+	return s.storage.FindUserLink(ctx, userID, originURL)
+}
+
+// ListUserLinks returns the page of links of the user from storage.
+func (s *Storage) ListUserLinks(ctx context.Context, userID string, query storage.LinksQuery) (storage.LinksPage, error) {
+	return s.storage.ListUserLinks(ctx, userID, query)
+}
+
+// Put saves short URL in storage and invalidates it in cache.
+func (s *Storage) Put(ctx context.Context, userID, shortURL, originURL string, opts storage.LinkOptions) error {
+	defer s.cache.invalidate(shortURL)
+	return s.storage.Put(ctx, userID, shortURL, originURL, opts)
+}
+
+// PutBatch saves short URLs in storage and invalidates them in cache.
+func (s *Storage) PutBatch(ctx context.Context, userID string, batchForDB map[string]string, opts map[string]storage.LinkOptions) error {
+	shortURLs := make([]string, 0, len(batchForDB))
+	for _, shortURL := range batchForDB {
+		shortURLs = append(shortURLs, shortURL)
+	}
+	defer s.cache.invalidate(shortURLs...)
+	return s.storage.PutBatch(ctx, userID, batchForDB, opts)
+}
+
+// Delete marks short URLs of the user as deleted and invalidates them in cache.
+// Links read before asynchronous storages delete them are invalidated again by storage.DeleteNotifier.
+func (s *Storage) Delete(ctx context.Context, shortURLs []string, userID string) error {
+	defer s.cache.invalidate(shortURLs...)
+	return s.storage.Delete(ctx, shortURLs, userID)
+}
+
+// Edit changes the original URL in storage and invalidates it in cache.
+func (s *Storage) Edit(ctx context.Context, userID, shortURL, originURL string, at time.Time) (storage.Revision, error) {
+	defer s.cache.invalidate(shortURL)
+	return s.storage.Edit(ctx, userID, shortURL, originURL, at)
+}
+
+// GetHistory returns revisions of short URL from storage.
+func (s *Storage) GetHistory(ctx context.Context, userID, shortURL string) ([]storage.Revision, error) {
+	return s.storage.GetHistory(ctx, userID, shortURL)
+}
+
+// Purge removes expired links from storage and from cache.
+func (s *Storage) Purge(ctx context.Context, expiredBefore time.Time) ([]string, error) {
+	purged, err := s.storage.Purge(ctx, expiredBefore)
+	s.cache.invalidate(purged...)
+	return purged, err
+}
+
+// SaveClicks saves clicks in storage.
+func (s *Storage) SaveClicks(ctx context.Context, clicks []storage.Click) error {
+	return s.storage.SaveClicks(ctx, clicks)
+}
+
+// GetClicks returns clicks of the link from storage.
+func (s *Storage) GetClicks(ctx context.Context, shortURL string, from, to time.Time) ([]storage.Click, error) {
+	return s.storage.GetClicks(ctx, shortURL, from, to)
+}
+
+// GetLinkStats returns statistics of clicks of the link from storage.
+func (s *Storage) GetLinkStats(ctx context.Context, userID, shortURL string, query storage.StatsQuery) (storage.LinkStats, error) {
+	return s.storage.GetLinkStats(ctx, userID, shortURL, query)
+}
+
+// Export calls fn for every link of every user in storage.
+func (s *Storage) Export(ctx context.Context, fn func(record storage.LinkRecord) error) error {
+	return s.storage.Export(ctx, fn)
+}
+
+// SaveRefreshToken stores the refresh token in storage.
+func (s *Storage) SaveRefreshToken(ctx context.Context, token storage.RefreshToken) error {
+	return s.storage.SaveRefreshToken(ctx, token)
+}
+
+// RotateRefreshToken rotates the refresh token in storage.
+func (s *Storage) RotateRefreshToken(ctx context.Context, hash string, next storage.RefreshToken, at time.Time) (storage.RefreshToken, error) {
+	return s.storage.RotateRefreshToken(ctx, hash, next, at)
+}
+
+// RevokeTokenFamily removes refresh tokens of the family from storage.
+func (s *Storage) RevokeTokenFamily(ctx context.Context, family string) error {
+	return s.storage.RevokeTokenFamily(ctx, family)
+}
+
+// GetCounts returns numbers of short URLs and users from storage.
+func (s *Storage) GetCounts(ctx context.Context) (storage.Counts, error) {
+	return s.storage.GetCounts(ctx)
+}
+
+// PingDB checks connection to DB if the storage supports it.
+func (s *Storage) PingDB() error {
+	pinger, valid := s.storage.(storage.Pinger)
+	if !valid {
+		return errors.New("storage doesn't implement interface Pinger")
+	}
+	return pinger.PingDB()
+}
+
+// Stats returns counters of cache usage.
+func (s *Storage) Stats() Stats {
+	return Stats{
+		Hits:   atomic.LoadInt64(&s.hits),
+		Misses: atomic.LoadInt64(&s.misses),
+	}
+}
+
+// Close closes storage.
+func (s *Storage) Close() error {
+	return s.storage.Close()
+}
+
+// lookup returns cached link or loads it from storage.
+func (s *Storage) lookup(ctx context.Context, shortURL string) entry {
+	if e, ok := s.cache.get(shortURL); ok {
+		atomic.AddInt64(&s.hits, 1)
+		return e
+	}
+	atomic.AddInt64(&s.misses, 1)
+
+	res, _, _ := s.group.Do(shortURL, func() (interface{}, error) {
+		epoch := s.cache.currentEpoch()
+		link, err := s.storage.GetLink(ctx, shortURL)
+		if err == nil || errors.Is(err, dto.ErrNotFound) {
+			s.cache.add(shortURL, link, err, epoch)
+		}
+		return entry{key: shortURL, link: link, err: err}, nil
+	})
+	return res.(entry)
+}
+
+// resolve returns base URL of the link unless it is expired.
+func resolve(e entry) (string, error) {
+	if e.err != nil {
+		return "", e.err
+	}
+	if e.link.Expired(time.Now()) {
+		return "", dto.ErrExpired
+	}
+	return e.link.OriginURL, nil
+}
@@ -0,0 +1,184 @@
+// Package cached implements read-through cache decorator for storage.
+package cached
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhel1/yandex-practicum-go/internal/dto"
+	"github.com/zhel1/yandex-practicum-go/internal/storage"
+	"github.com/zhel1/yandex-practicum-go/internal/storage/inmemory"
+	"github.com/zhel1/yandex-practicum-go/internal/storage/storagetest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingStorage counts calls of GetLink and makes them slow.
+type countingStorage struct {
+	storage.Storage
+	gets  int64
+	delay time.Duration
+}
+
+func (s *countingStorage) GetLink(ctx context.Context, shortURL string) (storage.Link, error) {
+	atomic.AddInt64(&s.gets, 1)
+	time.Sleep(s.delay)
+	return s.Storage.GetLink(ctx, shortURL)
+}
+
+// asyncStorage deletes links after Delete returns, like storages which delete them in batches.
+// Links are deleted by flush or in background after delay if it is set.
+type asyncStorage struct {
+	storage.Storage
+	delay    time.Duration
+	mu       sync.Mutex
+	pending  map[string][]string // user ID -> short URLs
+	onDelete []func(shortURLs []string)
+	wg       sync.WaitGroup
+}
+
+func newAsyncStorage(delay time.Duration) *asyncStorage {
+	return &asyncStorage{Storage: inmemory.NewStorage(), delay: delay, pending: make(map[string][]string)}
+}
+
+func (s *asyncStorage) Delete(ctx context.Context, shortURLs []string, userID string) error {
+	s.mu.Lock()
+	s.pending[userID] = append(s.pending[userID], shortURLs...)
+	s.mu.Unlock()
+	if s.delay > 0 {
+		s.wg.Add(1)
+		time.AfterFunc(s.delay, func() {
+			defer s.wg.Done()
+			s.flush()
+		})
+	}
+	return nil
+}
+
+func (s *asyncStorage) OnDelete(fn func(shortURLs []string)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onDelete = append(s.onDelete, fn)
+}
+
+// flush deletes pending links and notifies about them.
+func (s *asyncStorage) flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for userID, shortURLs := range s.pending {
+		if err := s.Storage.Delete(context.Background(), shortURLs, userID); err != nil {
+			panic(err)
+		}
+		for _, fn := range s.onDelete {
+			fn(shortURLs)
+		}
+	}
+	s.pending = make(map[string][]string)
+}
+
+func (s *asyncStorage) Close() error {
+	s.wg.Wait()
+	return s.Storage.Close()
+}
+
+func TestStorage(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		return NewStorage(inmemory.NewStorage(), 100, time.Minute)
+	})
+}
+
+func TestStorageAsyncDelete(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		return NewStorage(newAsyncStorage(50*time.Millisecond), 100, time.Minute)
+	})
+}
+
+func TestCache(t *testing.T) {
+	ctx := context.Background()
+	inner := &countingStorage{Storage: inmemory.NewStorage()}
+	st := NewStorage(inner, 2, time.Minute)
+
+	// negative caching
+	_, err := st.Get(ctx, "1234567")
+	assert.ErrorIs(t, err, dto.ErrNotFound)
+	_, err = st.Get(ctx, "1234567")
+	assert.ErrorIs(t, err, dto.ErrNotFound)
+	assert.Equal(t, int64(1), atomic.LoadInt64(&inner.gets))
+
+	// invalidation on put
+	require.NoError(t, st.Put(ctx, "user1", "1234567", "https://yandex.ru/news/", storage.LinkOptions{}))
+	originURL, err := st.Get(ctx, "1234567")
+	require.NoError(t, err)
+	assert.Equal(t, "https://yandex.ru/news/", originURL)
+	assert.Equal(t, int64(2), atomic.LoadInt64(&inner.gets))
+
+	// invalidation on delete
+	require.NoError(t, st.Delete(ctx, []string{"1234567"}, "user1"))
+	_, err = st.Get(ctx, "1234567")
+	assert.ErrorIs(t, err, dto.ErrDeleted)
+
+	// eviction of the least recently used
+	require.NoError(t, st.Put(ctx, "user1", "1234568", "https://yandex.ru/sport/", storage.LinkOptions{}))
+	require.NoError(t, st.Put(ctx, "user1", "1234569", "https://yandex.ru/weather/", storage.LinkOptions{}))
+	st.Get(ctx, "1234568")
+	st.Get(ctx, "1234569")
+	st.Get(ctx, "1234568")
+	st.Get(ctx, "1234570")
+	gets := atomic.LoadInt64(&inner.gets)
+	st.Get(ctx, "1234569")
+	assert.Equal(t, gets+1, atomic.LoadInt64(&inner.gets))
+
+	assert.Equal(t, Stats{Hits: 2, Misses: 7}, st.Stats())
+}
+
+func TestCacheAsyncDelete(t *testing.T) {
+	ctx := context.Background()
+	inner := newAsyncStorage(0)
+	st := NewStorage(inner, 10, time.Minute)
+	require.NoError(t, st.Put(ctx, "user1", "1234567", "https://yandex.ru/news/", storage.LinkOptions{}))
+
+	// the link read before storage deletes it is invalidated when it is deleted
+	require.NoError(t, st.Delete(ctx, []string{"1234567"}, "user1"))
+	originURL, err := st.Get(ctx, "1234567")
+	require.NoError(t, err)
+	assert.Equal(t, "https://yandex.ru/news/", originURL)
+
+	inner.flush()
+	_, err = st.Get(ctx, "1234567")
+	assert.ErrorIs(t, err, dto.ErrDeleted)
+}
+
+func TestCacheTTL(t *testing.T) {
+	ctx := context.Background()
+	inner := &countingStorage{Storage: inmemory.NewStorage()}
+	st := NewStorage(inner, 10, 50*time.Millisecond)
+
+	st.Get(ctx, "1234567")
+	st.Get(ctx, "1234567")
+	time.Sleep(100 * time.Millisecond)
+	st.Get(ctx, "1234567")
+	assert.Equal(t, int64(2), atomic.LoadInt64(&inner.gets))
+}
+
+func TestCacheSingleflight(t *testing.T) {
+	ctx := context.Background()
+	inner := &countingStorage{Storage: inmemory.NewStorage(), delay: 100 * time.Millisecond}
+	require.NoError(t, inner.Put(ctx, "user1", "1234567", "https://yandex.ru/news/", storage.LinkOptions{}))
+	st := NewStorage(inner, 10, time.Minute)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			originURL, err := st.Get(ctx, "1234567")
+			assert.NoError(t, err)
+			assert.Equal(t, "https://yandex.ru/news/", originURL)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int64(1), atomic.LoadInt64(&inner.gets))
+}
@@ -10,7 +10,13 @@ type (
 		Err error
 	}
 	AlreadyExistsError struct {
-		Err error
+		Err  error
+		Keys []string // keys which already exist, if known
+	}
+	CodeTakenError struct {
+		Err      error
+		Keys     []string // short URLs which are taken by other URLs
+		Existing []string // short URLs of the same batch which already exist
 	}
 	StatementPSQLError struct {
 		Err error
@@ -28,6 +34,10 @@ func (e *AlreadyExistsError) Error() string {
 	return fmt.Sprintf("%s: already exists in storage\n", e.Err.Error())
 }
 
+func (e *CodeTakenError) Error() string {
+	return fmt.Sprintf("%s: short URL is taken in storage\n", e.Err.Error())
+}
+
 func (e *StatementPSQLError) Error() string {
 	return fmt.Sprintf("%s: could not compile statement\n", e.Err.Error())
 }
@@ -44,6 +54,10 @@ func (e *AlreadyExistsError) Unwrap() error {
 	return e.Err
 }
 
+func (e *CodeTakenError) Unwrap() error {
+	return e.Err
+}
+
 func (e *StatementPSQLError) Unwrap() error {
 	return e.Err
 }
@@ -0,0 +1,158 @@
+// Package infile implements storage in file.
+package infile
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// CompactionConfig contains settings of background compaction of the log.
+type CompactionConfig struct {
+	// Interval is period of compaction by timer. Zero disables the timer.
+	Interval time.Duration
+	// Ratio triggers compaction when the file has grown Ratio times since the last snapshot. Zero disables it.
+	Ratio float64
+	// MinSize is the file size below which compaction by ratio is not triggered.
+	MinSize int64
+}
+
+// DefaultCompactionConfig is used by NewStorage.
+var DefaultCompactionConfig = CompactionConfig{
+	Interval: 10 * time.Minute,
+	Ratio:    2,
+	MinSize:  1 << 20,
+}
+
+// Compact writes a snapshot of the current state to a temporary file and atomically replaces the log with it.
+// The state is serialized under the lock of writes, so every record is either in the snapshot or after it.
+// Records appended while the snapshot is being written are copied to the new file before the replacement,
+// so Put is blocked only for serialization and Get is not blocked at all.
+func (s *Storage) Compact(ctx context.Context) error {
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+
+	s.mu.Lock()
+	buf, err := snapshotRecord(s.cache)
+	s.compacting = err == nil
+	s.pending = nil
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	file, err := s.writeSnapshot(ctx, buf)
+	if err != nil {
+		s.mu.Lock()
+		s.compacting = false
+		s.pending = nil
+		s.mu.Unlock()
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.compacting = false
+
+	size, err := file.Seek(0, io.SeekEnd)
+	if err == nil {
+		for _, buf := range s.pending {
+			if _, err = file.Write(buf); err != nil {
+				break
+			}
+			size += int64(len(buf))
+		}
+	}
+	s.pending = nil
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), s.fileName)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	syncDir(s.fileName)
+
+	s.file.Close()
+	s.file = file
+	s.size = size
+	s.baseSize = size
+	return nil
+}
+
+// writeSnapshot writes magic and the encoded snapshot record in a temporary file.
+func (s *Storage) writeSnapshot(ctx context.Context, buf []byte) (*os.File, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(s.fileName+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = file.Write(append([]byte(logMagic), buf...)); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// compactor runs compaction by timer or by the signal of growth of the file.
+func (s *Storage) compactor() {
+	defer close(s.done)
+
+	var tick <-chan time.Time
+	if s.compaction.Interval > 0 {
+		t := time.NewTicker(s.compaction.Interval)
+		defer t.Stop()
+		tick = t.C
+	}
+
+	for {
+		select {
+		case <-s.shutdown:
+			return
+		case <-tick:
+			s.mu.Lock()
+			grown := s.size > s.baseSize
+			s.mu.Unlock()
+			if !grown {
+				continue
+			}
+		case <-s.trigger:
+		}
+
+		start := time.Now()
+		if err := s.Compact(context.Background()); err != nil {
+			log.Println("DB file compaction ERROR: ", err)
+			continue
+		}
+		log.Printf("DB file is compacted in %v", time.Since(start))
+	}
+}
+
+// needsCompaction checks if the file has grown enough for compaction by ratio. It must be called under s.mu.
+func (s *Storage) needsCompaction() bool {
+	if s.compacting || s.compaction.Ratio <= 0 || s.size < s.compaction.MinSize {
+		return false
+	}
+	return float64(s.size) >= float64(s.baseSize)*s.compaction.Ratio
+}
+
+// syncDir flushes the directory entry after rename.
+func syncDir(fileName string) {
+	dir, err := os.Open(filepath.Dir(fileName))
+	if err != nil {
+		return
+	}
+	defer dir.Close()
+	dir.Sync()
+}
@@ -0,0 +1,162 @@
+// Package infile implements storage in file.
+package infile
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhel1/yandex-practicum-go/internal/dto"
+	"github.com/zhel1/yandex-practicum-go/internal/storage"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// readOps returns operations of records of the log file.
+func readOps(t *testing.T, fileName string) []string {
+	file, err := os.Open(fileName)
+	require.NoError(t, err)
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	_, err = reader.Discard(len(logMagic))
+	require.NoError(t, err)
+	var ops []string
+	for {
+		rec, _, err := readRecord(reader)
+		if err == io.EOF {
+			return ops
+		}
+		require.NoError(t, err)
+		ops = append(ops, rec.Op)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	ctx := context.Background()
+	fileName := filepath.Join(t.TempDir(), "db")
+
+	st, err := NewStorage(fileName, CompactionConfig{})
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		require.NoError(t, st.Put(ctx, "user1", fmt.Sprintf("short%d", i), fmt.Sprintf("https://yandex.ru/%d", i), storage.LinkOptions{}))
+	}
+	require.NoError(t, st.Delete(ctx, []string{"short0"}, "user1"))
+	before, err := os.Stat(fileName)
+	require.NoError(t, err)
+
+	// the log is replaced by one snapshot and records after it are appended to it
+	require.NoError(t, st.(*Storage).Compact(ctx))
+	after, err := os.Stat(fileName)
+	require.NoError(t, err)
+	assert.Less(t, after.Size(), before.Size())
+	assert.Equal(t, []string{opSnapshot}, readOps(t, fileName))
+	require.NoError(t, st.Put(ctx, "user1", "short10", "https://yandex.ru/10", storage.LinkOptions{}))
+	assert.Equal(t, []string{opSnapshot, opPut}, readOps(t, fileName))
+	_, err = os.Stat(fileName + ".tmp")
+	assert.True(t, os.IsNotExist(err), "temporary file must be renamed")
+	require.NoError(t, st.Close())
+
+	st, err = NewStorage(fileName, CompactionConfig{})
+	require.NoError(t, err)
+	defer st.Close()
+	_, err = st.Get(ctx, "short0")
+	assert.ErrorIs(t, err, dto.ErrDeleted)
+	counts, err := st.GetCounts(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, storage.Counts{URLs: 11, Users: 1}, counts)
+}
+
+func TestCompactByRatio(t *testing.T) {
+	ctx := context.Background()
+	fileName := filepath.Join(t.TempDir(), "db")
+
+	st, err := NewStorage(fileName, CompactionConfig{Ratio: 2})
+	require.NoError(t, err)
+	defer st.Close()
+	require.NoError(t, st.Put(ctx, "user1", "1234567", "https://yandex.ru/", storage.LinkOptions{MaxClicks: 1000}))
+
+	// visits grow the log while the state stays small
+	for i := 0; i < 100; i++ {
+		_, err = st.Visit(ctx, "1234567")
+		require.NoError(t, err)
+	}
+	require.Eventually(t, func() bool {
+		ops := readOps(t, fileName)
+		return len(ops) > 0 && ops[0] == opSnapshot
+	}, time.Second, 10*time.Millisecond, "the grown log must be compacted")
+
+	link, err := st.GetLink(ctx, "1234567")
+	require.NoError(t, err)
+	assert.Equal(t, int64(100), link.Clicks)
+}
+
+func TestCompactConcurrentWrites(t *testing.T) {
+	ctx := context.Background()
+	fileName := filepath.Join(t.TempDir(), "db")
+	now := time.Now().UTC()
+	const writes = 200
+
+	st, err := NewStorage(fileName, CompactionConfig{})
+	require.NoError(t, err)
+	require.NoError(t, st.Put(ctx, "user1", "1234567", "https://yandex.ru/", storage.LinkOptions{MaxClicks: 10 * writes}))
+	require.NoError(t, st.SaveRefreshToken(ctx, storage.RefreshToken{Hash: "hash0", UserID: "user1", Family: "family1", ExpiresAt: now.Add(time.Hour)}))
+
+	var wg sync.WaitGroup
+	run := func(fn func(i int) error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				if err := fn(i); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	run(func(i int) error {
+		return st.Put(ctx, "user2", fmt.Sprintf("short%d", i), fmt.Sprintf("https://yandex.ru/%d", i), storage.LinkOptions{})
+	})
+	run(func(i int) error {
+		_, err := st.Visit(ctx, "1234567")
+		return err
+	})
+	run(func(i int) error {
+		return st.SaveClicks(ctx, []storage.Click{{ShortURL: "1234567", At: now}})
+	})
+	run(func(i int) error {
+		next := storage.RefreshToken{Hash: fmt.Sprintf("hash%d", i+1), ExpiresAt: now.Add(time.Hour)}
+		_, err := st.RotateRefreshToken(ctx, fmt.Sprintf("hash%d", i), next, now)
+		return err
+	})
+	run(func(i int) error {
+		return st.(*Storage).Compact(ctx)
+	})
+	wg.Wait()
+	require.NoError(t, st.Close())
+
+	// every write is applied exactly once after restart
+	st, err = NewStorage(fileName, CompactionConfig{})
+	require.NoError(t, err)
+	defer st.Close()
+
+	counts, err := st.GetCounts(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, storage.Counts{URLs: writes + 1, Users: 2}, counts)
+	link, err := st.GetLink(ctx, "1234567")
+	require.NoError(t, err)
+	assert.Equal(t, int64(writes), link.Clicks)
+	clicks, err := st.GetClicks(ctx, "1234567", now, now.Add(time.Second))
+	require.NoError(t, err)
+	assert.Len(t, clicks, writes)
+	_, err = st.RotateRefreshToken(ctx, fmt.Sprintf("hash%d", writes-1), storage.RefreshToken{Hash: "next"}, now)
+	assert.ErrorIs(t, err, dto.ErrTokenUsed)
+	_, err = st.RotateRefreshToken(ctx, fmt.Sprintf("hash%d", writes), storage.RefreshToken{Hash: "next", ExpiresAt: now.Add(time.Hour)}, now)
+	assert.NoError(t, err)
+}
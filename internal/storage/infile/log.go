@@ -0,0 +1,119 @@
+// Package infile implements storage in file.
+package infile
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/zhel1/yandex-practicum-go/internal/storage"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+// logMagic is written at the beginning of every log file.
+// It distinguishes the record log from the legacy single JSON document format.
+const logMagic = "SHRTLOG1"
+
+// recordHeaderSize is size of length prefix and checksum of one record.
+const recordHeaderSize = 8
+
+// maxRecordSize limits the size of one record to protect from reading garbage length.
+const maxRecordSize = 1 << 30
+
+// Operations stored in the log.
+const (
+	opPut      = "put"
+	opBatch    = "batch"
+	opDelete   = "delete"
+	opVisit    = "visit"
+	opEdit     = "edit"
+	opClicks   = "clicks"
+	opToken    = "token"
+	opRotate   = "rotate"
+	opRevoke   = "revoke"
+	opPurge    = "purge"
+	opSnapshot = "snapshot"
+)
+
+var (
+	errTornRecord    = errors.New("torn record")
+	errDamagedRecord = errors.New("damaged record")
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// record is one entry of the append-only log.
+type record struct {
+	Op           string                         `json:"op"`
+	UserID       string                         `json:"user_id,omitempty"`
+	ShortURL     string                         `json:"short_url,omitempty"`
+	OriginURL    string                         `json:"origin_url,omitempty"`
+	Options      *storage.LinkOptions           `json:"options,omitempty"`
+	Batch        map[string]string              `json:"batch,omitempty"`
+	BatchOptions map[string]storage.LinkOptions `json:"batch_options,omitempty"`
+	ShortURLs    []string                       `json:"short_urls,omitempty"`
+	At           *time.Time                     `json:"at,omitempty"`
+	Clicks       []storage.Click                `json:"clicks,omitempty"`
+	Token        *storage.RefreshToken          `json:"token,omitempty"`
+	Hash         string                         `json:"hash,omitempty"`
+	Family       string                         `json:"family,omitempty"`
+	Data         json.RawMessage                `json:"data,omitempty"`
+}
+
+// encodeRecord returns record in on-disk format: length, checksum, payload.
+func encodeRecord(r record) ([]byte, error) {
+	payload, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.Checksum(payload, crcTable))
+	copy(buf[recordHeaderSize:], payload)
+	return buf, nil
+}
+
+// readRecord reads one record from reader.
+// It returns io.EOF when there are no more records, errTornRecord when the record is incomplete
+// and errDamagedRecord when the checksum doesn't match.
+func readRecord(r io.Reader) (record, int64, error) {
+	var rec record
+
+	header := make([]byte, recordHeaderSize)
+	n, err := io.ReadFull(r, header)
+	switch {
+	case err == io.EOF:
+		return rec, 0, io.EOF
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return rec, int64(n), errTornRecord
+	case err != nil:
+		return rec, int64(n), err
+	}
+
+	size := binary.BigEndian.Uint32(header[0:4])
+	sum := binary.BigEndian.Uint32(header[4:8])
+	if size > maxRecordSize {
+		return rec, int64(n), errDamagedRecord
+	}
+
+	payload := make([]byte, size)
+	m, err := io.ReadFull(r, payload)
+	read := int64(n + m)
+	if err != nil {
+		if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+			return rec, read, errTornRecord
+		}
+		return rec, read, err
+	}
+
+	if crc32.Checksum(payload, crcTable) != sum {
+		return rec, read, errDamagedRecord
+	}
+
+	if err := json.Unmarshal(payload, &rec); err != nil {
+		return rec, read, errDamagedRecord
+	}
+	return rec, read, nil
+}
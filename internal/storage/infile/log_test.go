@@ -0,0 +1,52 @@
+// Package infile implements storage in file.
+package infile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"testing"
+)
+
+func TestRecord(t *testing.T) {
+	rec := record{Op: opPut, UserID: "user1", ShortURL: "1234567", OriginURL: "https://yandex.ru/"}
+	buf, err := encodeRecord(rec)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(len(buf)-recordHeaderSize), binary.BigEndian.Uint32(buf[0:4]))
+
+	// records follow each other and the end of the log is io.EOF
+	reader := bytes.NewReader(append(append([]byte(nil), buf...), buf...))
+	for i := 0; i < 2; i++ {
+		got, n, err := readRecord(reader)
+		require.NoError(t, err)
+		assert.Equal(t, rec, got)
+		assert.Equal(t, int64(len(buf)), n)
+	}
+	_, n, err := readRecord(reader)
+	assert.Equal(t, io.EOF, err)
+	assert.Zero(t, n)
+
+	damaged := append([]byte(nil), buf...)
+	damaged[len(damaged)-2] ^= 0xff
+	oversized := append([]byte(nil), buf...)
+	binary.BigEndian.PutUint32(oversized[0:4], maxRecordSize+1)
+
+	tests := []struct {
+		name     string
+		data     []byte
+		wantErr  error
+		wantRead int64
+	}{
+		{name: "checksum mismatch", data: damaged, wantErr: errDamagedRecord, wantRead: int64(len(buf))},
+		{name: "garbage length", data: oversized, wantErr: errDamagedRecord, wantRead: recordHeaderSize},
+		{name: "torn header", data: buf[:recordHeaderSize-3], wantErr: errTornRecord, wantRead: recordHeaderSize - 3},
+		{name: "torn payload", data: buf[:len(buf)-1], wantErr: errTornRecord, wantRead: int64(len(buf) - 1)},
+	}
+	for _, tt := range tests {
+		_, n, err := readRecord(bytes.NewReader(tt.data))
+		assert.ErrorIs(t, err, tt.wantErr, tt.name)
+		assert.Equal(t, tt.wantRead, n, tt.name)
+	}
+}
@@ -2,12 +2,19 @@
 package infile
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/zhel1/yandex-practicum-go/internal/dto"
 	"github.com/zhel1/yandex-practicum-go/internal/storage"
 	"github.com/zhel1/yandex-practicum-go/internal/storage/inmemory"
+	"io"
 	"log"
 	"os"
+	"sync"
+	"time"
 )
 
 //Check interface implementation
@@ -15,35 +22,57 @@ var (
 	_ storage.Storage = (*Storage)(nil)
 )
 
-// Storage is DB in file struct
+// Storage is DB in file struct.
+// All changes are appended to the file as records, the file is replayed into the cache on start.
+// The file is periodically compacted into a snapshot of the cache.
 type Storage struct {
-	file    *os.File
-	cache   storage.Storage
-	encoder *json.Encoder
+	fileName   string
+	cache      *inmemory.Storage
+	compaction CompactionConfig
+
+	mu         sync.Mutex // protects fields below
+	file       *os.File
+	size       int64    // current size of the file
+	baseSize   int64    // size of the file after the last compaction
+	compacting bool     // true while the snapshot is being written
+	pending    [][]byte // records appended during compaction
+	broken     error    // set if the failed write can't be removed from the file
+
+	compactMu sync.Mutex // only one compaction at a time
+	trigger   chan struct{}
+	shutdown  chan struct{}
+	done      chan struct{}
 }
 
 // NewStorage is DB constructor
-func NewStorage(fileName string) (storage.Storage, error) {
-	file, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE, 0755)
+func NewStorage(fileName string, compaction CompactionConfig) (storage.Storage, error) {
+	data := inmemory.NewStorage().(*inmemory.Storage)
+
+	file, err := openLog(fileName, data)
 	if err != nil {
 		return nil, err
 	}
 
-	data := inmemory.NewStorage()
+	size, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
 
-	if stat, _ := file.Stat(); stat.Size() != 0 {
-		decoder := json.NewDecoder(file)
-		if err := decoder.Decode(&data); err != nil {
-			log.Fatal("DB file is damaged.")
-			return nil, err
-		}
+	s := &Storage{
+		fileName:   fileName,
+		cache:      data,
+		compaction: compaction,
+		file:       file,
+		size:       size,
+		baseSize:   size,
+		trigger:    make(chan struct{}, 1),
+		shutdown:   make(chan struct{}),
+		done:       make(chan struct{}),
 	}
+	go s.compactor()
 
-	return &Storage{
-		file:    file,
-		cache:   data,
-		encoder: json.NewEncoder(file),
-	}, nil
+	return s, nil
 }
 
 // Get gets base URL from DB
@@ -51,40 +80,425 @@ func (s *Storage) Get(ctx context.Context, shortURL string) (string, error) {
 	return s.cache.Get(ctx, shortURL)
 }
 
+// GetLink gets base URL with its restrictions from DB
+func (s *Storage) GetLink(ctx context.Context, shortURL string) (storage.Link, error) {
+	return s.cache.GetLink(ctx, shortURL)
+}
+
+// Visit gets base URL from DB for redirect
+// Only redirects by links with limited number of them are written to the file, with their time,
+// so the link reaching the limit expires at the same time after replay
+func (s *Storage) Visit(ctx context.Context, shortURL string) (string, error) {
+	link, err := s.cache.GetLink(ctx, shortURL)
+	if err != nil || link.Options.MaxClicks == 0 {
+		return s.cache.Visit(ctx, shortURL)
+	}
+
+	at := time.Now()
+	var originURL string
+	err = s.write(record{Op: opVisit, ShortURL: shortURL, At: &at}, func() (bool, error) {
+		originURL, err = s.cache.VisitAt(ctx, shortURL, at)
+		return err == nil, err
+	})
+	return originURL, err
+}
+
 // GetUserLinks gets all URLs by UserID from DB
 func (s *Storage) GetUserLinks(ctx context.Context, userID string) (map[string]string, error) {
 	return s.cache.GetUserLinks(ctx, userID)
 }
 
+// FindUserLink returns short URL of the user to the original URL from DB
+func (s *Storage) FindUserLink(ctx context.Context, userID, originURL string) (string, error) {
+	return s.cache.FindUserLink(ctx, userID, originURL)
+}
+
+// ListUserLinks returns the page of links of the user from DB
+func (s *Storage) ListUserLinks(ctx context.Context, userID string, query storage.LinksQuery) (storage.LinksPage, error) {
+	return s.cache.ListUserLinks(ctx, userID, query)
+}
+
 // Put sets short URL in DB
-func (s *Storage) Put(ctx context.Context, userID string, shortURL, originURL string) error {
-	if err := s.cache.Put(ctx, userID, shortURL, originURL); err != nil {
-		return err
+func (s *Storage) Put(ctx context.Context, userID string, shortURL, originURL string, opts storage.LinkOptions) error {
+	rec := record{Op: opPut, UserID: userID, ShortURL: shortURL, OriginURL: originURL}
+	if opts != (storage.LinkOptions{}) {
+		rec.Options = &opts
 	}
+	return s.write(rec, func() (bool, error) {
+		err := s.cache.Put(ctx, userID, shortURL, originURL, opts)
+		return err == nil, err
+	})
+}
 
-	//rewrite all file
-	s.file.Truncate(0)
-	s.file.Seek(0, 0)
-	return s.encoder.Encode(&s.cache)
+// PutBatch sets short URLs in DB
+// New URLs are saved even if some of them already exist or their short URLs are taken, the rest are reported in error
+func (s *Storage) PutBatch(ctx context.Context, userID string, batchForDB map[string]string, opts map[string]storage.LinkOptions) error {
+	return s.write(record{Op: opBatch, UserID: userID, Batch: batchForDB, BatchOptions: opts}, func() (bool, error) {
+		err := s.cache.PutBatch(ctx, userID, batchForDB, opts)
+		return err == nil || errors.Is(err, dto.ErrAlreadyExists) || errors.Is(err, dto.ErrCodeTaken), err
+	})
 }
 
-func (s *Storage) PutBatch(ctx context.Context, userID string, batchForDB map[string]string) error {
-	s.cache.PutBatch(ctx, userID, batchForDB)
+// Edit changes the original URL of short URL owned by the user
+// The time of the change is written to the file, so the revision is the same after replay
+func (s *Storage) Edit(ctx context.Context, userID, shortURL, originURL string, at time.Time) (storage.Revision, error) {
+	var rev storage.Revision
+	err := s.write(record{Op: opEdit, UserID: userID, ShortURL: shortURL, OriginURL: originURL, At: &at}, func() (bool, error) {
+		var err error
+		rev, err = s.cache.Edit(ctx, userID, shortURL, originURL, at)
+		return err == nil && rev.Number != 0, err
+	})
+	return rev, err
+}
 
-	//rewrite all file
-	s.file.Truncate(0)
-	s.file.Seek(0, 0)
-	return s.encoder.Encode(&s.cache)
+// GetHistory returns revisions of short URL owned by the user
+func (s *Storage) GetHistory(ctx context.Context, userID, shortURL string) ([]storage.Revision, error) {
+	return s.cache.GetHistory(ctx, userID, shortURL)
 }
 
-// Delete does nothing
-// It is necessary for the implementation of the interface Storage
+// Delete marks short URLs of the user as deleted
 func (s *Storage) Delete(ctx context.Context, shortURLs []string, userID string) error {
-	return nil
+	return s.write(record{Op: opDelete, UserID: userID, ShortURLs: shortURLs}, func() (bool, error) {
+		err := s.cache.Delete(ctx, shortURLs, userID)
+		return err == nil, err
+	})
+}
+
+// Purge removes links expired before the time
+// The time is written to the file, so the same links and tokens are removed on replay
+func (s *Storage) Purge(ctx context.Context, expiredBefore time.Time) ([]string, error) {
+	var purged []string
+	err := s.write(record{Op: opPurge, At: &expiredBefore}, func() (bool, error) {
+		var err error
+		purged, err = s.cache.Purge(ctx, expiredBefore)
+		return err == nil, err
+	})
+	return purged, err
+}
+
+// SaveClicks appends clicks to their links, the whole batch is written as one record
+func (s *Storage) SaveClicks(ctx context.Context, clicks []storage.Click) error {
+	if len(clicks) == 0 {
+		return nil
+	}
+	return s.write(record{Op: opClicks, Clicks: clicks}, func() (bool, error) {
+		err := s.cache.SaveClicks(ctx, clicks)
+		return err == nil, err
+	})
+}
+
+// GetClicks returns clicks of the link made in [from, to)
+func (s *Storage) GetClicks(ctx context.Context, shortURL string, from, to time.Time) ([]storage.Click, error) {
+	return s.cache.GetClicks(ctx, shortURL, from, to)
+}
+
+// GetLinkStats returns statistics of clicks of the link owned by the user
+func (s *Storage) GetLinkStats(ctx context.Context, userID, shortURL string, query storage.StatsQuery) (storage.LinkStats, error) {
+	return s.cache.GetLinkStats(ctx, userID, shortURL, query)
+}
+
+// Export calls fn for every link of every user
+func (s *Storage) Export(ctx context.Context, fn func(record storage.LinkRecord) error) error {
+	return s.cache.Export(ctx, fn)
+}
+
+// SaveRefreshToken stores the refresh token in DB
+func (s *Storage) SaveRefreshToken(ctx context.Context, token storage.RefreshToken) error {
+	return s.write(record{Op: opToken, Token: &token}, func() (bool, error) {
+		err := s.cache.SaveRefreshToken(ctx, token)
+		return err == nil, err
+	})
 }
 
-// Close removes cache and close thr file
+// RotateRefreshToken marks the refresh token used and saves the next one in DB
+// The time of rotation is written to the file, so the used token is the same after replay
+func (s *Storage) RotateRefreshToken(ctx context.Context, hash string, next storage.RefreshToken, at time.Time) (storage.RefreshToken, error) {
+	var token storage.RefreshToken
+	err := s.write(record{Op: opRotate, Hash: hash, Token: &next, At: &at}, func() (bool, error) {
+		var err error
+		token, err = s.cache.RotateRefreshToken(ctx, hash, next, at)
+		return err == nil, err
+	})
+	return token, err
+}
+
+// RevokeTokenFamily removes refresh tokens of the family from DB
+func (s *Storage) RevokeTokenFamily(ctx context.Context, family string) error {
+	return s.write(record{Op: opRevoke, Family: family}, func() (bool, error) {
+		err := s.cache.RevokeTokenFamily(ctx, family)
+		return err == nil, err
+	})
+}
+
+// GetCounts returns numbers of short URLs and users from the cache
+func (s *Storage) GetCounts(ctx context.Context) (storage.Counts, error) {
+	return s.cache.GetCounts(ctx)
+}
+
+// Close stops compaction, removes cache and close thr file
 func (s *Storage) Close() error {
+	close(s.shutdown)
+	<-s.done
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.cache = nil
+	if err := s.file.Sync(); err != nil {
+		s.file.Close()
+		return err
+	}
 	return s.file.Close()
 }
+
+//**********************************************************************************************************************
+
+// write appends the record at the end of the file and then makes the change of the cache.
+// The record is removed from the file if it can't be written or the change doesn't keep it,
+// so the cache is changed only by written records and the file never has a broken record before others.
+func (s *Storage) write(rec record, change func() (keep bool, err error)) error {
+	buf, err := encodeRecord(rec)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.broken != nil {
+		return s.broken
+	}
+
+	if _, err = s.file.Write(buf); err != nil {
+		s.truncate()
+		return err
+	}
+	keep, err := change()
+	if !keep {
+		s.truncate()
+		return err
+	}
+	s.size += int64(len(buf))
+
+	if s.compacting {
+		s.pending = append(s.pending, buf)
+	} else if s.needsCompaction() {
+		select {
+		case s.trigger <- struct{}{}:
+		default:
+		}
+	}
+	return err
+}
+
+// truncate removes the record written after the last good one. It must be called under s.mu.
+// If the file can't be truncated, it isn't written anymore: records appended after garbage can't be replayed.
+func (s *Storage) truncate() {
+	err := s.file.Truncate(s.size)
+	if err == nil {
+		_, err = s.file.Seek(s.size, io.SeekStart)
+	}
+	if err != nil {
+		s.broken = fmt.Errorf("DB file can't be written after failed write: %w", err)
+		log.Println(s.broken)
+	}
+}
+
+// openLog opens the log file, replays it into cache and leaves the file ready for appending.
+// The file in legacy format (one JSON document) is converted into the log.
+func openLog(fileName string, cache *inmemory.Storage) (*os.File, error) {
+	file, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if stat.Size() == 0 {
+		if _, err = file.Write([]byte(logMagic)); err != nil {
+			file.Close()
+			return nil, err
+		}
+		return file, nil
+	}
+
+	magic := make([]byte, len(logMagic))
+	if _, err = io.ReadFull(file, magic); err != nil || string(magic) != logMagic {
+		// legacy format: the whole DB is one JSON document
+		if _, err = file.Seek(0, io.SeekStart); err != nil {
+			file.Close()
+			return nil, err
+		}
+		err = json.NewDecoder(file).Decode(cache)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("DB file is damaged: %w", err)
+		}
+		log.Println("DB file in legacy format is converted to the log")
+		if err = writeSnapshotFile(fileName, cache); err != nil {
+			return nil, err
+		}
+		return os.OpenFile(fileName, os.O_RDWR|os.O_APPEND, 0755)
+	}
+
+	offset, err := replay(file, stat.Size(), cache)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if offset != stat.Size() {
+		log.Printf("DB file has torn record at offset %d, it is truncated", offset)
+		if err = file.Truncate(offset); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	if _, err = file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// replay applies records from the file to the cache.
+// It returns offset of the end of the last valid record.
+func replay(file *os.File, size int64, cache *inmemory.Storage) (int64, error) {
+	reader := bufio.NewReader(file)
+	offset := int64(len(logMagic))
+
+	for {
+		rec, n, err := readRecord(reader)
+		switch {
+		case err == io.EOF:
+			return offset, nil
+		case errors.Is(err, errTornRecord):
+			return offset, nil
+		case errors.Is(err, errDamagedRecord):
+			// the damaged last record is the result of interrupted write
+			if offset+n >= size {
+				return offset, nil
+			}
+			return 0, fmt.Errorf("DB file is damaged at offset %d: %w", offset, err)
+		case err != nil:
+			return 0, err
+		}
+
+		if err = apply(cache, rec); err != nil {
+			return 0, fmt.Errorf("DB file is damaged at offset %d: %w", offset, err)
+		}
+		offset += n
+	}
+}
+
+// apply changes cache according to record.
+func apply(cache *inmemory.Storage, rec record) error {
+	ctx := context.Background()
+
+	var err error
+	switch rec.Op {
+	case opPut:
+		var opts storage.LinkOptions
+		if rec.Options != nil {
+			opts = *rec.Options
+		}
+		err = cache.Put(ctx, rec.UserID, rec.ShortURL, rec.OriginURL, opts)
+	case opBatch:
+		err = cache.PutBatch(ctx, rec.UserID, rec.Batch, rec.BatchOptions)
+	case opVisit:
+		// logs written before the time of visits was recorded are replayed at the current time,
+		// so their visits can come after the expiry or the deletion of the link
+		at := time.Now()
+		if rec.At != nil {
+			at = *rec.At
+		}
+		_, err = cache.VisitAt(ctx, rec.ShortURL, at)
+		if errors.Is(err, dto.ErrExpired) || errors.Is(err, dto.ErrDeleted) {
+			err = nil
+		}
+	case opDelete:
+		err = cache.Delete(ctx, rec.ShortURLs, rec.UserID)
+	case opEdit:
+		if rec.At == nil {
+			return fmt.Errorf("edit of %q has no time", rec.ShortURL)
+		}
+		_, err = cache.Edit(ctx, rec.UserID, rec.ShortURL, rec.OriginURL, *rec.At)
+	case opPurge:
+		if rec.At == nil {
+			return fmt.Errorf("purge has no time")
+		}
+		_, err = cache.Purge(ctx, *rec.At)
+	case opClicks:
+		err = cache.SaveClicks(ctx, rec.Clicks)
+	case opToken, opRotate:
+		if rec.Token == nil {
+			return fmt.Errorf("%s has no refresh token", rec.Op)
+		}
+		if rec.Op == opToken {
+			err = cache.SaveRefreshToken(ctx, *rec.Token)
+			break
+		}
+		if rec.At == nil {
+			return fmt.Errorf("rotation of refresh token has no time")
+		}
+		_, err = cache.RotateRefreshToken(ctx, rec.Hash, *rec.Token, *rec.At)
+	case opRevoke:
+		err = cache.RevokeTokenFamily(ctx, rec.Family)
+	case opSnapshot:
+		err = json.Unmarshal(rec.Data, cache)
+	default:
+		err = fmt.Errorf("unknown operation %q", rec.Op)
+	}
+
+	// the same items of the batch are rejected on replay as on the first put
+	if errors.Is(err, dto.ErrAlreadyExists) || errors.Is(err, dto.ErrCodeTaken) {
+		return nil
+	}
+	return err
+}
+
+// snapshotRecord returns encoded record with the whole state of cache.
+func snapshotRecord(cache storage.Storage) ([]byte, error) {
+	data, err := json.Marshal(cache)
+	if err != nil {
+		return nil, err
+	}
+
+	return encodeRecord(record{Op: opSnapshot, Data: data})
+}
+
+// writeSnapshotFile atomically replaces the file with the log containing one snapshot record.
+func writeSnapshotFile(fileName string, cache storage.Storage) error {
+	buf, err := snapshotRecord(cache)
+	if err != nil {
+		return err
+	}
+
+	tmpName := fileName + ".tmp"
+	tmp, err := os.OpenFile(tmpName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+
+	if _, err = tmp.Write(append([]byte(logMagic), buf...)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpName, fileName); err != nil {
+		return err
+	}
+	syncDir(fileName)
+	return nil
+}
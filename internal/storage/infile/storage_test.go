@@ -0,0 +1,260 @@
+// Package infile implements storage in file.
+package infile
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhel1/yandex-practicum-go/internal/dto"
+	"github.com/zhel1/yandex-practicum-go/internal/storage"
+	"github.com/zhel1/yandex-practicum-go/internal/storage/storagetest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStorage(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		st, err := NewStorage(filepath.Join(t.TempDir(), "db"), DefaultCompactionConfig)
+		require.NoError(t, err)
+		return st
+	})
+}
+
+func TestStorageRestart(t *testing.T) {
+	ctx := context.Background()
+	fileName := filepath.Join(t.TempDir(), "db")
+
+	st, err := NewStorage(fileName, DefaultCompactionConfig)
+	require.NoError(t, err)
+	require.NoError(t, st.Put(ctx, "user1", "1234567", "https://yandex.ru/news/", storage.LinkOptions{}))
+	require.NoError(t, st.PutBatch(ctx, "user1", map[string]string{"https://yandex.ru/sport/": "1234568"}, nil))
+	require.NoError(t, st.(*Storage).Compact(ctx))
+	require.NoError(t, st.Delete(ctx, []string{"1234568"}, "user1"))
+	require.NoError(t, st.Close())
+
+	// torn trailing record is truncated on start
+	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND, 0755)
+	require.NoError(t, err)
+	_, err = file.Write([]byte{0, 0, 1, 0, 0xde, 0xad})
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	st, err = NewStorage(fileName, DefaultCompactionConfig)
+	require.NoError(t, err)
+	defer st.Close()
+
+	originURL, err := st.Get(ctx, "1234567")
+	require.NoError(t, err)
+	assert.Equal(t, "https://yandex.ru/news/", originURL)
+
+	_, err = st.Get(ctx, "1234568")
+	assert.ErrorIs(t, err, dto.ErrDeleted)
+
+	require.NoError(t, st.Put(ctx, "user1", "1234569", "https://yandex.ru/weather/", storage.LinkOptions{}))
+	counts, err := st.GetCounts(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, storage.Counts{URLs: 3, Users: 1}, counts)
+}
+
+func TestStorageRestartRefreshTokens(t *testing.T) {
+	ctx := context.Background()
+	fileName := filepath.Join(t.TempDir(), "db")
+	now := time.Now().UTC()
+
+	st, err := NewStorage(fileName, DefaultCompactionConfig)
+	require.NoError(t, err)
+	require.NoError(t, st.SaveRefreshToken(ctx, storage.RefreshToken{Hash: "hash1", UserID: "user1", Family: "family1", ExpiresAt: now.Add(time.Hour)}))
+	require.NoError(t, st.SaveRefreshToken(ctx, storage.RefreshToken{Hash: "hash2", UserID: "user2", Family: "family2", ExpiresAt: now.Add(time.Hour)}))
+	require.NoError(t, st.(*Storage).Compact(ctx))
+	_, err = st.RotateRefreshToken(ctx, "hash1", storage.RefreshToken{Hash: "hash3", ExpiresAt: now.Add(time.Hour)}, now)
+	require.NoError(t, err)
+	require.NoError(t, st.RevokeTokenFamily(ctx, "family2"))
+	require.NoError(t, st.Close())
+
+	// tokens are restored from the snapshot and from the log
+	st, err = NewStorage(fileName, DefaultCompactionConfig)
+	require.NoError(t, err)
+	defer st.Close()
+
+	used, err := st.RotateRefreshToken(ctx, "hash1", storage.RefreshToken{Hash: "hash4", ExpiresAt: now.Add(time.Hour)}, now)
+	assert.ErrorIs(t, err, dto.ErrTokenUsed, "rotation is replayed")
+	require.NotNil(t, used.UsedAt)
+	assert.True(t, now.Equal(*used.UsedAt))
+	used, err = st.RotateRefreshToken(ctx, "hash3", storage.RefreshToken{Hash: "hash4", ExpiresAt: now.Add(time.Hour)}, now)
+	require.NoError(t, err)
+	assert.Equal(t, "user1", used.UserID)
+	_, err = st.RotateRefreshToken(ctx, "hash2", storage.RefreshToken{Hash: "hash5", ExpiresAt: now.Add(time.Hour)}, now)
+	assert.ErrorIs(t, err, dto.ErrNotFound, "revocation is replayed")
+}
+
+func TestStorageRestartClicks(t *testing.T) {
+	ctx := context.Background()
+	fileName := filepath.Join(t.TempDir(), "db")
+	at := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	st, err := NewStorage(fileName, DefaultCompactionConfig)
+	require.NoError(t, err)
+	require.NoError(t, st.Put(ctx, "user1", "1234567", "https://yandex.ru/news/", storage.LinkOptions{}))
+	require.NoError(t, st.SaveClicks(ctx, []storage.Click{{ShortURL: "1234567", At: at, Referrer: "https://ya.ru/", IP: "10.0.0.0", Visitor: 1}}))
+	require.NoError(t, st.(*Storage).Compact(ctx))
+	require.NoError(t, st.SaveClicks(ctx, []storage.Click{{ShortURL: "1234567", At: at.Add(time.Hour), UserAgent: "curl/7.79.1", Visitor: 1 << 63}}))
+	require.NoError(t, st.Close())
+
+	// clicks are restored from the snapshot and from the log
+	st, err = NewStorage(fileName, DefaultCompactionConfig)
+	require.NoError(t, err)
+	defer st.Close()
+
+	clicks, err := st.GetClicks(ctx, "1234567", at, at.Add(2*time.Hour))
+	require.NoError(t, err)
+	require.Len(t, clicks, 2)
+	assert.True(t, clicks[0].At.Equal(at))
+	assert.Equal(t, "https://ya.ru/", clicks[0].Referrer)
+	assert.Equal(t, "10.0.0.0", clicks[0].IP)
+	assert.Equal(t, "curl/7.79.1", clicks[1].UserAgent)
+
+	// hourly statistics and sketches of visitors are restored from the snapshot and from the log
+	stats, err := st.GetLinkStats(ctx, "user1", "1234567", storage.StatsQuery{From: at, To: at.Add(2 * time.Hour), Bucket: storage.BucketHour, Top: 10})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), stats.Total)
+	assert.Equal(t, []storage.StatsCount{{Name: "", Clicks: 1}, {Name: "curl", Clicks: 1}}, stats.Agents)
+	assert.Equal(t, int64(2), stats.Visitors)
+}
+
+func TestStorageRestartEdit(t *testing.T) {
+	ctx := context.Background()
+	fileName := filepath.Join(t.TempDir(), "db")
+	at := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	st, err := NewStorage(fileName, DefaultCompactionConfig)
+	require.NoError(t, err)
+	require.NoError(t, st.Put(ctx, "user1", "1234567", "https://yandex.ru/news/", storage.LinkOptions{}))
+	_, err = st.Edit(ctx, "user1", "1234567", "https://yandex.ru/sport/", at)
+	require.NoError(t, err)
+	require.NoError(t, st.(*Storage).Compact(ctx))
+	_, err = st.Edit(ctx, "user1", "1234567", "https://yandex.ru/weather/", at.Add(time.Hour))
+	require.NoError(t, err)
+	require.NoError(t, st.Close())
+
+	// revisions are restored from the snapshot and from the log with their times
+	st, err = NewStorage(fileName, DefaultCompactionConfig)
+	require.NoError(t, err)
+	defer st.Close()
+
+	originURL, err := st.Get(ctx, "1234567")
+	require.NoError(t, err)
+	assert.Equal(t, "https://yandex.ru/weather/", originURL)
+
+	history, err := st.GetHistory(ctx, "user1", "1234567")
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	assert.True(t, history[0].ChangedAt.Equal(at))
+	assert.True(t, history[1].ChangedAt.Equal(at.Add(time.Hour)))
+	assert.Equal(t, "https://yandex.ru/sport/", history[1].OldURL)
+}
+
+func TestStorageDamagedRecord(t *testing.T) {
+	ctx := context.Background()
+	fileName := filepath.Join(t.TempDir(), "db")
+
+	st, err := NewStorage(fileName, DefaultCompactionConfig)
+	require.NoError(t, err)
+	require.NoError(t, st.Put(ctx, "user1", "1234567", "https://yandex.ru/news/", storage.LinkOptions{}))
+	require.NoError(t, st.Put(ctx, "user1", "1234568", "https://yandex.ru/sport/", storage.LinkOptions{}))
+	require.NoError(t, st.Close())
+
+	data, err := os.ReadFile(fileName)
+	require.NoError(t, err)
+	last := len(data) - 1
+
+	// the damaged last record is the result of interrupted write, it is truncated
+	data[last] ^= 0xff
+	require.NoError(t, os.WriteFile(fileName, data, 0755))
+	st, err = NewStorage(fileName, DefaultCompactionConfig)
+	require.NoError(t, err)
+	_, err = st.Get(ctx, "1234567")
+	assert.NoError(t, err)
+	_, err = st.Get(ctx, "1234568")
+	assert.ErrorIs(t, err, dto.ErrNotFound)
+	require.NoError(t, st.Put(ctx, "user1", "1234568", "https://yandex.ru/sport/", storage.LinkOptions{}))
+	require.NoError(t, st.Close())
+
+	// the damaged record followed by others is reported
+	data, err = os.ReadFile(fileName)
+	require.NoError(t, err)
+	data[len(logMagic)+recordHeaderSize+1] ^= 0xff
+	require.NoError(t, os.WriteFile(fileName, data, 0755))
+	_, err = NewStorage(fileName, DefaultCompactionConfig)
+	assert.ErrorContains(t, err, "DB file is damaged")
+}
+
+func TestStorageFailedWrite(t *testing.T) {
+	ctx := context.Background()
+	fileName := filepath.Join(t.TempDir(), "db")
+
+	st, err := NewStorage(fileName, DefaultCompactionConfig)
+	require.NoError(t, err)
+	require.NoError(t, st.Put(ctx, "user1", "1234567", "https://yandex.ru/news/", storage.LinkOptions{}))
+	stat, err := os.Stat(fileName)
+	require.NoError(t, err)
+
+	// rejected changes leave no records
+	err = st.Put(ctx, "user2", "1234567", "https://yandex.ru/sport/", storage.LinkOptions{})
+	require.ErrorIs(t, err, dto.ErrCodeTaken)
+	_, err = st.Edit(ctx, "user2", "1234567", "https://yandex.ru/sport/", time.Now())
+	require.Error(t, err)
+	rejected, err := os.Stat(fileName)
+	require.NoError(t, err)
+	assert.Equal(t, stat.Size(), rejected.Size())
+
+	// the cache isn't changed when the record can't be written
+	require.NoError(t, st.(*Storage).file.Close())
+	assert.Error(t, st.Put(ctx, "user1", "1234568", "https://yandex.ru/sport/", storage.LinkOptions{}))
+	_, err = st.Get(ctx, "1234568")
+	assert.ErrorIs(t, err, dto.ErrNotFound)
+	assert.Error(t, st.Delete(ctx, []string{"1234567"}, "user1"))
+	_, err = st.Get(ctx, "1234567")
+	assert.NoError(t, err)
+	st.Close()
+
+	st, err = NewStorage(fileName, DefaultCompactionConfig)
+	require.NoError(t, err)
+	defer st.Close()
+	_, err = st.Get(ctx, "1234567")
+	assert.NoError(t, err)
+}
+
+func TestStorageRestartExpiry(t *testing.T) {
+	ctx := context.Background()
+	fileName := filepath.Join(t.TempDir(), "db")
+	now := time.Now()
+
+	st, err := NewStorage(fileName, DefaultCompactionConfig)
+	require.NoError(t, err)
+	require.NoError(t, st.Put(ctx, "user1", "1234567", "https://yandex.ru/news/", storage.LinkOptions{MaxClicks: 1}))
+	require.NoError(t, st.Put(ctx, "user1", "1234568", "https://yandex.ru/sport/", storage.LinkOptions{ExpiresAt: now.Add(-time.Hour)}))
+	_, err = st.Visit(ctx, "1234567")
+	require.NoError(t, err)
+	limited, err := st.GetLink(ctx, "1234567")
+	require.NoError(t, err)
+	require.False(t, limited.Options.ExpiresAt.IsZero())
+	purged, err := st.Purge(ctx, now)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1234568"}, purged)
+	require.NoError(t, st.Close())
+	assert.Equal(t, []string{opPut, opPut, opVisit, opPurge}, readOps(t, fileName), "purge must not need compaction")
+
+	// the link expires at the time of the visit and the purge is replayed
+	st, err = NewStorage(fileName, DefaultCompactionConfig)
+	require.NoError(t, err)
+	defer st.Close()
+
+	link, err := st.GetLink(ctx, "1234567")
+	require.NoError(t, err)
+	assert.True(t, limited.Options.ExpiresAt.Equal(link.Options.ExpiresAt), "expiry must not change on restart")
+	assert.Equal(t, int64(1), link.Clicks)
+	_, err = st.Get(ctx, "1234568")
+	assert.ErrorIs(t, err, dto.ErrNotFound)
+}
@@ -0,0 +1,114 @@
+// Package inmemory implements storage in ram.
+package inmemory
+
+import (
+	"context"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/zhel1/yandex-practicum-go/internal/storage"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+const (
+	benchPreloaded = 10000
+	benchBatchSize = 5000
+)
+
+// benchStorage is a compared implementation.
+type benchStorage struct {
+	name       string
+	newStorage func() storage.Storage
+}
+
+// benchStorages returns constructors of compared implementations.
+func benchStorages() []benchStorage {
+	return []benchStorage{
+		{name: "single", newStorage: NewStorage},
+		{name: "sharded-16", newStorage: func() storage.Storage { return NewShardedStorage(16) }},
+		{name: "sharded-64", newStorage: func() storage.Storage { return NewShardedStorage(64) }},
+	}
+}
+
+// preload fills storage with links of several users and returns their short URLs.
+func preload(st storage.Storage) []string {
+	ctx := context.Background()
+	shortURLs := make([]string, benchPreloaded)
+	for i := range shortURLs {
+		shortURLs[i] = fmt.Sprintf("s%d", i)
+		st.Put(ctx, fmt.Sprintf("user%d", i%100), shortURLs[i], "https://www."+shortURLs[i]+".com", storage.LinkOptions{})
+	}
+	return shortURLs
+}
+
+// Benchmark_MixedReadWrite measures redirects and single puts in the ratio 9:1.
+func Benchmark_MixedReadWrite(b *testing.B) {
+	for _, bs := range benchStorages() {
+		b.Run(bs.name, func(b *testing.B) {
+			st := bs.newStorage()
+			shortURLs := preload(st)
+			var counter int64
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				ctx := context.Background()
+				r := rand.New(rand.NewSource(atomic.AddInt64(&counter, 1)))
+				for pb.Next() {
+					if r.Intn(10) == 0 {
+						id := atomic.AddInt64(&counter, 1)
+						st.Put(ctx, "writer", fmt.Sprintf("w%d", id), "https://www.writer.com", storage.LinkOptions{})
+						continue
+					}
+					st.Get(ctx, shortURLs[r.Intn(len(shortURLs))])
+				}
+			})
+		})
+	}
+}
+
+// Benchmark_ReadDuringBatch measures redirects while big batches are being put concurrently.
+func Benchmark_ReadDuringBatch(b *testing.B) {
+	for _, bs := range benchStorages() {
+		b.Run(bs.name, func(b *testing.B) {
+			st := bs.newStorage()
+			shortURLs := preload(st)
+
+			stop := make(chan struct{})
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ctx := context.Background()
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+
+					batch := make(map[string]string, benchBatchSize)
+					for j := 0; j < benchBatchSize; j++ {
+						id := uuid.New().String()
+						batch["https://www."+id+".com"] = id
+					}
+					st.PutBatch(ctx, "batch", batch, nil)
+				}
+			}()
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				ctx := context.Background()
+				r := rand.New(rand.NewSource(rand.Int63()))
+				for pb.Next() {
+					st.Get(ctx, shortURLs[r.Intn(len(shortURLs))])
+				}
+			})
+			b.StopTimer()
+
+			close(stop)
+			wg.Wait()
+		})
+	}
+}
@@ -0,0 +1,226 @@
+// Package inmemory implements storage in ram.
+package inmemory
+
+import (
+	"encoding/json"
+	"github.com/zhel1/yandex-practicum-go/internal/hll"
+	"github.com/zhel1/yandex-practicum-go/internal/storage"
+	"sync/atomic"
+	"time"
+)
+
+// formatVersion is the version of current JSON format of the storage.
+const formatVersion = 2
+
+// jsonStorage is JSON representation of the storage.
+type jsonStorage struct {
+	Version       int                    `json:"version"`
+	Links         map[string]jsonLink    `json:"links"`
+	RefreshTokens []storage.RefreshToken `json:"refresh_tokens,omitempty"`
+}
+
+// jsonLink is JSON representation of the link.
+type jsonLink struct {
+	OriginURL    string             `json:"origin_url"`
+	Owners       map[string]bool    `json:"owners"`
+	ExpiresAt    *time.Time         `json:"expires_at,omitempty"`
+	MaxClicks    int64              `json:"max_clicks,omitempty"`
+	Clicks       int64              `json:"clicks,omitempty"`
+	PasswordHash string             `json:"password_hash,omitempty"`
+	History      []storage.Revision `json:"history,omitempty"`
+	Seqs         map[string]int64   `json:"seqs,omitempty"`   // user ID -> order of creation
+	Events       []storage.Click    `json:"events,omitempty"` // the latest clicks
+	Hours        []jsonHour         `json:"hours,omitempty"`
+	Visitors     map[int64][]byte   `json:"visitors,omitempty"` // Unix time of the day -> encoded sketch
+}
+
+// jsonHour is JSON representation of clicks of the link made within one hour.
+type jsonHour struct {
+	Hour      int64            `json:"hour"`
+	Bot       bool             `json:"bot,omitempty"`
+	Clicks    int64            `json:"clicks"`
+	Referrers map[string]int64 `json:"referrers,omitempty"`
+	Agents    map[string]int64 `json:"agents,omitempty"`
+}
+
+//MarshalJSON serializes the database given in json format
+//The data is copied under the lock and serialized without it, so writers are blocked only for copying.
+//Statistics of clicks are written as hourly statistics and sketches of visitors with the latest clicks only.
+func (s *Storage) MarshalJSON() ([]byte, error) {
+	s.RLock()
+	data := jsonStorage{
+		Version: formatVersion,
+		Links:   make(map[string]jsonLink, len(s.links)),
+	}
+	for shortURL, l := range s.links {
+		owners := make(map[string]bool, len(l.owners))
+		seqs := make(map[string]int64, len(l.owners))
+		for userID, isDeleted := range l.owners {
+			owners[userID] = isDeleted
+			seqs[userID] = s.users[userID][shortURL]
+		}
+		jl := jsonLink{OriginURL: l.originURL, Owners: owners, MaxClicks: l.opts.MaxClicks, Clicks: l.clicks, PasswordHash: l.opts.PasswordHash}
+		jl.History = append(jl.History, l.history...)
+		jl.Events = append(jl.Events, l.recentClicks()...)
+		for key, h := range l.hours {
+			jh := jsonHour{Hour: key.hour, Bot: key.bot, Clicks: h.clicks, Referrers: make(map[string]int64, len(h.referrers)), Agents: make(map[string]int64, len(h.agents))}
+			for name, clicks := range h.referrers {
+				jh.Referrers[name] = clicks
+			}
+			for name, clicks := range h.agents {
+				jh.Agents[name] = clicks
+			}
+			jl.Hours = append(jl.Hours, jh)
+		}
+		if len(l.visitors) > 0 {
+			jl.Visitors = make(map[int64][]byte, len(l.visitors))
+			for day, sketch := range l.visitors {
+				data, err := sketch.MarshalBinary()
+				if err != nil {
+					s.RUnlock()
+					return nil, err
+				}
+				jl.Visitors[day] = data
+			}
+		}
+		jl.Seqs = seqs
+		if !l.opts.ExpiresAt.IsZero() {
+			expiresAt := l.opts.ExpiresAt
+			jl.ExpiresAt = &expiresAt
+		}
+		data.Links[shortURL] = jl
+	}
+	for _, token := range s.tokens {
+		data.RefreshTokens = append(data.RefreshTokens, *token)
+	}
+	s.RUnlock()
+
+	return json.Marshal(data)
+}
+
+//UnmarshalJSON deserializes the database given from json format
+//The legacy format (map of storage.UserData by user ID) is supported too.
+func (s *Storage) UnmarshalJSON(data []byte) error {
+	var probe map[string]json.RawMessage
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return err
+	}
+
+	links := make(map[string]*link)
+	users := make(map[string]map[string]int64)
+	tokens := make(map[string]*storage.RefreshToken)
+	var maxSeq int64
+	var unordered [][2]string // user ID and short URL of links saved without order of creation
+	index := func(userID, shortURL string, seq int64) {
+		if _, ok := users[userID]; !ok {
+			users[userID] = make(map[string]int64)
+		}
+		if seq == 0 {
+			unordered = append(unordered, [2]string{userID, shortURL})
+			return
+		}
+		users[userID][shortURL] = seq
+		if seq > maxSeq {
+			maxSeq = seq
+		}
+	}
+
+	var version int
+	if raw, ok := probe["version"]; ok && json.Unmarshal(raw, &version) == nil && version >= formatVersion {
+		var v jsonStorage
+		if err := json.Unmarshal(data, &v); err != nil {
+			return err
+		}
+
+		for shortURL, jl := range v.Links {
+			opts := storage.LinkOptions{MaxClicks: jl.MaxClicks, PasswordHash: jl.PasswordHash}
+			if jl.ExpiresAt != nil {
+				opts.ExpiresAt = *jl.ExpiresAt
+			}
+			l := newLink(jl.OriginURL, opts)
+			l.clicks = jl.Clicks
+			l.history = jl.History
+			if err := l.restoreClicks(jl); err != nil {
+				return err
+			}
+			for userID, isDeleted := range jl.Owners {
+				l.owners[userID] = isDeleted
+				index(userID, shortURL, jl.Seqs[userID])
+			}
+			links[shortURL] = l
+		}
+		for _, token := range v.RefreshTokens {
+			token := token
+			tokens[token.Hash] = &token
+		}
+	} else {
+		var legacy map[string]storage.UserData
+		if err := json.Unmarshal(data, &legacy); err != nil {
+			return err
+		}
+
+		for userID, usrData := range legacy {
+			for shortURL, originURL := range usrData.URLs {
+				l, ok := links[shortURL]
+				if !ok {
+					l = newLink(originURL, storage.LinkOptions{})
+					links[shortURL] = l
+				}
+				l.owners[userID] = usrData.Deleted[shortURL]
+				index(userID, shortURL, 0)
+			}
+		}
+	}
+
+	for _, link := range unordered {
+		maxSeq++
+		users[link[0]][link[1]] = maxSeq
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	for userID, shortURLs := range s.users {
+		s.counts.add(userID, -len(shortURLs))
+	}
+	for userID, shortURLs := range users {
+		s.counts.add(userID, len(shortURLs))
+	}
+	s.links = links
+	s.users = users
+	s.tokens = tokens
+	if atomic.LoadInt64(s.seq) < maxSeq {
+		atomic.StoreInt64(s.seq, maxSeq)
+	}
+	return nil
+}
+
+// restoreClicks restores clicks and their statistics of the link.
+// Snapshots written before statistics were saved have all clicks, statistics are rebuilt from them.
+func (l *link) restoreClicks(jl jsonLink) error {
+	if len(jl.Hours) == 0 && len(jl.Visitors) == 0 {
+		for _, click := range jl.Events {
+			l.addClick(click)
+		}
+		return nil
+	}
+
+	l.events = jl.Events
+	for _, jh := range jl.Hours {
+		h := &hourStats{clicks: jh.Clicks, referrers: jh.Referrers, agents: jh.Agents}
+		if h.referrers == nil {
+			h.referrers = make(map[string]int64)
+		}
+		if h.agents == nil {
+			h.agents = make(map[string]int64)
+		}
+		l.hours[hourKey{hour: jh.Hour, bot: jh.Bot}] = h
+	}
+	for day, data := range jl.Visitors {
+		sketch := hll.New()
+		if err := sketch.UnmarshalBinary(data); err != nil {
+			return err
+		}
+		l.visitors[day] = sketch
+	}
+	return nil
+}
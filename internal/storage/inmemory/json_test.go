@@ -0,0 +1,109 @@
+// Package inmemory implements storage in ram.
+package inmemory
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhel1/yandex-practicum-go/internal/dto"
+	"github.com/zhel1/yandex-practicum-go/internal/storage"
+	"testing"
+	"time"
+)
+
+func TestUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{
+			name: "legacy format",
+			data: `{"user1":{"id":"user1","urls":{"1234567":"https://yandex.ru/news/","1234568":"https://yandex.ru/sport/"},"deleted":{"1234568":true}},` +
+				`"user2":{"id":"user2","urls":{"1234567":"https://yandex.ru/news/"}}}`,
+		},
+		{
+			name: "current format",
+			data: `{"version":2,"links":{"1234567":{"origin_url":"https://yandex.ru/news/","owners":{"user1":false,"user2":false}},` +
+				`"1234568":{"origin_url":"https://yandex.ru/sport/","owners":{"user1":true}}}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			s := NewStorage()
+			require.NoError(t, json.Unmarshal([]byte(tt.data), s))
+
+			originURL, err := s.Get(ctx, "1234567")
+			require.NoError(t, err)
+			assert.Equal(t, "https://yandex.ru/news/", originURL)
+
+			_, err = s.Get(ctx, "1234568")
+			assert.ErrorIs(t, err, dto.ErrDeleted)
+
+			links, err := s.GetUserLinks(ctx, "user1")
+			require.NoError(t, err)
+			assert.Len(t, links, 2)
+
+			links, err = s.GetUserLinks(ctx, "user2")
+			require.NoError(t, err)
+			assert.Equal(t, map[string]string{"1234567": "https://yandex.ru/news/"}, links)
+
+			// round trip keeps the data
+			data, err := json.Marshal(s)
+			require.NoError(t, err)
+			restored := NewStorage()
+			require.NoError(t, json.Unmarshal(data, restored))
+			assert.Equal(t, s, restored)
+		})
+	}
+}
+
+func TestMarshalJSONClicks(t *testing.T) {
+	ctx := context.Background()
+	at := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	s := NewStorage()
+	require.NoError(t, s.Put(ctx, "user1", "1234567", "https://yandex.ru/news/", storage.LinkOptions{}))
+
+	// only the latest clicks are kept, statistics count all of them
+	const total = 3*maxLinkEvents + 10
+	clicks := make([]storage.Click, 0, total)
+	for i := 0; i < total; i++ {
+		clicks = append(clicks, storage.Click{ShortURL: "1234567", At: at.Add(time.Duration(i) * time.Second), Referrer: "https://ya.ru/", Visitor: uint64(i + 1), Bot: i%2 == 1})
+	}
+	require.NoError(t, s.SaveClicks(ctx, clicks))
+	recent, err := s.GetClicks(ctx, "1234567", at, at.Add(24*time.Hour))
+	require.NoError(t, err)
+	require.Len(t, recent, maxLinkEvents)
+	assert.True(t, recent[0].At.Equal(clicks[total-maxLinkEvents].At))
+	query := storage.StatsQuery{From: at.Add(-time.Hour), To: at.Add(24 * time.Hour), Bucket: storage.BucketHour, Top: 10, Bots: true}
+	stats, err := s.GetLinkStats(ctx, "user1", "1234567", query)
+	require.NoError(t, err)
+	assert.Equal(t, int64(total), stats.Total)
+
+	// snapshots keep statistics and the latest clicks, their size doesn't grow with clicks
+	data, err := json.Marshal(s)
+	require.NoError(t, err)
+	var snapshot jsonStorage
+	require.NoError(t, json.Unmarshal(data, &snapshot))
+	assert.Len(t, snapshot.Links["1234567"].Events, maxLinkEvents)
+
+	restored := NewStorage()
+	require.NoError(t, json.Unmarshal(data, restored))
+	restoredStats, err := restored.GetLinkStats(ctx, "user1", "1234567", query)
+	require.NoError(t, err)
+	assert.Equal(t, stats, restoredStats)
+	restoredClicks, err := restored.GetClicks(ctx, "1234567", at, at.Add(24*time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, recent, restoredClicks)
+
+	// statistics are rebuilt from clicks of snapshots written before statistics were saved
+	legacy := NewStorage()
+	require.NoError(t, json.Unmarshal([]byte(`{"version":2,"links":{"1234567":{"origin_url":"https://yandex.ru/news/","owners":{"user1":false},`+
+		`"events":[{"short_url":"1234567","at":"2022-05-01T12:00:00Z","visitor":1},{"short_url":"1234567","at":"2022-05-01T13:00:00Z","visitor":9223372036854775808}]}}}`), legacy))
+	legacyStats, err := legacy.GetLinkStats(ctx, "user1", "1234567", query)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), legacyStats.Total)
+	assert.Equal(t, int64(2), legacyStats.Visitors)
+}
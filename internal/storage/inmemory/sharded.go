@@ -0,0 +1,269 @@
+// Package inmemory implements storage in ram.
+package inmemory
+
+import (
+	"context"
+	"errors"
+	"github.com/zhel1/yandex-practicum-go/internal/dto"
+	"github.com/zhel1/yandex-practicum-go/internal/storage"
+	storageErrors "github.com/zhel1/yandex-practicum-go/internal/storage/errors"
+	"hash/fnv"
+	"time"
+)
+
+// Check interface implementation.
+var (
+	_ storage.Storage = (*ShardedStorage)(nil)
+)
+
+// ShardedStorage is DB in memory split into shards by hash of short URL.
+// Every shard has its own lock and keeps the per-user index of its own short URLs,
+// so writers of one shard don't block readers of the others.
+type ShardedStorage struct {
+	shards []*Storage
+}
+
+// NewShardedStorage creates DB in memory with n shards.
+func NewShardedStorage(n int) storage.Storage {
+	if n < 1 {
+		n = 1
+	}
+
+	seq := new(int64)
+	counts := newUserCounts()
+	shards := make([]*Storage, n)
+	for i := range shards {
+		shards[i] = NewStorage().(*Storage)
+		shards[i].seq = seq
+		shards[i].counts = counts
+	}
+	return &ShardedStorage{shards: shards}
+}
+
+// Get gets base URL from DB.
+func (s *ShardedStorage) Get(ctx context.Context, shortURL string) (string, error) {
+	return s.shard(shortURL).Get(ctx, shortURL)
+}
+
+// GetLink gets base URL with its restrictions from DB.
+func (s *ShardedStorage) GetLink(ctx context.Context, shortURL string) (storage.Link, error) {
+	return s.shard(shortURL).GetLink(ctx, shortURL)
+}
+
+// Visit gets base URL from DB for redirect.
+func (s *ShardedStorage) Visit(ctx context.Context, shortURL string) (string, error) {
+	return s.shard(shortURL).Visit(ctx, shortURL)
+}
+
+// GetUserLinks returns all URLs by UserID from DB.
+func (s *ShardedStorage) GetUserLinks(ctx context.Context, userID string) (map[string]string, error) {
+	result := make(map[string]string)
+	found := false
+	for _, shard := range s.shards {
+		links, err := shard.GetUserLinks(ctx, userID)
+		if err != nil {
+			if errors.Is(err, dto.ErrNotFound) {
+				continue
+			}
+			return nil, err
+		}
+
+		found = true
+		for shortURL, originURL := range links {
+			result[shortURL] = originURL
+		}
+	}
+
+	if !found {
+		return nil, &storageErrors.NotFoundError{Err: dto.ErrNotFound}
+	}
+	return result, nil
+}
+
+// Edit changes the original URL of short URL owned by the user.
+func (s *ShardedStorage) Edit(ctx context.Context, userID, shortURL, originURL string, at time.Time) (storage.Revision, error) {
+	return s.shard(shortURL).Edit(ctx, userID, shortURL, originURL, at)
+}
+
+// GetHistory returns revisions of short URL owned by the user.
+func (s *ShardedStorage) GetHistory(ctx context.Context, userID, shortURL string) ([]storage.Revision, error) {
+	return s.shard(shortURL).GetHistory(ctx, userID, shortURL)
+}
+
+// FindUserLink returns short URL of the user to the original URL from the first shard which has it.
+func (s *ShardedStorage) FindUserLink(ctx context.Context, userID, originURL string) (string, error) {
+	for _, shard := range s.shards {
+		shortURL, err := shard.FindUserLink(ctx, userID, originURL)
+		if !errors.Is(err, dto.ErrNotFound) {
+			return shortURL, err
+		}
+	}
+	return "", &storageErrors.NotFoundError{Err: dto.ErrNotFound}
+}
+
+// ListUserLinks returns the page of links of the user merged from pages of all shards.
+func (s *ShardedStorage) ListUserLinks(ctx context.Context, userID string, query storage.LinksQuery) (storage.LinksPage, error) {
+	var links []storage.UserLink
+	more := false
+	for _, shard := range s.shards {
+		page, err := shard.ListUserLinks(ctx, userID, query)
+		if err != nil {
+			return storage.LinksPage{}, err
+		}
+		links = append(links, page.Links...)
+		more = more || page.Next != nil
+	}
+
+	page := query.Page(links)
+	if page.Next == nil && more {
+		page.Next = query.Cursor(page.Links[len(page.Links)-1])
+	}
+	return page, nil
+}
+
+// SaveClicks saves clicks in shards of their links.
+func (s *ShardedStorage) SaveClicks(ctx context.Context, clicks []storage.Click) error {
+	parts := make(map[*Storage][]storage.Click)
+	for _, click := range clicks {
+		shard := s.shard(click.ShortURL)
+		parts[shard] = append(parts[shard], click)
+	}
+	for shard, part := range parts {
+		if err := shard.SaveClicks(ctx, part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetClicks returns clicks of the link from its shard.
+func (s *ShardedStorage) GetClicks(ctx context.Context, shortURL string, from, to time.Time) ([]storage.Click, error) {
+	return s.shard(shortURL).GetClicks(ctx, shortURL, from, to)
+}
+
+// GetLinkStats returns statistics of clicks of the link from its shard.
+func (s *ShardedStorage) GetLinkStats(ctx context.Context, userID, shortURL string, query storage.StatsQuery) (storage.LinkStats, error) {
+	return s.shard(shortURL).GetLinkStats(ctx, userID, shortURL, query)
+}
+
+// Put save short URL in DB.
+func (s *ShardedStorage) Put(ctx context.Context, userID, shortURL, originURL string, opts storage.LinkOptions) error {
+	return s.shard(shortURL).Put(ctx, userID, shortURL, originURL, opts)
+}
+
+// PutBatch save short URLs in DB.
+// Every shard is locked only for its own part of the batch, not saved short URLs of all shards are reported together.
+func (s *ShardedStorage) PutBatch(ctx context.Context, userID string, batchForDB map[string]string, opts map[string]storage.LinkOptions) error {
+	parts := make(map[*Storage]map[string]string)
+	for originURL, shortURL := range batchForDB {
+		shard := s.shard(shortURL)
+		if _, ok := parts[shard]; !ok {
+			parts[shard] = make(map[string]string)
+		}
+		parts[shard][originURL] = shortURL
+	}
+
+	var existing, taken []string
+	for shard, part := range parts {
+		if err := shard.PutBatch(ctx, userID, part, opts); err != nil {
+			var existsErr *storageErrors.AlreadyExistsError
+			var takenErr *storageErrors.CodeTakenError
+			switch {
+			case errors.As(err, &existsErr):
+				existing = append(existing, existsErr.Keys...)
+			case errors.As(err, &takenErr):
+				existing = append(existing, takenErr.Existing...)
+				taken = append(taken, takenErr.Keys...)
+			default:
+				return err
+			}
+		}
+	}
+
+	return batchError(existing, taken)
+}
+
+// Delete marks short URLs of the user as deleted.
+func (s *ShardedStorage) Delete(ctx context.Context, shortURLs []string, userID string) error {
+	parts := make(map[*Storage][]string)
+	for _, shortURL := range shortURLs {
+		shard := s.shard(shortURL)
+		parts[shard] = append(parts[shard], shortURL)
+	}
+
+	for shard, part := range parts {
+		if err := shard.Delete(ctx, part, userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Purge removes links expired before the time shard by shard.
+func (s *ShardedStorage) Purge(ctx context.Context, expiredBefore time.Time) ([]string, error) {
+	var purged []string
+	for _, shard := range s.shards {
+		keys, err := shard.Purge(ctx, expiredBefore)
+		if err != nil {
+			return purged, err
+		}
+		purged = append(purged, keys...)
+	}
+	return purged, nil
+}
+
+// Export calls fn for every link of every user shard by shard.
+func (s *ShardedStorage) Export(ctx context.Context, fn func(record storage.LinkRecord) error) error {
+	for _, shard := range s.shards {
+		if err := shard.Export(ctx, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetCounts sums short URLs of all shards, users are counted once by the counter shards share.
+func (s *ShardedStorage) GetCounts(ctx context.Context) (storage.Counts, error) {
+	var counts storage.Counts
+	for _, shard := range s.shards {
+		shardCounts, err := shard.GetCounts(ctx)
+		if err != nil {
+			return storage.Counts{}, err
+		}
+		counts.URLs += shardCounts.URLs
+		counts.Users = shardCounts.Users
+	}
+	return counts, nil
+}
+
+// SaveRefreshToken stores the refresh token in the first shard, tokens of one family must be in one shard.
+func (s *ShardedStorage) SaveRefreshToken(ctx context.Context, token storage.RefreshToken) error {
+	return s.shards[0].SaveRefreshToken(ctx, token)
+}
+
+// RotateRefreshToken rotates the refresh token in the first shard.
+func (s *ShardedStorage) RotateRefreshToken(ctx context.Context, hash string, next storage.RefreshToken, at time.Time) (storage.RefreshToken, error) {
+	return s.shards[0].RotateRefreshToken(ctx, hash, next, at)
+}
+
+// RevokeTokenFamily removes refresh tokens of the family from the first shard.
+func (s *ShardedStorage) RevokeTokenFamily(ctx context.Context, family string) error {
+	return s.shards[0].RevokeTokenFamily(ctx, family)
+}
+
+// Close clears all shards.
+func (s *ShardedStorage) Close() error {
+	for _, shard := range s.shards {
+		if err := shard.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shard returns the shard of short URL.
+func (s *ShardedStorage) shard(shortURL string) *Storage {
+	h := fnv.New32a()
+	h.Write([]byte(shortURL))
+	return s.shards[h.Sum32()%uint32(len(s.shards))]
+}
@@ -3,11 +3,15 @@ package inmemory
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"github.com/zhel1/yandex-practicum-go/internal/dto"
+	"github.com/zhel1/yandex-practicum-go/internal/hll"
 	"github.com/zhel1/yandex-practicum-go/internal/storage"
 	storageErrors "github.com/zhel1/yandex-practicum-go/internal/storage/errors"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Check interface implementation.
@@ -15,104 +19,651 @@ var (
 	_ storage.Storage = (*Storage)(nil)
 )
 
-// Storage is DB in memory struct
+// maxLinkEvents is the number of the latest clicks of the link kept as they are.
+// Older clicks are kept only in hourly statistics and sketches of visitors, so memory and snapshots
+// grow with the number of links and hours rather than with traffic.
+const maxLinkEvents = 1000
+
+// link is an entry of the primary index.
+type link struct {
+	originURL string
+	owners    map[string]bool // user ID -> is deleted
+	opts      storage.LinkOptions
+	clicks    int64
+	history   []storage.Revision
+	events    []storage.Click        // the latest recorded clicks in order of saving, see recentClicks
+	hours     map[hourKey]*hourStats // clicks aggregated by hours and by bots
+	visitors  map[int64]*hll.Sketch  // unique visitors by days, Unix time of the day -> sketch
+}
+
+// hourKey identifies clicks of people or of bots made within the hour.
+type hourKey struct {
+	hour int64 // Unix time of the hour
+	bot  bool
+}
+
+// hourStats are clicks of the link made within one hour.
+type hourStats struct {
+	clicks    int64
+	referrers map[string]int64
+	agents    map[string]int64
+}
+
+// newLink creates link without owners.
+func newLink(originURL string, opts storage.LinkOptions) *link {
+	return &link{
+		originURL: originURL,
+		owners:    make(map[string]bool),
+		opts:      opts,
+		hours:     make(map[hourKey]*hourStats),
+		visitors:  make(map[int64]*hll.Sketch),
+	}
+}
+
+// addClick records the click and adds it to statistics of its hour and visitors of its day. Bots are not visitors.
+func (l *link) addClick(click storage.Click) {
+	// the oldest clicks are dropped by halves, so clicks are not moved on every append
+	if len(l.events) >= 2*maxLinkEvents {
+		l.events = append(l.events[:0], l.recentClicks()...)
+	}
+	l.events = append(l.events, click)
+
+	key := hourKey{hour: storage.ClickHour(click.At).Unix(), bot: click.Bot}
+	h, ok := l.hours[key]
+	if !ok {
+		h = &hourStats{referrers: make(map[string]int64), agents: make(map[string]int64)}
+		l.hours[key] = h
+	}
+	h.clicks++
+	h.referrers[storage.ReferrerHost(click.Referrer)]++
+	h.agents[storage.AgentFamily(click.UserAgent)]++
+
+	if click.Visitor != 0 && !click.Bot {
+		day := storage.ClickDay(click.At).Unix()
+		sketch, ok := l.visitors[day]
+		if !ok {
+			sketch = hll.New()
+			l.visitors[day] = sketch
+		}
+		sketch.Add(click.Visitor)
+	}
+}
+
+// recentClicks returns the latest maxLinkEvents clicks.
+func (l *link) recentClicks() []storage.Click {
+	if len(l.events) > maxLinkEvents {
+		return l.events[len(l.events)-maxLinkEvents:]
+	}
+	return l.events
+}
+
+// isDeleted checks whether the link is deleted by all users who own it.
+func (l *link) isDeleted() bool {
+	for _, isDeleted := range l.owners {
+		if !isDeleted {
+			return false
+		}
+	}
+	return true
+}
+
+// info returns the link in storage format.
+func (l *link) info() storage.Link {
+	return storage.Link{OriginURL: l.originURL, Options: l.opts, Clicks: l.clicks}
+}
+
+// Storage is DB in memory struct.
+// Short URLs are resolved by the primary index, user links are listed by the secondary index.
 type Storage struct {
 	sync.RWMutex
-	m map[string]storage.UserData
+	links  map[string]*link                 // short URL -> link
+	users  map[string]map[string]int64      // user ID -> short URL -> order of creation
+	seq    *int64                           // the last order of creation, shards share it
+	counts *userCounts                      // numbers of short URLs of users, shards share it
+	tokens map[string]*storage.RefreshToken // hash -> refresh token
 }
 
 // NewStorage creates DB in memory.
 func NewStorage() storage.Storage {
 	return &Storage{
-		m: make(map[string]storage.UserData),
+		links:  make(map[string]*link),
+		users:  make(map[string]map[string]int64),
+		seq:    new(int64),
+		counts: newUserCounts(),
+		tokens: make(map[string]*storage.RefreshToken),
+	}
+}
+
+// userCounts counts short URLs of every user in all shards, so users are counted without scanning their links.
+type userCounts struct {
+	mu    sync.Mutex
+	links map[string]int // user ID -> number of short URLs
+}
+
+// newUserCounts creates userCounts without users.
+func newUserCounts() *userCounts {
+	return &userCounts{links: make(map[string]int)}
+}
+
+// add changes the number of short URLs of the user by n, users without short URLs are removed.
+func (c *userCounts) add(userID string, n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.links[userID] += n; c.links[userID] <= 0 {
+		delete(c.links, userID)
 	}
 }
 
+// users returns the number of users with short URLs.
+func (c *userCounts) users() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return int64(len(c.links))
+}
+
 // Get gets base URL from DB.
+// It returns dto.ErrDeleted if the URL is deleted by all users who own it and dto.ErrExpired if it is expired.
 func (s *Storage) Get(ctx context.Context, shortURL string) (string, error) {
 	s.RLock()
 	defer s.RUnlock()
-	for _, usrData := range s.m {
-		if v, ok := usrData.URLs[shortURL]; ok {
-			return v, nil
-		}
+	l, err := s.active(shortURL, time.Now())
+	if err != nil {
+		return "", err
+	}
+	return l.originURL, nil
+}
+
+// GetLink gets base URL with its restrictions from DB.
+func (s *Storage) GetLink(ctx context.Context, shortURL string) (storage.Link, error) {
+	s.RLock()
+	defer s.RUnlock()
+	l, ok := s.links[shortURL]
+	if !ok {
+		return storage.Link{}, &storageErrors.NotFoundError{Err: dto.ErrNotFound}
+	}
+	if l.isDeleted() {
+		return storage.Link{}, dto.ErrDeleted
+	}
+	return l.info(), nil
+}
+
+// Visit gets base URL from DB for redirect.
+// Redirects are counted only for links with limited number of them, so other links are served under the read lock.
+func (s *Storage) Visit(ctx context.Context, shortURL string) (string, error) {
+	return s.VisitAt(ctx, shortURL, time.Now())
+}
+
+// VisitAt counts the redirect made at the time, so replay of redirects expires links at the same time.
+func (s *Storage) VisitAt(ctx context.Context, shortURL string, at time.Time) (string, error) {
+	s.RLock()
+	l, err := s.active(shortURL, at)
+	if err != nil {
+		s.RUnlock()
+		return "", err
+	}
+	originURL, limited := l.originURL, l.opts.MaxClicks > 0
+	s.RUnlock()
+	if !limited {
+		return originURL, nil
 	}
-	return "", &storageErrors.NotFoundError{Err: dto.ErrNotFound}
+
+	s.Lock()
+	defer s.Unlock()
+	return s.visit(shortURL, at)
 }
 
 // GetUserLinks returns all URLs by UserID from DB.
 func (s *Storage) GetUserLinks(ctx context.Context, userID string) (map[string]string, error) {
 	s.RLock()
 	defer s.RUnlock()
-	if usrData, ok := s.m[userID]; ok {
-		return usrData.URLs, nil
-	} else {
+	shortURLs, ok := s.users[userID]
+	if !ok {
 		return nil, &storageErrors.NotFoundError{Err: dto.ErrNotFound}
 	}
+
+	result := make(map[string]string, len(shortURLs))
+	for shortURL := range shortURLs {
+		result[shortURL] = s.links[shortURL].originURL
+	}
+	return result, nil
+}
+
+// FindUserLink returns the first short URL of the user to the original URL which is not protected by password.
+// Deleted links are found too, it returns dto.ErrNotFound if the user has no such link.
+func (s *Storage) FindUserLink(ctx context.Context, userID, originURL string) (string, error) {
+	s.RLock()
+	defer s.RUnlock()
+	found, first := "", int64(0)
+	for shortURL, seq := range s.users[userID] {
+		l := s.links[shortURL]
+		if l.originURL == originURL && l.opts.PasswordHash == "" && (found == "" || seq < first) {
+			found, first = shortURL, seq
+		}
+	}
+	if found == "" {
+		return "", &storageErrors.NotFoundError{Err: dto.ErrNotFound}
+	}
+	return found, nil
+}
+
+// ListUserLinks returns the page of links of the user.
+func (s *Storage) ListUserLinks(ctx context.Context, userID string, query storage.LinksQuery) (storage.LinksPage, error) {
+	s.RLock()
+	shortURLs := s.users[userID]
+	links := make([]storage.UserLink, 0, len(shortURLs))
+	for shortURL, seq := range shortURLs {
+		l := s.links[shortURL]
+		links = append(links, storage.UserLink{
+			Seq:       seq,
+			ShortURL:  shortURL,
+			OriginURL: l.originURL,
+			IsDeleted: l.owners[userID],
+		})
+	}
+	s.RUnlock()
+
+	return query.Page(links), nil
 }
 
 // Put save short URL in DB.
-func (s *Storage) Put(ctx context.Context, userID, shortURL, originURL string) error {
+// Restrictions of the link are set only if the link is new.
+func (s *Storage) Put(ctx context.Context, userID, shortURL, originURL string, opts storage.LinkOptions) error {
+	s.Lock()
+	defer s.Unlock()
+	return s.put(userID, shortURL, originURL, opts)
+}
+
+// PutBatch save short URLs in DB. Restrictions of links are taken from opts by short URL.
+// New URLs are saved even if some of them already exist or their short URLs are taken.
+// The taken ones are reported in CodeTakenError, otherwise the existing ones are reported in AlreadyExistsError.
+func (s *Storage) PutBatch(ctx context.Context, userID string, batchForDB map[string]string, opts map[string]storage.LinkOptions) error {
+	s.Lock()
+	defer s.Unlock()
+	var existing, taken []string
+	for originURL, shortURL := range batchForDB {
+		if err := s.put(userID, shortURL, originURL, opts[shortURL]); err != nil {
+			switch {
+			case errors.Is(err, dto.ErrAlreadyExists):
+				existing = append(existing, shortURL)
+			case errors.Is(err, dto.ErrCodeTaken):
+				taken = append(taken, shortURL)
+			default:
+				return err
+			}
+		}
+	}
+
+	return batchError(existing, taken)
+}
+
+// Delete marks short URLs of the user as deleted.
+// URLs of other users with the same short URL are not affected.
+func (s *Storage) Delete(ctx context.Context, shortURLs []string, userID string) error {
 	s.Lock()
 	defer s.Unlock()
-	if usrData, ok := s.m[userID]; ok {
-		//User with uuid exists.
-		//Just append new item to URLs
-		if _, ok := usrData.URLs[shortURL]; ok {
-			return &storageErrors.AlreadyExistsError{Err: dto.ErrAlreadyExists}
-		}
-		usrData.URLs[shortURL] = originURL
-	} else {
-		usrData := storage.NewUserData(userID)
-		usrData.URLs[shortURL] = originURL
-		s.m[userID] = usrData
+	for _, shortURL := range shortURLs {
+		if l, ok := s.links[shortURL]; ok {
+			if _, ok := l.owners[userID]; ok {
+				l.owners[userID] = true
+			}
+		}
 	}
 	return nil
 }
 
-// Put save short URLs in DB.
-func (s *Storage) PutBatch(ctx context.Context, userID string, batchForDB map[string]string) error {
+// Edit changes the original URL of short URL owned by the user and records the revision.
+// The link can be edited only by its single owner, it returns dto.ErrLinkShared if other users own it too.
+func (s *Storage) Edit(ctx context.Context, userID, shortURL, originURL string, at time.Time) (storage.Revision, error) {
 	s.Lock()
 	defer s.Unlock()
-	if _, ok := s.m[userID]; !ok {
-		usrData := storage.NewUserData(userID)
-		s.m[userID] = usrData
+	l, err := s.owned(userID, shortURL)
+	if err != nil {
+		return storage.Revision{}, err
 	}
 
-	for originURL, shortURL := range batchForDB {
-		if _, ok := s.m[userID].URLs[shortURL]; ok {
-			return &storageErrors.AlreadyExistsError{Err: dto.ErrAlreadyExists}
+	for ownerID, isDeleted := range l.owners {
+		if ownerID != userID && !isDeleted {
+			return storage.Revision{}, dto.ErrLinkShared
 		}
-		s.m[userID].URLs[shortURL] = originURL
 	}
 
+	if l.originURL == originURL {
+		return storage.Revision{}, nil
+	}
+
+	rev := storage.Revision{
+		Number:    len(l.history) + 1,
+		UserID:    userID,
+		ChangedAt: at,
+		OldURL:    l.originURL,
+		NewURL:    originURL,
+	}
+	l.history = append(l.history, rev)
+	l.originURL = originURL
+	return rev, nil
+}
+
+// GetHistory returns revisions of short URL owned by the user.
+func (s *Storage) GetHistory(ctx context.Context, userID, shortURL string) ([]storage.Revision, error) {
+	s.RLock()
+	defer s.RUnlock()
+	l, err := s.owned(userID, shortURL)
+	if err != nil {
+		return nil, err
+	}
+
+	history := make([]storage.Revision, len(l.history))
+	copy(history, l.history)
+	return history, nil
+}
+
+// Purge removes links and refresh tokens expired before the time.
+func (s *Storage) Purge(ctx context.Context, expiredBefore time.Time) ([]string, error) {
+	s.Lock()
+	defer s.Unlock()
+	var purged []string
+	for shortURL, l := range s.links {
+		if !l.opts.ExpiresAt.IsZero() && l.opts.ExpiresAt.Before(expiredBefore) {
+			for userID := range l.owners {
+				s.unindex(userID, shortURL)
+			}
+			delete(s.links, shortURL)
+			purged = append(purged, shortURL)
+		}
+	}
+	for hash, token := range s.tokens {
+		if token.ExpiresAt.Before(expiredBefore) {
+			delete(s.tokens, hash)
+		}
+	}
+	return purged, nil
+}
+
+// SaveRefreshToken stores the refresh token by its hash.
+func (s *Storage) SaveRefreshToken(ctx context.Context, token storage.RefreshToken) error {
+	s.Lock()
+	defer s.Unlock()
+	s.tokens[token.Hash] = &token
 	return nil
 }
 
-// Delete needs to implement Storage interface.
-func (s *Storage) Delete(ctx context.Context, shortURLs []string, userID string) error {
+// RotateRefreshToken marks the token used at the time and saves the next token of its family.
+// The token is returned with dto.ErrTokenUsed too, so reuse can be told from concurrent rotation by the time of use.
+func (s *Storage) RotateRefreshToken(ctx context.Context, hash string, next storage.RefreshToken, at time.Time) (storage.RefreshToken, error) {
+	s.Lock()
+	defer s.Unlock()
+	token, ok := s.tokens[hash]
+	if !ok {
+		return storage.RefreshToken{}, &storageErrors.NotFoundError{Err: dto.ErrNotFound}
+	}
+
+	next, err := token.Rotate(next, at)
+	if err != nil {
+		return *token, err
+	}
+	token.UsedAt = &at
+	s.tokens[next.Hash] = &next
+	return *token, nil
+}
+
+// RevokeTokenFamily removes all refresh tokens of the family.
+func (s *Storage) RevokeTokenFamily(ctx context.Context, family string) error {
+	s.Lock()
+	defer s.Unlock()
+	for hash, token := range s.tokens {
+		if token.Family == family {
+			delete(s.tokens, hash)
+		}
+	}
+	return nil
+}
+
+// SaveClicks appends clicks to their links.
+func (s *Storage) SaveClicks(ctx context.Context, clicks []storage.Click) error {
+	s.Lock()
+	defer s.Unlock()
+	for _, click := range clicks {
+		if l, ok := s.links[click.ShortURL]; ok {
+			l.addClick(click)
+		}
+	}
 	return nil
 }
 
+// GetClicks returns clicks of the link made in [from, to) among the latest maxLinkEvents clicks.
+func (s *Storage) GetClicks(ctx context.Context, shortURL string, from, to time.Time) ([]storage.Click, error) {
+	s.RLock()
+	var clicks []storage.Click
+	if l, ok := s.links[shortURL]; ok {
+		for _, click := range l.recentClicks() {
+			if !click.At.Before(from) && click.At.Before(to) {
+				clicks = append(clicks, click)
+			}
+		}
+	}
+	s.RUnlock()
+
+	// batches are saved in order of their flushing, clicks of concurrent batches can be mixed
+	sort.SliceStable(clicks, func(i, j int) bool {
+		return clicks[i].At.Before(clicks[j].At)
+	})
+	return clicks, nil
+}
+
+// GetLinkStats returns statistics of clicks of the link owned by the user.
+// Only hourly statistics and daily sketches are read, the number of them doesn't depend on the number of clicks.
+func (s *Storage) GetLinkStats(ctx context.Context, userID, shortURL string, query storage.StatsQuery) (storage.LinkStats, error) {
+	s.RLock()
+	defer s.RUnlock()
+	l, err := s.owned(userID, shortURL)
+	if err != nil {
+		return storage.LinkStats{}, err
+	}
+
+	var stats storage.LinkStats
+	buckets := make(map[time.Time]int64)
+	referrers := make(map[string]int64)
+	agents := make(map[string]int64)
+	from, to := query.From.Unix(), query.To.Unix()
+	for key, h := range l.hours {
+		if key.hour < from || key.hour >= to {
+			continue
+		}
+		if key.bot {
+			stats.Bots += h.clicks
+			if !query.Bots {
+				continue
+			}
+		}
+		stats.Total += h.clicks
+		buckets[query.BucketStart(time.Unix(key.hour, 0))] += h.clicks
+		for name, clicks := range h.referrers {
+			referrers[name] += clicks
+		}
+		for name, clicks := range h.agents {
+			agents[name] += clicks
+		}
+	}
+
+	visitors := hll.New()
+	dayVisitors := make(map[time.Time]int64)
+	fromDay, toDay := query.Days()
+	for day, sketch := range l.visitors {
+		if day < fromDay.Unix() || day >= toDay.Unix() {
+			continue
+		}
+		visitors.Merge(sketch)
+		if query.Bucket == storage.BucketDay {
+			dayVisitors[time.Unix(day, 0).UTC()] = int64(sketch.Estimate())
+		}
+	}
+	stats.Visitors = int64(visitors.Estimate())
+
+	stats.Buckets = make([]storage.StatsBucket, 0, len(buckets))
+	for start, clicks := range buckets {
+		stats.Buckets = append(stats.Buckets, storage.StatsBucket{Start: start, Clicks: clicks, Visitors: dayVisitors[start]})
+	}
+	sort.Slice(stats.Buckets, func(i, j int) bool {
+		return stats.Buckets[i].Start.Before(stats.Buckets[j].Start)
+	})
+	stats.Referrers = storage.TopCounts(referrers, query.Top)
+	stats.Agents = storage.TopCounts(agents, query.Top)
+	return stats, nil
+}
+
+// Export calls fn for every link of every user.
+// The links are copied under the lock, fn is called without it.
+func (s *Storage) Export(ctx context.Context, fn func(record storage.LinkRecord) error) error {
+	s.RLock()
+	records := make([]storage.LinkRecord, 0, len(s.links))
+	for shortURL, l := range s.links {
+		for userID, isDeleted := range l.owners {
+			record := storage.LinkRecord{
+				UserID:       userID,
+				ShortURL:     shortURL,
+				OriginURL:    l.originURL,
+				IsDeleted:    isDeleted,
+				MaxClicks:    l.opts.MaxClicks,
+				PasswordHash: l.opts.PasswordHash,
+			}
+			if !l.opts.ExpiresAt.IsZero() {
+				expiresAt := l.opts.ExpiresAt
+				record.ExpiresAt = &expiresAt
+			}
+			records = append(records, record)
+		}
+	}
+	s.RUnlock()
+
+	for _, record := range records {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetCounts returns numbers of short URLs and users, users are counted in all shards sharing the storage.
+func (s *Storage) GetCounts(ctx context.Context) (storage.Counts, error) {
+	s.RLock()
+	defer s.RUnlock()
+	return storage.Counts{URLs: int64(len(s.links)), Users: s.counts.users()}, nil
+}
+
 // Close clears the map with user data.
 func (s *Storage) Close() error {
 	s.Lock()
 	defer s.Unlock()
-	s.m = nil
+	s.links = nil
+	s.users = nil
+	s.tokens = nil
 	return nil
 }
 
-//**********************************************************************************************************************
+// active returns the link which is neither deleted nor expired at the time. It must be called under the lock.
+func (s *Storage) active(shortURL string, now time.Time) (*link, error) {
+	l, ok := s.links[shortURL]
+	if !ok {
+		return nil, &storageErrors.NotFoundError{Err: dto.ErrNotFound}
+	}
+	if l.isDeleted() {
+		return nil, dto.ErrDeleted
+	}
+	if l.info().Expired(now) {
+		return nil, dto.ErrExpired
+	}
+	return l, nil
+}
+
+// owned returns the link of the user unless he deleted it. It must be called under the lock.
+func (s *Storage) owned(userID, shortURL string) (*link, error) {
+	l, ok := s.links[shortURL]
+	if !ok {
+		return nil, &storageErrors.NotFoundError{Err: dto.ErrNotFound}
+	}
 
-//MarshalJSON serializes the database given in json format
-func (s *Storage) MarshalJSON() ([]byte, error) {
-	return json.Marshal(s.m)
+	isDeleted, ok := l.owners[userID]
+	if !ok {
+		return nil, dto.ErrNotOwner
+	}
+	if isDeleted {
+		return nil, dto.ErrDeleted
+	}
+	return l, nil
+}
+
+// visit counts the redirect by the link at the time. It must be called under the write lock.
+// The link expires at the time of the last allowed redirect.
+func (s *Storage) visit(shortURL string, now time.Time) (string, error) {
+	l, err := s.active(shortURL, now)
+	if err != nil {
+		return "", err
+	}
+
+	if l.opts.MaxClicks > 0 {
+		l.clicks++
+		if l.clicks >= l.opts.MaxClicks {
+			l.opts.ExpiresAt = now
+		}
+	}
+	return l.originURL, nil
 }
 
-//UnmarshalJSON deserializes the database given from json format
-func (s *Storage) UnmarshalJSON(data []byte) error {
-	if err := json.Unmarshal(data, &((*s).m)); err != nil {
-		return err
+// put adds the user to owners of short URL. It must be called under the lock.
+// The short URL is taken if it has another original URL or another password.
+func (s *Storage) put(userID, shortURL, originURL string, opts storage.LinkOptions) error {
+	l, ok := s.links[shortURL]
+	if !ok {
+		l = newLink(originURL, opts)
+		s.links[shortURL] = l
+	} else if l.originURL != originURL || l.opts.PasswordHash != opts.PasswordHash {
+		return &storageErrors.CodeTakenError{Err: dto.ErrCodeTaken}
+	}
+
+	if _, ok := l.owners[userID]; ok {
+		return &storageErrors.AlreadyExistsError{Err: dto.ErrAlreadyExists}
 	}
+	l.owners[userID] = false
+
+	s.index(userID, shortURL)
 	return nil
 }
+
+// index adds short URL to the secondary index of the user. It must be called under the lock.
+func (s *Storage) index(userID, shortURL string) {
+	shortURLs, ok := s.users[userID]
+	if !ok {
+		shortURLs = make(map[string]int64)
+		s.users[userID] = shortURLs
+	}
+	if _, ok = shortURLs[shortURL]; !ok {
+		s.counts.add(userID, 1)
+	}
+	shortURLs[shortURL] = atomic.AddInt64(s.seq, 1)
+}
+
+// batchError reports short URLs of the batch which were not saved.
+func batchError(existing, taken []string) error {
+	if len(taken) > 0 {
+		return &storageErrors.CodeTakenError{Err: dto.ErrCodeTaken, Keys: taken, Existing: existing}
+	}
+	if len(existing) > 0 {
+		return &storageErrors.AlreadyExistsError{Err: dto.ErrAlreadyExists, Keys: existing}
+	}
+	return nil
+}
+
+// unindex removes short URL from the secondary index of the user. It must be called under the lock.
+func (s *Storage) unindex(userID, shortURL string) {
+	shortURLs := s.users[userID]
+	if _, ok := shortURLs[shortURL]; ok {
+		delete(shortURLs, shortURL)
+		s.counts.add(userID, -1)
+	}
+	if len(shortURLs) == 0 {
+		delete(s.users, userID)
+	}
+}
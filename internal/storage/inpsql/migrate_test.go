@@ -0,0 +1,64 @@
+// Package inpsql implements storage in postgres database.
+package inpsql
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	t.Run("embedded migrations", func(t *testing.T) {
+		migrations, err := loadMigrations(migrationsFS)
+		require.NoError(t, err)
+		require.NotEmpty(t, migrations)
+		for i := 1; i < len(migrations); i++ {
+			assert.Less(t, migrations[i-1].Version, migrations[i].Version)
+		}
+	})
+
+	tests := []struct {
+		name    string
+		files   fstest.MapFS
+		wantErr bool
+	}{
+		{
+			name: "sorted by version",
+			files: fstest.MapFS{
+				"migrations/0002_b.up.sql":   {Data: []byte("up2")},
+				"migrations/0002_b.down.sql": {Data: []byte("down2")},
+				"migrations/0001_a.up.sql":   {Data: []byte("up1")},
+				"migrations/0001_a.down.sql": {Data: []byte("down1")},
+			},
+		},
+		{
+			name: "no down script",
+			files: fstest.MapFS{
+				"migrations/0001_a.up.sql": {Data: []byte("up1")},
+			},
+			wantErr: true,
+		},
+		{
+			name: "wrong file name",
+			files: fstest.MapFS{
+				"migrations/init.sql": {Data: []byte("up1")},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			migrations, err := loadMigrations(tt.files)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, migrations, 2)
+			assert.Equal(t, Migration{Version: 1, Name: "a", Up: "up1", Down: "down1"}, migrations[0])
+			assert.Equal(t, Migration{Version: 2, Name: "b", Up: "up2", Down: "down2"}, migrations[1])
+		})
+	}
+}
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS users_url;
+DROP TABLE IF EXISTS urls;
@@ -0,0 +1,13 @@
+-- The "is_deleted" flag is stored in "users_url" table, so user can control only his copy of URL.
+-- If user deletes his URL, the short link continues to work while other users own it.
+CREATE TABLE IF NOT EXISTS urls (
+	id serial primary key,
+	origin_url text not null unique,
+	short_url text not null
+);
+CREATE TABLE IF NOT EXISTS users_url (
+	user_id text not null,
+	url_id int not null references urls(id),
+	is_deleted boolean not null default false,
+	CONSTRAINT unique_url UNIQUE (user_id, url_id)
+);
@@ -0,0 +1,2 @@
+ALTER TABLE urls DROP CONSTRAINT IF EXISTS urls_short_url_key;
+ALTER TABLE urls ADD CONSTRAINT urls_origin_url_key UNIQUE (origin_url);
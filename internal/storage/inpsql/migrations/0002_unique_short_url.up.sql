@@ -0,0 +1,4 @@
+-- Short URL identifies the link, so it must be unique. The same original URL can have several short URLs
+-- made by generators which are not derived from the URL.
+ALTER TABLE urls DROP CONSTRAINT IF EXISTS urls_origin_url_key;
+ALTER TABLE urls ADD CONSTRAINT urls_short_url_key UNIQUE (short_url);
@@ -0,0 +1,7 @@
+-- Links can expire by time or by the number of redirects. When the last allowed redirect is made,
+-- "expires_at" is set to the time of it, so the sweeper purges links by "expires_at" only.
+ALTER TABLE urls
+	ADD COLUMN IF NOT EXISTS expires_at timestamptz,
+	ADD COLUMN IF NOT EXISTS max_clicks bigint not null default 0,
+	ADD COLUMN IF NOT EXISTS clicks bigint not null default 0;
+CREATE INDEX IF NOT EXISTS urls_expires_at_idx ON urls (expires_at) WHERE expires_at IS NOT NULL;
@@ -0,0 +1,2 @@
+-- Only salted slow hashes of passwords are stored, empty hash means the link is not protected.
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS password_hash text not null default '';
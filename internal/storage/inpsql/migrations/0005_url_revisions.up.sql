@@ -0,0 +1,10 @@
+-- Every change of the original URL is kept, revisions of one link are numbered from 1.
+CREATE TABLE IF NOT EXISTS url_revisions (
+	url_id int not null references urls(id) ON DELETE CASCADE,
+	revision int not null,
+	user_id text not null,
+	changed_at timestamptz not null,
+	old_url text not null,
+	new_url text not null,
+	PRIMARY KEY (url_id, revision)
+);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS users_url_user_id_id_idx;
+ALTER TABLE users_url DROP COLUMN IF EXISTS id;
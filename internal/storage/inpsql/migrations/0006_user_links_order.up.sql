@@ -0,0 +1,3 @@
+-- Links of the user are listed in order of creation, pages are taken by keyset on "id".
+ALTER TABLE users_url ADD COLUMN IF NOT EXISTS id bigserial;
+CREATE INDEX IF NOT EXISTS users_url_user_id_id_idx ON users_url (user_id, id);
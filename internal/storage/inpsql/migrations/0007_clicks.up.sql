@@ -0,0 +1,9 @@
+-- Redirects are recorded by batches, IP addresses are anonymised before they are saved.
+CREATE TABLE IF NOT EXISTS clicks (
+	url_id int not null references urls(id) ON DELETE CASCADE,
+	clicked_at timestamptz not null,
+	referrer text not null default '',
+	user_agent text not null default '',
+	ip text not null default ''
+);
+CREATE INDEX IF NOT EXISTS clicks_url_id_clicked_at_idx ON clicks (url_id, clicked_at);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS click_agents;
+DROP TABLE IF EXISTS click_referrers;
+DROP TABLE IF EXISTS click_hours;
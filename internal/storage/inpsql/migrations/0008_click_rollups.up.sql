@@ -0,0 +1,54 @@
+-- Clicks are aggregated by hours in UTC when they are saved, statistics are read from aggregates only.
+-- Clicks saved before the migration are aggregated by it, families of agents are defined like in storage.AgentFamily.
+CREATE TABLE IF NOT EXISTS click_hours (
+	url_id int not null references urls(id) ON DELETE CASCADE,
+	hour timestamptz not null,
+	clicks bigint not null,
+	PRIMARY KEY (url_id, hour)
+);
+CREATE TABLE IF NOT EXISTS click_referrers (
+	url_id int not null references urls(id) ON DELETE CASCADE,
+	hour timestamptz not null,
+	referrer text not null,
+	clicks bigint not null,
+	PRIMARY KEY (url_id, hour, referrer)
+);
+CREATE TABLE IF NOT EXISTS click_agents (
+	url_id int not null references urls(id) ON DELETE CASCADE,
+	hour timestamptz not null,
+	family text not null,
+	clicks bigint not null,
+	PRIMARY KEY (url_id, hour, family)
+);
+
+CREATE TEMPORARY TABLE click_backfill ON COMMIT DROP AS
+SELECT
+	url_id,
+	date_trunc('hour', clicked_at AT TIME ZONE 'UTC') AT TIME ZONE 'UTC' AS hour,
+	regexp_replace(lower(coalesce(substring(referrer from '^[^:/?#]+://(?:[^@/?#]*@)?([^:/?#]+)'), '')), '^www\.', '') AS referrer,
+	CASE
+		WHEN user_agent = '' THEN ''
+		WHEN lower(user_agent) LIKE '%yabrowser/%' THEN 'Yandex Browser'
+		WHEN lower(user_agent) LIKE '%edg/%' OR lower(user_agent) LIKE '%edge/%' THEN 'Edge'
+		WHEN lower(user_agent) LIKE '%opr/%' OR lower(user_agent) LIKE '%opera%' THEN 'Opera'
+		WHEN lower(user_agent) LIKE '%firefox/%' THEN 'Firefox'
+		WHEN lower(user_agent) LIKE '%chrome/%' OR lower(user_agent) LIKE '%crios/%' THEN 'Chrome'
+		WHEN lower(user_agent) LIKE '%safari/%' THEN 'Safari'
+		WHEN lower(user_agent) LIKE '%curl/%' THEN 'curl'
+		WHEN lower(user_agent) LIKE '%wget/%' THEN 'Wget'
+		WHEN lower(user_agent) LIKE '%go-http-client/%' THEN 'Go'
+		WHEN lower(user_agent) LIKE '%python-requests/%' THEN 'Python'
+		WHEN lower(user_agent) LIKE '%bot%' OR lower(user_agent) LIKE '%crawler%' OR lower(user_agent) LIKE '%spider%' THEN 'Bot'
+		ELSE 'Other'
+	END AS family
+FROM clicks;
+
+INSERT INTO click_hours (url_id, hour, clicks)
+SELECT url_id, hour, count(*) FROM click_backfill GROUP BY url_id, hour
+ON CONFLICT DO NOTHING;
+INSERT INTO click_referrers (url_id, hour, referrer, clicks)
+SELECT url_id, hour, referrer, count(*) FROM click_backfill GROUP BY url_id, hour, referrer
+ON CONFLICT DO NOTHING;
+INSERT INTO click_agents (url_id, hour, family, clicks)
+SELECT url_id, hour, family, count(*) FROM click_backfill GROUP BY url_id, hour, family
+ON CONFLICT DO NOTHING;
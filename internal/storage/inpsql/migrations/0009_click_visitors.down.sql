@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS click_visitors;
+ALTER TABLE clicks DROP COLUMN IF EXISTS visitor;
@@ -0,0 +1,9 @@
+-- Unique visitors are estimated by HyperLogLog sketches of days in UTC, see package hll.
+-- Sketches are merged by Storage under the lock of their rows, clicks saved before the migration have no visitors.
+ALTER TABLE clicks ADD COLUMN IF NOT EXISTS visitor bigint not null default 0;
+CREATE TABLE IF NOT EXISTS click_visitors (
+	url_id int not null references urls(id) ON DELETE CASCADE,
+	day timestamptz not null,
+	sketch bytea not null,
+	PRIMARY KEY (url_id, day)
+);
@@ -0,0 +1,26 @@
+-- Clicks of bots are merged into clicks of people.
+INSERT INTO click_hours (url_id, hour, bot, clicks)
+SELECT url_id, hour, false, clicks FROM click_hours WHERE bot
+ON CONFLICT (url_id, hour, bot) DO UPDATE SET clicks = click_hours.clicks + EXCLUDED.clicks;
+DELETE FROM click_hours WHERE bot;
+ALTER TABLE click_hours DROP CONSTRAINT IF EXISTS click_hours_pkey;
+ALTER TABLE click_hours DROP COLUMN IF EXISTS bot;
+ALTER TABLE click_hours ADD PRIMARY KEY (url_id, hour);
+
+INSERT INTO click_referrers (url_id, hour, bot, referrer, clicks)
+SELECT url_id, hour, false, referrer, clicks FROM click_referrers WHERE bot
+ON CONFLICT (url_id, hour, bot, referrer) DO UPDATE SET clicks = click_referrers.clicks + EXCLUDED.clicks;
+DELETE FROM click_referrers WHERE bot;
+ALTER TABLE click_referrers DROP CONSTRAINT IF EXISTS click_referrers_pkey;
+ALTER TABLE click_referrers DROP COLUMN IF EXISTS bot;
+ALTER TABLE click_referrers ADD PRIMARY KEY (url_id, hour, referrer);
+
+INSERT INTO click_agents (url_id, hour, bot, family, clicks)
+SELECT url_id, hour, false, family, clicks FROM click_agents WHERE bot
+ON CONFLICT (url_id, hour, bot, family) DO UPDATE SET clicks = click_agents.clicks + EXCLUDED.clicks;
+DELETE FROM click_agents WHERE bot;
+ALTER TABLE click_agents DROP CONSTRAINT IF EXISTS click_agents_pkey;
+ALTER TABLE click_agents DROP COLUMN IF EXISTS bot;
+ALTER TABLE click_agents ADD PRIMARY KEY (url_id, hour, family);
+
+ALTER TABLE clicks DROP COLUMN IF EXISTS bot;
@@ -0,0 +1,15 @@
+-- Clicks of bots are tagged when they are recorded and aggregated apart from clicks of people,
+-- so statistics can exclude them. Clicks saved before the migration are counted as clicks of people.
+ALTER TABLE clicks ADD COLUMN IF NOT EXISTS bot boolean not null default false;
+
+ALTER TABLE click_hours ADD COLUMN IF NOT EXISTS bot boolean not null default false;
+ALTER TABLE click_hours DROP CONSTRAINT IF EXISTS click_hours_pkey;
+ALTER TABLE click_hours ADD PRIMARY KEY (url_id, hour, bot);
+
+ALTER TABLE click_referrers ADD COLUMN IF NOT EXISTS bot boolean not null default false;
+ALTER TABLE click_referrers DROP CONSTRAINT IF EXISTS click_referrers_pkey;
+ALTER TABLE click_referrers ADD PRIMARY KEY (url_id, hour, bot, referrer);
+
+ALTER TABLE click_agents ADD COLUMN IF NOT EXISTS bot boolean not null default false;
+ALTER TABLE click_agents DROP CONSTRAINT IF EXISTS click_agents_pkey;
+ALTER TABLE click_agents ADD PRIMARY KEY (url_id, hour, bot, family);
@@ -0,0 +1,11 @@
+-- Refresh tokens are stored by their hashes. Rotated tokens are kept used until they expire, so their reuse is detected
+-- and the whole family of tokens is revoked.
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+	hash text primary key,
+	user_id text not null,
+	family text not null,
+	expires_at timestamptz not null,
+	used_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS refresh_tokens_family_idx ON refresh_tokens (family);
+CREATE INDEX IF NOT EXISTS refresh_tokens_expires_at_idx ON refresh_tokens (expires_at);
@@ -0,0 +1,292 @@
+// Package inpsql implements storage in postgres database.
+package inpsql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// statements contains statements prepared once at construction of Storage.
+type statements struct {
+	getLink      *sql.Stmt
+	visit        *sql.Stmt
+	getUserLinks *sql.Stmt
+	findUserLink *sql.Stmt
+	addURL       *sql.Stmt
+	addUser      *sql.Stmt
+	putBatch     *sql.Stmt
+	deleteBatch  *sql.Stmt
+	export       *sql.Stmt
+	getCounts    *sql.Stmt
+	purgeUsers   *sql.Stmt
+	purgeURLs    *sql.Stmt
+	getURL       *sql.Stmt
+	lockURL      *sql.Stmt
+	getOwners    *sql.Stmt
+	editURL      *sql.Stmt
+	getHistory   *sql.Stmt
+	saveClicks   *sql.Stmt
+	getClicks    *sql.Stmt
+
+	// refresh tokens of users
+	saveToken    *sql.Stmt
+	lockToken    *sql.Stmt
+	useToken     *sql.Stmt
+	revokeFamily *sql.Stmt
+	purgeTokens  *sql.Stmt
+
+	// daily sketches of unique visitors
+	addVisitors    *sql.Stmt
+	lockVisitors   *sql.Stmt
+	updateVisitors *sql.Stmt
+
+	// statistics of clicks from hourly aggregates and daily sketches
+	statsBuckets   *sql.Stmt
+	statsReferrers *sql.Stmt
+	statsAgents    *sql.Stmt
+	statsVisitors  *sql.Stmt
+	statsBots      *sql.Stmt
+
+	// pages of user links by sort order
+	listByCreated     *sql.Stmt
+	listByCreatedDesc *sql.Stmt
+	listByURL         *sql.Stmt
+	listByURLDesc     *sql.Stmt
+}
+
+// getLinkQuery resolves short URL to the original one with its restrictions and checks if it is deleted by all its users.
+const getLinkQuery = `
+SELECT u.origin_url, COALESCE(bool_and(uu.is_deleted), true), u.expires_at, u.max_clicks, u.clicks, u.password_hash
+FROM urls u LEFT JOIN users_url uu ON uu.url_id = u.id
+WHERE u.short_url = $1
+GROUP BY u.id
+LIMIT 1;`
+
+// visitQuery counts the redirect by the link if it is not expired.
+// The link expires at the time of the last allowed redirect.
+const visitQuery = `
+UPDATE urls SET
+	clicks = clicks + 1,
+	expires_at = CASE WHEN clicks + 1 >= max_clicks THEN now() ELSE expires_at END
+WHERE short_url = $1 AND clicks < max_clicks AND (expires_at IS NULL OR expires_at > now())
+RETURNING origin_url;`
+
+// getCountsQuery counts short URLs and users who own them, distinct users are read from the index of links of users.
+const getCountsQuery = `
+SELECT (SELECT count(*) FROM urls), (SELECT count(DISTINCT user_id) FROM users_url);`
+
+// addURLQuery inserts URL or returns the URL which already has the short URL.
+// "DO UPDATE" is used instead of "DO NOTHING" to return the existing row.
+const addURLQuery = `
+INSERT INTO urls (origin_url, short_url, expires_at, max_clicks, password_hash) VALUES ($1, $2, $3, $4, $5)
+ON CONFLICT (short_url) DO UPDATE SET short_url = EXCLUDED.short_url
+RETURNING id, origin_url, password_hash;`
+
+// putBatchQuery inserts all URLs of the batch and links them to the user in one statement.
+// Expiry times are passed in microseconds since epoch, 0 means the link doesn't expire by time.
+// URLs are linked to the user only if their short URLs are not taken by other URLs or by the same URL with another password.
+// It returns short URLs which were not saved: taken by other URLs (also within the batch) or already linked to the user.
+const putBatchQuery = `
+WITH raw_input AS (
+	SELECT origin_url, short_url, expires_at, max_clicks, password_hash
+	FROM unnest($2::text[], $3::text[], $4::bigint[], $5::bigint[], $6::text[]) AS t(origin_url, short_url, expires_at, max_clicks, password_hash)
+), input AS (
+	SELECT DISTINCT ON (short_url) origin_url, short_url, expires_at, max_clicks, password_hash FROM raw_input
+), batch_urls AS (
+	INSERT INTO urls (origin_url, short_url, expires_at, max_clicks, password_hash)
+	SELECT origin_url, short_url, CASE WHEN expires_at = 0 THEN NULL ELSE to_timestamp(expires_at / 1000000.0) END, max_clicks, password_hash
+	FROM input
+	ON CONFLICT (short_url) DO UPDATE SET short_url = EXCLUDED.short_url
+	RETURNING id, origin_url, short_url, password_hash
+), owned_urls AS (
+	SELECT b.id FROM batch_urls b
+	JOIN input i ON i.short_url = b.short_url AND i.origin_url = b.origin_url AND i.password_hash = b.password_hash
+), batch_users AS (
+	INSERT INTO users_url (user_id, url_id)
+	SELECT $1::text, id FROM owned_urls
+	ON CONFLICT ON CONSTRAINT unique_url DO NOTHING
+	RETURNING url_id
+)
+SELECT short_url, id NOT IN (SELECT id FROM owned_urls) AS taken
+FROM batch_urls WHERE id NOT IN (SELECT url_id FROM batch_users)
+UNION ALL
+SELECT short_url, true FROM raw_input r
+WHERE NOT EXISTS (SELECT 1 FROM input i WHERE i.short_url = r.short_url AND i.origin_url = r.origin_url);`
+
+// editURLQuery changes the original URL and records the revision with the next number.
+// The row of the link must be locked by lockURL in the same transaction.
+const editURLQuery = `
+WITH updated AS (
+	UPDATE urls SET origin_url = $3 WHERE id = $1
+)
+INSERT INTO url_revisions (url_id, revision, user_id, changed_at, old_url, new_url)
+SELECT $1, COALESCE(MAX(revision), 0) + 1, $2, $4, $5, $3 FROM url_revisions WHERE url_id = $1
+RETURNING revision;`
+
+// saveClicksQuery inserts the batch of clicks passed as arrays of fields and adds it to hourly aggregates.
+// Times are in microseconds since epoch, hours, hosts of referrers and families of agents are computed by Storage.
+// Clicks of bots are aggregated apart from clicks of people. Clicks of unknown short URLs are skipped by the join.
+const saveClicksQuery = `
+WITH input AS (
+	SELECT u.id AS url_id, to_timestamp(t.clicked_at / 1000000.0) AS clicked_at, t.referrer, t.user_agent, t.ip, t.visitor, t.bot,
+		to_timestamp(t.hour / 1000000.0) AS hour, t.referrer_host, t.family
+	FROM unnest($1::text[], $2::bigint[], $3::text[], $4::text[], $5::text[], $6::bigint[], $7::text[], $8::text[], $9::bigint[], $10::boolean[])
+		AS t(short_url, clicked_at, referrer, user_agent, ip, hour, referrer_host, family, visitor, bot)
+	JOIN urls u ON u.short_url = t.short_url
+), raw AS (
+	INSERT INTO clicks (url_id, clicked_at, referrer, user_agent, ip, visitor, bot)
+	SELECT url_id, clicked_at, referrer, user_agent, ip, visitor, bot FROM input
+), hours AS (
+	INSERT INTO click_hours (url_id, hour, bot, clicks)
+	SELECT url_id, hour, bot, count(*) FROM input GROUP BY url_id, hour, bot
+	ON CONFLICT (url_id, hour, bot) DO UPDATE SET clicks = click_hours.clicks + EXCLUDED.clicks
+), referrers AS (
+	INSERT INTO click_referrers (url_id, hour, bot, referrer, clicks)
+	SELECT url_id, hour, bot, referrer_host, count(*) FROM input GROUP BY url_id, hour, bot, referrer_host
+	ON CONFLICT (url_id, hour, bot, referrer) DO UPDATE SET clicks = click_referrers.clicks + EXCLUDED.clicks
+)
+INSERT INTO click_agents (url_id, hour, bot, family, clicks)
+SELECT url_id, hour, bot, family, count(*) FROM input GROUP BY url_id, hour, bot, family
+ON CONFLICT (url_id, hour, bot, family) DO UPDATE SET clicks = click_agents.clicks + EXCLUDED.clicks;`
+
+// addVisitorsQuery creates empty sketches of links ($1) and days ($2, microseconds since epoch) which have no sketches yet.
+// Rows are created before they are locked by lockVisitorsQuery, so concurrent batches can't overwrite sketches of each other.
+const addVisitorsQuery = `
+INSERT INTO click_visitors (url_id, day, sketch)
+SELECT u.id, to_timestamp(t.day / 1000000.0), ''::bytea
+FROM unnest($1::text[], $2::bigint[]) AS t(short_url, day)
+JOIN urls u ON u.short_url = t.short_url
+ON CONFLICT (url_id, day) DO NOTHING;`
+
+// lockVisitorsQuery locks and returns sketches of links ($1) and days ($2) in the order of their keys.
+const lockVisitorsQuery = `
+SELECT t.short_url, t.day, v.sketch
+FROM unnest($1::text[], $2::bigint[]) AS t(short_url, day)
+JOIN urls u ON u.short_url = t.short_url
+JOIN click_visitors v ON v.url_id = u.id AND v.day = to_timestamp(t.day / 1000000.0)
+ORDER BY v.url_id, v.day
+FOR UPDATE OF v;`
+
+// updateVisitorsQuery replaces sketches of links ($1) and days ($2) by merged ones ($3).
+const updateVisitorsQuery = `
+UPDATE click_visitors v SET sketch = t.sketch
+FROM unnest($1::text[], $2::bigint[], $3::bytea[]) AS t(short_url, day, sketch)
+JOIN urls u ON u.short_url = t.short_url
+WHERE v.url_id = u.id AND v.day = to_timestamp(t.day / 1000000.0);`
+
+// statsBucketsQuery returns clicks of the link in [$2, $3) by hours or by days in UTC if $4 is "day".
+// Clicks of bots are included if $5 is true.
+const statsBucketsQuery = `
+SELECT CASE WHEN $4::text = 'day' THEN date_trunc('day', hour AT TIME ZONE 'UTC') AT TIME ZONE 'UTC' ELSE hour END AS bucket,
+	sum(clicks)::bigint
+FROM click_hours
+WHERE url_id = $1 AND hour >= $2 AND hour < $3 AND (NOT bot OR $5::boolean)
+GROUP BY bucket
+ORDER BY bucket;`
+
+// statsTopQuery returns at most $4 values of the column of the aggregate table with the most clicks of the link in [$2, $3).
+// Clicks of bots are included if $5 is true. Ties are ordered bytewise like in other storages.
+func statsTopQuery(table, column string) string {
+	return fmt.Sprintf(`
+SELECT %[2]s, sum(clicks)::bigint AS total
+FROM %[1]s
+WHERE url_id = $1 AND hour >= $2 AND hour < $3 AND (NOT bot OR $5::boolean)
+GROUP BY %[2]s
+ORDER BY total DESC, %[2]s COLLATE "C"
+LIMIT $4;`, table, column)
+}
+
+// listUserLinksQuery returns query of the page of user links in the order with the keyset condition.
+// Parameters: user ID, substring of the URL, domain, deleted state or NULL, ID and URL of the last link or 0, limit.
+// URLs are compared bytewise by "C" collation like in other storages.
+// The last link is bound in "after", so the queries which don't use its URL have the same parameters.
+func listUserLinksQuery(orderBy, keyset string) string {
+	return fmt.Sprintf(`
+WITH after AS (
+	SELECT $5::bigint AS id, $6::text AS url
+)
+SELECT uu.id, u.short_url, u.origin_url, uu.is_deleted
+FROM after, users_url uu JOIN urls u ON u.id = uu.url_id
+CROSS JOIN LATERAL (
+	SELECT lower(substring(u.origin_url from '^[^:/?#]+://(?:[^@/?#]*@)?([^:/?#]+)')) AS host
+) h
+WHERE uu.user_id = $1
+	AND ($2::text = '' OR strpos(lower(u.origin_url), lower($2)) > 0)
+	AND ($3::text = '' OR h.host = $3 OR right(h.host, length($3) + 1) = '.' || $3)
+	AND ($4::boolean IS NULL OR uu.is_deleted = $4)
+	AND (after.id = 0 OR %s)
+ORDER BY %s
+LIMIT $7;`, keyset, orderBy)
+}
+
+// prepareStatements prepares all statements used by Storage.
+func prepareStatements(ctx context.Context, db *sql.DB) (*statements, error) {
+	st := &statements{}
+	queries := []struct {
+		stmt  **sql.Stmt
+		query string
+	}{
+		{&st.getLink, getLinkQuery},
+		{&st.visit, visitQuery},
+		{&st.getUserLinks, `SELECT short_url, origin_url FROM users_url RIGHT JOIN urls u on users_url.url_id=u.id WHERE user_id=$1;`},
+		{&st.findUserLink, `SELECT u.short_url FROM users_url uu JOIN urls u ON u.id = uu.url_id WHERE uu.user_id = $1 AND u.origin_url = $2 AND u.password_hash = '' ORDER BY uu.id LIMIT 1;`},
+		{&st.addURL, addURLQuery},
+		{&st.addUser, `INSERT INTO users_url (user_id, url_id) VALUES ($1, $2);`},
+		{&st.putBatch, putBatchQuery},
+		{&st.deleteBatch, `UPDATE users_url SET is_deleted = true WHERE user_id = $1 AND url_id = ANY(SELECT id FROM urls WHERE short_url = ANY($2));`},
+		{&st.getCounts, getCountsQuery},
+		{&st.export, `SELECT uu.user_id, u.short_url, u.origin_url, uu.is_deleted, u.expires_at, u.max_clicks, u.password_hash FROM users_url uu JOIN urls u ON u.id = uu.url_id ORDER BY u.id, uu.user_id;`},
+		{&st.purgeUsers, `DELETE FROM users_url WHERE url_id IN (SELECT id FROM urls WHERE expires_at < $1);`},
+		{&st.purgeURLs, `DELETE FROM urls WHERE expires_at < $1 RETURNING short_url;`},
+		{&st.getURL, `SELECT id, origin_url FROM urls WHERE short_url = $1;`},
+		{&st.lockURL, `SELECT id, origin_url FROM urls WHERE short_url = $1 FOR UPDATE;`},
+		{&st.getOwners, `SELECT user_id, is_deleted FROM users_url WHERE url_id = $1;`},
+		{&st.editURL, editURLQuery},
+		{&st.getHistory, `SELECT revision, user_id, changed_at, old_url, new_url FROM url_revisions WHERE url_id = $1 ORDER BY revision;`},
+		{&st.saveClicks, saveClicksQuery},
+		{&st.getClicks, `SELECT c.clicked_at, c.referrer, c.user_agent, c.ip, c.visitor, c.bot FROM clicks c JOIN urls u ON u.id = c.url_id WHERE u.short_url = $1 AND c.clicked_at >= $2 AND c.clicked_at < $3 ORDER BY c.clicked_at;`},
+		{&st.addVisitors, addVisitorsQuery},
+		{&st.saveToken, `INSERT INTO refresh_tokens (hash, user_id, family, expires_at) VALUES ($1, $2, $3, $4);`},
+		{&st.lockToken, `SELECT user_id, family, expires_at, used_at FROM refresh_tokens WHERE hash = $1 FOR UPDATE;`},
+		{&st.useToken, `UPDATE refresh_tokens SET used_at = $2 WHERE hash = $1;`},
+		{&st.revokeFamily, `DELETE FROM refresh_tokens WHERE family = $1;`},
+		{&st.purgeTokens, `DELETE FROM refresh_tokens WHERE expires_at < $1;`},
+		{&st.lockVisitors, lockVisitorsQuery},
+		{&st.updateVisitors, updateVisitorsQuery},
+		{&st.statsBuckets, statsBucketsQuery},
+		{&st.statsReferrers, statsTopQuery("click_referrers", "referrer")},
+		{&st.statsAgents, statsTopQuery("click_agents", "family")},
+		{&st.statsVisitors, `SELECT day, sketch FROM click_visitors WHERE url_id = $1 AND day >= $2 AND day < $3;`},
+		{&st.statsBots, `SELECT COALESCE(sum(clicks), 0)::bigint FROM click_hours WHERE url_id = $1 AND hour >= $2 AND hour < $3 AND bot;`},
+		{&st.listByCreated, listUserLinksQuery(`uu.id`, `uu.id > after.id`)},
+		{&st.listByCreatedDesc, listUserLinksQuery(`uu.id DESC`, `uu.id < after.id`)},
+		{&st.listByURL, listUserLinksQuery(`u.origin_url COLLATE "C", uu.id`, `(u.origin_url COLLATE "C", uu.id) > (after.url, after.id)`)},
+		{&st.listByURLDesc, listUserLinksQuery(`u.origin_url COLLATE "C" DESC, uu.id DESC`, `(u.origin_url COLLATE "C", uu.id) < (after.url, after.id)`)},
+	}
+
+	for _, q := range queries {
+		stmt, err := db.PrepareContext(ctx, q.query)
+		if err != nil {
+			st.Close()
+			return nil, err
+		}
+		*q.stmt = stmt
+	}
+	return st, nil
+}
+
+// Close closes all prepared statements.
+func (st *statements) Close() error {
+	for _, stmt := range []*sql.Stmt{st.getLink, st.visit, st.getUserLinks, st.findUserLink, st.addURL, st.addUser, st.putBatch, st.deleteBatch, st.export, st.getCounts, st.purgeUsers, st.purgeURLs,
+		st.getURL, st.lockURL, st.getOwners, st.editURL, st.getHistory, st.saveClicks, st.getClicks,
+		st.saveToken, st.lockToken, st.useToken, st.revokeFamily, st.purgeTokens,
+		st.addVisitors, st.lockVisitors, st.updateVisitors,
+		st.statsBuckets, st.statsReferrers, st.statsAgents, st.statsVisitors, st.statsBots,
+		st.listByCreated, st.listByCreatedDesc, st.listByURL, st.listByURLDesc} {
+		if stmt != nil {
+			stmt.Close()
+		}
+	}
+	return nil
+}
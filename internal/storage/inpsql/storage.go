@@ -8,9 +8,12 @@ import (
 	"fmt"
 	"github.com/jackc/pgerrcode"
 	"github.com/zhel1/yandex-practicum-go/internal/dto"
+	"github.com/zhel1/yandex-practicum-go/internal/hll"
 	"github.com/zhel1/yandex-practicum-go/internal/storage"
 	storageErrors "github.com/zhel1/yandex-practicum-go/internal/storage/errors"
 	"runtime"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/lib/pq"
@@ -23,26 +26,44 @@ import (
 
 //Check interface implementation
 var (
-	_ storage.Storage = (*Storage)(nil)
+	_ storage.Storage        = (*Storage)(nil)
+	_ storage.DeleteNotifier = (*Storage)(nil)
 )
 
+//PoolConfig contains settings of the pool of connections to DB
+type PoolConfig struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+}
+
 //DB PSQL struct
 type Storage struct {
 	DB          *sql.DB
+	stmts       *statements
 	deleteBuf   chan DeleteEntry //collect url until buff is full
 	deleteQueue chan []DeleteEntry
 	shutdown    chan int
 	done        chan int
+
+	onDeleteMu sync.RWMutex
+	onDelete   []func(shortURLs []string) //called after batches are deleted
 }
 
 //NewStorage is DB constructor
-func NewStorage(databaseDSN string) (storage.Storage, error) {
+func NewStorage(databaseDSN string, pool PoolConfig) (storage.Storage, error) {
 	//db, err := sql.Open("pgx", databaseDSN)
 	db, err := sql.Open("postgres", databaseDSN)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	db.SetMaxOpenConns(pool.MaxOpenConns)
+	db.SetMaxIdleConns(pool.MaxIdleConns)
+	db.SetConnMaxLifetime(pool.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(pool.ConnMaxIdleTime)
+
 	inPSQL := Storage{
 		DB:          db,
 		deleteBuf:   make(chan DeleteEntry),
@@ -55,7 +76,17 @@ func NewStorage(databaseDSN string) (storage.Storage, error) {
 		log.Fatal(err)
 	}
 
-	if err = inPSQL.createTable(); err != nil {
+	migrator, err := NewMigrator(inPSQL.DB)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err = migrator.Up(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+
+	inPSQL.stmts, err = prepareStatements(context.Background(), inPSQL.DB)
+	if err != nil {
 		log.Fatal(err)
 	}
 
@@ -107,75 +138,77 @@ func NewStorage(databaseDSN string) (storage.Storage, error) {
 }
 
 //Get gets original URL from DB
+//It returns dto.ErrDeleted if the URL is deleted by all users who own it and dto.ErrExpired if it is expired
 func (s *Storage) Get(ctx context.Context, shortURL string) (string, error) {
-	getOriginalURLStmt, err := s.DB.PrepareContext(ctx, "SELECT id,origin_url FROM urls WHERE short_url = $1;")
+	link, err := s.GetLink(ctx, shortURL)
 	if err != nil {
-		return "", &storageErrors.StatementPSQLError{Err: err}
+		return "", err
 	}
-	defer getOriginalURLStmt.Close()
 
-	var originURL string
-	var id int
-	if err := getOriginalURLStmt.QueryRowContext(ctx, shortURL).Scan(&id, &originURL); err != nil {
+	if link.Expired(time.Now()) {
+		return "", dto.ErrExpired
+	}
+
+	return link.OriginURL, nil
+}
+
+//GetLink gets original URL with its restrictions from DB
+func (s *Storage) GetLink(ctx context.Context, shortURL string) (storage.Link, error) {
+	var link storage.Link
+	var isDeleted bool
+	var expiresAt sql.NullTime
+	err := s.stmts.getLink.QueryRowContext(ctx, shortURL).Scan(&link.OriginURL, &isDeleted, &expiresAt, &link.Options.MaxClicks, &link.Clicks, &link.Options.PasswordHash)
+	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
-			return "", &storageErrors.NotFoundError{Err: dto.ErrNotFound}
+			return storage.Link{}, &storageErrors.NotFoundError{Err: dto.ErrNotFound}
 		default:
-			return "", &storageErrors.ExecutionPSQLError{Err: err}
+			return storage.Link{}, &storageErrors.ExecutionPSQLError{Err: err}
 		}
 	}
 
-	getDeletedRowsStmt, err := s.DB.PrepareContext(ctx, "SELECT is_deleted FROM users_url WHERE url_id = $1;")
-	if err != nil {
-		return "", &storageErrors.StatementPSQLError{Err: err}
+	if isDeleted {
+		return storage.Link{}, dto.ErrDeleted
 	}
-	defer getDeletedRowsStmt.Close()
 
-	deletedRows, err := getDeletedRowsStmt.QueryContext(ctx, id)
-	if err != nil {
-		return "", &storageErrors.ExecutionPSQLError{Err: err}
+	if expiresAt.Valid {
+		link.Options.ExpiresAt = expiresAt.Time
 	}
-	defer deletedRows.Close()
-
-	atLeastOneNotDeleted := false
-	for deletedRows.Next() {
-		var isDeleted bool
-		if err = deletedRows.Scan(&isDeleted); err != nil {
-			switch {
-			case errors.Is(err, sql.ErrNoRows):
-				return "", &storageErrors.NotFoundError{ /*Err: domain.ErrNotFound*/ }
-			default:
-				return "", &storageErrors.ExecutionPSQLError{Err: err}
-			}
-		}
+	return link, nil
+}
 
-		if !isDeleted {
-			atLeastOneNotDeleted = true
-			break
-		}
+//Visit gets original URL from DB for redirect
+//Redirects are counted only for links with limited number of them, other links are only read
+func (s *Storage) Visit(ctx context.Context, shortURL string) (string, error) {
+	link, err := s.GetLink(ctx, shortURL)
+	if err != nil {
+		return "", err
 	}
 
-	err = deletedRows.Err()
-	if err != nil {
-		return "", &storageErrors.ExecutionPSQLError{Err: err}
+	if link.Expired(time.Now()) {
+		return "", dto.ErrExpired
 	}
 
-	if !atLeastOneNotDeleted {
-		return "", dto.ErrDeleted
+	if link.Options.MaxClicks == 0 {
+		return link.OriginURL, nil
 	}
 
+	//the link can be expired by concurrent redirects after it was read
+	var originURL string
+	if err = s.stmts.visit.QueryRowContext(ctx, shortURL).Scan(&originURL); err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return "", dto.ErrExpired
+		default:
+			return "", &storageErrors.ExecutionPSQLError{Err: err}
+		}
+	}
 	return originURL, nil
 }
 
 //GetUserLinks gets all URLs by UserID from DB
 func (s *Storage) GetUserLinks(ctx context.Context, userID string) (map[string]string, error) {
-	getUserLinksRowsStmt, err := s.DB.PrepareContext(ctx, "SELECT short_url, origin_url FROM users_url RIGHT JOIN urls u on users_url.url_id=u.id WHERE user_id=$1;")
-	if err != nil {
-		return nil, &storageErrors.StatementPSQLError{Err: err}
-	}
-	defer getUserLinksRowsStmt.Close()
-
-	userLinksRows, err := getUserLinksRowsStmt.QueryContext(ctx, userID)
+	userLinksRows, err := s.stmts.getUserLinks.QueryContext(ctx, userID)
 	if err != nil {
 		fmt.Println(err.Error())
 		return nil, &storageErrors.ExecutionPSQLError{Err: err}
@@ -202,34 +235,83 @@ func (s *Storage) GetUserLinks(ctx context.Context, userID string) (map[string]s
 		return nil, &storageErrors.ExecutionPSQLError{Err: err}
 	}
 
+	if len(result) == 0 {
+		return nil, &storageErrors.NotFoundError{Err: dto.ErrNotFound}
+	}
+
 	return result, nil
 }
 
-//Put sets short URL in DB
-func (s *Storage) Put(ctx context.Context, userID string, shortURL, originURL string) error {
-	id := -1 //serial id in urls table
+//FindUserLink gets the first short URL of the user to the original URL without password from DB
+func (s *Storage) FindUserLink(ctx context.Context, userID, originURL string) (string, error) {
+	var shortURL string
+	if err := s.stmts.findUserLink.QueryRowContext(ctx, userID, originURL).Scan(&shortURL); err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return "", &storageErrors.NotFoundError{Err: dto.ErrNotFound}
+		default:
+			return "", &storageErrors.ExecutionPSQLError{Err: err}
+		}
+	}
+	return shortURL, nil
+}
 
-	//add URL statement
-	addURLStmt, err := s.DB.PrepareContext(ctx, `INSERT INTO urls (origin_url, short_url) VALUES ($1, $2) RETURNING id`)
-	if err != nil {
-		return &storageErrors.StatementPSQLError{Err: err}
+//ListUserLinks returns the page of links of the user taken by keyset condition
+func (s *Storage) ListUserLinks(ctx context.Context, userID string, query storage.LinksQuery) (storage.LinksPage, error) {
+	var stmt *sql.Stmt
+	switch {
+	case query.Sort == storage.SortURL && query.Desc:
+		stmt = s.stmts.listByURLDesc
+	case query.Sort == storage.SortURL:
+		stmt = s.stmts.listByURL
+	case query.Desc:
+		stmt = s.stmts.listByCreatedDesc
+	default:
+		stmt = s.stmts.listByCreated
 	}
-	defer addURLStmt.Close()
 
-	//add user statement
-	addUserStmt, err := s.DB.PrepareContext(ctx, `INSERT INTO users_url (user_id, url_id) VALUES ($1, $2);`)
-	if err != nil {
-		return &storageErrors.StatementPSQLError{Err: err}
+	var afterSeq int64
+	var afterURL string
+	if query.After != nil {
+		afterSeq, afterURL = query.After.Seq, query.After.OriginURL
+	}
+	var deleted sql.NullBool
+	if query.Deleted != nil {
+		deleted = sql.NullBool{Bool: *query.Deleted, Valid: true}
 	}
-	defer addUserStmt.Close()
 
-	//get id statement
-	getIDStmt, err := s.DB.PrepareContext(ctx, `SELECT id FROM urls WHERE origin_url = $1;`)
+	//one more link is taken to know if there is the next page
+	size := query.Size()
+	rows, err := stmt.QueryContext(ctx, userID, query.Search, query.Domain, deleted, afterSeq, afterURL, size+1)
 	if err != nil {
-		return &storageErrors.StatementPSQLError{Err: err}
+		return storage.LinksPage{}, &storageErrors.ExecutionPSQLError{Err: err}
+	}
+	defer rows.Close()
+
+	links := make([]storage.UserLink, 0, size)
+	for rows.Next() {
+		var link storage.UserLink
+		if err = rows.Scan(&link.Seq, &link.ShortURL, &link.OriginURL, &link.IsDeleted); err != nil {
+			return storage.LinksPage{}, &storageErrors.ExecutionPSQLError{Err: err}
+		}
+		links = append(links, link)
 	}
-	defer getIDStmt.Close()
 
+	if err = rows.Err(); err != nil {
+		return storage.LinksPage{}, &storageErrors.ExecutionPSQLError{Err: err}
+	}
+
+	if len(links) <= size {
+		return storage.LinksPage{Links: links}, nil
+	}
+	links = links[:size]
+	return storage.LinksPage{Links: links, Next: query.Cursor(links[len(links)-1])}, nil
+}
+
+//Put sets short URL in DB
+//It returns CodeTakenError if the short URL belongs to another original URL or to the same URL with another password
+//Restrictions of the link are set only if the link is new
+func (s *Storage) Put(ctx context.Context, userID string, shortURL, originURL string, opts storage.LinkOptions) error {
 	//begin transaction
 	tx, err := s.DB.BeginTx(ctx, nil)
 	if err != nil {
@@ -237,131 +319,229 @@ func (s *Storage) Put(ctx context.Context, userID string, shortURL, originURL st
 	}
 	defer tx.Rollback()
 
-	//add url
-	//I didn't find way to use prepared statement in transaction and get id using it.
-	err = addURLStmt.QueryRow(originURL, shortURL).Scan(&id)
+	txAddURLStmt := tx.StmtContext(ctx, s.stmts.addURL)
+	defer txAddURLStmt.Close()
+
+	//add url or get the url which already has the short URL
+	var id int
+	var existingURL, existingHash string
+	expiresAt := sql.NullTime{Time: opts.ExpiresAt, Valid: !opts.ExpiresAt.IsZero()}
+	err = txAddURLStmt.QueryRowContext(ctx, originURL, shortURL, expiresAt, opts.MaxClicks, opts.PasswordHash).Scan(&id, &existingURL, &existingHash)
 	if err != nil {
-		errCode := err.(*pq.Error).Code
-		//Error "already exists" is normal for another user
-		if !pgerrcode.IsIntegrityConstraintViolation(string(errCode)) {
-			return &storageErrors.ExecutionPSQLError{Err: err}
-		}
+		return &storageErrors.ExecutionPSQLError{Err: err}
+	}
+	if existingURL != originURL || existingHash != opts.PasswordHash {
+		return &storageErrors.CodeTakenError{Err: dto.ErrCodeTaken}
 	}
 
-	txAddUserStmt := tx.StmtContext(ctx, addUserStmt)
+	txAddUserStmt := tx.StmtContext(ctx, s.stmts.addUser)
 	defer txAddUserStmt.Close()
 
-	//if new row was added
-	if id != -1 {
-		if _, err := txAddUserStmt.ExecContext(ctx, userID, id); err != nil {
-			errCode := err.(*pq.Error).Code
-			if pgerrcode.IsIntegrityConstraintViolation(string(errCode)) {
-				return &storageErrors.AlreadyExistsError{Err: dto.ErrAlreadyExists}
-			}
-			return &storageErrors.ExecutionPSQLError{Err: err}
+	//error "already exists" means the user already has the URL
+	if _, err = txAddUserStmt.ExecContext(ctx, userID, id); err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pgerrcode.IsIntegrityConstraintViolation(string(pqErr.Code)) {
+			return &storageErrors.AlreadyExistsError{Err: dto.ErrAlreadyExists}
 		}
-	} else { //if new row already exists
-		err = getIDStmt.QueryRow(originURL).Scan(&id)
-		if err != nil {
-			fmt.Println(err.Error())
-			return &storageErrors.ExecutionPSQLError{Err: err}
+		return &storageErrors.ExecutionPSQLError{Err: err}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return &storageErrors.ExecutionPSQLError{Err: err}
+	}
+
+	return nil
+}
+
+//PutBatch sets short URLs in DB using a constant number of statements per batch
+//Restrictions of links are taken from opts by short URL
+//New URLs are saved even if some of them already exist or their short URLs are taken
+//The taken ones are reported in CodeTakenError, otherwise the existing ones are reported in AlreadyExistsError
+func (s *Storage) PutBatch(ctx context.Context, userID string, batchForDB map[string]string, opts map[string]storage.LinkOptions) error {
+	if len(batchForDB) == 0 {
+		return nil
+	}
+
+	originURLs := make([]string, 0, len(batchForDB))
+	shortURLs := make([]string, 0, len(batchForDB))
+	expiresAt := make([]int64, 0, len(batchForDB)) //microseconds since epoch, 0 if the link doesn't expire by time
+	maxClicks := make([]int64, 0, len(batchForDB))
+	passwordHashes := make([]string, 0, len(batchForDB))
+	for originURL, shortURL := range batchForDB {
+		originURLs = append(originURLs, originURL)
+		shortURLs = append(shortURLs, shortURL)
+
+		linkOpts := opts[shortURL]
+		var expiresAtMicro int64
+		if !linkOpts.ExpiresAt.IsZero() {
+			expiresAtMicro = linkOpts.ExpiresAt.UnixNano() / int64(time.Microsecond)
 		}
+		expiresAt = append(expiresAt, expiresAtMicro)
+		maxClicks = append(maxClicks, linkOpts.MaxClicks)
+		passwordHashes = append(passwordHashes, linkOpts.PasswordHash)
+	}
 
-		if _, err := txAddUserStmt.ExecContext(ctx, userID, id); err != nil {
-			errCode := err.(*pq.Error).Code
-			if pgerrcode.IsIntegrityConstraintViolation(string(errCode)) {
-				return &storageErrors.AlreadyExistsError{Err: dto.ErrAlreadyExists}
-			}
+	rejectedRows, err := s.stmts.putBatch.QueryContext(ctx, userID,
+		pq.Array(originURLs), pq.Array(shortURLs), pq.Array(expiresAt), pq.Array(maxClicks), pq.Array(passwordHashes))
+	if err != nil {
+		return &storageErrors.ExecutionPSQLError{Err: err}
+	}
+	defer rejectedRows.Close()
+
+	var existing, taken []string
+	for rejectedRows.Next() {
+		var shortURL string
+		var isTaken bool
+		if err = rejectedRows.Scan(&shortURL, &isTaken); err != nil {
 			return &storageErrors.ExecutionPSQLError{Err: err}
 		}
+		if isTaken {
+			taken = append(taken, shortURL)
+		} else {
+			existing = append(existing, shortURL)
+		}
 	}
 
-	err = tx.Commit()
-	if err != nil {
+	if err = rejectedRows.Err(); err != nil {
 		return &storageErrors.ExecutionPSQLError{Err: err}
 	}
 
+	if len(taken) > 0 {
+		return &storageErrors.CodeTakenError{Err: dto.ErrCodeTaken, Keys: taken, Existing: existing}
+	}
+	if len(existing) > 0 {
+		return &storageErrors.AlreadyExistsError{Err: dto.ErrAlreadyExists, Keys: existing}
+	}
 	return nil
 }
 
-func (s *Storage) PutBatch(ctx context.Context, userID string, batchForDB map[string]string) error {
-	id := -1 //serial id in urls table
+//Edit changes the original URL of short URL owned by the user and records the revision
+//The link can be edited only by its single owner, it returns dto.ErrLinkShared if other users own it too
+func (s *Storage) Edit(ctx context.Context, userID, shortURL, originURL string, at time.Time) (storage.Revision, error) {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return storage.Revision{}, &storageErrors.ExecutionPSQLError{Err: err}
+	}
+	defer tx.Rollback()
 
-	//add URL statement
-	addURLStmt, err := s.DB.PrepareContext(ctx, `INSERT INTO urls (origin_url, short_url) VALUES ($1, $2) RETURNING id`)
+	//the row is locked until the end of transaction, so concurrent edits get consecutive numbers
+	id, oldURL, err := s.owned(ctx, tx, userID, shortURL, true, true)
 	if err != nil {
-		return &storageErrors.StatementPSQLError{Err: err}
+		return storage.Revision{}, err
+	}
+
+	if oldURL == originURL {
+		return storage.Revision{}, nil
+	}
+
+	rev := storage.Revision{UserID: userID, ChangedAt: at, OldURL: oldURL, NewURL: originURL}
+	txEditStmt := tx.StmtContext(ctx, s.stmts.editURL)
+	defer txEditStmt.Close()
+	if err = txEditStmt.QueryRowContext(ctx, id, userID, originURL, at, oldURL).Scan(&rev.Number); err != nil {
+		return storage.Revision{}, &storageErrors.ExecutionPSQLError{Err: err}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return storage.Revision{}, &storageErrors.ExecutionPSQLError{Err: err}
 	}
-	defer addURLStmt.Close()
+	return rev, nil
+}
 
-	//add user statement
-	addUserStmt, err := s.DB.PrepareContext(ctx, `INSERT INTO users_url (user_id, url_id) VALUES ($1, $2);`)
+//GetHistory returns revisions of short URL owned by the user
+//Revisions are committed with the change of the link, so the history is read without locking the link
+func (s *Storage) GetHistory(ctx context.Context, userID, shortURL string) ([]storage.Revision, error) {
+	tx, err := s.DB.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
 	if err != nil {
-		return &storageErrors.StatementPSQLError{Err: err}
+		return nil, &storageErrors.ExecutionPSQLError{Err: err}
 	}
-	defer addUserStmt.Close()
+	defer tx.Rollback()
 
-	//get id statement
-	getIDStmt, err := s.DB.PrepareContext(ctx, `SELECT id FROM urls WHERE origin_url = $1;`)
+	id, _, err := s.owned(ctx, tx, userID, shortURL, false, false)
 	if err != nil {
-		return &storageErrors.StatementPSQLError{Err: err}
+		return nil, err
 	}
-	defer getIDStmt.Close()
 
-	//begin transaction
-	tx, err := s.DB.BeginTx(ctx, nil)
+	txHistoryStmt := tx.StmtContext(ctx, s.stmts.getHistory)
+	defer txHistoryStmt.Close()
+	rows, err := txHistoryStmt.QueryContext(ctx, id)
 	if err != nil {
-		return &storageErrors.ExecutionPSQLError{Err: err}
+		return nil, &storageErrors.ExecutionPSQLError{Err: err}
 	}
-	defer tx.Rollback()
+	defer rows.Close()
 
-	for originURL, shortURL := range batchForDB {
-		//add url
-		//I didn't find way to use prepared statement in transaction and get id using it.
-		err = addURLStmt.QueryRow(originURL, shortURL).Scan(&id)
-		if err != nil {
-			errCode := err.(*pq.Error).Code
-			//Error "already exists" is normal for another user
-			if !pgerrcode.IsIntegrityConstraintViolation(string(errCode)) {
-				return &storageErrors.ExecutionPSQLError{Err: err}
-			}
+	history := make([]storage.Revision, 0)
+	for rows.Next() {
+		var rev storage.Revision
+		if err = rows.Scan(&rev.Number, &rev.UserID, &rev.ChangedAt, &rev.OldURL, &rev.NewURL); err != nil {
+			return nil, &storageErrors.ExecutionPSQLError{Err: err}
 		}
+		history = append(history, rev)
+	}
 
-		txAddUserStmt := tx.StmtContext(ctx, addUserStmt)
-		defer txAddUserStmt.Close()
+	if err = rows.Err(); err != nil {
+		return nil, &storageErrors.ExecutionPSQLError{Err: err}
+	}
+	return history, nil
+}
 
-		//if new row was added
-		if id != -1 {
-			if _, err := txAddUserStmt.ExecContext(ctx, userID, id); err != nil {
-				errCode := err.(*pq.Error).Code
-				if pgerrcode.IsIntegrityConstraintViolation(string(errCode)) {
-					return &storageErrors.AlreadyExistsError{Err: dto.ErrAlreadyExists}
-				}
-				return &storageErrors.ExecutionPSQLError{Err: err}
-			}
-		} else { //if new row already exists
-			err = getIDStmt.QueryRow(originURL).Scan(&id)
-			if err != nil {
-				fmt.Println(err.Error())
-				return &storageErrors.ExecutionPSQLError{Err: err}
-			}
+//owned returns ID and original URL of short URL of the user unless he deleted it
+//The row of the link is locked until the end of the transaction if forUpdate is set, readers don't lock it
+//Other active owners are reported by dto.ErrLinkShared if exclusive is set
+func (s *Storage) owned(ctx context.Context, tx *sql.Tx, userID, shortURL string, forUpdate, exclusive bool) (int, string, error) {
+	stmt := s.stmts.getURL
+	if forUpdate {
+		stmt = s.stmts.lockURL
+	}
+	txURLStmt := tx.StmtContext(ctx, stmt)
+	defer txURLStmt.Close()
 
-			if _, err := txAddUserStmt.ExecContext(ctx, userID, id); err != nil {
-				errCode := err.(*pq.Error).Code
-				if pgerrcode.IsIntegrityConstraintViolation(string(errCode)) {
-					return &storageErrors.AlreadyExistsError{Err: dto.ErrAlreadyExists}
-				}
-				return &storageErrors.ExecutionPSQLError{Err: err}
-			}
+	var id int
+	var originURL string
+	if err := txURLStmt.QueryRowContext(ctx, shortURL).Scan(&id, &originURL); err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, "", &storageErrors.NotFoundError{Err: dto.ErrNotFound}
+		default:
+			return 0, "", &storageErrors.ExecutionPSQLError{Err: err}
 		}
 	}
 
-	err = tx.Commit()
+	txOwnersStmt := tx.StmtContext(ctx, s.stmts.getOwners)
+	defer txOwnersStmt.Close()
+	rows, err := txOwnersStmt.QueryContext(ctx, id)
 	if err != nil {
-		return &storageErrors.ExecutionPSQLError{Err: err}
+		return 0, "", &storageErrors.ExecutionPSQLError{Err: err}
 	}
+	defer rows.Close()
 
-	return nil
+	owner, deleted, shared := false, false, false
+	for rows.Next() {
+		var ownerID string
+		var isDeleted bool
+		if err = rows.Scan(&ownerID, &isDeleted); err != nil {
+			return 0, "", &storageErrors.ExecutionPSQLError{Err: err}
+		}
+		switch {
+		case ownerID == userID:
+			owner, deleted = true, isDeleted
+		case !isDeleted:
+			shared = true
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return 0, "", &storageErrors.ExecutionPSQLError{Err: err}
+	}
+
+	switch {
+	case !owner:
+		return 0, "", dto.ErrNotOwner
+	case deleted:
+		return 0, "", dto.ErrDeleted
+	case exclusive && shared:
+		return 0, "", dto.ErrLinkShared
+	}
+	return id, originURL, nil
 }
 
 //Delete deletes short URLs in DB by user ID
@@ -375,33 +555,492 @@ func (s *Storage) Delete(ctx context.Context, shortURLs []string, userID string)
 
 //Delete deletes batch short URLs in DB by user ID
 func (s *Storage) DeleteBatch(ctx context.Context, shortURLs []string, userID string) error {
-	deleteStmt, err := s.DB.PrepareContext(ctx, "UPDATE users_url SET is_deleted = true WHERE user_id = $1 AND url_id = ANY(SELECT id FROM urls WHERE short_url = ANY($2));")
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return &storageErrors.ExecutionPSQLError{Err: err}
+	}
+	defer tx.Rollback()
+
+	txDeleteStmt := tx.StmtContext(ctx, s.stmts.deleteBatch)
+	defer txDeleteStmt.Close()
+
+	_, err = txDeleteStmt.ExecContext(ctx, userID, pq.Array(shortURLs))
 	if err != nil {
 		return &storageErrors.ExecutionPSQLError{Err: err}
 	}
-	defer deleteStmt.Close()
 
+	err = tx.Commit()
+	if err != nil {
+		return &storageErrors.ExecutionPSQLError{Err: err}
+	}
+
+	s.onDeleteMu.RLock()
+	defer s.onDeleteMu.RUnlock()
+	for _, fn := range s.onDelete {
+		fn(shortURLs)
+	}
+	return nil
+}
+
+//OnDelete registers the function called with short URLs of every deleted batch
+func (s *Storage) OnDelete(fn func(shortURLs []string)) {
+	s.onDeleteMu.Lock()
+	defer s.onDeleteMu.Unlock()
+	s.onDelete = append(s.onDelete, fn)
+}
+
+//Purge removes links and refresh tokens expired before the time
+func (s *Storage) Purge(ctx context.Context, expiredBefore time.Time) ([]string, error) {
 	tx, err := s.DB.BeginTx(ctx, nil)
 	if err != nil {
+		return nil, &storageErrors.ExecutionPSQLError{Err: err}
+	}
+	defer tx.Rollback()
+
+	txPurgeUsersStmt := tx.StmtContext(ctx, s.stmts.purgeUsers)
+	defer txPurgeUsersStmt.Close()
+	if _, err = txPurgeUsersStmt.ExecContext(ctx, expiredBefore); err != nil {
+		return nil, &storageErrors.ExecutionPSQLError{Err: err}
+	}
+
+	txPurgeTokensStmt := tx.StmtContext(ctx, s.stmts.purgeTokens)
+	defer txPurgeTokensStmt.Close()
+	if _, err = txPurgeTokensStmt.ExecContext(ctx, expiredBefore); err != nil {
+		return nil, &storageErrors.ExecutionPSQLError{Err: err}
+	}
+
+	txPurgeURLsStmt := tx.StmtContext(ctx, s.stmts.purgeURLs)
+	defer txPurgeURLsStmt.Close()
+	purgedRows, err := txPurgeURLsStmt.QueryContext(ctx, expiredBefore)
+	if err != nil {
+		return nil, &storageErrors.ExecutionPSQLError{Err: err}
+	}
+	defer purgedRows.Close()
+
+	var purged []string
+	for purgedRows.Next() {
+		var shortURL string
+		if err = purgedRows.Scan(&shortURL); err != nil {
+			return nil, &storageErrors.ExecutionPSQLError{Err: err}
+		}
+		purged = append(purged, shortURL)
+	}
+
+	if err = purgedRows.Err(); err != nil {
+		return nil, &storageErrors.ExecutionPSQLError{Err: err}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, &storageErrors.ExecutionPSQLError{Err: err}
+	}
+	return purged, nil
+}
+
+//SaveRefreshToken stores the refresh token by its hash
+func (s *Storage) SaveRefreshToken(ctx context.Context, token storage.RefreshToken) error {
+	if _, err := s.stmts.saveToken.ExecContext(ctx, token.Hash, token.UserID, token.Family, token.ExpiresAt); err != nil {
 		return &storageErrors.ExecutionPSQLError{Err: err}
 	}
+	return nil
+}
+
+//RotateRefreshToken marks the token used at the time and saves the next token of its family under the lock of the token
+//The token is returned with dto.ErrTokenUsed too, so reuse can be told from concurrent rotation by the time of use
+func (s *Storage) RotateRefreshToken(ctx context.Context, hash string, next storage.RefreshToken, at time.Time) (storage.RefreshToken, error) {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return storage.RefreshToken{}, &storageErrors.ExecutionPSQLError{Err: err}
+	}
 	defer tx.Rollback()
 
-	txDeleteStmt := tx.StmtContext(ctx, deleteStmt)
-	defer txDeleteStmt.Close()
+	token := storage.RefreshToken{Hash: hash}
+	var usedAt sql.NullTime
+	txLockStmt := tx.StmtContext(ctx, s.stmts.lockToken)
+	defer txLockStmt.Close()
+	err = txLockStmt.QueryRowContext(ctx, hash).Scan(&token.UserID, &token.Family, &token.ExpiresAt, &usedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return storage.RefreshToken{}, &storageErrors.NotFoundError{Err: dto.ErrNotFound}
+	}
+	if err != nil {
+		return storage.RefreshToken{}, &storageErrors.ExecutionPSQLError{Err: err}
+	}
+	if usedAt.Valid {
+		token.UsedAt = &usedAt.Time
+	}
 
-	_, err = txDeleteStmt.ExecContext(ctx, userID, pq.Array(shortURLs))
+	if next, err = token.Rotate(next, at); err != nil {
+		return token, err
+	}
+
+	txUseStmt := tx.StmtContext(ctx, s.stmts.useToken)
+	defer txUseStmt.Close()
+	if _, err = txUseStmt.ExecContext(ctx, hash, at); err != nil {
+		return storage.RefreshToken{}, &storageErrors.ExecutionPSQLError{Err: err}
+	}
+
+	txSaveStmt := tx.StmtContext(ctx, s.stmts.saveToken)
+	defer txSaveStmt.Close()
+	if _, err = txSaveStmt.ExecContext(ctx, next.Hash, next.UserID, next.Family, next.ExpiresAt); err != nil {
+		return storage.RefreshToken{}, &storageErrors.ExecutionPSQLError{Err: err}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return storage.RefreshToken{}, &storageErrors.ExecutionPSQLError{Err: err}
+	}
+	token.UsedAt = &at
+	return token, nil
+}
+
+//RevokeTokenFamily removes all refresh tokens of the family
+func (s *Storage) RevokeTokenFamily(ctx context.Context, family string) error {
+	if _, err := s.stmts.revokeFamily.ExecContext(ctx, family); err != nil {
+		return &storageErrors.ExecutionPSQLError{Err: err}
+	}
+	return nil
+}
+
+//SaveClicks inserts the batch of clicks by one statement and merges its visitors into daily sketches
+func (s *Storage) SaveClicks(ctx context.Context, clicks []storage.Click) error {
+	if len(clicks) == 0 {
+		return nil
+	}
+
+	shortURLs := make([]string, 0, len(clicks))
+	clickedAt := make([]int64, 0, len(clicks)) //microseconds since epoch
+	referrers := make([]string, 0, len(clicks))
+	userAgents := make([]string, 0, len(clicks))
+	ips := make([]string, 0, len(clicks))
+	hours := make([]int64, 0, len(clicks)) //microseconds since epoch
+	referrerHosts := make([]string, 0, len(clicks))
+	families := make([]string, 0, len(clicks))
+	visitors := make([]int64, 0, len(clicks)) //fingerprints are stored as signed bigint
+	bots := make([]bool, 0, len(clicks))
+	for _, click := range clicks {
+		shortURLs = append(shortURLs, click.ShortURL)
+		clickedAt = append(clickedAt, click.At.UnixMicro())
+		referrers = append(referrers, click.Referrer)
+		userAgents = append(userAgents, click.UserAgent)
+		ips = append(ips, click.IP)
+		hours = append(hours, storage.ClickHour(click.At).UnixMicro())
+		referrerHosts = append(referrerHosts, storage.ReferrerHost(click.Referrer))
+		families = append(families, storage.AgentFamily(click.UserAgent))
+		visitors = append(visitors, int64(click.Visitor))
+		bots = append(bots, click.Bot)
+	}
+
+	tx, err := s.DB.BeginTx(ctx, nil)
 	if err != nil {
 		return &storageErrors.ExecutionPSQLError{Err: err}
 	}
+	defer tx.Rollback()
 
-	err = tx.Commit()
+	txSaveStmt := tx.StmtContext(ctx, s.stmts.saveClicks)
+	defer txSaveStmt.Close()
+	_, err = txSaveStmt.ExecContext(ctx, pq.Array(shortURLs), pq.Array(clickedAt), pq.Array(referrers), pq.Array(userAgents), pq.Array(ips),
+		pq.Array(hours), pq.Array(referrerHosts), pq.Array(families), pq.Array(visitors), pq.Array(bots))
+	if err != nil {
+		return &storageErrors.ExecutionPSQLError{Err: err}
+	}
+
+	if err = s.saveVisitors(ctx, tx, clicks); err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return &storageErrors.ExecutionPSQLError{Err: err}
+	}
+	return nil
+}
+
+//visitorsKey identifies the sketch of visitors of the link for the day
+type visitorsKey struct {
+	shortURL string
+	day      int64 //microseconds since epoch
+}
+
+//saveVisitors merges visitors of clicks into sketches of their links and days, bots are not visitors.
+//Sketches can't be merged by DB, so they are locked, merged by Storage and written back in the transaction.
+func (s *Storage) saveVisitors(ctx context.Context, tx *sql.Tx, clicks []storage.Click) error {
+	batch := make(map[visitorsKey]*hll.Sketch)
+	for _, click := range clicks {
+		if click.Visitor == 0 || click.Bot {
+			continue
+		}
+		key := visitorsKey{shortURL: click.ShortURL, day: storage.ClickDay(click.At).UnixMicro()}
+		sketch, ok := batch[key]
+		if !ok {
+			sketch = hll.New()
+			batch[key] = sketch
+		}
+		sketch.Add(click.Visitor)
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+
+	keys := make([]visitorsKey, 0, len(batch))
+	for key := range batch {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].shortURL != keys[j].shortURL {
+			return keys[i].shortURL < keys[j].shortURL
+		}
+		return keys[i].day < keys[j].day
+	})
+	shortURLs := make([]string, 0, len(keys))
+	days := make([]int64, 0, len(keys))
+	for _, key := range keys {
+		shortURLs = append(shortURLs, key.shortURL)
+		days = append(days, key.day)
+	}
+
+	txAddStmt := tx.StmtContext(ctx, s.stmts.addVisitors)
+	defer txAddStmt.Close()
+	if _, err := txAddStmt.ExecContext(ctx, pq.Array(shortURLs), pq.Array(days)); err != nil {
+		return &storageErrors.ExecutionPSQLError{Err: err}
+	}
+
+	txLockStmt := tx.StmtContext(ctx, s.stmts.lockVisitors)
+	defer txLockStmt.Close()
+	rows, err := txLockStmt.QueryContext(ctx, pq.Array(shortURLs), pq.Array(days))
+	if err != nil {
+		return &storageErrors.ExecutionPSQLError{Err: err}
+	}
+	defer rows.Close()
+
+	//only links which exist are returned, clicks of unknown links are skipped
+	shortURLs, days = shortURLs[:0], days[:0]
+	var sketches [][]byte
+	for rows.Next() {
+		var key visitorsKey
+		var stored []byte
+		if err = rows.Scan(&key.shortURL, &key.day, &stored); err != nil {
+			return &storageErrors.ExecutionPSQLError{Err: err}
+		}
+		merged, err := mergeSketch(stored, batch[key])
+		if err != nil {
+			return &storageErrors.ExecutionPSQLError{Err: err}
+		}
+		shortURLs = append(shortURLs, key.shortURL)
+		days = append(days, key.day)
+		sketches = append(sketches, merged)
+	}
+	if err = rows.Err(); err != nil {
+		return &storageErrors.ExecutionPSQLError{Err: err}
+	}
+	rows.Close()
+
+	txUpdateStmt := tx.StmtContext(ctx, s.stmts.updateVisitors)
+	defer txUpdateStmt.Close()
+	if _, err = txUpdateStmt.ExecContext(ctx, pq.Array(shortURLs), pq.Array(days), pq.Array(sketches)); err != nil {
+		return &storageErrors.ExecutionPSQLError{Err: err}
+	}
+	return nil
+}
+
+//mergeSketch returns the stored sketch merged with the sketch of the batch, new sketches are stored empty
+func mergeSketch(stored []byte, batch *hll.Sketch) ([]byte, error) {
+	sketch, err := readSketch(stored)
+	if err != nil {
+		return nil, err
+	}
+	sketch.Merge(batch)
+	return sketch.MarshalBinary()
+}
+
+//readSketch decodes the stored sketch, new sketches are stored empty
+func readSketch(stored []byte) (*hll.Sketch, error) {
+	sketch := hll.New()
+	if len(stored) == 0 {
+		return sketch, nil
+	}
+	if err := sketch.UnmarshalBinary(stored); err != nil {
+		return nil, err
+	}
+	return sketch, nil
+}
+
+//GetClicks returns clicks of the link made in [from, to)
+func (s *Storage) GetClicks(ctx context.Context, shortURL string, from, to time.Time) ([]storage.Click, error) {
+	rows, err := s.stmts.getClicks.QueryContext(ctx, shortURL, from, to)
+	if err != nil {
+		return nil, &storageErrors.ExecutionPSQLError{Err: err}
+	}
+	defer rows.Close()
+
+	var clicks []storage.Click
+	for rows.Next() {
+		click := storage.Click{ShortURL: shortURL}
+		var visitor int64
+		if err = rows.Scan(&click.At, &click.Referrer, &click.UserAgent, &click.IP, &visitor, &click.Bot); err != nil {
+			return nil, &storageErrors.ExecutionPSQLError{Err: err}
+		}
+		click.Visitor = uint64(visitor)
+		clicks = append(clicks, click)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, &storageErrors.ExecutionPSQLError{Err: err}
+	}
+	return clicks, nil
+}
+
+//GetLinkStats returns statistics of clicks of the link owned by the user from hourly aggregates
+//The link is not locked, so reading statistics doesn't block edits and counting of visits
+func (s *Storage) GetLinkStats(ctx context.Context, userID, shortURL string, query storage.StatsQuery) (storage.LinkStats, error) {
+	tx, err := s.DB.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return storage.LinkStats{}, &storageErrors.ExecutionPSQLError{Err: err}
+	}
+	defer tx.Rollback()
+
+	id, _, err := s.owned(ctx, tx, userID, shortURL, false, false)
+	if err != nil {
+		return storage.LinkStats{}, err
+	}
+
+	var stats storage.LinkStats
+	txBucketsStmt := tx.StmtContext(ctx, s.stmts.statsBuckets)
+	defer txBucketsStmt.Close()
+	rows, err := txBucketsStmt.QueryContext(ctx, id, query.From, query.To, query.Bucket, query.Bots)
+	if err != nil {
+		return storage.LinkStats{}, &storageErrors.ExecutionPSQLError{Err: err}
+	}
+	defer rows.Close()
+
+	stats.Buckets = make([]storage.StatsBucket, 0)
+	for rows.Next() {
+		var bucket storage.StatsBucket
+		if err = rows.Scan(&bucket.Start, &bucket.Clicks); err != nil {
+			return storage.LinkStats{}, &storageErrors.ExecutionPSQLError{Err: err}
+		}
+		bucket.Start = bucket.Start.UTC()
+		stats.Total += bucket.Clicks
+		stats.Buckets = append(stats.Buckets, bucket)
+	}
+	if err = rows.Err(); err != nil {
+		return storage.LinkStats{}, &storageErrors.ExecutionPSQLError{Err: err}
+	}
+
+	if stats.Referrers, err = s.statsTop(ctx, tx, s.stmts.statsReferrers, id, query); err != nil {
+		return storage.LinkStats{}, err
+	}
+	if stats.Agents, err = s.statsTop(ctx, tx, s.stmts.statsAgents, id, query); err != nil {
+		return storage.LinkStats{}, err
+	}
+	if err = s.statsVisitors(ctx, tx, id, query, &stats); err != nil {
+		return storage.LinkStats{}, err
+	}
+
+	txBotsStmt := tx.StmtContext(ctx, s.stmts.statsBots)
+	defer txBotsStmt.Close()
+	if err = txBotsStmt.QueryRowContext(ctx, id, query.From, query.To).Scan(&stats.Bots); err != nil {
+		return storage.LinkStats{}, &storageErrors.ExecutionPSQLError{Err: err}
+	}
+	return stats, nil
+}
+
+//statsVisitors merges sketches of days overlapping the period into unique visitors of the period and of day buckets
+func (s *Storage) statsVisitors(ctx context.Context, tx *sql.Tx, id int, query storage.StatsQuery, stats *storage.LinkStats) error {
+	fromDay, toDay := query.Days()
+	txVisitorsStmt := tx.StmtContext(ctx, s.stmts.statsVisitors)
+	defer txVisitorsStmt.Close()
+	rows, err := txVisitorsStmt.QueryContext(ctx, id, fromDay, toDay)
+	if err != nil {
+		return &storageErrors.ExecutionPSQLError{Err: err}
+	}
+	defer rows.Close()
+
+	visitors := hll.New()
+	dayVisitors := make(map[int64]int64)
+	for rows.Next() {
+		var day time.Time
+		var stored []byte
+		if err = rows.Scan(&day, &stored); err != nil {
+			return &storageErrors.ExecutionPSQLError{Err: err}
+		}
+		sketch, err := readSketch(stored)
+		if err != nil {
+			return &storageErrors.ExecutionPSQLError{Err: err}
+		}
+		visitors.Merge(sketch)
+		dayVisitors[day.Unix()] = int64(sketch.Estimate())
+	}
+	if err = rows.Err(); err != nil {
+		return &storageErrors.ExecutionPSQLError{Err: err}
+	}
+
+	stats.Visitors = int64(visitors.Estimate())
+	if query.Bucket == storage.BucketDay {
+		for i := range stats.Buckets {
+			stats.Buckets[i].Visitors = dayVisitors[stats.Buckets[i].Start.Unix()]
+		}
+	}
+	return nil
+}
+
+//statsTop returns the top of referrers or agent families of the link by the statement
+func (s *Storage) statsTop(ctx context.Context, tx *sql.Tx, stmt *sql.Stmt, id int, query storage.StatsQuery) ([]storage.StatsCount, error) {
+	txTopStmt := tx.StmtContext(ctx, stmt)
+	defer txTopStmt.Close()
+	rows, err := txTopStmt.QueryContext(ctx, id, query.From, query.To, query.Top, query.Bots)
+	if err != nil {
+		return nil, &storageErrors.ExecutionPSQLError{Err: err}
+	}
+	defer rows.Close()
+
+	top := make([]storage.StatsCount, 0, query.Top)
+	for rows.Next() {
+		var count storage.StatsCount
+		if err = rows.Scan(&count.Name, &count.Clicks); err != nil {
+			return nil, &storageErrors.ExecutionPSQLError{Err: err}
+		}
+		top = append(top, count)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, &storageErrors.ExecutionPSQLError{Err: err}
+	}
+	return top, nil
+}
+
+//Export calls fn for every link of every user, rows are streamed from DB
+func (s *Storage) Export(ctx context.Context, fn func(record storage.LinkRecord) error) error {
+	rows, err := s.stmts.export.QueryContext(ctx)
 	if err != nil {
 		return &storageErrors.ExecutionPSQLError{Err: err}
 	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var record storage.LinkRecord
+		var expiresAt sql.NullTime
+		if err = rows.Scan(&record.UserID, &record.ShortURL, &record.OriginURL, &record.IsDeleted, &expiresAt, &record.MaxClicks, &record.PasswordHash); err != nil {
+			return &storageErrors.ExecutionPSQLError{Err: err}
+		}
+		if expiresAt.Valid {
+			record.ExpiresAt = &expiresAt.Time
+		}
+		if err = fn(record); err != nil {
+			return err
+		}
+	}
+
+	if err = rows.Err(); err != nil {
+		return &storageErrors.ExecutionPSQLError{Err: err}
+	}
 	return nil
 }
 
+//GetCounts returns numbers of short URLs and users counted by DB
+func (s *Storage) GetCounts(ctx context.Context) (storage.Counts, error) {
+	var counts storage.Counts
+	if err := s.stmts.getCounts.QueryRowContext(ctx).Scan(&counts.URLs, &counts.Users); err != nil {
+		return storage.Counts{}, &storageErrors.ExecutionPSQLError{Err: err}
+	}
+	return counts, nil
+}
+
 //PingDB checks connection to DB
 func (s *Storage) PingDB() error {
 	return s.DB.Ping()
@@ -413,52 +1052,7 @@ func (s *Storage) Close() error {
 	<-s.done
 	close(s.deleteBuf)
 	close(s.deleteQueue)
+	s.stmts.Close()
 	s.DB.Close()
 	return nil
 }
-
-//**********************************************************************************************************************
-// ************************************ WAITING FOR A COMMENT FROM MENTORS *********************************************
-//**********************************************************************************************************************
-//	There are two variant to store "is_deleted" flag:
-//			   1. To store it in "urls" table. In this situation two or more users can control one URL.
-//				  Problem: User can expect, that his URL can be deleted by another user. Not good. Against task.
-//
-//  current -> 2. To store it in "users_url" table. In this situation user can control only his copy of URL.
-//				  Problem: If user delete his URL, he can expect, that his short link will continue to work.
-//**********************************************************************************************************************
-
-// 1.
-//func (s *Storage) createTable() error {
-//	query := `CREATE TABLE IF NOT EXISTS urls (
-//		id serial primary key,
-//		origin_url text not null unique,
-//		short_url text not null,
-//	    is_deleted boolean not null default false
-//	);
-//	CREATE TABLE IF NOT EXISTS users_url (
-//	  user_id text not null,
-//	  url_id int not null references urls(id),
-//	  CONSTRAINT unique_url UNIQUE (user_id, url_id)
-//	);
-//	`
-//	_, err := s.DB.Exec(query)
-//	return err
-//}
-// 2.
-func (s *Storage) createTable() error {
-	query := `CREATE TABLE IF NOT EXISTS urls (
-		id serial primary key,
-		origin_url text not null unique,
-		short_url text not null
-	);
-	CREATE TABLE IF NOT EXISTS users_url (
-	  user_id text not null,
-	  url_id int not null references urls(id),
-	  is_deleted boolean not null default false,
-	  CONSTRAINT unique_url UNIQUE (user_id, url_id)
-	);
-	`
-	_, err := s.DB.Exec(query)
-	return err
-}
@@ -0,0 +1,33 @@
+// Package inpsql implements storage in postgres database.
+package inpsql
+
+import (
+	"github.com/stretchr/testify/require"
+	"github.com/zhel1/yandex-practicum-go/internal/storage"
+	"github.com/zhel1/yandex-practicum-go/internal/storage/storagetest"
+	"os"
+	"testing"
+	"time"
+)
+
+// testDSNEnv is the name of environment variable with DSN of the database for tests.
+// All data in the database is removed by tests.
+const testDSNEnv = "TEST_DATABASE_DSN"
+
+func TestStorage(t *testing.T) {
+	dsn := os.Getenv(testDSNEnv)
+	if dsn == "" {
+		t.Skipf("%s is not set", testDSNEnv)
+	}
+
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		st, err := NewStorage(dsn, PoolConfig{MaxOpenConns: 10, MaxIdleConns: 5, ConnMaxLifetime: time.Minute})
+		require.NoError(t, err)
+
+		// all tables are truncated in one statement, so references between them are allowed, the list follows migrations
+		_, err = st.(*Storage).DB.Exec(`TRUNCATE users_url, urls, url_revisions, clicks, click_hours, click_referrers, click_agents, click_visitors,
+			refresh_tokens RESTART IDENTITY CASCADE;`)
+		require.NoError(t, err)
+		return st
+	})
+}
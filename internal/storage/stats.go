@@ -0,0 +1,142 @@
+// Package storage provides interfaces for database.
+package storage
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+//Buckets of the time series of clicks.
+const (
+	BucketHour = "hour"
+	BucketDay  = "day"
+)
+
+//StatsQuery selects statistics of clicks of the link.
+//Statistics are pre-aggregated by hours, so bounds are whole hours in UTC.
+type StatsQuery struct {
+	From   time.Time // the first hour, included
+	To     time.Time // the hour after the last one, excluded
+	Bucket string    // BucketHour or BucketDay, days are in UTC
+	Top    int       // the number of referrers and agent families
+	Bots   bool      // include clicks of bots, they are excluded by default
+}
+
+//StatsBucket is the number of clicks made within one bucket.
+type StatsBucket struct {
+	Start    time.Time
+	Clicks   int64
+	Visitors int64 // estimated unique visitors of the day, only for BucketDay
+}
+
+//StatsCount is the number of clicks with one referrer or agent family.
+type StatsCount struct {
+	Name   string
+	Clicks int64
+}
+
+//LinkStats are statistics of clicks of the link.
+//Unique visitors are estimated by HyperLogLog sketches of whole days, so they are counted for days overlapping the period.
+//Bots are never counted as visitors.
+type LinkStats struct {
+	Total     int64
+	Bots      int64         // clicks of bots in the period whether they are included or not
+	Visitors  int64         // estimated unique visitors of the days
+	Buckets   []StatsBucket // only buckets with clicks in order of time
+	Referrers []StatsCount  // hosts of referrers, empty for direct clicks
+	Agents    []StatsCount  // families of user agents, see AgentFamily
+}
+
+//ClickHour returns the hour of the click, clicks are aggregated by it.
+func ClickHour(t time.Time) time.Time {
+	return t.UTC().Truncate(time.Hour)
+}
+
+//ClickDay returns the day of the click in UTC, unique visitors are estimated by it.
+func ClickDay(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+//BucketStart returns the start of the bucket which contains the hour.
+func (q StatsQuery) BucketStart(hour time.Time) time.Time {
+	if q.Bucket == BucketDay {
+		return ClickDay(hour)
+	}
+	return hour.UTC().Truncate(time.Hour)
+}
+
+//Days returns days overlapping the period: from the first day to the day after the last one.
+func (q StatsQuery) Days() (from, to time.Time) {
+	from, to = ClickDay(q.From), ClickDay(q.To)
+	if to.Before(q.To) {
+		to = to.AddDate(0, 0, 1)
+	}
+	return from, to
+}
+
+//ReferrerHost returns the host of the referrer without "www." prefix, empty if the referrer is not a URL.
+func ReferrerHost(referrer string) string {
+	u, err := url.Parse(referrer)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+}
+
+//agentFamilies are families of user agents in order of checking: browsers include tokens of browsers they are based on.
+var agentFamilies = []struct {
+	token  string
+	family string
+}{
+	{token: "yabrowser/", family: "Yandex Browser"},
+	{token: "edg/", family: "Edge"},
+	{token: "edge/", family: "Edge"},
+	{token: "opr/", family: "Opera"},
+	{token: "opera", family: "Opera"},
+	{token: "firefox/", family: "Firefox"},
+	{token: "chrome/", family: "Chrome"},
+	{token: "crios/", family: "Chrome"},
+	{token: "safari/", family: "Safari"},
+	{token: "curl/", family: "curl"},
+	{token: "wget/", family: "Wget"},
+	{token: "go-http-client/", family: "Go"},
+	{token: "python-requests/", family: "Python"},
+	{token: "bot", family: "Bot"},
+	{token: "crawler", family: "Bot"},
+	{token: "spider", family: "Bot"},
+}
+
+//AgentFamily returns the family of the user agent: browser, tool or "Bot". Unknown agents are "Other", empty one is "".
+func AgentFamily(userAgent string) string {
+	if userAgent == "" {
+		return ""
+	}
+	ua := strings.ToLower(userAgent)
+	for _, f := range agentFamilies {
+		if strings.Contains(ua, f.token) {
+			return f.family
+		}
+	}
+	return "Other"
+}
+
+//TopCounts returns at most n counts ordered by descending number of clicks, ties are ordered by name.
+func TopCounts(counts map[string]int64, n int) []StatsCount {
+	top := make([]StatsCount, 0, len(counts))
+	for name, clicks := range counts {
+		top = append(top, StatsCount{Name: name, Clicks: clicks})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Clicks != top[j].Clicks {
+			return top[i].Clicks > top[j].Clicks
+		}
+		return top[i].Name < top[j].Name
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
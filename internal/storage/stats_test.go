@@ -0,0 +1,65 @@
+// Package storage provides interfaces for database.
+package storage
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestAgentFamily(t *testing.T) {
+	tests := []struct {
+		userAgent string
+		want      string
+	}{
+		{userAgent: "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/101.0.4951.67 Safari/537.36", want: "Chrome"},
+		{userAgent: "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/101.0.4951.67 Safari/537.36 Edg/101.0.1210.53", want: "Edge"},
+		{userAgent: "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/100.0.4896.160 YaBrowser/22.5.0.1916 Yowser/2.5 Safari/537.36", want: "Yandex Browser"},
+		{userAgent: "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/101.0.4951.64 Safari/537.36 OPR/87.0.4390.36", want: "Opera"},
+		{userAgent: "Mozilla/5.0 (X11; Linux x86_64; rv:100.0) Gecko/20100101 Firefox/100.0", want: "Firefox"},
+		{userAgent: "Mozilla/5.0 (iPhone; CPU iPhone OS 15_5 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/15.5 Mobile/15E148 Safari/604.1", want: "Safari"},
+		{userAgent: "curl/7.79.1", want: "curl"},
+		{userAgent: "Go-http-client/1.1", want: "Go"},
+		{userAgent: "Mozilla/5.0 (compatible; YandexBot/3.0; +http://yandex.com/bots)", want: "Bot"},
+		{userAgent: "Lynx/2.8.9rel.1", want: "Other"},
+		{userAgent: "", want: ""},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, AgentFamily(tt.userAgent), tt.userAgent)
+	}
+}
+
+func TestReferrerHost(t *testing.T) {
+	assert.Equal(t, "ya.ru", ReferrerHost("https://www.YA.ru/search?text=go"))
+	assert.Equal(t, "mail.ya.ru", ReferrerHost("https://mail.ya.ru:443/"))
+	assert.Equal(t, "", ReferrerHost("ya.ru/search"))
+	assert.Equal(t, "", ReferrerHost(""))
+}
+
+func TestTopCounts(t *testing.T) {
+	counts := map[string]int64{"b": 2, "a": 2, "c": 5, "d": 1}
+	assert.Equal(t, []StatsCount{{Name: "c", Clicks: 5}, {Name: "a", Clicks: 2}, {Name: "b", Clicks: 2}}, TopCounts(counts, 3))
+	assert.Empty(t, TopCounts(nil, 3))
+}
+
+func TestBucketStart(t *testing.T) {
+	hour := time.Date(2022, 5, 1, 23, 0, 0, 0, time.UTC)
+	assert.True(t, hour.Equal(StatsQuery{Bucket: BucketHour}.BucketStart(hour)))
+	assert.True(t, time.Date(2022, 5, 1, 0, 0, 0, 0, time.UTC).Equal(StatsQuery{Bucket: BucketDay}.BucketStart(hour)))
+	// days are in UTC whatever the zone of the time is
+	moscow := time.FixedZone("MSK", 3*60*60)
+	assert.True(t, time.Date(2022, 5, 1, 0, 0, 0, 0, time.UTC).Equal(StatsQuery{Bucket: BucketDay}.BucketStart(hour.In(moscow))))
+}
+
+func TestDays(t *testing.T) {
+	query := StatsQuery{From: time.Date(2022, 5, 1, 23, 0, 0, 0, time.UTC), To: time.Date(2022, 5, 3, 1, 0, 0, 0, time.UTC)}
+	from, to := query.Days()
+	assert.True(t, time.Date(2022, 5, 1, 0, 0, 0, 0, time.UTC).Equal(from))
+	assert.True(t, time.Date(2022, 5, 4, 0, 0, 0, 0, time.UTC).Equal(to))
+
+	// the end of the whole day is not extended
+	query.To = time.Date(2022, 5, 3, 0, 0, 0, 0, time.UTC)
+	_, to = query.Days()
+	assert.True(t, query.To.Equal(to))
+}
@@ -3,22 +3,248 @@ package storage
 
 import (
 	"context"
+	"github.com/zhel1/yandex-practicum-go/internal/dto"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
 )
 
 //Users struct
 type UserData struct {
-	ID   string            `json:"id"`
-	URLs map[string]string `json:"urls"`
+	ID      string            `json:"id"`
+	URLs    map[string]string `json:"urls"`
+	Deleted map[string]bool   `json:"deleted,omitempty"`
 }
 
 //UserData constructor
 func NewUserData(id string) UserData {
 	return UserData{
-		ID:   id,
-		URLs: make(map[string]string),
+		ID:      id,
+		URLs:    make(map[string]string),
+		Deleted: make(map[string]bool),
 	}
 }
 
+//LinkRecord is one link of one user. It is used to move data between storages.
+//The number of made redirects, recorded clicks and revisions of the original URL are not moved.
+type LinkRecord struct {
+	UserID       string     `json:"user_id"`
+	ShortURL     string     `json:"short_url"`
+	OriginURL    string     `json:"original_url"`
+	IsDeleted    bool       `json:"is_deleted"`
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	MaxClicks    int64      `json:"max_clicks,omitempty"`
+	PasswordHash string     `json:"password_hash,omitempty"`
+}
+
+//Options returns restrictions of the link.
+func (r LinkRecord) Options() LinkOptions {
+	opts := LinkOptions{MaxClicks: r.MaxClicks, PasswordHash: r.PasswordHash}
+	if r.ExpiresAt != nil {
+		opts.ExpiresAt = *r.ExpiresAt
+	}
+	return opts
+}
+
+//LinkOptions are restrictions of the short URL set on its creation.
+//When the last allowed redirect is made, ExpiresAt is set to the time of it.
+//Links with different password hashes are never shared by users, hashes are salted, so protected links are not shared at all
+//unless they are moved between storages.
+type LinkOptions struct {
+	ExpiresAt    time.Time `json:"expires_at"`              // zero if the link doesn't expire by time
+	MaxClicks    int64     `json:"max_clicks,omitempty"`    // zero if the number of redirects is not limited
+	PasswordHash string    `json:"password_hash,omitempty"` // empty if the link is not protected by password
+}
+
+//Link is the original URL with restrictions of the short URL.
+type Link struct {
+	OriginURL string
+	Options   LinkOptions
+	Clicks    int64 // the number of counted redirects, they are counted only if MaxClicks is set
+}
+
+//Expired checks whether the link stops redirecting at the moment.
+func (l Link) Expired(now time.Time) bool {
+	if !l.Options.ExpiresAt.IsZero() && !now.Before(l.Options.ExpiresAt) {
+		return true
+	}
+	return l.Options.MaxClicks > 0 && l.Clicks >= l.Options.MaxClicks
+}
+
+//Revision is one change of the original URL of the short URL. Revisions of the link are numbered from 1.
+type Revision struct {
+	Number    int       `json:"number"`
+	UserID    string    `json:"user_id"`
+	ChangedAt time.Time `json:"changed_at"`
+	OldURL    string    `json:"old_url"`
+	NewURL    string    `json:"new_url"`
+}
+
+//Click is one redirect by the short URL.
+type Click struct {
+	ShortURL  string    `json:"short_url"`
+	At        time.Time `json:"at"`
+	Referrer  string    `json:"referrer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	IP        string    `json:"ip,omitempty"`      // anonymised address of the client
+	Visitor   uint64    `json:"visitor,omitempty"` // salted fingerprint of the client, 0 if unknown
+	Bot       bool      `json:"bot,omitempty"`     // made by a bot, a crawler or a preview of the link
+}
+
+//Sort orders of links of the user.
+const (
+	SortCreated = "created"
+	SortURL     = "url"
+)
+
+//UserLink is the link of the user as it is listed.
+type UserLink struct {
+	Seq       int64 // increases with creation of links, it is unique for all users
+	ShortURL  string
+	OriginURL string
+	IsDeleted bool
+}
+
+//LinksCursor is the position of the last link of the previous page.
+type LinksCursor struct {
+	Seq       int64  `json:"seq"`
+	OriginURL string `json:"url,omitempty"` // only for sort by URL
+}
+
+//LinksQuery selects the page of links of the user.
+type LinksQuery struct {
+	Sort    string // SortCreated or SortURL, ties are ordered by creation
+	Desc    bool
+	Search  string // substring of the original URL, case-insensitive
+	Domain  string // host of the original URL or its parent domain in lower case
+	Deleted *bool  // both deleted and not deleted links are listed if nil
+	Limit   int
+	After   *LinksCursor // the first page is listed if nil
+}
+
+//Limits of the size of page of user links.
+const (
+	DefaultPageSize = 100
+	MaxPageSize     = 1000
+)
+
+//Size returns the number of links on the page: DefaultPageSize if the limit is not positive, at most MaxPageSize.
+func (q LinksQuery) Size() int {
+	switch {
+	case q.Limit <= 0:
+		return DefaultPageSize
+	case q.Limit > MaxPageSize:
+		return MaxPageSize
+	default:
+		return q.Limit
+	}
+}
+
+//LinksPage is the page of links of the user. Next is nil on the last page.
+type LinksPage struct {
+	Links []UserLink
+	Next  *LinksCursor
+}
+
+//Match checks whether the link passes filters of the query.
+func (q LinksQuery) Match(l UserLink) bool {
+	if q.Deleted != nil && *q.Deleted != l.IsDeleted {
+		return false
+	}
+	if q.Search != "" && !strings.Contains(strings.ToLower(l.OriginURL), strings.ToLower(q.Search)) {
+		return false
+	}
+	if q.Domain != "" {
+		u, err := url.Parse(l.OriginURL)
+		if err != nil {
+			return false
+		}
+		host := strings.ToLower(u.Hostname())
+		if host != q.Domain && !strings.HasSuffix(host, "."+q.Domain) {
+			return false
+		}
+	}
+	return true
+}
+
+//Less reports whether the link a goes before the link b in order of the query.
+//URLs are compared bytewise.
+func (q LinksQuery) Less(a, b UserLink) bool {
+	if q.Sort == SortURL && a.OriginURL != b.OriginURL {
+		return (a.OriginURL < b.OriginURL) != q.Desc
+	}
+	if q.Desc {
+		return a.Seq > b.Seq
+	}
+	return a.Seq < b.Seq
+}
+
+//Cursor returns the position of the link in order of the query.
+func (q LinksQuery) Cursor(l UserLink) *LinksCursor {
+	c := &LinksCursor{Seq: l.Seq}
+	if q.Sort == SortURL {
+		c.OriginURL = l.OriginURL
+	}
+	return c
+}
+
+//Page filters the links, orders them and takes the page after the cursor.
+//It is used by storages which keep links in memory.
+func (q LinksQuery) Page(links []UserLink) LinksPage {
+	var after UserLink
+	if q.After != nil {
+		after = UserLink{Seq: q.After.Seq, OriginURL: q.After.OriginURL}
+	}
+
+	selected := make([]UserLink, 0, len(links))
+	for _, l := range links {
+		if q.Match(l) && (q.After == nil || q.Less(after, l)) {
+			selected = append(selected, l)
+		}
+	}
+	sort.Slice(selected, func(i, j int) bool {
+		return q.Less(selected[i], selected[j])
+	})
+
+	if len(selected) <= q.Size() {
+		return LinksPage{Links: selected}
+	}
+	selected = selected[:q.Size()]
+	return LinksPage{Links: selected, Next: q.Cursor(selected[len(selected)-1])}
+}
+
+//Counts are numbers of stored short URLs and of users who own them, deleted links and their owners are counted too.
+type Counts struct {
+	URLs  int64
+	Users int64
+}
+
+//RefreshToken is the refresh token of the user, only the hash of the token is stored.
+//Tokens issued by rotation of one token form its family, the rotated token is kept used until it expires,
+//so reuse of it is detected. Expired tokens are removed by Purge.
+type RefreshToken struct {
+	Hash      string     `json:"hash"`
+	UserID    string     `json:"user_id"`
+	Family    string     `json:"family"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty"` // nil until the token is rotated
+}
+
+//Rotate checks that the token can be rotated at the time and returns the next token of its family.
+//It returns dto.ErrExpired if the token is expired and dto.ErrTokenUsed if it is already rotated.
+//It is used by storages which keep tokens in memory.
+func (t RefreshToken) Rotate(next RefreshToken, at time.Time) (RefreshToken, error) {
+	if !at.Before(t.ExpiresAt) {
+		return RefreshToken{}, dto.ErrExpired
+	}
+	if t.UsedAt != nil {
+		return RefreshToken{}, dto.ErrTokenUsed
+	}
+	next.UserID, next.Family = t.UserID, t.Family
+	return next, nil
+}
+
 //**********************************************************************************************************************
 
 //Pinger interface
@@ -26,14 +252,35 @@ type Pinger interface {
 	PingDB() error
 }
 
+//DeleteNotifier is implemented by storages which delete links asynchronously, after Delete returns.
+//Registered functions are called with short URLs once they are deleted.
+type DeleteNotifier interface {
+	OnDelete(fn func(shortURLs []string))
+}
+
 //**********************************************************************************************************************
 
 //Storage interface
 type Storage interface {
 	Get(ctx context.Context, key string) (string, error)
+	GetLink(ctx context.Context, shortURL string) (Link, error) // link even if it is expired
+	Visit(ctx context.Context, shortURL string) (string, error) // Get which counts the redirect
 	GetUserLinks(ctx context.Context, userID string) (map[string]string, error)
-	Put(ctx context.Context, userID, shortURL, originURL string) error
-	PutBatch(ctx context.Context, userID string, batchForDB map[string]string) error
+	FindUserLink(ctx context.Context, userID, originURL string) (string, error) // short URL of the user to the URL without password
+	ListUserLinks(ctx context.Context, userID string, query LinksQuery) (LinksPage, error)
+	Put(ctx context.Context, userID, shortURL, originURL string, opts LinkOptions) error
+	PutBatch(ctx context.Context, userID string, batchForDB map[string]string, opts map[string]LinkOptions) error
 	Delete(ctx context.Context, shortURLs []string, userID string) error
+	Edit(ctx context.Context, userID, shortURL, originURL string, at time.Time) (Revision, error)   // zero revision if the URL is the same
+	GetHistory(ctx context.Context, userID, shortURL string) ([]Revision, error)                    // revisions in order of numbers
+	Purge(ctx context.Context, expiredBefore time.Time) ([]string, error)                           // removes links, returns their short URLs
+	SaveClicks(ctx context.Context, clicks []Click) error                                           // clicks of unknown links are skipped
+	GetClicks(ctx context.Context, shortURL string, from, to time.Time) ([]Click, error)            // clicks in [from, to) in order of time
+	GetLinkStats(ctx context.Context, userID, shortURL string, query StatsQuery) (LinkStats, error) // of the link owned by the user
+	Export(ctx context.Context, fn func(record LinkRecord) error) error
+	GetCounts(ctx context.Context) (Counts, error) // without scanning links
+	SaveRefreshToken(ctx context.Context, token RefreshToken) error
+	RotateRefreshToken(ctx context.Context, hash string, next RefreshToken, at time.Time) (RefreshToken, error) // marks the token used, saves the next one
+	RevokeTokenFamily(ctx context.Context, family string) error                                                 // removes all tokens of the family
 	Close() error
 }
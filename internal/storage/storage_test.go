@@ -0,0 +1,42 @@
+// Package storage provides interfaces for database.
+package storage
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestLinksQueryPage(t *testing.T) {
+	links := make([]UserLink, 0, MaxPageSize+10)
+	for i := 1; i <= MaxPageSize+10; i++ {
+		links = append(links, UserLink{Seq: int64(i), ShortURL: fmt.Sprint(i), OriginURL: fmt.Sprintf("https://yandex.ru/%d", i)})
+	}
+
+	tests := []struct {
+		name  string
+		limit int
+		want  int
+	}{
+		{name: "limit", limit: 3, want: 3},
+		{name: "zero limit", limit: 0, want: DefaultPageSize},
+		{name: "negative limit", limit: -1, want: DefaultPageSize},
+		{name: "too big limit", limit: MaxPageSize + 1, want: MaxPageSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := LinksQuery{Sort: SortCreated, Limit: tt.limit}
+			assert.Equal(t, tt.want, query.Size())
+
+			page := query.Page(links)
+			assert.Len(t, page.Links, tt.want)
+			if assert.NotNil(t, page.Next) {
+				assert.Equal(t, int64(tt.want), page.Next.Seq)
+			}
+		})
+	}
+
+	page := LinksQuery{Sort: SortCreated, Limit: -1}.Page(links[:2])
+	assert.Len(t, page.Links, 2)
+	assert.Nil(t, page.Next)
+}
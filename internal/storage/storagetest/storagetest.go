@@ -0,0 +1,856 @@
+// Package storagetest provides behavioural tests which every implementation of storage.Storage must pass.
+package storagetest
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhel1/yandex-practicum-go/internal/dto"
+	"github.com/zhel1/yandex-practicum-go/internal/storage"
+	storageErrors "github.com/zhel1/yandex-practicum-go/internal/storage/errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// NewStorageFunc creates empty storage for one test. The storage is closed by the test.
+type NewStorageFunc func(t *testing.T) storage.Storage
+
+// deleteTimeout is the time within which asynchronous deletion must be completed.
+const deleteTimeout = 15 * time.Second
+
+// Run runs all behavioural tests against storage created by newStorage.
+func Run(t *testing.T, newStorage NewStorageFunc) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, st storage.Storage)
+	}{
+		{name: "put and get", test: testPutGet},
+		{name: "get unknown", test: testGetUnknown},
+		{name: "put conflict", test: testPutConflict},
+		{name: "put taken code", test: testPutCodeTaken},
+		{name: "put by several users", test: testPutSeveralUsers},
+		{name: "user links", test: testGetUserLinks},
+		{name: "user links of unknown user", test: testGetUserLinksUnknown},
+		{name: "find user link", test: testFindUserLink},
+		{name: "put batch", test: testPutBatch},
+		{name: "put batch conflict", test: testPutBatchConflict},
+		{name: "put batch taken code", test: testPutBatchCodeTaken},
+		{name: "delete", test: testDelete},
+		{name: "delete by one of owners", test: testDeleteByOneOwner},
+		{name: "concurrent puts", test: testConcurrentPuts},
+		{name: "expiry by time", test: testExpiryByTime},
+		{name: "expiry by clicks", test: testExpiryByClicks},
+		{name: "options of existing link", test: testOptionsOfExistingLink},
+		{name: "purge", test: testPurge},
+		{name: "protected link is not shared", test: testProtectedLinkNotShared},
+		{name: "edit", test: testEdit},
+		{name: "edit by not owner", test: testEditNotOwner},
+		{name: "edit of shared link", test: testEditShared},
+		{name: "list user links by pages", test: testListUserLinks},
+		{name: "list user links with filters", test: testListUserLinksFilters},
+		{name: "clicks", test: testClicks},
+		{name: "link stats", test: testLinkStats},
+		{name: "link visitors", test: testLinkVisitors},
+		{name: "link stats without bots", test: testLinkStatsBots},
+		{name: "counts", test: testCounts},
+		{name: "refresh tokens", test: testRefreshTokens},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			st := newStorage(t)
+			tt.test(t, st)
+			assert.NoError(t, st.Close())
+		})
+	}
+}
+
+// origin returns unique original URL for short URL.
+func origin(shortURL string) string {
+	return "https://www." + shortURL + ".com/"
+}
+
+func testPutGet(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	require.NoError(t, st.Put(ctx, "user1", "short1", origin("short1"), storage.LinkOptions{}))
+
+	originURL, err := st.Get(ctx, "short1")
+	require.NoError(t, err)
+	assert.Equal(t, origin("short1"), originURL)
+}
+
+func testGetUnknown(t *testing.T, st storage.Storage) {
+	_, err := st.Get(context.Background(), "unknown")
+	assert.ErrorIs(t, err, dto.ErrNotFound)
+
+	var notFoundErr *storageErrors.NotFoundError
+	assert.True(t, errors.As(err, &notFoundErr))
+}
+
+func testPutConflict(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	require.NoError(t, st.Put(ctx, "user1", "short1", origin("short1"), storage.LinkOptions{}))
+
+	err := st.Put(ctx, "user1", "short1", origin("short1"), storage.LinkOptions{})
+	assert.ErrorIs(t, err, dto.ErrAlreadyExists)
+}
+
+func testPutCodeTaken(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	require.NoError(t, st.Put(ctx, "user1", "short1", origin("short1"), storage.LinkOptions{}))
+
+	for _, userID := range []string{"user1", "user2"} {
+		err := st.Put(ctx, userID, "short1", origin("other"), storage.LinkOptions{})
+		assert.ErrorIs(t, err, dto.ErrCodeTaken)
+		assert.False(t, errors.Is(err, dto.ErrAlreadyExists))
+	}
+
+	originURL, err := st.Get(ctx, "short1")
+	require.NoError(t, err)
+	assert.Equal(t, origin("short1"), originURL)
+}
+
+func testPutSeveralUsers(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	require.NoError(t, st.Put(ctx, "user1", "short1", origin("short1"), storage.LinkOptions{}))
+	require.NoError(t, st.Put(ctx, "user2", "short1", origin("short1"), storage.LinkOptions{}))
+
+	for _, userID := range []string{"user1", "user2"} {
+		links, err := st.GetUserLinks(ctx, userID)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{"short1": origin("short1")}, links)
+	}
+}
+
+func testGetUserLinks(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	require.NoError(t, st.Put(ctx, "user1", "short1", origin("short1"), storage.LinkOptions{}))
+	require.NoError(t, st.Put(ctx, "user1", "short2", origin("short2"), storage.LinkOptions{}))
+	require.NoError(t, st.Put(ctx, "user2", "short3", origin("short3"), storage.LinkOptions{}))
+
+	links, err := st.GetUserLinks(ctx, "user1")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"short1": origin("short1"),
+		"short2": origin("short2"),
+	}, links)
+}
+
+func testGetUserLinksUnknown(t *testing.T, st storage.Storage) {
+	_, err := st.GetUserLinks(context.Background(), "unknown")
+	assert.ErrorIs(t, err, dto.ErrNotFound)
+}
+
+func testFindUserLink(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	require.NoError(t, st.Put(ctx, "user1", "short1", origin("short1"), storage.LinkOptions{}))
+	require.NoError(t, st.Put(ctx, "user1", "short2", origin("short2"), storage.LinkOptions{PasswordHash: "hash"}))
+
+	shortURL, err := st.FindUserLink(ctx, "user1", origin("short1"))
+	require.NoError(t, err)
+	assert.Equal(t, "short1", shortURL)
+
+	// deleted links are found too
+	require.NoError(t, st.Delete(ctx, []string{"short1"}, "user1"))
+	assert.Eventually(t, func() bool {
+		_, err := st.Get(ctx, "short1")
+		return errors.Is(err, dto.ErrDeleted)
+	}, deleteTimeout, 50*time.Millisecond)
+	shortURL, err = st.FindUserLink(ctx, "user1", origin("short1"))
+	require.NoError(t, err)
+	assert.Equal(t, "short1", shortURL)
+
+	// protected links and links of other users are not found
+	_, err = st.FindUserLink(ctx, "user1", origin("short2"))
+	assert.ErrorIs(t, err, dto.ErrNotFound)
+	_, err = st.FindUserLink(ctx, "user2", origin("short1"))
+	assert.ErrorIs(t, err, dto.ErrNotFound)
+}
+
+func testPutBatch(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	batch := map[string]string{
+		origin("short1"): "short1",
+		origin("short2"): "short2",
+	}
+	require.NoError(t, st.PutBatch(ctx, "user1", batch, nil))
+
+	for originURL, shortURL := range batch {
+		got, err := st.Get(ctx, shortURL)
+		require.NoError(t, err)
+		assert.Equal(t, originURL, got)
+	}
+}
+
+func testPutBatchConflict(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	require.NoError(t, st.Put(ctx, "user1", "short1", origin("short1"), storage.LinkOptions{}))
+
+	err := st.PutBatch(ctx, "user1", map[string]string{
+		origin("short1"): "short1",
+		origin("short2"): "short2",
+	}, nil)
+	require.ErrorIs(t, err, dto.ErrAlreadyExists)
+
+	var existsErr *storageErrors.AlreadyExistsError
+	require.True(t, errors.As(err, &existsErr))
+	assert.Equal(t, []string{"short1"}, existsErr.Keys)
+
+	// new items of the batch are saved
+	links, err := st.GetUserLinks(ctx, "user1")
+	require.NoError(t, err)
+	assert.Len(t, links, 2)
+}
+
+func testPutBatchCodeTaken(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	require.NoError(t, st.Put(ctx, "user1", "short1", origin("short1"), storage.LinkOptions{}))
+	require.NoError(t, st.Put(ctx, "user1", "short2", origin("short2"), storage.LinkOptions{}))
+
+	err := st.PutBatch(ctx, "user1", map[string]string{
+		origin("other"):  "short1",
+		origin("short2"): "short2",
+		origin("short3"): "short3",
+	}, nil)
+	require.ErrorIs(t, err, dto.ErrCodeTaken)
+
+	var takenErr *storageErrors.CodeTakenError
+	require.True(t, errors.As(err, &takenErr))
+	assert.Equal(t, []string{"short1"}, takenErr.Keys)
+	assert.Equal(t, []string{"short2"}, takenErr.Existing)
+
+	// free items of the batch are saved
+	links, err := st.GetUserLinks(ctx, "user1")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"short1": origin("short1"),
+		"short2": origin("short2"),
+		"short3": origin("short3"),
+	}, links)
+}
+
+func testDelete(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	require.NoError(t, st.Put(ctx, "user1", "short1", origin("short1"), storage.LinkOptions{}))
+	require.NoError(t, st.Put(ctx, "user1", "short2", origin("short2"), storage.LinkOptions{}))
+	require.NoError(t, st.Delete(ctx, []string{"short1"}, "user1"))
+
+	assert.Eventually(t, func() bool {
+		_, err := st.Get(ctx, "short1")
+		return errors.Is(err, dto.ErrDeleted)
+	}, deleteTimeout, 50*time.Millisecond)
+
+	_, err := st.Get(ctx, "short2")
+	assert.NoError(t, err)
+}
+
+func testDeleteByOneOwner(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	require.NoError(t, st.Put(ctx, "user1", "short1", origin("short1"), storage.LinkOptions{}))
+	require.NoError(t, st.Put(ctx, "user2", "short1", origin("short1"), storage.LinkOptions{}))
+	require.NoError(t, st.Delete(ctx, []string{"short1"}, "user1"))
+	require.NoError(t, st.Delete(ctx, []string{"short1"}, "user3"))
+
+	// the link works while it has at least one owner who didn't delete it
+	assert.Never(t, func() bool {
+		_, err := st.Get(ctx, "short1")
+		return err != nil
+	}, time.Second, 50*time.Millisecond)
+
+	require.NoError(t, st.Delete(ctx, []string{"short1"}, "user2"))
+	assert.Eventually(t, func() bool {
+		_, err := st.Get(ctx, "short1")
+		return errors.Is(err, dto.ErrDeleted)
+	}, deleteTimeout, 50*time.Millisecond)
+}
+
+func testConcurrentPuts(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	const workers, perWorker = 8, 25
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*workers*perWorker)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				shortURL := fmt.Sprintf("w%d-%d", w, i)
+				if err := st.Put(ctx, "user1", shortURL, origin(shortURL), storage.LinkOptions{}); err != nil {
+					errs <- err
+				}
+				if _, err := st.Get(ctx, shortURL); err != nil {
+					errs <- err
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+
+	links, err := st.GetUserLinks(ctx, "user1")
+	require.NoError(t, err)
+	assert.Len(t, links, workers*perWorker)
+}
+
+func testExpiryByTime(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	expiresAt := time.Now().Add(-time.Minute).UTC().Truncate(time.Second)
+	require.NoError(t, st.Put(ctx, "user1", "short1", origin("short1"), storage.LinkOptions{ExpiresAt: expiresAt}))
+
+	_, err := st.Get(ctx, "short1")
+	assert.ErrorIs(t, err, dto.ErrExpired)
+	_, err = st.Visit(ctx, "short1")
+	assert.ErrorIs(t, err, dto.ErrExpired)
+
+	link, err := st.GetLink(ctx, "short1")
+	require.NoError(t, err)
+	assert.Equal(t, origin("short1"), link.OriginURL)
+	assert.True(t, link.Options.ExpiresAt.Equal(expiresAt))
+	assert.True(t, link.Expired(time.Now()))
+}
+
+func testExpiryByClicks(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	require.NoError(t, st.Put(ctx, "user1", "short1", origin("short1"), storage.LinkOptions{MaxClicks: 2}))
+
+	// Get doesn't count redirects
+	for i := 0; i < 3; i++ {
+		_, err := st.Get(ctx, "short1")
+		require.NoError(t, err)
+	}
+
+	for i := 0; i < 2; i++ {
+		originURL, err := st.Visit(ctx, "short1")
+		require.NoError(t, err)
+		assert.Equal(t, origin("short1"), originURL)
+	}
+	_, err := st.Visit(ctx, "short1")
+	assert.ErrorIs(t, err, dto.ErrExpired)
+	_, err = st.Get(ctx, "short1")
+	assert.ErrorIs(t, err, dto.ErrExpired)
+
+	link, err := st.GetLink(ctx, "short1")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), link.Clicks)
+	assert.False(t, link.Options.ExpiresAt.IsZero(), "exhausted link must get expiration time")
+}
+
+func testOptionsOfExistingLink(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	require.NoError(t, st.Put(ctx, "user1", "short1", origin("short1"), storage.LinkOptions{}))
+
+	expired := storage.LinkOptions{ExpiresAt: time.Now().Add(-time.Minute)}
+	assert.ErrorIs(t, st.Put(ctx, "user1", "short1", origin("short1"), expired), dto.ErrAlreadyExists)
+	require.NoError(t, st.Put(ctx, "user2", "short1", origin("short1"), expired))
+	require.NoError(t, st.PutBatch(ctx, "user3", map[string]string{origin("short1"): "short1"}, map[string]storage.LinkOptions{"short1": expired}))
+
+	_, err := st.Visit(ctx, "short1")
+	assert.NoError(t, err)
+}
+
+func testPurge(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	now := time.Now()
+	require.NoError(t, st.Put(ctx, "user1", "short1", origin("short1"), storage.LinkOptions{ExpiresAt: now.Add(-time.Hour)}))
+	require.NoError(t, st.Put(ctx, "user1", "short2", origin("short2"), storage.LinkOptions{ExpiresAt: now.Add(-time.Second)}))
+	require.NoError(t, st.Put(ctx, "user1", "short3", origin("short3"), storage.LinkOptions{}))
+	require.NoError(t, st.PutBatch(ctx, "user2", map[string]string{origin("short4"): "short4"},
+		map[string]storage.LinkOptions{"short4": {ExpiresAt: now.Add(-time.Hour)}}))
+
+	purged, err := st.Purge(ctx, now.Add(-time.Minute))
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"short1", "short4"}, purged)
+
+	_, err = st.Get(ctx, "short1")
+	assert.ErrorIs(t, err, dto.ErrNotFound)
+	_, err = st.Get(ctx, "short2")
+	assert.ErrorIs(t, err, dto.ErrExpired)
+
+	links, err := st.GetUserLinks(ctx, "user1")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"short2": origin("short2"),
+		"short3": origin("short3"),
+	}, links)
+
+	_, err = st.GetUserLinks(ctx, "user2")
+	assert.ErrorIs(t, err, dto.ErrNotFound)
+
+	// purged code is free again
+	require.NoError(t, st.Put(ctx, "user1", "short1", origin("short5"), storage.LinkOptions{}))
+}
+
+func testProtectedLinkNotShared(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	protected := storage.LinkOptions{PasswordHash: "hash1"}
+	require.NoError(t, st.Put(ctx, "user1", "short1", origin("short1"), protected))
+
+	link, err := st.GetLink(ctx, "short1")
+	require.NoError(t, err)
+	assert.Equal(t, "hash1", link.Options.PasswordHash)
+
+	// the same URL without password or with another one gets another short URL
+	for _, opts := range []storage.LinkOptions{{}, {PasswordHash: "hash2"}} {
+		assert.ErrorIs(t, st.Put(ctx, "user2", "short1", origin("short1"), opts), dto.ErrCodeTaken)
+		err = st.PutBatch(ctx, "user2", map[string]string{origin("short1"): "short1"}, map[string]storage.LinkOptions{"short1": opts})
+		assert.ErrorIs(t, err, dto.ErrCodeTaken)
+	}
+	require.NoError(t, st.Put(ctx, "user3", "short2", origin("short2"), storage.LinkOptions{}))
+	assert.ErrorIs(t, st.Put(ctx, "user2", "short2", origin("short2"), protected), dto.ErrCodeTaken)
+
+	_, err = st.GetUserLinks(ctx, "user2")
+	assert.ErrorIs(t, err, dto.ErrNotFound)
+
+	// the same hash comes only with links moved between storages
+	require.NoError(t, st.Put(ctx, "user2", "short1", origin("short1"), protected))
+}
+
+func testEdit(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	require.NoError(t, st.Put(ctx, "user1", "short1", origin("short1"), storage.LinkOptions{}))
+
+	history, err := st.GetHistory(ctx, "user1", "short1")
+	require.NoError(t, err)
+	assert.Empty(t, history)
+
+	at := time.Now().UTC().Truncate(time.Second)
+	rev, err := st.Edit(ctx, "user1", "short1", origin("edited1"), at)
+	require.NoError(t, err)
+	assert.Equal(t, 1, rev.Number)
+	rev, err = st.Edit(ctx, "user1", "short1", origin("edited2"), at.Add(time.Second))
+	require.NoError(t, err)
+	assert.Equal(t, 2, rev.Number)
+
+	// the same URL is not a change
+	rev, err = st.Edit(ctx, "user1", "short1", origin("edited2"), at.Add(2*time.Second))
+	require.NoError(t, err)
+	assert.Zero(t, rev.Number)
+
+	originURL, err := st.Get(ctx, "short1")
+	require.NoError(t, err)
+	assert.Equal(t, origin("edited2"), originURL)
+
+	links, err := st.GetUserLinks(ctx, "user1")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"short1": origin("edited2")}, links)
+
+	history, err = st.GetHistory(ctx, "user1", "short1")
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	assert.Equal(t, 1, history[0].Number)
+	assert.Equal(t, "user1", history[0].UserID)
+	assert.True(t, history[0].ChangedAt.Equal(at))
+	assert.Equal(t, origin("short1"), history[0].OldURL)
+	assert.Equal(t, origin("edited1"), history[0].NewURL)
+	assert.Equal(t, 2, history[1].Number)
+	assert.Equal(t, origin("edited1"), history[1].OldURL)
+	assert.Equal(t, origin("edited2"), history[1].NewURL)
+}
+
+func testEditNotOwner(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	require.NoError(t, st.Put(ctx, "user1", "short1", origin("short1"), storage.LinkOptions{}))
+
+	_, err := st.Edit(ctx, "user2", "short1", origin("edited"), time.Now())
+	assert.ErrorIs(t, err, dto.ErrNotOwner)
+	_, err = st.GetHistory(ctx, "user2", "short1")
+	assert.ErrorIs(t, err, dto.ErrNotOwner)
+
+	_, err = st.Edit(ctx, "user1", "unknown", origin("edited"), time.Now())
+	assert.ErrorIs(t, err, dto.ErrNotFound)
+	_, err = st.GetHistory(ctx, "user1", "unknown")
+	assert.ErrorIs(t, err, dto.ErrNotFound)
+
+	originURL, err := st.Get(ctx, "short1")
+	require.NoError(t, err)
+	assert.Equal(t, origin("short1"), originURL)
+}
+
+func testEditShared(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	require.NoError(t, st.Put(ctx, "user1", "short1", origin("short1"), storage.LinkOptions{}))
+	require.NoError(t, st.Put(ctx, "user2", "short1", origin("short1"), storage.LinkOptions{}))
+
+	_, err := st.Edit(ctx, "user1", "short1", origin("edited"), time.Now())
+	assert.ErrorIs(t, err, dto.ErrLinkShared)
+
+	// the link of the user who deleted it can't be changed by him, but doesn't prevent changes by others
+	require.NoError(t, st.Delete(ctx, []string{"short1"}, "user2"))
+	require.Eventually(t, func() bool {
+		_, err = st.Edit(ctx, "user2", "short1", origin("edited"), time.Now())
+		return errors.Is(err, dto.ErrDeleted)
+	}, deleteTimeout, 50*time.Millisecond)
+
+	_, err = st.Edit(ctx, "user1", "short1", origin("edited"), time.Now())
+	require.NoError(t, err)
+
+	originURL, err := st.Get(ctx, "short1")
+	require.NoError(t, err)
+	assert.Equal(t, origin("edited"), originURL)
+}
+
+// listAll reads all pages of user links and returns short URLs in order of pages.
+func listAll(t *testing.T, st storage.Storage, userID string, query storage.LinksQuery) []string {
+	var shortURLs []string
+	for pages := 0; ; pages++ {
+		require.Less(t, pages, 100, "too many pages")
+		page, err := st.ListUserLinks(context.Background(), userID, query)
+		require.NoError(t, err)
+		require.LessOrEqual(t, len(page.Links), query.Limit)
+		for _, link := range page.Links {
+			shortURLs = append(shortURLs, link.ShortURL)
+		}
+		if page.Next == nil {
+			return shortURLs
+		}
+		query.After = page.Next
+	}
+}
+
+func testListUserLinks(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	// original URLs are in reverse order of creation
+	created := []string{"short1", "short2", "short3", "short4", "short5"}
+	originURLs := []string{"https://e.com/", "https://d.com/", "https://c.com/", "https://b.com/", "https://a.com/"}
+	for i, shortURL := range created {
+		require.NoError(t, st.Put(ctx, "user1", shortURL, originURLs[i], storage.LinkOptions{}))
+	}
+	require.NoError(t, st.Put(ctx, "user2", "short6", origin("short6"), storage.LinkOptions{}))
+
+	reversed := []string{"short5", "short4", "short3", "short2", "short1"}
+	tests := []struct {
+		name  string
+		query storage.LinksQuery
+		want  []string
+	}{
+		{name: "created", query: storage.LinksQuery{Sort: storage.SortCreated, Limit: 2}, want: created},
+		{name: "created desc", query: storage.LinksQuery{Sort: storage.SortCreated, Desc: true, Limit: 2}, want: reversed},
+		{name: "url", query: storage.LinksQuery{Sort: storage.SortURL, Limit: 3}, want: reversed},
+		{name: "url desc", query: storage.LinksQuery{Sort: storage.SortURL, Desc: true, Limit: 3}, want: created},
+		{name: "one page", query: storage.LinksQuery{Sort: storage.SortCreated, Limit: 5}, want: created},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, listAll(t, st, "user1", tt.query), tt.name)
+	}
+
+	page, err := st.ListUserLinks(ctx, "unknown", storage.LinksQuery{Sort: storage.SortCreated, Limit: 10})
+	require.NoError(t, err)
+	assert.Empty(t, page.Links)
+	assert.Nil(t, page.Next)
+}
+
+func testListUserLinksFilters(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	links := map[string]string{
+		"short1": "https://yandex.ru/news/",
+		"short2": "https://maps.yandex.ru/",
+		"short3": "https://notyandex.ru/",
+		"short4": "https://google.com/search?q=yandex",
+		"short5": "https://yandex.ru/weather/",
+	}
+	for _, shortURL := range []string{"short1", "short2", "short3", "short4", "short5"} {
+		require.NoError(t, st.Put(ctx, "user1", shortURL, links[shortURL], storage.LinkOptions{}))
+	}
+	require.NoError(t, st.Delete(ctx, []string{"short5"}, "user1"))
+
+	deleted, notDeleted := true, false
+	require.Eventually(t, func() bool {
+		return len(listAll(t, st, "user1", storage.LinksQuery{Sort: storage.SortCreated, Limit: 10, Deleted: &deleted})) == 1
+	}, deleteTimeout, 50*time.Millisecond)
+
+	tests := []struct {
+		name  string
+		query storage.LinksQuery
+		want  []string
+	}{
+		{name: "search", query: storage.LinksQuery{Search: "yandex.ru/"}, want: []string{"short1", "short2", "short3", "short5"}},
+		{name: "domain", query: storage.LinksQuery{Domain: "yandex.ru"}, want: []string{"short1", "short2", "short5"}},
+		{name: "subdomain", query: storage.LinksQuery{Domain: "maps.yandex.ru"}, want: []string{"short2"}},
+		{name: "deleted", query: storage.LinksQuery{Deleted: &deleted}, want: []string{"short5"}},
+		{name: "not deleted", query: storage.LinksQuery{Deleted: &notDeleted}, want: []string{"short1", "short2", "short3", "short4"}},
+		{name: "domain and not deleted", query: storage.LinksQuery{Domain: "yandex.ru", Deleted: &notDeleted}, want: []string{"short1", "short2"}},
+		{name: "nothing found", query: storage.LinksQuery{Search: "bing"}, want: nil},
+	}
+	for _, tt := range tests {
+		tt.query.Sort = storage.SortCreated
+		tt.query.Limit = 2
+		assert.Equal(t, tt.want, listAll(t, st, "user1", tt.query), tt.name)
+	}
+}
+
+func testClicks(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	require.NoError(t, st.Put(ctx, "user1", "short1", origin("short1"), storage.LinkOptions{}))
+	require.NoError(t, st.Put(ctx, "user1", "short2", origin("short2"), storage.LinkOptions{}))
+
+	at := time.Date(2022, 5, 1, 12, 0, 0, 0, time.UTC)
+	require.NoError(t, st.SaveClicks(ctx, []storage.Click{
+		{ShortURL: "short1", At: at.Add(time.Minute), Referrer: "https://ya.ru/", UserAgent: "curl/7.79.1", IP: "10.0.0.0", Visitor: 1 << 63},
+		{ShortURL: "short2", At: at},
+		{ShortURL: "unknown", At: at},
+	}))
+	require.NoError(t, st.SaveClicks(ctx, []storage.Click{
+		{ShortURL: "short1", At: at},
+		{ShortURL: "short1", At: at.Add(time.Hour)},
+	}))
+	require.NoError(t, st.SaveClicks(ctx, nil))
+
+	// the end of the range is excluded, clicks are ordered by time
+	clicks, err := st.GetClicks(ctx, "short1", at, at.Add(time.Hour))
+	require.NoError(t, err)
+	require.Len(t, clicks, 2)
+	assert.True(t, clicks[0].At.Equal(at))
+	assert.True(t, clicks[1].At.Equal(at.Add(time.Minute)))
+	assert.Equal(t, "short1", clicks[1].ShortURL)
+	assert.Equal(t, "https://ya.ru/", clicks[1].Referrer)
+	assert.Equal(t, "curl/7.79.1", clicks[1].UserAgent)
+	assert.Equal(t, "10.0.0.0", clicks[1].IP)
+	assert.Equal(t, uint64(1<<63), clicks[1].Visitor)
+
+	clicks, err = st.GetClicks(ctx, "unknown", at, at.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Empty(t, clicks)
+
+	// clicks are removed with the link
+	require.NoError(t, st.Put(ctx, "user1", "short3", origin("short3"), storage.LinkOptions{ExpiresAt: at}))
+	require.NoError(t, st.SaveClicks(ctx, []storage.Click{{ShortURL: "short3", At: at.Add(-time.Minute)}}))
+	_, err = st.Purge(ctx, at.Add(time.Minute))
+	require.NoError(t, err)
+	require.NoError(t, st.Put(ctx, "user1", "short3", origin("short3"), storage.LinkOptions{}))
+	clicks, err = st.GetClicks(ctx, "short3", at.Add(-time.Hour), at)
+	require.NoError(t, err)
+	assert.Empty(t, clicks)
+}
+
+func testLinkStats(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	require.NoError(t, st.Put(ctx, "user1", "short1", origin("short1"), storage.LinkOptions{}))
+	require.NoError(t, st.Put(ctx, "user1", "short2", origin("short2"), storage.LinkOptions{}))
+
+	day := time.Date(2022, 5, 1, 0, 0, 0, 0, time.UTC)
+	chrome := "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/101.0.4951.64 Safari/537.36"
+	firefox := "Mozilla/5.0 (X11; Linux x86_64; rv:100.0) Gecko/20100101 Firefox/100.0"
+	require.NoError(t, st.SaveClicks(ctx, []storage.Click{
+		{ShortURL: "short1", At: day.Add(10*time.Hour + time.Minute), Referrer: "https://www.ya.ru/search", UserAgent: chrome},
+		{ShortURL: "short1", At: day.Add(10*time.Hour + 59*time.Minute), Referrer: "https://ya.ru/", UserAgent: chrome},
+		{ShortURL: "short1", At: day.Add(12 * time.Hour), Referrer: "https://google.com/", UserAgent: firefox},
+		{ShortURL: "short2", At: day.Add(10 * time.Hour), UserAgent: firefox},
+	}))
+	// the second batch is added to the same hours
+	require.NoError(t, st.SaveClicks(ctx, []storage.Click{
+		{ShortURL: "short1", At: day.Add(10*time.Hour + 30*time.Minute), UserAgent: "curl/7.79.1"},
+		{ShortURL: "short1", At: day.Add(26 * time.Hour), Referrer: "https://ya.ru/", UserAgent: chrome},
+	}))
+
+	stats, err := st.GetLinkStats(ctx, "user1", "short1", storage.StatsQuery{From: day, To: day.Add(24 * time.Hour), Bucket: storage.BucketHour, Top: 10})
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), stats.Total)
+	require.Len(t, stats.Buckets, 2)
+	assert.True(t, stats.Buckets[0].Start.Equal(day.Add(10*time.Hour)))
+	assert.Equal(t, int64(3), stats.Buckets[0].Clicks)
+	assert.True(t, stats.Buckets[1].Start.Equal(day.Add(12*time.Hour)))
+	assert.Equal(t, int64(1), stats.Buckets[1].Clicks)
+	assert.Equal(t, []storage.StatsCount{{Name: "ya.ru", Clicks: 2}, {Name: "", Clicks: 1}, {Name: "google.com", Clicks: 1}}, stats.Referrers)
+	assert.Equal(t, []storage.StatsCount{{Name: "Chrome", Clicks: 2}, {Name: "Firefox", Clicks: 1}, {Name: "curl", Clicks: 1}}, stats.Agents)
+
+	stats, err = st.GetLinkStats(ctx, "user1", "short1", storage.StatsQuery{From: day, To: day.Add(48 * time.Hour), Bucket: storage.BucketDay, Top: 1})
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), stats.Total)
+	require.Len(t, stats.Buckets, 2)
+	assert.True(t, stats.Buckets[0].Start.Equal(day))
+	assert.Equal(t, int64(4), stats.Buckets[0].Clicks)
+	assert.True(t, stats.Buckets[1].Start.Equal(day.Add(24*time.Hour)))
+	assert.Equal(t, int64(1), stats.Buckets[1].Clicks)
+	assert.Equal(t, []storage.StatsCount{{Name: "ya.ru", Clicks: 3}}, stats.Referrers)
+	assert.Equal(t, []storage.StatsCount{{Name: "Chrome", Clicks: 3}}, stats.Agents)
+
+	// the end of the period is excluded
+	stats, err = st.GetLinkStats(ctx, "user1", "short1", storage.StatsQuery{From: day, To: day.Add(10 * time.Hour), Bucket: storage.BucketHour, Top: 10})
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), stats.Total)
+	assert.Empty(t, stats.Buckets)
+	assert.Empty(t, stats.Referrers)
+
+	_, err = st.GetLinkStats(ctx, "user2", "short1", storage.StatsQuery{From: day, To: day.Add(time.Hour), Bucket: storage.BucketHour, Top: 10})
+	assert.ErrorIs(t, err, dto.ErrNotOwner)
+	_, err = st.GetLinkStats(ctx, "user1", "unknown", storage.StatsQuery{From: day, To: day.Add(time.Hour), Bucket: storage.BucketHour, Top: 10})
+	assert.ErrorIs(t, err, dto.ErrNotFound)
+}
+
+// visitor returns the fingerprint of the visitor with the number.
+func visitor(i int) uint64 {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("visitor%d", i)))
+	return binary.BigEndian.Uint64(sum[:])
+}
+
+func testLinkVisitors(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	require.NoError(t, st.Put(ctx, "user1", "short1", origin("short1"), storage.LinkOptions{}))
+
+	// visitors 0-999 on the first day in two overlapping batches, visitors 800-1299 on the second day
+	day := time.Date(2022, 5, 1, 0, 0, 0, 0, time.UTC)
+	var first, second, third []storage.Click
+	for i := 0; i < 600; i++ {
+		first = append(first, storage.Click{ShortURL: "short1", At: day.Add(10 * time.Hour), Visitor: visitor(i)})
+	}
+	for i := 400; i < 1000; i++ {
+		second = append(second, storage.Click{ShortURL: "short1", At: day.Add(20 * time.Hour), Visitor: visitor(i)})
+	}
+	for i := 800; i < 1300; i++ {
+		third = append(third, storage.Click{ShortURL: "short1", At: day.Add(30 * time.Hour), Visitor: visitor(i)})
+	}
+	// clicks of unknown visitors and links are not counted
+	third = append(third, storage.Click{ShortURL: "short1", At: day.Add(30 * time.Hour)}, storage.Click{ShortURL: "unknown", At: day, Visitor: visitor(0)})
+	require.NoError(t, st.SaveClicks(ctx, first))
+	require.NoError(t, st.SaveClicks(ctx, second))
+	require.NoError(t, st.SaveClicks(ctx, third))
+
+	stats, err := st.GetLinkStats(ctx, "user1", "short1", storage.StatsQuery{From: day, To: day.Add(48 * time.Hour), Bucket: storage.BucketDay, Top: 10})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1701), stats.Total)
+	assert.InEpsilon(t, 1300, stats.Visitors, 0.03)
+	require.Len(t, stats.Buckets, 2)
+	assert.InEpsilon(t, 1000, stats.Buckets[0].Visitors, 0.03)
+	assert.InEpsilon(t, 500, stats.Buckets[1].Visitors, 0.03)
+
+	// visitors are counted for whole days overlapping the period
+	stats, err = st.GetLinkStats(ctx, "user1", "short1", storage.StatsQuery{From: day.Add(20 * time.Hour), To: day.Add(21 * time.Hour), Bucket: storage.BucketHour, Top: 10})
+	require.NoError(t, err)
+	assert.Equal(t, int64(600), stats.Total)
+	assert.InEpsilon(t, 1000, stats.Visitors, 0.03)
+	require.Len(t, stats.Buckets, 1)
+	assert.Zero(t, stats.Buckets[0].Visitors)
+
+	stats, err = st.GetLinkStats(ctx, "user1", "short1", storage.StatsQuery{From: day.Add(48 * time.Hour), To: day.Add(72 * time.Hour), Bucket: storage.BucketDay, Top: 10})
+	require.NoError(t, err)
+	assert.Zero(t, stats.Visitors)
+}
+
+func testLinkStatsBots(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	require.NoError(t, st.Put(ctx, "user1", "short1", origin("short1"), storage.LinkOptions{}))
+
+	day := time.Date(2022, 5, 1, 0, 0, 0, 0, time.UTC)
+	chrome := "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/101.0.4951.64 Safari/537.36"
+	googlebot := "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"
+	require.NoError(t, st.SaveClicks(ctx, []storage.Click{
+		{ShortURL: "short1", At: day.Add(10 * time.Hour), Referrer: "https://ya.ru/", UserAgent: chrome, Visitor: visitor(0)},
+		{ShortURL: "short1", At: day.Add(10 * time.Hour), UserAgent: googlebot, Visitor: visitor(1), Bot: true},
+		{ShortURL: "short1", At: day.Add(11 * time.Hour), UserAgent: googlebot, Visitor: visitor(1), Bot: true},
+	}))
+
+	// bots are excluded by default, but counted
+	query := storage.StatsQuery{From: day, To: day.Add(24 * time.Hour), Bucket: storage.BucketHour, Top: 10}
+	stats, err := st.GetLinkStats(ctx, "user1", "short1", query)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), stats.Total)
+	assert.Equal(t, int64(2), stats.Bots)
+	require.Len(t, stats.Buckets, 1)
+	assert.Equal(t, int64(1), stats.Buckets[0].Clicks)
+	assert.Equal(t, []storage.StatsCount{{Name: "ya.ru", Clicks: 1}}, stats.Referrers)
+	assert.Equal(t, []storage.StatsCount{{Name: "Chrome", Clicks: 1}}, stats.Agents)
+	assert.Equal(t, int64(1), stats.Visitors, "bots are not visitors")
+
+	query.Bots = true
+	stats, err = st.GetLinkStats(ctx, "user1", "short1", query)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), stats.Total)
+	assert.Equal(t, int64(2), stats.Bots)
+	require.Len(t, stats.Buckets, 2)
+	assert.Equal(t, int64(2), stats.Buckets[0].Clicks)
+	assert.Equal(t, []storage.StatsCount{{Name: "", Clicks: 2}, {Name: "ya.ru", Clicks: 1}}, stats.Referrers)
+	assert.Equal(t, int64(1), stats.Visitors, "bots are not visitors")
+
+	clicks, err := st.GetClicks(ctx, "short1", day, day.Add(24*time.Hour))
+	require.NoError(t, err)
+	require.Len(t, clicks, 3)
+	bots := 0
+	for _, click := range clicks {
+		if click.Bot {
+			bots++
+		}
+	}
+	assert.Equal(t, 2, bots)
+}
+
+func testCounts(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	counts, err := st.GetCounts(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, storage.Counts{}, counts)
+
+	// shared and deleted links are counted once, their owners too
+	require.NoError(t, st.Put(ctx, "user1", "short1", origin("short1"), storage.LinkOptions{}))
+	require.NoError(t, st.PutBatch(ctx, "user1", map[string]string{origin("short2"): "short2", origin("short3"): "short3"}, nil))
+	require.NoError(t, st.Put(ctx, "user2", "short1", origin("short1"), storage.LinkOptions{}))
+	require.NoError(t, st.Delete(ctx, []string{"short2"}, "user1"))
+	counts, err = st.GetCounts(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, storage.Counts{URLs: 3, Users: 2}, counts)
+
+	// purged links and users without links are not counted
+	require.NoError(t, st.Put(ctx, "user3", "short4", origin("short4"), storage.LinkOptions{ExpiresAt: time.Now().Add(-time.Hour)}))
+	counts, err = st.GetCounts(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, storage.Counts{URLs: 4, Users: 3}, counts)
+	_, err = st.Purge(ctx, time.Now())
+	require.NoError(t, err)
+	counts, err = st.GetCounts(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, storage.Counts{URLs: 3, Users: 2}, counts)
+}
+
+func testRefreshTokens(t *testing.T, st storage.Storage) {
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+	require.NoError(t, st.SaveRefreshToken(ctx, storage.RefreshToken{Hash: "hash1", UserID: "user1", Family: "family1", ExpiresAt: now.Add(time.Hour)}))
+	require.NoError(t, st.SaveRefreshToken(ctx, storage.RefreshToken{Hash: "hash2", UserID: "user2", Family: "family2", ExpiresAt: now.Add(time.Hour)}))
+
+	// the next token inherits the user and the family
+	used, err := st.RotateRefreshToken(ctx, "hash1", storage.RefreshToken{Hash: "hash3", ExpiresAt: now.Add(2 * time.Hour)}, now)
+	require.NoError(t, err)
+	assert.Equal(t, "user1", used.UserID)
+	assert.Equal(t, "family1", used.Family)
+	require.NotNil(t, used.UsedAt)
+	assert.True(t, now.Equal(*used.UsedAt))
+
+	// the used token is returned with the time of its use
+	used, err = st.RotateRefreshToken(ctx, "hash1", storage.RefreshToken{Hash: "hash4", ExpiresAt: now.Add(2 * time.Hour)}, now.Add(time.Minute))
+	assert.ErrorIs(t, err, dto.ErrTokenUsed)
+	assert.Equal(t, "family1", used.Family)
+	require.NotNil(t, used.UsedAt)
+	assert.True(t, now.Equal(*used.UsedAt))
+
+	used, err = st.RotateRefreshToken(ctx, "hash3", storage.RefreshToken{Hash: "hash5", ExpiresAt: now.Add(3 * time.Hour)}, now.Add(time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, "user1", used.UserID)
+
+	_, err = st.RotateRefreshToken(ctx, "unknown", storage.RefreshToken{Hash: "hash6"}, now)
+	assert.ErrorIs(t, err, dto.ErrNotFound)
+	_, err = st.RotateRefreshToken(ctx, "hash2", storage.RefreshToken{Hash: "hash6"}, now.Add(time.Hour))
+	assert.ErrorIs(t, err, dto.ErrExpired)
+
+	// revocation removes all tokens of the family only
+	require.NoError(t, st.RevokeTokenFamily(ctx, "family1"))
+	for _, hash := range []string{"hash1", "hash3", "hash5"} {
+		_, err = st.RotateRefreshToken(ctx, hash, storage.RefreshToken{Hash: "hash6"}, now)
+		assert.ErrorIs(t, err, dto.ErrNotFound, hash)
+	}
+
+	// expired tokens are purged with links
+	_, err = st.Purge(ctx, now.Add(2*time.Hour))
+	require.NoError(t, err)
+	_, err = st.RotateRefreshToken(ctx, "hash2", storage.RefreshToken{Hash: "hash6"}, now)
+	assert.ErrorIs(t, err, dto.ErrNotFound)
+}